@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseInterleaved - Parses the flags of the set, allowing them to be mixed
+// with positional arguments (flag stops at the first positional one).
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+
+	var positionals []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positionals, nil
+		}
+
+		positionals = append(positionals, args[0])
+		args = args[1:]
+	}
+}
+
+// applyPositionalArgs - Maps the legacy "host[:port] [port]" positional
+// arguments onto the -ip and -port values. Flags given explicitly take
+// precedence, the conflicting positional value only raising a warning.
+func applyPositionalArgs(positionals []string, link string, port string, ipSet bool, portSet bool) (string, string, []string, error) {
+
+	var warnings []string
+
+	if len(positionals) == 0 {
+		return link, port, nil, nil
+	}
+	if len(positionals) > 2 {
+		return "", "", nil, fmt.Errorf("too many arguments: expected host[:port] [port], got %d arguments", len(positionals))
+	}
+
+	host, posPort, err := splitHostMaybePort(positionals[0])
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if len(positionals) == 2 {
+		if posPort != "" && posPort != positionals[1] {
+			return "", "", nil, fmt.Errorf("conflicting ports %s and %s given as arguments", posPort, positionals[1])
+		}
+		posPort = positionals[1]
+	}
+
+	if posPort != "" {
+		if err := validPort(posPort); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	if ipSet {
+		if !sameHost(link, host) {
+			warnings = append(warnings, fmt.Sprintf("ignoring host argument %s, -ip %s takes precedence", host, link))
+		}
+	} else {
+		link = host
+		// Keep IPv6 literals bracketed, -ip accepts host[:port] lists.
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			link = "[" + host + "]"
+		}
+	}
+
+	if posPort != "" {
+		if portSet {
+			if port != posPort {
+				warnings = append(warnings, fmt.Sprintf("ignoring port argument %s, -port %s takes precedence", posPort, port))
+			}
+		} else {
+			port = posPort
+		}
+	}
+
+	return link, port, warnings, nil
+}
+
+// sameHost - Tells if the -ip value names the host of the positional
+// argument, whatever its brackets, port or IP spelling ([::1], ::1 and
+// 0:0::1 are the same host).
+func sameHost(link string, host string) bool {
+
+	linkHost, _, err := splitHostMaybePort(link)
+	if err != nil {
+		return link == host
+	}
+
+	if a, b := net.ParseIP(linkHost), net.ParseIP(host); a != nil && b != nil {
+		return a.Equal(b)
+	}
+
+	return strings.EqualFold(linkHost, host)
+}
+
+// isFlagSet - Tells if the flag was given on the command line.
+func isFlagSet(name string) bool {
+
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// listFlag - String flag which may be repeated, its values joined by commas.
+type listFlag struct {
+	value *string
+	set   bool
+}
+
+func (f *listFlag) String() string {
+
+	if f.value == nil {
+		return ""
+	}
+
+	return *f.value
+}
+
+func (f *listFlag) Set(v string) error {
+
+	if f.set && *f.value != "" {
+		*f.value += "," + v
+	} else {
+		*f.value = v
+	}
+	f.set = true
+
+	return nil
+}
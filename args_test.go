@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyPositionalArgs(t *testing.T) {
+
+	const defLink, defPort = "idnet.ua-corp.com", "27650"
+
+	tests := []struct {
+		name       string
+		args       []string
+		link, port string
+		ipSet      bool
+		portSet    bool
+		wantLink   string
+		wantPort   string
+		warnings   []string // Substrings, one per warning
+		err        string
+	}{
+		{name: "none", wantLink: defLink, wantPort: defPort},
+		{name: "host", args: []string{"master.example"}, wantLink: "master.example", wantPort: defPort},
+		{name: "host:port", args: []string{"master.example:27700"}, wantLink: "master.example", wantPort: "27700"},
+		{name: "host port", args: []string{"master.example", "27700"}, wantLink: "master.example", wantPort: "27700"},
+		{name: "host:port same port", args: []string{"master.example:27700", "27700"}, wantLink: "master.example", wantPort: "27700"},
+		{name: "ipv4", args: []string{"192.0.2.1:27700"}, wantLink: "192.0.2.1", wantPort: "27700"},
+		{name: "bare ipv6", args: []string{"::1"}, wantLink: "[::1]", wantPort: defPort},
+		{name: "bare ipv6 port", args: []string{"2001:db8::1", "27700"}, wantLink: "[2001:db8::1]", wantPort: "27700"},
+		{name: "bracketed ipv6", args: []string{"[::1]"}, wantLink: "[::1]", wantPort: defPort},
+		{name: "bracketed ipv6:port", args: []string{"[::1]:27700"}, wantLink: "[::1]", wantPort: "27700"},
+
+		// Flags given explicitly
+		{name: "-ip same host", args: []string{"master.example"}, link: "master.example", ipSet: true, wantLink: "master.example", wantPort: defPort},
+		{name: "-ip same host case", args: []string{"Master.Example"}, link: "master.example", ipSet: true, wantLink: "master.example", wantPort: defPort},
+		{name: "-ip other host", args: []string{"other.example"}, link: "master.example", ipSet: true, wantLink: "master.example", wantPort: defPort,
+			warnings: []string{"ignoring host argument other.example"}},
+		{name: "-ip bracketed ipv6, bare argument", args: []string{"::1"}, link: "[::1]", ipSet: true, wantLink: "[::1]", wantPort: defPort},
+		{name: "-ip bare ipv6, bracketed argument", args: []string{"[::1]:27700"}, link: "::1", ipSet: true, wantLink: "::1", wantPort: "27700"},
+		{name: "-ip ipv6 spelt otherwise", args: []string{"0:0::1"}, link: "[::1]", ipSet: true, wantLink: "[::1]", wantPort: defPort},
+		{name: "-ip with port", args: []string{"192.0.2.1"}, link: "192.0.2.1:27700", ipSet: true, wantLink: "192.0.2.1:27700", wantPort: defPort},
+		{name: "-ip other ipv6", args: []string{"::2"}, link: "[::1]", ipSet: true, wantLink: "[::1]", wantPort: defPort,
+			warnings: []string{"ignoring host argument ::2"}},
+		{name: "-port same", args: []string{"master.example:27700"}, port: "27700", portSet: true, wantLink: "master.example", wantPort: "27700"},
+		{name: "-port other", args: []string{"master.example", "27700"}, port: "27800", portSet: true, wantLink: "master.example", wantPort: "27800",
+			warnings: []string{"ignoring port argument 27700"}},
+		{name: "both flags differ", args: []string{"[::2]:27700"}, link: "[::1]", port: "27800", ipSet: true, portSet: true, wantLink: "[::1]", wantPort: "27800",
+			warnings: []string{"ignoring host argument ::2", "ignoring port argument 27700"}},
+
+		// Errors
+		{name: "too many", args: []string{"a", "1", "2"}, err: "too many arguments"},
+		{name: "conflicting ports", args: []string{"master.example:27700", "27800"}, err: "conflicting ports"},
+		{name: "bad port", args: []string{"master.example", "99999"}, err: "99999"},
+		{name: "bad ipv6 port", args: []string{"[::1]:port"}, err: "port"},
+		{name: "empty", args: []string{""}, err: "empty address"},
+		{name: "missing host", args: []string{":27700"}, err: "missing host"},
+	}
+
+	for _, tt := range tests {
+		link, port := tt.link, tt.port
+		if !tt.ipSet {
+			link = defLink
+		}
+		if !tt.portSet {
+			port = defPort
+		}
+
+		gotLink, gotPort, warnings, err := applyPositionalArgs(tt.args, link, port, tt.ipSet, tt.portSet)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: %v, want an error with %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if gotLink != tt.wantLink || gotPort != tt.wantPort {
+			t.Errorf("%s: %s %s, want %s %s", tt.name, gotLink, gotPort, tt.wantLink, tt.wantPort)
+		}
+		if len(warnings) != len(tt.warnings) {
+			t.Errorf("%s: warnings %q, want %q", tt.name, warnings, tt.warnings)
+			continue
+		}
+		for i, w := range tt.warnings {
+			if !strings.Contains(warnings[i], w) {
+				t.Errorf("%s: warning %q, want %q", tt.name, warnings[i], w)
+			}
+		}
+	}
+}
+
+func TestSplitHostMaybePort(t *testing.T) {
+
+	tests := map[string][]string{
+		"master.example":       {"master.example", ""},
+		"master.example:27650": {"master.example", "27650"},
+		"192.0.2.1":            {"192.0.2.1", ""},
+		"::1":                  {"::1", ""},
+		"[::1]":                {"::1", ""},
+		"[::1]:27650":          {"::1", "27650"},
+		" 192.0.2.1:1 ":        {"192.0.2.1", "1"},
+	}
+
+	for entry, want := range tests {
+		host, port, err := splitHostMaybePort(entry)
+		if err != nil || !reflect.DeepEqual([]string{host, port}, want) {
+			t.Errorf("%q: %q %q %v, want %q", entry, host, port, err, want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BatchFile - List of query specs run by "batch".
+type BatchFile struct {
+	Specs []BatchSpec `json:"specs"`
+}
+
+// BatchSpec - One named query of a batch file.
+type BatchSpec struct {
+	Name    string       `json:"name"`
+	Game    string       `json:"game"`
+	Master  string       `json:"master"` // Comma-separated host[:port], the game master when empty
+	Mod     string       `json:"mod"`
+	Filters BatchFilters `json:"filters"`
+	Output  BatchOutput  `json:"output"`
+}
+
+// BatchFilters - Filters of a spec, by filter flag name, e.g.
+// {"hide-empty": true, "map": "q4ctf1", "nopassword": true}. Underscores
+// can stand for the dashes, as in "hide_empty".
+type BatchFilters map[string]json.RawMessage
+
+// Parse - Values of the filter flags, checked like on the command line.
+func (bf BatchFilters) Parse() (FilterFlags, error) {
+
+	var ff FilterFlags
+	fs := flag.NewFlagSet("filters", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	ff.Register(fs)
+
+	// Sorted, so that errors don't depend on the map order.
+	var names []string
+	for n := range bf {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		name := strings.ReplaceAll(n, "_", "-")
+		if fs.Lookup(name) == nil {
+			return ff, fmt.Errorf("unknown filter %q", n)
+		}
+
+		// Strings are unquoted, numbers and booleans taken as written.
+		var value string
+		if err := json.Unmarshal(bf[n], &value); err != nil {
+			value = string(bf[n])
+		}
+		if err := fs.Set(name, value); err != nil {
+			return ff, fmt.Errorf("filter %q: invalid value %s", n, bf[n])
+		}
+	}
+
+	if _, _, _, err := ff.Filters(); err != nil {
+		return ff, err
+	}
+
+	return ff, nil
+}
+
+// BatchOutput - Where a spec writes its list. An empty path is the standard output.
+type BatchOutput struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+}
+
+// BatchResult - Outcome of one spec.
+type BatchResult struct {
+	Spec     string
+	Servers  int
+	Duration time.Duration
+	Err      error
+}
+
+// specError - Validation error naming the spec and its field.
+func specError(index int, spec BatchSpec, field string, format string, args ...interface{}) error {
+
+	name := spec.Name
+	if name == "" {
+		name = "#" + strconv.Itoa(index+1)
+	}
+
+	return fmt.Errorf("spec %q: field %q: %s", name, field, fmt.Sprintf(format, args...))
+}
+
+// LoadBatchFile - Reads and validates a batch file, in TOML when its name
+// ends with .toml, in JSON otherwise.
+func LoadBatchFile(path string) (*BatchFile, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		tree, err := parseTOML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch file: %s", err)
+		}
+		// Decoded as JSON, for the same checks on the fields.
+		if data, err = json.Marshal(tree); err != nil {
+			return nil, fmt.Errorf("invalid batch file: %s", err)
+		}
+	}
+
+	return parseBatchFile(bytes.NewReader(data))
+}
+
+func parseBatchFile(r io.Reader) (*BatchFile, error) {
+
+	var batch BatchFile
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&batch); err != nil {
+		return nil, fmt.Errorf("invalid batch file: %s", err)
+	}
+
+	if len(batch.Specs) == 0 {
+		return nil, fmt.Errorf("invalid batch file: no specs")
+	}
+
+	seen := make(map[string]bool)
+	for i, spec := range batch.Specs {
+		if err := validateBatchSpec(i, spec); err != nil {
+			return nil, err
+		}
+		if seen[spec.Name] {
+			return nil, specError(i, spec, "name", "duplicate name")
+		}
+		seen[spec.Name] = true
+	}
+
+	return &batch, nil
+}
+
+// validateBatchSpec - Checks the fields of a spec.
+func validateBatchSpec(index int, spec BatchSpec) error {
+
+	if strings.TrimSpace(spec.Name) == "" {
+		return specError(index, spec, "name", "missing")
+	}
+
+	if spec.Game == GameAll {
+		return specError(index, spec, "game", "%q is not allowed in a batch, use one spec per game", GameAll)
+	}
+	games, err := protocolsByGame(spec.Game)
+	if err != nil {
+		return specError(index, spec, "game", "%s", err)
+	}
+
+	if spec.Master != "" {
+		if _, err := splitMasterList(spec.Master, games[0].MasterPort); err != nil {
+			return specError(index, spec, "master", "%s", err)
+		}
+	}
+
+	if _, err := spec.Filters.Parse(); err != nil {
+		return specError(index, spec, "filters", "%s", err)
+	}
+
+	if spec.Output.Format != "" {
+		if _, err := outputEnum.Parse(spec.Output.Format); err != nil {
+			return specError(index, spec, "output.format", "%s", err)
+		}
+	}
+
+	return nil
+}
+
+// runBatchSpec - Queries the masters of a spec and writes its list.
+func runBatchSpec(ctx context.Context, spec BatchSpec, stdout io.Writer) (int, error) {
+
+	games, err := protocolsByGame(spec.Game)
+	if err != nil {
+		return 0, err
+	}
+	game := games[0]
+
+	masters := []string{net.JoinHostPort(game.Master, game.MasterPort)}
+	if spec.Master != "" {
+		if masters, err = splitMasterList(spec.Master, game.MasterPort); err != nil {
+			return 0, err
+		}
+	}
+
+	specMod := spec.Mod
+	if specMod == "" {
+		specMod = game.DefaultMod
+	}
+
+	ff, err := spec.Filters.Parse()
+	if err != nil {
+		return 0, err
+	}
+	specFilter, specMasterFilter, specRegions, _ := ff.Filters()
+	if len(specRegions) > 0 && geoDB == nil {
+		return 0, fmt.Errorf("the region filter needs a -geoip database")
+	}
+
+	list, results, err := QueryMasterServers(ctx, masters, MasterRequest{Protocol: game, Mod: specMod, Filter: specMasterFilter})
+	if err != nil {
+		return 0, err
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %s: %s\n", spec.Name, res.Master, res.Err)
+		}
+	}
+
+	if geoDB != nil {
+		LocateServers(list, geoDB)
+		list = FilterRegions(list, specRegions)
+	}
+	list = FilterFamily(list, ipFamily)
+
+	if specFilter.Active() {
+		if err := requireConfirmation(planDetailSweep(list, false)); err != nil {
+			return 0, err
+		}
+		QueryAllServerInfo(ctx, list)
+		list = FilterServers(list, specFilter)
+	}
+
+	format := OutputPlain
+	if spec.Output.Format != "" {
+		if format, err = outputEnum.Parse(spec.Output.Format); err != nil {
+			return 0, err
+		}
+	}
+	csvOpts := csvOptions{Separator: ','}
+
+	if spec.Output.Path == "" || spec.Output.Path == "-" {
+		return len(list), writeOutputFormat(stdout, list, format, false, false, nil, csvOpts)
+	}
+
+	return len(list), writeOutputFile(spec.Output.Path, false, list, format, nil, csvOpts, time.Now())
+}
+
+// RunBatch - Runs the specs at once, sharing the resolved master addresses
+// and the -workers server queries, and returns the result of each one.
+// The lists going to stdout are written in the order of the specs. Once
+// ctx is done, the specs left fail without being run.
+func RunBatch(ctx context.Context, batch *BatchFile, stdout io.Writer) []BatchResult {
+
+	if dnsCache == nil {
+		dnsCache = NewDNSCache()
+	}
+
+	results := make([]BatchResult, len(batch.Specs))
+	outputs := make([]bytes.Buffer, len(batch.Specs))
+
+	var wg sync.WaitGroup
+	for i, spec := range batch.Specs {
+		wg.Add(1)
+		go func(i int, spec BatchSpec) {
+			defer wg.Done()
+
+			if err := ctx.Err(); err != nil {
+				results[i] = BatchResult{Spec: spec.Name, Err: err}
+				return
+			}
+
+			logVerbose("batch: running spec %q", spec.Name)
+			start := time.Now()
+			n, err := runBatchSpec(ctx, spec, &outputs[i])
+			results[i] = BatchResult{Spec: spec.Name, Servers: n, Duration: time.Since(start), Err: err}
+		}(i, spec)
+	}
+	wg.Wait()
+
+	for i := range outputs {
+		outputs[i].WriteTo(stdout)
+	}
+
+	return results
+}
+
+// writeBatchSummary - One row per spec, with its status.
+func writeBatchSummary(w io.Writer, results []BatchResult) error {
+
+	var rows [][]string
+	for _, res := range results {
+		status := "ok"
+		if res.Err != nil {
+			status = "failed: " + res.Err.Error()
+		}
+		rows = append(rows, []string{res.Spec, strconv.Itoa(res.Servers), humanDuration(res.Duration), status})
+	}
+
+	return writeTable(w, []string{"SPEC", "SERVERS", "TIME", "STATUS"}, rows)
+}
+
+// runBatchCommand - "batch <file>": exit code 0 if every spec worked, 1 otherwise.
+func runBatchCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s batch [flags] <file>\n", os.Args[0])
+		return 2
+	}
+
+	batch, err := LoadBatchFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results := RunBatch(ctx, batch, os.Stdout)
+	writeBatchSummary(os.Stderr, results)
+
+	code := 0
+	for _, res := range results {
+		if res.Err != nil && code == 0 {
+			code = 1
+		}
+		if isConfirmError(res.Err) {
+			code = exitNeedsConfirmation
+		}
+	}
+
+	return code
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, content string) string {
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadBatchFileTOML(t *testing.T) {
+
+	jsonBatch, err := LoadBatchFile(writeTestFile(t, "batch.json", `{"specs": [
+		{"name": "q4-ctf", "game": "quake4", "filters": {"hide_empty": true, "map": "q4ctf1", "gametype": 2},
+		 "output": {"path": "q4.csv", "format": "csv"}},
+		{"name": "doom3", "game": "doom3", "master": "127.0.0.1:27650"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tomlBatch, err := LoadBatchFile(writeTestFile(t, "batch.toml", `
+[[specs]]
+name = "q4-ctf"
+game = "quake4"
+filters = { hide_empty = true, map = "q4ctf1", gametype = 2 }
+output = { path = "q4.csv", format = "csv" }
+
+[[specs]]
+name = "doom3"
+game = "doom3"
+master = "127.0.0.1:27650"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(jsonBatch, tomlBatch) {
+		t.Errorf("TOML batch %+v differs from the JSON one %+v", tomlBatch, jsonBatch)
+	}
+
+	ff, err := tomlBatch.Specs[0].Filters.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ff.HideEmpty || ff.Map != "q4ctf1" || ff.GameType != 2 {
+		t.Errorf("filters = %+v, want hide-empty, map q4ctf1 and game type 2", ff)
+	}
+}
+
+func TestBatchFilterErrors(t *testing.T) {
+
+	tests := []struct {
+		filters string
+		err     string
+	}{
+		{`{"hide-empty": true, "min-players": 2, "maxping": 150, "nopassword": true, "notfull": true, "notempty": true}`, ""},
+		{`{"hide_empy": true}`, `field "filters": unknown filter "hide_empy"`},
+		{`{"maxping": -1}`, `field "filters": invalid -maxping: must be 0 or more`},
+		{`{"gametype": 300}`, `field "filters": invalid -gametype 300`},
+		{`{"hide-full": "maybe"}`, `field "filters": filter "hide-full": invalid value "maybe"`},
+		{`{"min-players": "two"}`, `field "filters": filter "min-players": invalid value "two"`},
+		{`{"region": "XX1"}`, `field "filters": `},
+	}
+
+	for _, tt := range tests {
+		_, err := parseBatchFile(strings.NewReader(`{"specs": [{"name": "a", "game": "doom3", "filters": ` + tt.filters + `}]}`))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %s", tt.filters, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want %q", tt.filters, err, tt.err)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+
+	keepGlobals(t)
+	dialServer = dialFake
+	savedCache := dnsCache
+	t.Cleanup(func() { dnsCache = savedCache })
+
+	batch, err := parseBatchFile(strings.NewReader(`{"specs": [
+		{"name": "all", "game": "doom3", "master": "127.0.0.1:27650"},
+		{"name": "busy", "game": "doom3", "master": "127.0.0.1:27650", "filters": {"min-players": 2}},
+		{"name": "dead", "game": "doom3", "master": "127.0.0.1:27650", "filters": {"map": "nowhere"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	results := RunBatch(context.Background(), batch, &out)
+
+	var got []int
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("%s: %s", res.Spec, res.Err)
+		}
+		got = append(got, res.Servers)
+	}
+	if !reflect.DeepEqual(got, []int{2, 1, 0}) {
+		t.Errorf("servers per spec = %v, want [2 1 0]", got)
+	}
+
+	// The lists come in the order of the specs, whatever order they ended in.
+	lists := out.String()
+	first, second := strings.Index(lists, "127.0.0.1:27666"), strings.LastIndex(lists, "127.0.0.1:27667")
+	if first < 0 || second < first || strings.Count(lists, "127.0.0.1:27666") != 1 {
+		t.Errorf("unexpected batch output:\n%s", lists)
+	}
+}
+
+func TestRunBatchCancelled(t *testing.T) {
+
+	keepGlobals(t)
+	dialServer = dialFake
+
+	batch, err := parseBatchFile(strings.NewReader(`{"specs": [{"name": "a", "game": "doom3", "master": "127.0.0.1:27650"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := RunBatch(ctx, batch, &bytes.Buffer{})
+	if results[0].Err != context.Canceled {
+		t.Errorf("spec run after cancel: %v", results[0].Err)
+	}
+}
+
+func TestForEachServerSharedPool(t *testing.T) {
+
+	saved := workers
+	t.Cleanup(func() { workers = saved })
+	workers = 3
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	query := func(sv *idTech4_Server) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+
+	// Two sweeps at once, as two batch specs do.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forEachServer(make([]idTech4_Server, 10), nil, query)
+		}()
+	}
+	wg.Wait()
+
+	if most > workers {
+		t.Errorf("%d queries ran at once, want at most %d", most, workers)
+	}
+}
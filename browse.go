@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Keys of the terminal browser, printable ones being their rune.
+const (
+	keyUp rune = -1 - iota
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyEnter
+	keyEscape
+	keyBackspace
+)
+
+// Orders the browser cycles through with "s".
+var browseSorts = []string{"ping", "players", "name"}
+
+// browser - State of the terminal server browser.
+type browser struct {
+	list      []idTech4_Server
+	refreshed time.Time
+	lastErr   error
+	loading   bool
+
+	cursor  int  // Selected server
+	offset  int  // First server shown
+	players bool // Player list of the selected server shown
+	sortBy  int  // Index in browseSorts
+	status  string
+}
+
+// parseKeys - Keys of a read from the terminal. Escape sequences of the
+// arrows and paging keys are decoded; a lone escape is the Escape key.
+func parseKeys(b []byte) []rune {
+
+	var keys []rune
+	for len(b) > 0 {
+		if b[0] == 27 {
+			seq := string(b)
+			switch {
+			case strings.HasPrefix(seq, "\x1b[A"), strings.HasPrefix(seq, "\x1bOA"):
+				keys, b = append(keys, keyUp), b[3:]
+			case strings.HasPrefix(seq, "\x1b[B"), strings.HasPrefix(seq, "\x1bOB"):
+				keys, b = append(keys, keyDown), b[3:]
+			case strings.HasPrefix(seq, "\x1b[H"), strings.HasPrefix(seq, "\x1bOH"):
+				keys, b = append(keys, keyHome), b[3:]
+			case strings.HasPrefix(seq, "\x1b[F"), strings.HasPrefix(seq, "\x1bOF"):
+				keys, b = append(keys, keyEnd), b[3:]
+			case strings.HasPrefix(seq, "\x1b[5~"):
+				keys, b = append(keys, keyPageUp), b[4:]
+			case strings.HasPrefix(seq, "\x1b[6~"):
+				keys, b = append(keys, keyPageDown), b[4:]
+			case len(b) == 1:
+				keys, b = append(keys, keyEscape), b[1:]
+			default:
+				// Unknown sequence: skip up to its final byte
+				end := 1
+				for end < len(b) && (end == 1 || b[end] < 0x40 || b[end] > 0x7e) {
+					end++
+				}
+				if end < len(b) {
+					end++
+				}
+				b = b[end:]
+			}
+			continue
+		}
+
+		switch b[0] {
+		case '\r', '\n':
+			keys = append(keys, keyEnter)
+		case 127, 8:
+			keys = append(keys, keyBackspace)
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, r)
+			b = b[size:]
+			continue
+		}
+		b = b[1:]
+	}
+
+	return keys
+}
+
+// sortList - Sorts the servers by the current order.
+func (br *browser) sortList() {
+
+	switch browseSorts[br.sortBy] {
+	case "ping":
+		SortByPing(br.list)
+	case "players":
+		SortByPlayers(br.list)
+	default:
+		sort.SliceStable(br.list, func(i, j int) bool {
+			return strings.ToLower(stripColors(br.list[i].DisplayName())) < strings.ToLower(stripColors(br.list[j].DisplayName()))
+		})
+	}
+}
+
+// setList - Shows a new server list, keeping the selected server when it is still listed.
+func (br *browser) setList(list []idTech4_Server, err error, now time.Time) {
+
+	br.loading = false
+	br.lastErr = err
+	if err != nil {
+		return
+	}
+
+	selected := br.selected()
+	br.list = list
+	br.refreshed = now
+	br.sortList()
+	br.selectAddress(selected)
+}
+
+// selected - Address of the selected server, empty without servers.
+func (br *browser) selected() string {
+
+	if br.cursor < len(br.list) {
+		return br.list[br.cursor].Address()
+	}
+
+	return ""
+}
+
+// selectAddress - Selects the server, or the first one when it isn't listed.
+func (br *browser) selectAddress(address string) {
+
+	br.cursor = 0
+	for i, sv := range br.list {
+		if sv.Address() == address {
+			br.cursor = i
+		}
+	}
+}
+
+// move - Moves the selection by delta servers.
+func (br *browser) move(delta int) {
+
+	br.cursor += delta
+	if br.cursor >= len(br.list) {
+		br.cursor = len(br.list) - 1
+	}
+	if br.cursor < 0 {
+		br.cursor = 0
+	}
+}
+
+// fitLine - Cuts or pads a line to the width of the terminal.
+func fitLine(s string, width int) string {
+
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+
+	runes := []rune(s)
+	return string(runes[:width])
+}
+
+// browseRow - Columns of a server in the list.
+func browseRow(sv idTech4_Server) string {
+
+	name := stripColors(sv.DisplayName())
+	if !sv.Reachable() {
+		return fmt.Sprintf("%-21s  %7s  %6s  %-16s  %s", sv.Address(), "-", "-", "", name)
+	}
+
+	players := fmt.Sprintf("%d/%d", sv.Info.Players, sv.Info.MaxPlayers)
+	ping := strconv.FormatInt(sv.Info.Ping.Milliseconds(), 10) + "ms"
+
+	return fmt.Sprintf("%-21s  %7s  %6s  %-16s  %s", sv.Address(), players, ping, sv.Info.Map, name)
+}
+
+// render - Draws the browser on a terminal of the given size.
+func (br *browser) render(w io.Writer, width, height int) {
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+
+	title := fmt.Sprintf(" msquery - %d servers, sorted by %s", len(br.list), browseSorts[br.sortBy])
+	switch {
+	case br.loading:
+		title += " - refreshing..."
+	case !br.refreshed.IsZero():
+		title += " - updated " + br.refreshed.Format("15:04:05")
+	}
+	b.WriteString("\x1b[7m" + fitLine(title, width) + "\x1b[0m\r\n")
+
+	rows := height - 2 // Between the title and help lines
+	var body []string
+	if br.players && br.cursor < len(br.list) {
+		body = br.playerLines()
+	} else {
+		body = append(body, "\x1b[1m"+fitLine(fmt.Sprintf("%-21s  %7s  %6s  %-16s  %s", "ADDRESS", "PLAYERS", "PING", "MAP", "NAME"), width)+"\x1b[0m")
+
+		shown := rows - 1
+		if br.cursor < br.offset {
+			br.offset = br.cursor
+		}
+		if br.cursor >= br.offset+shown {
+			br.offset = br.cursor - shown + 1
+		}
+		for i := br.offset; i < len(br.list) && i < br.offset+shown; i++ {
+			line := fitLine(browseRow(br.list[i]), width)
+			if i == br.cursor {
+				line = "\x1b[7m" + line + "\x1b[0m"
+			}
+			body = append(body, line)
+		}
+	}
+	for i := 0; i < rows; i++ {
+		line := ""
+		if i < len(body) {
+			line = body[i]
+		}
+		if !strings.HasPrefix(line, "\x1b[") {
+			line = fitLine(line, width)
+		}
+		b.WriteString(line + "\r\n")
+	}
+
+	help := " ↑/↓ move  Enter players  r refresh  s sort  c copy connect  q quit"
+	if br.players {
+		help = " Esc back  r refresh  c copy connect  q quit"
+	}
+	if br.lastErr != nil {
+		help = " Error: " + br.lastErr.Error()
+	} else if br.status != "" {
+		help = " " + br.status
+	}
+	b.WriteString("\x1b[7m" + fitLine(help, width) + "\x1b[0m")
+
+	io.WriteString(w, b.String())
+}
+
+// playerLines - Details and players of the selected server.
+func (br *browser) playerLines() []string {
+
+	sv := br.list[br.cursor]
+	lines := []string{
+		"Name:      " + stripColors(sv.DisplayName()),
+		"Address:   " + sv.Address(),
+	}
+	if !sv.Reachable() {
+		return append(lines, "", "The server didn't answer.")
+	}
+
+	info := sv.Info
+	lines = append(lines,
+		"Map:       "+info.Map,
+		"Mod:       "+info.Mod,
+		"Game type: "+info.GameType,
+		fmt.Sprintf("Players:   %d/%d", info.Players, info.MaxPlayers),
+		fmt.Sprintf("Ping:      %dms", info.Ping.Milliseconds()),
+		"",
+	)
+	if len(info.PlayerList) == 0 {
+		return append(lines, "No player.")
+	}
+
+	lines = append(lines, fmt.Sprintf("%-3s %-32s %s", "#", "PLAYER", "PING"))
+	for _, p := range info.PlayerList {
+		lines = append(lines, fmt.Sprintf("%-3d %-32s %dms", p.Client, stripColors(p.Name), p.Ping))
+	}
+
+	return lines
+}
+
+// copyToClipboard - Asks the terminal to copy the text with an OSC 52
+// sequence, which goes through SSH. Terminals may ignore it.
+func copyToClipboard(w io.Writer, text string) {
+	fmt.Fprintf(w, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+}
+
+// RunBrowse - Terminal server browser, until q is pressed or ctx is done.
+// The first list is collected before the terminal is put in raw mode, so
+// that the confirmation prompt of big sweeps still works.
+func RunBrowse(ctx context.Context, collect func() ([]idTech4_Server, error)) error {
+
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return fmt.Errorf("browse needs an interactive terminal")
+	}
+
+	fmt.Fprintln(os.Stderr, "Querying the servers...")
+	br := &browser{}
+	list, err := collect()
+	if isConfirmError(err) {
+		return err
+	}
+	br.setList(list, err, time.Now())
+	// The sweep was confirmed once, don't ask again on every refresh.
+	assumeYes = true
+
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	out := os.Stdout
+	io.WriteString(out, "\x1b[?1049h\x1b[?25l\x1b[2J")
+	defer io.WriteString(out, "\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan []rune)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- parseKeys(buf[:n])
+		}
+	}()
+
+	type collected struct {
+		list []idTech4_Server
+		err  error
+	}
+	refreshed := make(chan collected)
+	startRefresh := func() {
+		if br.loading {
+			return
+		}
+		br.loading = true
+		go func() {
+			list, err := collect()
+			refreshed <- collected{list, err}
+		}()
+	}
+
+	width, height := terminalSize(out)
+	br.render(out, width, height)
+	resize := time.NewTicker(500 * time.Millisecond)
+	defer resize.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case res := <-refreshed:
+			br.setList(res.list, res.err, time.Now())
+
+		case <-resize.C:
+			w, h := terminalSize(out)
+			if w == width && h == height {
+				continue
+			}
+			width, height = w, h
+			io.WriteString(out, "\x1b[2J")
+
+		case pressed, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			br.status = ""
+			for _, k := range pressed {
+				page := height - 4
+				switch k {
+				case 'q', 'Q', 3: // Ctrl-C, without ISIG in raw mode
+					return nil
+				case keyUp, 'k':
+					br.move(-1)
+				case keyDown, 'j':
+					br.move(1)
+				case keyPageUp:
+					br.move(-page)
+				case keyPageDown:
+					br.move(page)
+				case keyHome, 'g':
+					br.move(-len(br.list))
+				case keyEnd, 'G':
+					br.move(len(br.list))
+				case keyEnter:
+					br.players = len(br.list) > 0
+				case keyEscape, keyBackspace:
+					br.players = false
+				case 'r', 'R':
+					startRefresh()
+				case 's', 'S':
+					selected := br.selected()
+					br.sortBy = (br.sortBy + 1) % len(browseSorts)
+					br.sortList()
+					br.selectAddress(selected)
+				case 'c', 'C':
+					if br.cursor < len(br.list) {
+						connect := "connect " + br.list[br.cursor].Address()
+						copyToClipboard(out, connect)
+						br.status = fmt.Sprintf("Copied %q (terminals without OSC 52 support ignore it)", connect)
+					}
+				}
+			}
+		}
+
+		br.render(out, width, height)
+	}
+}
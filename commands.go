@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Subcommands with their own flag set, by name. "query" and "serve" share
+// the flags of the legacy invocation, see main.
+var subcommands = map[string]func(args []string) int{
+	"info":       runInfoCommand,
+	"ping":       runPingCommand,
+	"master":     runMasterCommand,
+	"matrix":     runMatrixCommand,
+	"history":    runHistoryCommand,
+	"completion": runCompletionCommand,
+}
+
+// Address "msquery serve" listens on when -serve isn't given.
+const defaultServeAddress = ":8080"
+
+// writeUsage - Usage of the tool, listing the subcommands.
+func writeUsage(w io.Writer) {
+
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  query [host[:port] [port]]  List the servers of masters (the default)")
+	fmt.Fprintln(w, "  info <host:port>            Show the details of a game server")
+	fmt.Fprintln(w, "  ping <host:port>...         Measure the ping of game servers")
+	fmt.Fprintln(w, "  serve                       Serve the server list over HTTP")
+	fmt.Fprintln(w, "  browse                      Browse the servers in the terminal")
+	fmt.Fprintln(w, "  master                      Run a master server")
+	fmt.Fprintln(w, "  batch <file>                Run the queries of a batch file")
+	fmt.Fprintln(w, "  matrix <result.json|dir>... Compare the results of several vantage points")
+	fmt.Fprintln(w, "  history -db <file>          Show the servers recorded with -db over the last days")
+	fmt.Fprintln(w, "  completion <bash|zsh|fish>  Write the shell completion script")
+	fmt.Fprintf(w, "\nRun \"%s <command> -h\" for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(w, "Running without command is the deprecated form of \"%s query\".\n\n", os.Args[0])
+	fmt.Fprintln(w, "Flags of query, serve, browse and batch:")
+}
+
+// resolveServer - Game server at host:port, the host being resolved if needed.
+func resolveServer(ctx context.Context, address string) (idTech4_Server, error) {
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return idTech4_Server{}, fmt.Errorf("invalid server address %q: expected host:port", address)
+	}
+	if err := validPort(port); err != nil {
+		return idTech4_Server{}, err
+	}
+
+	addrs, err := resolveMaster(ctx, host, port)
+	if err != nil {
+		return idTech4_Server{}, err
+	}
+
+	ipText, _, _ := net.SplitHostPort(addrs[0])
+	p, _ := strconv.Atoi(port)
+
+	return idTech4_Server{IP: net.ParseIP(ipText), Port: uint16(p)}, nil
+}
+
+// runInfoCommand - "info" subcommand: getInfo, and getStatus with -status, of a single server.
+func runInfoCommand(args []string) int {
+
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fs.DurationVar(&timeout, "timeout", 3*time.Second, "How long to wait for the answer.")
+	fs.IntVar(&retries, "retries", 1, "How many times the query is sent again when it times out.")
+	withStatus := fs.Bool("status", false, "Also send getStatus, for the server cvars.")
+	jsonOut := fs.Bool("json", false, "Write the server as JSON.")
+	fs.BoolVar(&demo, "demo", false, "Answer from the built-in fixtures instead of the network.")
+	fs.BoolVar(&verbose, "v", false, "Verbose output.")
+	fs.BoolVar(&debugLog, "debug", false, "Like -v, also dumping the packets as annotated hex.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s info [flags] <host:port>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	positionals, _ := parseInterleaved(fs, args)
+	if len(positionals) != 1 {
+		fs.Usage()
+		return 2
+	}
+	if demo {
+		if err := enableDemo(); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot load the demo fixtures:", err)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sv, err := resolveServer(ctx, positionals[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if sv.Info, err = QueryServerInfo(ctx, sv); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", sv.Address(), err)
+		return 1
+	}
+	if *withStatus {
+		status, err := QueryServerStatus(ctx, sv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: no getStatus answer: %s\n", sv.Address(), err)
+		} else {
+			sv.Info = MergeServerInfo(sv.Info, status)
+		}
+	}
+	ResolveNames(ctx, []idTech4_Server{sv}, []string{NameSourceInfo}, nil)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(toJSONServer(sv)); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	writeServerInfo(os.Stdout, sv)
+	return 0
+}
+
+// writeServerInfo - The details of a server, one per line, then its players and cvars.
+func writeServerInfo(w io.Writer, sv idTech4_Server) {
+
+	info := sv.Info
+	rows := [][]string{
+		{"Address:", sv.Address()},
+		{"Name:", stripColors(sv.DisplayName())},
+		{"Map:", info.Map},
+		{"Mod:", info.Mod},
+		{"Game type:", info.GameType},
+		{"Players:", fmt.Sprintf("%d/%d", info.Players, info.MaxPlayers)},
+		{"Ping:", fmt.Sprintf("%dms", info.Ping.Milliseconds())},
+		{"Protocol:", fmt.Sprintf("%d.%d", info.Protocol>>16, info.Protocol&0xffff)},
+		{"Engine:", info.Engine()},
+		{"OS:", info.OSName()},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-11s %s\n", row[0], row[1])
+	}
+
+	if len(info.PlayerList) > 0 {
+		fmt.Fprintln(w)
+		var players [][]string
+		for _, p := range info.PlayerList {
+			players = append(players, []string{strconv.Itoa(p.Client), stripColors(p.Name), fmt.Sprintf("%dms", p.Ping)})
+		}
+		writeTable(w, []string{"#", "PLAYER", "PING"}, players)
+	}
+
+	if len(info.Rules) > 0 {
+		fmt.Fprintln(w)
+		var keys []string
+		for k := range info.Rules {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var cvars [][]string
+		for _, k := range keys {
+			cvars = append(cvars, []string{k, info.Rules[k]})
+		}
+		writeTable(w, []string{"CVAR", "VALUE"}, cvars)
+	}
+}
+
+// runPingCommand - "ping" subcommand: sends getInfo to servers at an
+// interval and prints the round trips, like ping.
+func runPingCommand(args []string) int {
+
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	count := fs.Int("count", 4, "Queries sent to each server, 0 to go on until interrupted.")
+	interval := fs.Duration("interval", time.Second, "Time between two queries to a server.")
+	fs.DurationVar(&timeout, "timeout", 3*time.Second, "How long to wait for each answer.")
+	fs.BoolVar(&debugLog, "debug", false, "Dump the packets as annotated hex.")
+	fs.BoolVar(&demo, "demo", false, "Answer from the built-in fixtures instead of the network.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ping [flags] <host:port>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	positionals, _ := parseInterleaved(fs, args)
+	if len(positionals) == 0 || *count < 0 || *interval <= 0 {
+		fs.Usage()
+		return 2
+	}
+	if demo {
+		if err := enableDemo(); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot load the demo fixtures:", err)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var list []idTech4_Server
+	for _, address := range positionals {
+		sv, err := resolveServer(ctx, address)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		list = append(list, sv)
+	}
+
+	rtts := make([][]time.Duration, len(list))
+	sent := make([]int, len(list))
+
+	for round := 0; *count == 0 || round < *count; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		for i, sv := range list {
+			sent[i]++
+			rtt, err := pingServer(ctx, sv)
+			if ctx.Err() != nil {
+				// Interrupted: the query isn't lost
+				sent[i]--
+				break
+			}
+			if err != nil {
+				fmt.Printf("%s: %s\n", sv.Address(), err)
+				continue
+			}
+			rtts[i] = append(rtts[i], rtt)
+			fmt.Printf("%s: seq=%d time=%s\n", sv.Address(), round, humanDuration(rtt))
+		}
+	}
+
+	fmt.Println()
+	lost := false
+	for i, sv := range list {
+		writePingSummary(os.Stdout, sv, sent[i], rtts[i])
+		if len(rtts[i]) == 0 {
+			lost = true
+		}
+	}
+
+	if lost {
+		return 1
+	}
+	return 0
+}
+
+// pingServer - Round trip of a getInfo query, without retry.
+func pingServer(ctx context.Context, sv idTech4_Server) (time.Duration, error) {
+
+	conn, err := openConn(ctx, sv.Address())
+	if err != nil {
+		return 0, newQueryError(CodeUnreachable, "cannot access the server", err)
+	}
+	defer conn.Close()
+
+	info, err := QueryServerInfoConn(conn, rand.Uint32())
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Ping, nil
+}
+
+// writePingSummary - Loss and min/avg/max round trips of a server.
+func writePingSummary(w io.Writer, sv idTech4_Server, sent int, rtts []time.Duration) {
+
+	loss := 0.0
+	if sent > 0 {
+		loss = 100 * float64(sent-len(rtts)) / float64(sent)
+	}
+	fmt.Fprintf(w, "%s: %d sent, %d received, %.0f%% loss", sv.Address(), sent, len(rtts), loss)
+
+	if len(rtts) > 0 {
+		lowest, highest, total := rtts[0], rtts[0], time.Duration(0)
+		for _, rtt := range rtts {
+			if rtt < lowest {
+				lowest = rtt
+			}
+			if rtt > highest {
+				highest = rtt
+			}
+			total += rtt
+		}
+		avg := total / time.Duration(len(rtts))
+		fmt.Fprintf(w, ", min/avg/max %s/%s/%s", humanDuration(lowest), humanDuration(avg), humanDuration(highest))
+	}
+	fmt.Fprintln(w)
+}
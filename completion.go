@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Shells "msquery completion" writes a script for.
+var completionEnum = Enum{Name: "shell", Values: []string{"bash", "zsh", "fish"}}
+
+// Commands offered by the completion, the ones of writeUsage.
+var completionCommands = []string{"query", "info", "ping", "serve", "browse", "master", "batch", "matrix", "history", "completion"}
+
+// Flags whose values are completed, by "msquery completion -words".
+var completionValueFlags = []string{"game", "profile", "output", "export", "sort"}
+
+// completionWords - Values of a flag, as completed by the shell. The games
+// and profiles come from the config, read at every completion so that the
+// custom games show up as soon as they are declared.
+func completionWords(flagName string, configPath string, required bool) ([]string, error) {
+
+	switch flagName {
+	case "output":
+		return outputEnum.Values, nil
+	case "export":
+		return exportEnum.Values, nil
+	case "sort":
+		return sortEnum.Values, nil
+	case "game", "profile":
+	default:
+		return nil, fmt.Errorf("no values to complete for -%s", flagName)
+	}
+
+	cfg, err := LoadConfig(configPath, required)
+	if err != nil {
+		if flagName == "profile" {
+			return nil, err
+		}
+		// The built-in games are still worth completing
+		cfg = &Config{}
+	}
+
+	var words []string
+	if flagName == "profile" {
+		for name := range cfg.Profiles {
+			words = append(words, name)
+		}
+		sort.Strings(words)
+		return words, nil
+	}
+
+	custom, customErr := cfg.Protocols(protocols)
+	if err == nil {
+		err = customErr
+	}
+	for _, p := range append(append([]Protocol(nil), protocols...), custom...) {
+		words = append(words, strings.ToLower(p.ID))
+	}
+	words = append(words, GameAll)
+
+	aliases := len(words)
+	for alias := range gameAliases {
+		words = append(words, alias)
+	}
+	sort.Strings(words[aliases:])
+
+	return words, err
+}
+
+// writeCompletion - Completion script of the shell for the program name:
+// the commands, the flags of query, serve, browse and batch, and the values
+// of completionValueFlags, asked to the program itself.
+func writeCompletion(w io.Writer, shell string, name string, flags *flag.FlagSet) {
+
+	var flagNames []string
+	flags.VisitAll(func(f *flag.Flag) {
+		flagNames = append(flagNames, "-"+f.Name)
+	})
+	fn := "_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if shell == "fish" {
+		fmt.Fprintf(w, "# fish completion of %s, from \"%s completion fish\"\n", name, name)
+		fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -a '%s'\n", name, strings.Join(completionCommands, " "))
+		fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from completion' -a '%s'\n", name, strings.Join(completionEnum.Values, " "))
+		valued := make(map[string]bool)
+		for _, f := range completionValueFlags {
+			valued[f] = true
+			fmt.Fprintf(w, "complete -c %s -o %s -x -a '(%s completion (%s_config) -words %s 2>/dev/null)'\n", name, f, name, fn, f)
+		}
+		for _, f := range flagNames {
+			if !valued[f[1:]] {
+				fmt.Fprintf(w, "complete -c %s -o %s\n", name, f[1:])
+			}
+		}
+		fmt.Fprintf(w, "function %s_config\n", fn)
+		fmt.Fprintln(w, "    set -l words (commandline -opc)")
+		fmt.Fprintln(w, "    set -l i (contains -i -- -config $words; or contains -i -- --config $words)")
+		fmt.Fprintln(w, "    and set -q words[(math $i + 1)]")
+		fmt.Fprintln(w, "    and echo -config $words[(math $i + 1)]")
+		fmt.Fprintln(w, "end")
+		return
+	}
+
+	fmt.Fprintf(w, "# %s completion of %s, from \"%s completion %s\"\n", shell, name, name, shell)
+	if shell == "zsh" {
+		fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+	}
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintln(w, "	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} config=() i")
+	fmt.Fprintln(w, "	for ((i = 1; i < COMP_CWORD - 1; i++)); do")
+	fmt.Fprintln(w, "		if [[ ${COMP_WORDS[i]} == -config || ${COMP_WORDS[i]} == --config ]]; then")
+	fmt.Fprintln(w, "			config=(-config \"${COMP_WORDS[i+1]}\")")
+	fmt.Fprintln(w, "		fi")
+	fmt.Fprintln(w, "	done")
+	var valuePatterns []string
+	for _, f := range completionValueFlags {
+		valuePatterns = append(valuePatterns, "-"+f, "--"+f)
+	}
+	fmt.Fprintln(w, "	case $prev in")
+	fmt.Fprintf(w, "	%s)\n", strings.Join(valuePatterns, "|"))
+	fmt.Fprintf(w, "		COMPREPLY=($(compgen -W \"$(%s completion \"${config[@]}\" -words \"${prev##*-}\" 2>/dev/null)\" -- \"$cur\"))\n", name)
+	fmt.Fprintln(w, "		return;;")
+	fmt.Fprintln(w, "	esac")
+	fmt.Fprintln(w, "	if ((COMP_CWORD == 1)); then")
+	fmt.Fprintf(w, "		COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(completionCommands, " "))
+	fmt.Fprintln(w, "	elif [[ ${COMP_WORDS[1]} == completion ]]; then")
+	fmt.Fprintf(w, "		COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(completionEnum.Values, " "))
+	fmt.Fprintln(w, "	elif [[ $cur == -* ]]; then")
+	fmt.Fprintf(w, "		COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(flagNames, " "))
+	fmt.Fprintln(w, "	else")
+	fmt.Fprintln(w, "		COMPREPLY=($(compgen -f -- \"$cur\"))")
+	fmt.Fprintln(w, "	fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, name)
+}
+
+// runCompletionCommand - "completion" subcommand: writes the completion
+// script of a shell, or with -words the values of a flag.
+func runCompletionCommand(args []string) int {
+
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Config file declaring custom games and profiles.")
+	words := fs.String("words", "", "Write the values of this flag, one per line, instead of a script ("+strings.Join(completionValueFlags, ", ")+").")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s completion <%s>\n", os.Args[0], strings.Join(completionEnum.Values, "|"))
+		fs.PrintDefaults()
+	}
+
+	positionals, _ := parseInterleaved(fs, args)
+
+	if *words != "" {
+		configGiven := false
+		fs.Visit(func(f *flag.Flag) {
+			configGiven = configGiven || f.Name == "config"
+		})
+		values, err := completionWords(strings.TrimLeft(*words, "-"), configPath, configGiven)
+		for _, v := range values {
+			fmt.Println(v)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(positionals) != 1 {
+		fs.Usage()
+		return 2
+	}
+	shell, err := completionEnum.Parse(positionals[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	writeCompletion(os.Stdout, shell, filepath.Base(os.Args[0]), flag.CommandLine)
+
+	return 0
+}
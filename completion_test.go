@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompletionWordsCustomGames(t *testing.T) {
+
+	path := writeConfig(t, `{"games": [{"id": "mytc", "protocol": "1.43", "master": "master.example"}],
+		"profiles": {"q4": {"game": "quake4"}, "lan": {"lan": true}}}`)
+
+	games, err := completionWords("game", path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protocols) != 4 {
+		t.Errorf("the known games were changed: %d", len(protocols))
+	}
+	if strings.Join(games, " ") != "doom3 quake4 dhewm3 etqw mytc all d3 et q4 quakewars" {
+		t.Errorf("games %q", games)
+	}
+
+	profiles, err := completionWords("profile", path, true)
+	if err != nil || !reflect.DeepEqual(profiles, []string{"lan", "q4"}) {
+		t.Errorf("profiles %q, %v", profiles, err)
+	}
+
+	if words, err := completionWords("output", "", false); err != nil || !reflect.DeepEqual(words, outputEnum.Values) {
+		t.Errorf("output %q, %v", words, err)
+	}
+	if _, err := completionWords("timeout", "", false); err == nil {
+		t.Error("completed the values of -timeout")
+	}
+}
+
+func TestCompletionWordsBrokenConfig(t *testing.T) {
+
+	path := writeConfig(t, `{"games": [{"id": "mytc"}]}`)
+
+	// The built-in games are still completed
+	games, err := completionWords("game", path, true)
+	if err == nil || len(games) == 0 || games[0] != "doom3" {
+		t.Errorf("games %q, %v", games, err)
+	}
+	if profiles, err := completionWords("profile", writeConfig(t, `{"profiles": `), true); err == nil || len(profiles) != 0 {
+		t.Errorf("profiles of a broken file %q, %v", profiles, err)
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+
+	fs := flag.NewFlagSet("msquery", flag.ContinueOnError)
+	fs.String("game", "", "")
+	fs.Bool("hide-empty", false, "")
+
+	for _, shell := range completionEnum.Values {
+		var buf bytes.Buffer
+		writeCompletion(&buf, shell, "msquery", fs)
+		script := buf.String()
+
+		for _, want := range []string{"-words", "hide-empty", "completion", "history"} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s: the script lacks %q:\n%s", shell, want, script)
+			}
+		}
+		if strings.Contains(script, "mytc") {
+			t.Errorf("%s: the games are written in the script", shell)
+		}
+	}
+
+	var buf bytes.Buffer
+	writeCompletion(&buf, "bash", "msquery-dev", fs)
+	if !strings.Contains(buf.String(), "complete -F _msquery_dev msquery-dev\n") {
+		t.Errorf("bash function of msquery-dev:\n%s", buf.String())
+	}
+}
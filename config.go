@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config - Settings read from the -config file.
+type Config struct {
+	Games    []GameProfile      `json:"games"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Profile - Named set of flag values selected with -profile, by flag name,
+// e.g. game = "quake4", mod = "q4max", hide-empty = true.
+type Profile map[string]json.RawMessage
+
+// GameProfile - Custom game declared in the config, e.g. a total conversion
+// running its own master.
+type GameProfile struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"` // Protocol long, or major.minor
+	Master     string `json:"master"`
+	MasterPort string `json:"master_port"`
+	GamePort   int    `json:"game_port"`
+	Layout     string `json:"layout"` // Name of a layout of entryLayouts
+	Mod        string `json:"mod"`    // Default -mod
+}
+
+// Layouts a custom game can use, by name.
+var entryLayouts = map[string]EntryLayout{
+	"doom3": layoutDoom3,
+	"etqw":  layoutETQW,
+}
+
+// defaultConfigPath - config.toml in the user configuration directory.
+func defaultConfigPath() string {
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "msquery", "config.toml")
+}
+
+// LoadConfig - Reads a config file, in TOML, or in JSON when its name ends
+// with .json. A missing file is an error only when required, for a path
+// given explicitly.
+func LoadConfig(path string, required bool) (*Config, error) {
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		tree, err := parseTOML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		// Decoded as JSON, for the same checks on the fields.
+		if data, err = json.Marshal(tree); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// parseProtocolVersion - Protocol long given as a number or as major.minor.
+func parseProtocolVersion(value string) (uint32, error) {
+
+	if parts := strings.SplitN(value, ".", 2); len(parts) == 2 {
+		ma, err1 := strconv.ParseUint(parts[0], 10, 16)
+		mi, err2 := strconv.ParseUint(parts[1], 10, 16)
+		if err1 != nil || err2 != nil {
+			return 0, fmt.Errorf("invalid protocol %q: expected major.minor", value)
+		}
+		return uint32(ma<<16 | mi), nil
+	}
+
+	return parseRawProtocol(value)
+}
+
+// profileError - Validation error pointing at the config section.
+func profileError(index int, g GameProfile, field string, format string, args ...interface{}) error {
+	return fmt.Errorf("config games[%d] (%q): field %q: %s", index, g.ID, field, fmt.Sprintf(format, args...))
+}
+
+// Protocols - Protocols of the custom games, validated against the known ones.
+func (cfg *Config) Protocols(known []Protocol) ([]Protocol, error) {
+
+	taken := make(map[string]bool)
+	for _, p := range known {
+		taken[strings.ToLower(p.ID)] = true
+	}
+	for alias := range gameAliases {
+		taken[alias] = true
+	}
+	taken[GameAll] = true
+
+	var custom []Protocol
+	for i, g := range cfg.Games {
+		id := strings.ToLower(strings.TrimSpace(g.ID))
+		if id == "" {
+			return nil, profileError(i, g, "id", "missing")
+		}
+		if taken[id] {
+			return nil, profileError(i, g, "id", "%q is already a game", g.ID)
+		}
+		taken[id] = true
+
+		version, err := parseProtocolVersion(g.Protocol)
+		if err != nil {
+			return nil, profileError(i, g, "protocol", "%s", err)
+		}
+
+		if g.Master == "" {
+			return nil, profileError(i, g, "master", "missing")
+		}
+		masterPort := g.MasterPort
+		if masterPort == "" {
+			masterPort = "27650"
+		}
+		if err := validPort(masterPort); err != nil {
+			return nil, profileError(i, g, "master_port", "%s", err)
+		}
+		if g.GamePort < 0 || g.GamePort > 65535 {
+			return nil, profileError(i, g, "game_port", "invalid port %d", g.GamePort)
+		}
+
+		layout := layoutDoom3
+		if g.Layout != "" {
+			layoutName, err := layoutEnum.Parse(g.Layout)
+			if err != nil {
+				return nil, profileError(i, g, "layout", "%s", err)
+			}
+			layout = entryLayouts[layoutName]
+		}
+
+		name := g.Name
+		if name == "" {
+			name = id
+		}
+
+		custom = append(custom, Protocol{
+			ID:         id,
+			Name:       name,
+			Version:    version,
+			Master:     g.Master,
+			MasterPort: masterPort,
+			GamePort:   g.GamePort,
+			Layout:     layout,
+			DefaultMod: g.Mod,
+			AltPorts:   altPortsIdTech4,
+		})
+	}
+
+	return custom, nil
+}
+
+// applyConfig - Loads the config and adds its games to the known protocols.
+func applyConfig(path string, required bool) (*Config, error) {
+
+	if path == "" {
+		return &Config{}, nil
+	}
+
+	cfg, err := LoadConfig(path, required)
+	if err != nil {
+		return nil, err
+	}
+
+	custom, err := cfg.Protocols(protocols)
+	if err != nil {
+		return nil, err
+	}
+	protocols = append(protocols, custom...)
+
+	return cfg, nil
+}
+
+// Flags a profile can't set.
+var profileForbidden = map[string]bool{"profile": true, "config": true}
+
+// ApplyProfile - Sets the flags of the named profile. Flags given on the
+// command line, and the ones in skip, keep their value.
+func (cfg *Config) ApplyProfile(name string, fs *flag.FlagSet, skip map[string]bool) error {
+
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		var known []string
+		for n := range cfg.Profiles {
+			known = append(known, n)
+		}
+		sort.Strings(known)
+		if len(known) == 0 {
+			return fmt.Errorf("unknown profile %q: the config has no profiles", name)
+		}
+		return fmt.Errorf("unknown profile %q (known: %s)", name, strings.Join(known, ", "))
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	// Sorted, so that errors don't depend on the map order.
+	var names []string
+	for n := range profile {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if profileForbidden[n] || fs.Lookup(n) == nil {
+			return fmt.Errorf("config profiles[%q]: unknown flag %q", name, n)
+		}
+		if given[n] || skip[n] {
+			continue
+		}
+
+		// Strings are unquoted, numbers and booleans taken as written.
+		raw := profile[n]
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+		if err := fs.Set(n, value); err != nil {
+			return fmt.Errorf("config profiles[%q]: flag %q: %s", name, n, err)
+		}
+	}
+
+	return nil
+}
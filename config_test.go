@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// keepProtocols - Restores the known protocols, which applyConfig extends.
+func keepProtocols(t *testing.T) {
+
+	saved := append([]Protocol(nil), protocols...)
+	t.Cleanup(func() { protocols = saved })
+}
+
+func writeConfig(t *testing.T, content string) string {
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigGameValidation(t *testing.T) {
+
+	valid := `{"id": "ok", "protocol": "1.41", "master": "master.example"}`
+
+	tests := []struct {
+		game string
+		want string
+	}{
+		{`{"protocol": "1.41", "master": "m"}`, `games[1] (""): field "id": missing`},
+		{`{"id": "Doom3", "protocol": "1.41", "master": "m"}`, `games[1] ("Doom3"): field "id": "Doom3" is already a game`},
+		{`{"id": "q4", "protocol": "1.41", "master": "m"}`, `field "id": "q4" is already a game`},
+		{`{"id": "all", "protocol": "1.41", "master": "m"}`, `field "id": "all" is already a game`},
+		{`{"id": "OK", "protocol": "1.41", "master": "m"}`, `games[1] ("OK"): field "id": "OK" is already a game`},
+		{`{"id": "tc", "protocol": "1.x", "master": "m"}`, `games[1] ("tc"): field "protocol": invalid protocol "1.x"`},
+		{`{"id": "tc", "protocol": "70000.1", "master": "m"}`, `field "protocol"`},
+		{`{"id": "tc", "protocol": "", "master": "m"}`, `field "protocol"`},
+		{`{"id": "tc", "protocol": "65577"}`, `games[1] ("tc"): field "master": missing`},
+		{`{"id": "tc", "protocol": "65577", "master": "m", "master_port": "99999"}`, `games[1] ("tc"): field "master_port"`},
+		{`{"id": "tc", "protocol": "65577", "master": "m", "game_port": 70000}`, `games[1] ("tc"): field "game_port": invalid port 70000`},
+		{`{"id": "tc", "protocol": "65577", "master": "m", "layout": "quake3"}`, `games[1] ("tc"): field "layout"`},
+	}
+
+	for _, tt := range tests {
+		keepProtocols(t)
+		path := writeConfig(t, `{"games": [`+valid+`, `+tt.game+`]}`)
+		_, err := applyConfig(path, true)
+		if err == nil || !strings.HasPrefix(err.Error(), "config games[1] ") || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %s", tt.game, err, tt.want)
+		}
+	}
+
+	// Unknown fields are typos, not ignored
+	if _, err := applyConfig(writeConfig(t, `{"games": [{"id": "tc", "protocl": "1.41"}]}`), true); err == nil || !strings.Contains(err.Error(), "protocl") {
+		t.Errorf("unknown field: %v", err)
+	}
+}
+
+func TestConfigCustomGameQuery(t *testing.T) {
+
+	keepProtocols(t)
+	keepProbeSettings(t)
+
+	master := newMockMaster(t, serversPacket(28000, 28001, 28002))
+	path := writeConfig(t, `{"games": [{
+		"id": "MyTC", "name": "My Total Conversion", "protocol": "1.99",
+		"master": "127.0.0.1", "master_port": "`+master.Port()+`",
+		"game_port": 28000, "layout": "doom3", "mod": "mytc"
+	}]}`)
+	if _, err := applyConfig(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Known to -game, -protocol and the registry listing
+	found, err := protocolsByGame("mytc")
+	if err != nil || len(found) != 1 {
+		t.Fatalf("-game mytc: %v, %v", found, err)
+	}
+	custom := found[0]
+	if custom.Name != "My Total Conversion" || custom.Version != 1<<16+99 || custom.Master != "127.0.0.1" || custom.MasterPort != master.Port() ||
+		custom.GamePort != 28000 || custom.Layout != layoutDoom3 || custom.DefaultMod != "mytc" {
+		t.Errorf("game %+v", custom)
+	}
+	if p, err := protocolByIndex(len(protocols) - 1); err != nil || p.ID != "mytc" {
+		t.Errorf("-protocol %d: %v, %v", len(protocols)-1, p.ID, err)
+	}
+	var games bytes.Buffer
+	writeGames(&games)
+	if !strings.Contains(games.String(), "My Total Conversion") || !strings.Contains(games.String(), "65635 (1.99)") {
+		t.Errorf("listing:\n%s", games.String())
+	}
+	if !strings.Contains(protocolHelp(), "My Total Conversion") {
+		t.Errorf("-protocol help: %s", protocolHelp())
+	}
+
+	// A full query of its master, with its protocol and mod
+	gameProtocol = custom
+	savedMod := mod
+	t.Cleanup(func() { mod = savedMod })
+	mod = custom.DefaultMod
+
+	list, results, err := collectServers(context.Background(), []string{net.JoinHostPort(custom.Master, custom.MasterPort)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Port != 28000 || len(results) != 1 || results[0].Err != nil {
+		t.Errorf("%d servers %v, results %+v", len(list), list, results)
+	}
+
+	request, _ := idtech4.BuildGetServers(1<<16+99, "mytc", "")
+	if !bytes.Equal(master.LastRequest(), request) {
+		t.Errorf("request %q, want %q", master.LastRequest(), request)
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeFile(t, path, `# msquery config
+[[games]]
+id = "mytc"
+protocol = "1.43"
+master = "master.example.org"
+game_port = 27700
+
+[profiles.quake4-classic]
+game = "quake4"
+mod = "q4max"
+hide-empty = true
+workers = 8
+`)
+
+	cfg, err := LoadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := cfg.Protocols(nil)
+	if err != nil || len(custom) != 1 || custom[0].Version != 1<<16+43 || custom[0].GamePort != 27700 {
+		t.Fatalf("games %+v, %v", custom, err)
+	}
+
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	game := fs.String("game", "doom3", "")
+	modFlag := fs.String("mod", "", "")
+	hideEmpty := fs.Bool("hide-empty", false, "")
+	workers := fs.Int("workers", 0, "")
+	fs.String("profile", "", "")
+	if err := fs.Parse([]string{"-mod", "vanilla"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ApplyProfile("quake4-classic", fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *game != "quake4" || *modFlag != "vanilla" || !*hideEmpty || *workers != 8 {
+		t.Errorf("game %q, mod %q, hide-empty %v, workers %d", *game, *modFlag, *hideEmpty, *workers)
+	}
+
+	// Errors name the file and the line
+	writeFile(t, path, "[profiles.x]\ngame = quake4\n")
+	if _, err := LoadConfig(path, true); err == nil || !strings.Contains(err.Error(), path+": line 2") {
+		t.Errorf("invalid TOML: %v", err)
+	}
+
+	// A missing default file is no error
+	if cfg, err := LoadConfig(filepath.Join(t.TempDir(), "config.toml"), false); err != nil || len(cfg.Games) != 0 {
+		t.Errorf("missing file: %+v, %v", cfg, err)
+	}
+}
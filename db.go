@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunRecord - A query run stored in the -db database.
+type RunRecord struct {
+	Time     time.Time      `json:"time"`
+	Game     string         `json:"game,omitempty"`
+	Protocol uint32         `json:"protocol,omitempty"`
+	Masters  []string       `json:"masters,omitempty"` // Masters that answered
+	LAN      bool           `json:"lan,omitempty"`
+	Servers  []ServerRecord `json:"servers"`
+}
+
+// ServerRecord - A server seen by a run. Players is nil when the server
+// wasn't queried or didn't answer.
+type ServerRecord struct {
+	Address    string `json:"address"`
+	Name       string `json:"name,omitempty"`
+	Map        string `json:"map,omitempty"`
+	Players    *int   `json:"players,omitempty"`
+	MaxPlayers int    `json:"max_players,omitempty"`
+}
+
+// newRunRecord - Record of the servers found by a run started at the given time.
+func newRunRecord(start time.Time, list []idTech4_Server, results []MasterResult) RunRecord {
+
+	meta := newQueryMeta(start, gameProtocol, results, lan)
+	run := RunRecord{Time: meta.Time, Game: meta.Game, Protocol: meta.Protocol, Masters: meta.Masters, LAN: meta.LAN}
+
+	run.Servers = make([]ServerRecord, 0, len(list))
+	for _, sv := range list {
+		rec := ServerRecord{Address: sv.Address(), Name: stripColors(sv.DisplayName())}
+		if sv.Reachable() {
+			players := sv.Info.Players
+			rec.Players = &players
+			rec.MaxPlayers = sv.Info.MaxPlayers
+			rec.Map = sv.Info.Map
+		}
+		run.Servers = append(run.Servers, rec)
+	}
+
+	return run
+}
+
+// runSchema - Tables of the -db store: a row per run, and a row per server
+// seen by a run. Times are Unix milliseconds, masters are space separated.
+const runSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id       INTEGER PRIMARY KEY,
+	time     INTEGER NOT NULL,
+	game     TEXT    NOT NULL DEFAULT '',
+	protocol INTEGER NOT NULL DEFAULT 0,
+	masters  TEXT    NOT NULL DEFAULT '',
+	lan      INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS servers (
+	run_id      INTEGER NOT NULL REFERENCES runs(id) ON DELETE CASCADE,
+	address     TEXT    NOT NULL,
+	name        TEXT    NOT NULL DEFAULT '',
+	map         TEXT    NOT NULL DEFAULT '',
+	players     INTEGER,
+	max_players INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS runs_time ON runs(time);
+CREATE INDEX IF NOT EXISTS servers_run ON servers(run_id);
+CREATE INDEX IF NOT EXISTS servers_address ON servers(address);
+`
+
+// RunStore - The SQLite database of the -db runs.
+type RunStore struct {
+	db *sqliteDB
+}
+
+// OpenRunStore - Opens the -db database, created if needed.
+func OpenRunStore(path string) (*RunStore, error) {
+
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.ExecScript(runSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &RunStore{db: db}, nil
+}
+
+// Close - Closes the database.
+func (s *RunStore) Close() error {
+	return s.db.Close()
+}
+
+// Append - Stores a run and its servers, in a single transaction.
+func (s *RunStore) Append(run RunRecord) error {
+
+	if err := s.db.ExecScript("BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+
+	if err := s.insert(run); err != nil {
+		s.db.ExecScript("ROLLBACK")
+		return err
+	}
+
+	return s.db.ExecScript("COMMIT")
+}
+
+func (s *RunStore) insert(run RunRecord) error {
+
+	err := s.db.Exec(`INSERT INTO runs (time, game, protocol, masters, lan) VALUES (?, ?, ?, ?, ?)`,
+		run.Time.UnixMilli(), run.Game, run.Protocol, strings.Join(run.Masters, " "), run.LAN)
+	if err != nil {
+		return err
+	}
+	id := s.db.LastInsertID()
+
+	stmt, err := s.db.Prepare(`INSERT INTO servers (run_id, address, name, map, players, max_players) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, sv := range run.Servers {
+		if err := stmt.Exec(id, sv.Address, sv.Name, sv.Map, sv.Players, sv.MaxPlayers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Runs - Runs since the given time, oldest first.
+func (s *RunStore) Runs(since time.Time) ([]RunRecord, error) {
+
+	var runs []RunRecord
+	index := make(map[int64]int)
+
+	err := s.db.Query(`SELECT id, time, game, protocol, masters, lan FROM runs WHERE time >= ? ORDER BY time, id`, func(row sqliteRow) error {
+		index[row.Int(0)] = len(runs)
+		runs = append(runs, RunRecord{
+			Time:     time.UnixMilli(row.Int(1)),
+			Game:     row.Text(2),
+			Protocol: uint32(row.Int(3)),
+			Masters:  strings.Fields(row.Text(4)),
+			LAN:      row.Int(5) != 0,
+			Servers:  []ServerRecord{},
+		})
+		return nil
+	}, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Query(`SELECT s.run_id, s.address, s.name, s.map, s.players, s.max_players
+		FROM servers s JOIN runs r ON r.id = s.run_id WHERE r.time >= ? ORDER BY s.rowid`, func(row sqliteRow) error {
+		rec := ServerRecord{Address: row.Text(1), Name: row.Text(2), Map: row.Text(3), MaxPlayers: int(row.Int(5))}
+		if !row.Null(4) {
+			players := int(row.Int(4))
+			rec.Players = &players
+		}
+		i := index[row.Int(0)]
+		runs[i].Servers = append(runs[i].Servers, rec)
+		return nil
+	}, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// AppendRun - Appends a run to the -db database.
+func AppendRun(path string, run RunRecord) error {
+
+	store, err := OpenRunStore(path)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Append(run); err != nil {
+		store.Close()
+		return err
+	}
+
+	return store.Close()
+}
+
+// recordRun - Stores the run in the -db database when there is one. Failing
+// to do so doesn't fail the query.
+func recordRun(start time.Time, list []idTech4_Server, results []MasterResult) {
+
+	if dbPath == "" {
+		return
+	}
+	if err := AppendRun(dbPath, newRunRecord(start, list, results)); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: cannot record the run:", err)
+	}
+}
+
+// ServerTrend - What the runs tell about a server.
+type ServerTrend struct {
+	Address   string    `json:"address"`
+	Name      string    `json:"name,omitempty"` // Last name known
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Seen      int       `json:"seen"`    // Runs listing the server
+	Gone      bool      `json:"gone"`    // Not listed by the last run
+	Peak      int       `json:"peak"`    // Most players seen
+	Average   float64   `json:"average"` // Players, over the runs where it answered
+	samples   int
+}
+
+// BuildTrends - Trend of every server seen by the runs, those seen last first.
+func BuildTrends(runs []RunRecord) []ServerTrend {
+
+	byAddr := make(map[string]*ServerTrend)
+	var last time.Time
+	for _, run := range runs {
+		last = run.Time
+		for _, sv := range run.Servers {
+			t, ok := byAddr[sv.Address]
+			if !ok {
+				t = &ServerTrend{Address: sv.Address, FirstSeen: run.Time}
+				byAddr[sv.Address] = t
+			}
+			t.LastSeen = run.Time
+			t.Seen++
+			if sv.Name != "" {
+				t.Name = sv.Name
+			}
+			if sv.Players != nil {
+				if *sv.Players > t.Peak {
+					t.Peak = *sv.Players
+				}
+				t.Average += float64(*sv.Players)
+				t.samples++
+			}
+		}
+	}
+
+	trends := make([]ServerTrend, 0, len(byAddr))
+	for _, t := range byAddr {
+		if t.samples > 0 {
+			t.Average /= float64(t.samples)
+		}
+		t.Gone = t.LastSeen.Before(last)
+		trends = append(trends, *t)
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		if !trends[i].LastSeen.Equal(trends[j].LastSeen) {
+			return trends[i].LastSeen.After(trends[j].LastSeen)
+		}
+		return trends[i].Address < trends[j].Address
+	})
+
+	return trends
+}
+
+// runHistoryCommand - "history" subcommand: trends of the servers recorded with -db.
+func runHistoryCommand(args []string) int {
+
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.StringVar(&dbPath, "db", "", "Database the runs were recorded to with -db.")
+	days := fs.Int("days", 7, "Only use the runs of the last days, 0 for all of them.")
+	goneOnly := fs.Bool("gone", false, "Only list the servers missing from the last run.")
+	jsonOut := fs.Bool("json", false, "Write the trends as JSON.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s history -db <file> [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if rest, _ := parseInterleaved(fs, args); len(rest) > 0 || dbPath == "" || *days < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if _, err := os.Stat(dbPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	store, err := OpenRunStore(dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	var since time.Time
+	if *days > 0 {
+		since = time.Now().Add(-time.Duration(*days) * 24 * time.Hour)
+	}
+	runs, err := store.Runs(since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	trends := BuildTrends(runs)
+	if *goneOnly {
+		kept := trends[:0]
+		for _, t := range trends {
+			if t.Gone {
+				kept = append(kept, t)
+			}
+		}
+		trends = kept
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(trends); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	if len(runs) == 0 {
+		fmt.Fprintln(os.Stderr, "No run recorded in that period.")
+		return 1
+	}
+
+	if err := writeTrends(os.Stdout, runs, trends); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// writeTrends - Table of the trends, after a line about the runs.
+func writeTrends(w io.Writer, runs []RunRecord, trends []ServerTrend) error {
+
+	const layout = "2006-01-02 15:04"
+	fmt.Fprintf(w, "%d runs from %s to %s\n\n", len(runs), runs[0].Time.Local().Format(layout), runs[len(runs)-1].Time.Local().Format(layout))
+
+	var rows [][]string
+	for _, t := range trends {
+		status := "up"
+		if t.Gone {
+			status = "gone"
+		}
+		rows = append(rows, []string{
+			t.Address,
+			status,
+			fmt.Sprintf("%d/%d", t.Seen, len(runs)),
+			t.FirstSeen.Local().Format(layout),
+			t.LastSeen.Local().Format(layout),
+			strconv.Itoa(t.Peak),
+			strconv.FormatFloat(t.Average, 'f', 1, 64),
+			t.Name,
+		})
+	}
+
+	if err := writeTable(w, []string{"ADDRESS", "STATUS", "SEEN", "FIRST SEEN", "LAST SEEN", "PEAK", "AVG", "NAME"}, rows); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintln(w, "There are", len(trends), "servers found.")
+	return err
+}
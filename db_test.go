@@ -0,0 +1,232 @@
+//go:build sqlite && cgo
+// +build sqlite,cgo
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRun - Run of two servers, the second one silent.
+func testRun(at time.Time, players int) RunRecord {
+
+	return RunRecord{
+		Time:     at,
+		Game:     "doom3",
+		Protocol: 0x00010029,
+		Masters:  []string{"idnet.ua-corp.com:27650", "[::1]:27650"},
+		Servers: []ServerRecord{
+			{Address: "10.0.0.1:27666", Name: "Frag 'n' Beer", Map: "game/mp/d3dm1", Players: &players, MaxPlayers: 8},
+			{Address: "10.0.0.2:27666"},
+		},
+	}
+}
+
+func TestRunStoreRoundTrip(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "servers.db")
+	base := time.UnixMilli(time.Now().UnixMilli())
+
+	for i := 0; i < 3; i++ {
+		if err := AppendRun(path, testRun(base.Add(time.Duration(i)*time.Hour), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lan := RunRecord{Time: base.Add(3 * time.Hour), LAN: true, Servers: []ServerRecord{}}
+	if err := AppendRun(path, lan); err != nil {
+		t.Fatal(err)
+	}
+
+	head := make([]byte, 16)
+	f, _ := os.Open(path)
+	f.Read(head)
+	f.Close()
+	if string(head) != "SQLite format 3\x00" {
+		t.Fatalf("%s is not a SQLite database: %q", path, head)
+	}
+
+	store, err := OpenRunStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	runs, err := store.Runs(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 4 {
+		t.Fatalf("%d runs, want 4", len(runs))
+	}
+	for i := 0; i < 3; i++ {
+		want := testRun(base.Add(time.Duration(i)*time.Hour), i)
+		got := runs[i]
+		if !got.Time.Equal(want.Time) {
+			t.Errorf("run %d at %s, want %s", i, got.Time, want.Time)
+		}
+		got.Time = want.Time
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("run %d:\n got %+v\nwant %+v", i, got, want)
+		}
+	}
+	if !runs[3].LAN || len(runs[3].Servers) != 0 || len(runs[3].Masters) != 0 {
+		t.Errorf("LAN run %+v", runs[3])
+	}
+
+	recent, err := store.Runs(base.Add(90 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 2 || *recent[0].Servers[0].Players != 2 {
+		t.Errorf("runs since 1h30: %+v", recent)
+	}
+}
+
+func TestRunStoreRejectsOtherFiles(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "servers.db")
+	os.WriteFile(path, []byte("these are not the runs you're looking for, padded to a page "+strings.Repeat(".", 200)), 0644)
+
+	if err := AppendRun(path, testRun(time.Now(), 1)); err == nil {
+		t.Error("a run was appended to a file that isn't a database")
+	}
+}
+
+func TestBuildTrends(t *testing.T) {
+
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	runs := []RunRecord{testRun(base, 2), testRun(base.Add(time.Hour), 6)}
+	runs[1].Servers = runs[1].Servers[:1]
+
+	trends := BuildTrends(runs)
+	if len(trends) != 2 {
+		t.Fatalf("%d trends, want 2", len(trends))
+	}
+
+	up, gone := trends[0], trends[1]
+	if up.Address != "10.0.0.1:27666" || up.Gone || up.Seen != 2 || up.Peak != 6 || up.Average != 4 || up.Name != "Frag 'n' Beer" {
+		t.Errorf("trend %+v", up)
+	}
+	if gone.Address != "10.0.0.2:27666" || !gone.Gone || !gone.LastSeen.Equal(base) || gone.Peak != 0 {
+		t.Errorf("trend %+v", gone)
+	}
+}
+
+// storedRuns - Number of runs in the -db database.
+func storedRuns(t *testing.T, path string) int {
+
+	store, err := OpenRunStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	runs, err := store.Runs(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(runs)
+}
+
+func TestRecoverSQLite(t *testing.T) {
+
+	corruptions := []struct {
+		name string
+		fn   func(data []byte) []byte
+	}{
+		{"truncated", func(data []byte) []byte { return data[:len(data)/2] }},
+		{"overwritten pages", func(data []byte) []byte {
+			for i := 4096; i < len(data); i++ {
+				data[i] = 0xa5
+			}
+			return data
+		}},
+	}
+
+	for _, c := range corruptions {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "servers.db")
+		for i := 0; i < 20; i++ {
+			if err := AppendRun(path, testRun(time.Now(), i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A sound database is left alone, nothing is copied.
+		if action, err := recoverSQLite(path); action != "" || err != nil {
+			t.Fatalf("%s: sound database: %q, %v", c.name, action, err)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+			t.Fatalf("%s: files next to a sound database: %v", c.name, files)
+		}
+
+		data, _ := os.ReadFile(path)
+		os.WriteFile(path, c.fn(data), 0644)
+
+		action, err := recoverSQLite(path)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !strings.Contains(action, "integrity check failed") || !strings.Contains(action, "still readable") {
+			t.Errorf("%s: action %q", c.name, action)
+		}
+		if _, err := os.Stat(path + ".corrupt"); err != nil {
+			t.Errorf("%s: damaged file not kept: %v", c.name, err)
+		}
+
+		// The rebuilt database is sound, and takes new runs.
+		n := storedRuns(t, path)
+		if n >= 20 {
+			t.Errorf("%s: %d runs after the rebuild, some were damaged", c.name, n)
+		}
+		if action, err := recoverSQLite(path); action != "" || err != nil {
+			t.Errorf("%s: rebuilt database: %q, %v", c.name, action, err)
+		}
+		if err := AppendRun(path, testRun(time.Now(), 1)); err != nil || storedRuns(t, path) != n+1 {
+			t.Errorf("%s: append after the rebuild: %v", c.name, err)
+		}
+	}
+}
+
+func TestRecoverSQLiteSalvages(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "servers.db")
+	for i := 0; i < 3; i++ {
+		if err := AppendRun(path, testRun(time.Now(), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Damage the index only: every row stays readable.
+	store, err := OpenRunStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.db.ExecScript(`PRAGMA writable_schema = ON;
+		UPDATE sqlite_master SET rootpage = (SELECT rootpage FROM sqlite_master WHERE name = 'runs_time') WHERE name = 'servers_address';
+		PRAGMA writable_schema = OFF;`)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	action, err := recoverSQLite(path)
+	if err != nil || !strings.Contains(action, "rebuilt from the 3 runs still readable") {
+		t.Fatalf("%q, %v", action, err)
+	}
+	store, err = OpenRunStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	runs, err := store.Runs(time.Time{})
+	if err != nil || len(runs) != 3 || len(runs[2].Servers) != 2 || *runs[2].Servers[0].Players != 2 {
+		t.Errorf("salvaged runs %+v, %v", runs, err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+//go:embed demo/fixtures.json
+var demoFiles embed.FS
+
+// Watermark of the outputs made from the demo fixtures.
+const demoWatermark = "*** DEMO DATA: fixtures, not a real master ***"
+
+// demoServer - Game server of the fixtures.
+type demoServer struct {
+	IP         string   `json:"ip"`
+	Port       uint16   `json:"port"`
+	Hostname   string   `json:"hostname"`
+	Map        string   `json:"map"`
+	GameType   string   `json:"gametype"`
+	Mod        string   `json:"mod"`
+	MaxPlayers int      `json:"max_players"`
+	PingMs     int      `json:"ping_ms"`
+	Players    []string `json:"players"`
+}
+
+// DemoNetwork - Fake network answering the queries from the embedded fixtures.
+// Every master address lists the servers of the game matching the protocol
+// of the request, and the servers answer getInfo and getStatus.
+type DemoNetwork struct {
+	MasterIP net.IP
+	games    map[string][]demoServer
+	servers  map[string]demoServer // By IP:port
+	proto    map[string]Protocol   // Protocol of each server, by IP:port
+}
+
+// LoadDemoNetwork - Network of the embedded fixtures.
+func LoadDemoNetwork() (*DemoNetwork, error) {
+
+	data, err := demoFiles.ReadFile("demo/fixtures.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures struct {
+		MasterIP string                  `json:"master_ip"`
+		Games    map[string][]demoServer `json:"games"`
+	}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, err
+	}
+
+	dn := &DemoNetwork{
+		MasterIP: net.ParseIP(fixtures.MasterIP),
+		games:    fixtures.Games,
+		servers:  make(map[string]demoServer),
+		proto:    make(map[string]Protocol),
+	}
+
+	for _, p := range protocols {
+		for _, sv := range fixtures.Games[p.ID] {
+			addr := net.JoinHostPort(sv.IP, strconv.Itoa(int(sv.Port)))
+			dn.servers[addr] = sv
+			dn.proto[addr] = p
+		}
+	}
+
+	return dn, nil
+}
+
+// Dial - DialFunc of the demo network. It never opens a socket.
+func (dn *DemoNetwork) Dial(address string) (PacketConn, error) {
+	return &demoConn{network: dn, address: address}, nil
+}
+
+// LookupIP - Every master hostname resolves to the demo master.
+func (dn *DemoNetwork) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return []net.IP{dn.MasterIP}, nil
+}
+
+// masterAnswer - servers answer listing the fixtures of the requested protocol.
+func (dn *DemoNetwork) masterAnswer(version uint32) []byte {
+
+	game := protocols[0]
+	for _, p := range protocols {
+		if p.Version == version {
+			game = p
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xff})
+	buf.WriteString("servers\x00")
+
+	for _, sv := range dn.games[game.ID] {
+		buf.Write(net.ParseIP(sv.IP).To4())
+		b := make([]byte, 2)
+		if game.Layout.PortBigEndian {
+			binary.BigEndian.PutUint16(b, sv.Port)
+		} else {
+			binary.LittleEndian.PutUint16(b, sv.Port)
+		}
+		buf.Write(b)
+		buf.Write(make([]byte, game.Layout.FlagBytes))
+	}
+
+	return buf.Bytes()
+}
+
+// infoAnswer - infoResponse or statusResponse of a fixture server, in the full layout.
+func infoAnswer(command string, sv demoServer, proto Protocol, challenge uint32) []byte {
+
+	var pkt QuakePacket
+	pkt.PreparePacket()
+	pkt.WriteString(command)
+	pkt.WriteLong(challenge)
+	pkt.WriteLong(proto.Version)
+
+	rules := [][2]string{
+		{"si_name", sv.Hostname},
+		{"si_map", sv.Map},
+		{"si_gameType", sv.GameType},
+		{"si_maxPlayers", strconv.Itoa(sv.MaxPlayers)},
+		{"fs_game", sv.Mod},
+	}
+	var body QuakePacket
+	for _, kv := range rules {
+		body.WriteString(kv[0])
+		body.WriteString(kv[1])
+	}
+	body.WriteString("")
+	body.WriteString("")
+
+	etqw := proto.Version>>16 == etqwProtocolMajor
+	// Quake 4 sends the clan after each player name.
+	withClan := proto.Version>>16 == 2
+	for i, name := range sv.Players {
+		body.WriteByte(byte(i))
+		body.WriteShort(uint16(sv.PingMs))
+		if etqw {
+			body.WriteString(name)
+			body.WriteByte(0) // Clan tag position
+			body.WriteString("")
+			body.WriteByte(0) // Not a bot
+			continue
+		}
+		body.WriteLong(25000)
+		body.WriteString(name)
+		if withClan {
+			body.WriteString("")
+		}
+	}
+	body.WriteByte(maxAsyncClients)
+	body.WriteLong(1) // OS mask
+	if etqw {
+		body.WriteByte(0)          // Not ranked
+		body.WriteLong(20 * 60000) // Time left
+		body.WriteByte(1)          // Game state
+		body.WriteByte(0)          // Regular server
+		body.WriteByte(0)          // Interested clients
+	}
+
+	// ETQW sends the size of the rest of the answer first.
+	if etqw {
+		pkt.WriteLong(uint32(body.Len()))
+	}
+	pkt.WriteBytes(body.ExportToBytes())
+
+	return pkt.ExportToBytes()
+}
+
+// demoConn - Connection of the demo network. Each request written queues
+// its answer, which Read returns after the fixture ping.
+type demoConn struct {
+	network *DemoNetwork
+	address string
+
+	mu      sync.Mutex
+	pending [][]byte
+	delay   time.Duration
+}
+
+func (c *demoConn) Write(b []byte) (int, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a := idtech4.NewAnswer(b)
+	a.ReadShort()
+	cmd, _ := a.ReadString()
+
+	switch cmd {
+	case "getServers", idtech4.CommandGetServersExt:
+		version, _ := a.ReadLong()
+		c.pending = append(c.pending, c.network.masterAnswer(version))
+	case "getInfo", "getStatus":
+		answer := "infoResponse"
+		if cmd == "getStatus" {
+			answer = "statusResponse"
+		}
+		challenge, _ := a.ReadLong()
+		if sv, ok := c.network.servers[c.address]; ok {
+			c.pending = append(c.pending, infoAnswer(answer, sv, c.network.proto[c.address], challenge))
+			c.delay = time.Duration(sv.PingMs) * time.Millisecond
+		}
+	}
+
+	return len(b), nil
+}
+
+func (c *demoConn) Read(b []byte) (int, error) {
+
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return 0, replayTimeout{}
+	}
+	answer, delay := c.pending[0], c.delay
+	c.pending = c.pending[1:]
+	c.mu.Unlock()
+
+	time.Sleep(delay)
+	return copy(b, answer), nil
+}
+
+func (c *demoConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *demoConn) Close() error {
+	return nil
+}
+
+// enableDemo - Routes every query to the demo network.
+func enableDemo() error {
+
+	dn, err := LoadDemoNetwork()
+	if err != nil {
+		return err
+	}
+
+	dialServer = dn.Dial
+	lookupIP = dn.LookupIP
+
+	// Reverse lookups would leave the fake network
+	withoutRDNS()
+
+	return nil
+}
+
+// withoutRDNS - Removes the reverse lookups from the name sources.
+func withoutRDNS() {
+
+	var sources []string
+	for _, src := range nameSources {
+		if src != NameSourceRDNS {
+			sources = append(sources, src)
+		}
+	}
+	nameSources = sources
+}
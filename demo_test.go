@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noNetwork - Fails the test as soon as a socket is opened or a name
+// looked up, and restores the network hooks when it ends.
+func noNetwork(t *testing.T) {
+
+	savedDial, savedAddr, savedCache, savedSources := dialNet, lookupAddr, dnsCache, nameSources
+	t.Cleanup(func() { dialNet, lookupAddr, dnsCache, nameSources = savedDial, savedAddr, savedCache, savedSources })
+
+	dialNet = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		t.Errorf("socket opened to %s %s", network, address)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError("demo")}
+	}
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		t.Errorf("%s looked up", host)
+		return nil, &net.DNSError{Err: "demo", Name: host}
+	}
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		t.Errorf("reverse lookup of %s", addr)
+		return nil, &net.DNSError{Err: "demo", Name: addr}
+	}
+	dialServer, dnsCache = dialUDP, nil
+}
+
+func TestDemoNeverOpensSockets(t *testing.T) {
+
+	keepGlobals(t)
+	noNetwork(t)
+
+	savedDetails := details
+	t.Cleanup(func() { details = savedDetails })
+	details, showPing = true, true
+	nameSources = []string{NameSourceRDNS, NameSourceInfo}
+
+	if err := enableDemo(); err != nil {
+		t.Fatal(err)
+	}
+	dn, err := LoadDemoNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range protocols {
+		fixtures := dn.games[p.ID]
+		if len(fixtures) == 0 {
+			continue
+		}
+		gameProtocol = p
+
+		list, results, err := collectServers(context.Background(), []string{"idnet.ua-corp.com:27650"}, nil)
+		if err != nil {
+			t.Errorf("%s: %v", p.ID, err)
+			continue
+		}
+		if len(list) != len(fixtures) {
+			t.Errorf("%s: %d servers, want the %d fixtures", p.ID, len(list), len(fixtures))
+		}
+		for _, sv := range list {
+			if !sv.Reachable() || sv.Info.Hostname == "" || sv.Name != sv.Info.Hostname {
+				t.Errorf("%s: %s not detailed: %+v", p.ID, sv.Address(), sv.Info)
+			}
+		}
+
+		// Every output of the pipeline
+		meta := newQueryMeta(time.Now(), p, results, false)
+		for _, format := range outputEnum.Values {
+			var out bytes.Buffer
+			if err := writeOutputFormat(&out, list, format, true, true, meta, csvOptions{}); err != nil {
+				t.Errorf("%s %s: %v", p.ID, format, err)
+			}
+			if !strings.Contains(out.String(), fixtures[0].IP) {
+				t.Errorf("%s %s: no fixture in\n%s", p.ID, format, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Kinds of changes between two server lists.
+const (
+	EventAdded   = "added"
+	EventRemoved = "removed"
+	EventMoved   = "moved"
+	EventMap     = "map"     // Same server, other map
+	EventPlayers = "players" // Same server, other player count
+)
+
+// Default minimal hostname similarity for a removed and an added server
+// on the same IP to be reported as a single move.
+const defaultMoveSimilarity = 0.8
+
+// ServerEvent - A change between two server lists.
+// For moves, map and player changes, Server is the new entry and From the old one.
+type ServerEvent struct {
+	Type   string
+	Server idTech4_Server
+	From   *idTech4_Server
+}
+
+// stripColors - Removes idTech4 color escapes (^0 to ^9, ^c + 3 digits).
+func stripColors(name string) string {
+
+	var b strings.Builder
+
+	r := []rune(name)
+	for i := 0; i < len(r); i++ {
+		if r[i] == '^' && i+1 < len(r) {
+			if r[i+1] >= '0' && r[i+1] <= '9' {
+				i++
+				continue
+			}
+			if (r[i+1] == 'c' || r[i+1] == 'C') && i+4 < len(r) {
+				i += 4
+				continue
+			}
+		}
+		b.WriteRune(r[i])
+	}
+
+	return b.String()
+}
+
+// normalizeHostname - Color-stripped, lowercased hostname with collapsed spaces.
+func normalizeHostname(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(stripColors(name)), unicode.IsSpace), " ")
+}
+
+// hostnameSimilarity - Similarity between two hostnames, from 0 (different) to 1 (same),
+// based on the edit distance of their normalized forms.
+func hostnameSimilarity(a string, b string) float64 {
+
+	ra := []rune(normalizeHostname(a))
+	rb := []rune(normalizeHostname(b))
+
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// hostnameOf - Hostname of a server, empty when unknown.
+func hostnameOf(sv idTech4_Server) string {
+	if sv.Reachable() {
+		return sv.Info.Hostname
+	}
+	return ""
+}
+
+// DiffServers - Lists the servers added and removed between two lists.
+// A removed and an added server sharing their IP and a hostname at least
+// minSimilarity alike are merged into a single move. Without hostnames
+// (no getInfo), a server can't be told apart from another one on the same
+// IP, so no move is reported.
+// Servers answering getInfo in both lists are also compared, reporting
+// their map and player count changes.
+func DiffServers(prev []idTech4_Server, cur []idTech4_Server, minSimilarity float64) []ServerEvent {
+
+	before := make(map[string]idTech4_Server)
+	for _, sv := range prev {
+		before[sv.Address()] = sv
+	}
+	after := make(map[string]bool)
+	for _, sv := range cur {
+		after[sv.Address()] = true
+	}
+
+	var removed []idTech4_Server
+	for _, sv := range prev {
+		if !after[sv.Address()] {
+			removed = append(removed, sv)
+		}
+	}
+
+	var events []ServerEvent
+	used := make([]bool, len(removed))
+
+	for _, sv := range cur {
+		if old, ok := before[sv.Address()]; ok {
+			events = append(events, diffServerInfo(old, sv)...)
+			continue
+		}
+
+		moved := false
+		if name := hostnameOf(sv); name != "" {
+			best := -1
+			bestScore := 0.0
+			for i, old := range removed {
+				if used[i] || !old.IP.Equal(sv.IP) || hostnameOf(old) == "" {
+					continue
+				}
+				score := hostnameSimilarity(name, hostnameOf(old))
+				if score >= minSimilarity && score > bestScore {
+					best, bestScore = i, score
+				}
+			}
+
+			if best >= 0 {
+				used[best] = true
+				from := removed[best]
+				events = append(events, ServerEvent{Type: EventMoved, Server: sv, From: &from})
+				moved = true
+			}
+		}
+
+		if !moved {
+			events = append(events, ServerEvent{Type: EventAdded, Server: sv})
+		}
+	}
+
+	for i, sv := range removed {
+		if !used[i] {
+			events = append(events, ServerEvent{Type: EventRemoved, Server: sv})
+		}
+	}
+
+	return events
+}
+
+// diffServerInfo - Map and player count changes of a server between two
+// queries. A server which didn't answer one of them has no changes.
+func diffServerInfo(old idTech4_Server, sv idTech4_Server) []ServerEvent {
+
+	if !old.Reachable() || !sv.Reachable() {
+		return nil
+	}
+
+	var events []ServerEvent
+	if old.Info.Map != sv.Info.Map {
+		events = append(events, ServerEvent{Type: EventMap, Server: sv, From: &old})
+	}
+	if old.Info.Players != sv.Info.Players {
+		events = append(events, ServerEvent{Type: EventPlayers, Server: sv, From: &old})
+	}
+
+	return events
+}
+
+// String - Human readable form of the event, e.g. "moved 1.2.3.4:27666 → :27667".
+func (ev ServerEvent) String() string {
+
+	switch ev.Type {
+	case EventAdded:
+		return "+ " + ev.Server.Address() + " (new)"
+	case EventRemoved:
+		return "- " + ev.Server.Address() + " (gone)"
+	case EventMoved:
+		return "moved " + ev.From.Address() + " → :" + strconv.Itoa(int(ev.Server.Port))
+	case EventMap:
+		return "~ " + ev.Server.Address() + " map " + ev.From.Info.Map + " → " + ev.Server.Info.Map
+	case EventPlayers:
+		return fmt.Sprintf("~ %s players %d → %d/%d", ev.Server.Address(), ev.From.Info.Players, ev.Server.Info.Players, ev.Server.Info.MaxPlayers)
+	}
+
+	return ev.Type + " " + ev.Server.Address()
+}
+
+// MarshalJSON - Events are written as {"type":"moved","server":{...},"from":{...}}.
+func (ev ServerEvent) MarshalJSON() ([]byte, error) {
+
+	out := struct {
+		Type   string      `json:"type"`
+		Server jsonServer  `json:"server"`
+		From   *jsonServer `json:"from,omitempty"`
+	}{
+		Type:   ev.Type,
+		Server: toJSONServer(ev.Server),
+	}
+
+	if ev.From != nil {
+		from := toJSONServer(*ev.From)
+		out.From = &from
+	}
+
+	return json.Marshal(out)
+}
+
+func (ev *ServerEvent) UnmarshalJSON(data []byte) error {
+
+	var in struct {
+		Type   string          `json:"type"`
+		Server idTech4_Server  `json:"server"`
+		From   *idTech4_Server `json:"from"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	*ev = ServerEvent{Type: in.Type, Server: in.Server, From: in.From}
+	return nil
+}
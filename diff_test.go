@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+)
+
+func TestHostnameSimilarity(t *testing.T) {
+
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"^1Fast ^7Frags", "fast   frags", 1},
+		{"^c255Red", "red", 1},
+		{"Doom Server", "Doom Server #2", 11.0 / 14},
+		{"abcd", "abce", 0.75},
+		{"abc", "xyz", 0},
+		{"abc", "", 0},
+	}
+
+	for _, tt := range tests {
+		if got := hostnameSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("hostnameSimilarity(%q, %q) = %.3f, want %.3f", tt.a, tt.b, got, tt.want)
+		}
+		if got, back := hostnameSimilarity(tt.a, tt.b), hostnameSimilarity(tt.b, tt.a); got != back {
+			t.Errorf("hostnameSimilarity(%q, %q) isn't symmetric: %.3f, %.3f", tt.a, tt.b, got, back)
+		}
+	}
+}
+
+// namedServer - Reachable server of 10.0.0.1 with the hostname.
+func namedServer(port uint16, hostname string, players int) idTech4_Server {
+	return idTech4_Server{IP: net.IPv4(10, 0, 0, 1), Port: port, Info: &ServerInfo{Hostname: hostname, Players: players}}
+}
+
+func TestDiffServersMoveThreshold(t *testing.T) {
+
+	prev := []idTech4_Server{namedServer(27666, "abcd", 2)}
+	cur := []idTech4_Server{namedServer(27667, "abce", 2)}
+
+	tests := []struct {
+		threshold float64
+		want      []string
+	}{
+		{0.5, []string{EventMoved}},
+		{0.75, []string{EventMoved}}, // Exactly the similarity
+		{0.76, []string{EventAdded, EventRemoved}},
+		{1, []string{EventAdded, EventRemoved}},
+	}
+
+	for _, tt := range tests {
+		events := DiffServers(prev, cur, tt.threshold)
+		var got []string
+		for _, ev := range events {
+			got = append(got, ev.Type)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("threshold %.2f: events %v, want %v", tt.threshold, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("threshold %.2f: events %v, want %v", tt.threshold, got, tt.want)
+			}
+		}
+	}
+
+	// Another IP is never a move, whatever the hostname.
+	other := namedServer(27667, "abcd", 2)
+	other.IP = net.IPv4(10, 0, 0, 2)
+	if events := DiffServers(prev, []idTech4_Server{other}, 0); len(events) != 2 {
+		t.Errorf("server on another IP: %v, want added and removed", events)
+	}
+
+	// Without getInfo answers, the servers can't be told apart.
+	if events := DiffServers([]idTech4_Server{{IP: net.IPv4(10, 0, 0, 1), Port: 1}}, []idTech4_Server{{IP: net.IPv4(10, 0, 0, 1), Port: 2}}, 0); len(events) != 2 {
+		t.Errorf("servers without info: %v, want added and removed", events)
+	}
+}
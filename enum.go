@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Enum - Values allowed for an enum-valued setting, with their aliases.
+// Matching ignores the case and the surrounding whitespace.
+type Enum struct {
+	Name    string            // Setting named in the errors, e.g. -output
+	Values  []string          // Canonical values, in lowercase
+	Aliases map[string]string // Alias to canonical value
+}
+
+// Parse - Canonical value of a user given one.
+func (e Enum) Parse(value string) (string, error) {
+
+	v := strings.ToLower(strings.TrimSpace(value))
+
+	if canonical, ok := e.Aliases[v]; ok {
+		v = canonical
+	}
+	for _, allowed := range e.Values {
+		if v == allowed {
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid %s %q (valid: %s)", e.Name, value, e.Valid())
+}
+
+// ParseList - Canonical values of a comma-separated list, without duplicates.
+func (e Enum) ParseList(value string) ([]string, error) {
+
+	var values []string
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		v, err := e.Parse(item)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+
+	return values, nil
+}
+
+// Valid - The allowed values for the help and errors, aliases in parenthesis.
+func (e Enum) Valid() string {
+
+	byValue := make(map[string][]string)
+	for alias, canonical := range e.Aliases {
+		byValue[canonical] = append(byValue[canonical], alias)
+	}
+
+	valid := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		valid[i] = v
+		if aliases := byValue[v]; len(aliases) > 0 {
+			sort.Strings(aliases)
+			valid[i] += " (" + strings.Join(aliases, ", ") + ")"
+		}
+	}
+
+	return strings.Join(valid, ", ")
+}
+
+// Short names accepted by -game.
+var gameAliases = map[string]string{
+	"d3":        "doom3",
+	"q4":        "quake4",
+	"et":        "etqw",
+	"quakewars": "etqw",
+}
+
+// gameEnum - Games known to -game, including the custom ones of the config.
+func gameEnum() Enum {
+
+	e := Enum{Name: "game", Aliases: make(map[string]string)}
+	for _, p := range protocols {
+		e.Values = append(e.Values, strings.ToLower(p.ID))
+	}
+	e.Values = append(e.Values, GameAll)
+
+	for alias, canonical := range gameAliases {
+		e.Aliases[alias] = canonical
+	}
+
+	return e
+}
+
+var (
+	outputEnum = Enum{Name: "output format", Values: []string{OutputPlain, OutputCSV, OutputJSON}}
+
+	sortEnum = Enum{Name: "sort column", Values: overviewColumns}
+
+	nameSourceEnum = Enum{Name: "name source", Values: []string{NameSourceInfo, NameSourceAnnotations, NameSourceRDNS}}
+
+	layoutEnum = Enum{Name: "layout", Values: []string{"doom3", "etqw"}}
+)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnumFlags(t *testing.T) {
+
+	keepProtocols(t)
+
+	tests := []struct {
+		enum  Enum
+		value string
+		want  string
+		err   string
+	}{
+		{outputEnum, "json", "json", ""},
+		{outputEnum, " CSV ", "csv", ""},
+		{outputEnum, "Plain", "plain", ""},
+		{outputEnum, "xml", "", `invalid output format "xml" (valid: plain, csv, json)`},
+
+		{gameEnum(), "Doom3", "doom3", ""},
+		{gameEnum(), " DHEWM3\t", "dhewm3", ""},
+		{gameEnum(), "d3", "doom3", ""},
+		{gameEnum(), "Q4", "quake4", ""},
+		{gameEnum(), "et", "etqw", ""},
+		{gameEnum(), "QuakeWars", "etqw", ""},
+		{gameEnum(), "ALL", "all", ""},
+		{gameEnum(), "quake3", "", `invalid game "quake3" (valid: doom3 (d3), quake4 (q4), dhewm3, etqw (et, quakewars), all)`},
+
+		{sortEnum, "Players", "players", ""},
+		{sortEnum, "name", "", `invalid sort column "name" (valid: game, master, servers, players, ping, time, errors)`},
+
+		{layoutEnum, "ETQW", "etqw", ""},
+		{layoutEnum, "q3", "", `invalid layout "q3" (valid: doom3, etqw)`},
+
+		{exportEnum, "Quake4", "quake4", ""},
+		{exportEnum, "q4", "quake4", ""},
+		{exportEnum, " D3", "doom3", ""},
+		{exportEnum, "etqw", "", `invalid -export game "etqw" (valid: doom3 (d3), dhewm3, quake4 (q4))`},
+
+		{replayTimingEnum, "HONOR", "honor", ""},
+		{replayTimingEnum, "fast", "", `invalid replay timing "fast" (valid: compress, honor)`},
+
+		{protocolEnum(), "0", "0", ""},
+		{protocolEnum(), " 3 ", "3", ""},
+		{protocolEnum(), "Auto", "auto", ""},
+		{protocolEnum(), "Quake4", "1", ""},
+		{protocolEnum(), "q4", "1", ""},
+		{protocolEnum(), "quakewars", "3", ""},
+		{protocolEnum(), "4", "", `invalid protocol "4" (valid: 0 (d3, doom3), 1 (q4, quake4), 2 (dhewm3), 3 (et, etqw, quakewars), auto)`},
+		{protocolEnum(), "-1", "", `invalid protocol "-1"`},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.enum.Parse(tt.value)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s %q: %q, %v, want the error %s", tt.enum.Name, tt.value, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: %q, %v, want %q", tt.enum.Name, tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestEnumList(t *testing.T) {
+
+	got, err := nameSourceEnum.ParseList(" RDNS, info,,rdns ,Annotations")
+	if want := []string{"rdns", "info", "annotations"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, %v, want %v", got, err, want)
+	}
+
+	if _, err := nameSourceEnum.ParseList("info,whois"); err == nil || err.Error() != `invalid name source "whois" (valid: info, annotations, rdns)` {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestProtocolFlag(t *testing.T) {
+
+	keepProtocols(t)
+	keepGlobals(t)
+	savedProtocol, savedAuto, savedValue := protocol, protocolAuto, protocolValue
+	t.Cleanup(func() { protocol, protocolAuto, protocolValue = savedProtocol, savedAuto, savedValue })
+
+	// Set keeps the value, a custom game of the config is then known
+	var f protocolFlag
+	if err := f.Set(" MyTC "); err != nil || f.String() != " MyTC " {
+		t.Fatalf("%v, %q", err, f.String())
+	}
+	protocols = append(protocols, Protocol{ID: "mytc", Name: "My TC", Version: 1<<16 + 99})
+
+	if err := applyProtocolFlag(protocolValue); err != nil || protocol != len(protocols)-1 || protocolAuto {
+		t.Errorf("-protocol mytc: %v, protocol %d, auto %v", err, protocol, protocolAuto)
+	}
+	if err := applyProtocolFlag("AUTO"); err != nil || !protocolAuto {
+		t.Errorf("-protocol AUTO: %v, auto %v", err, protocolAuto)
+	}
+	if err := applyProtocolFlag("q4"); err != nil || protocol != 1 || protocolAuto {
+		t.Errorf("-protocol q4: %v, protocol %d, auto %v", err, protocol, protocolAuto)
+	}
+	protocol = 1
+	if err := applyProtocolFlag("9"); err == nil || protocol != 1 {
+		t.Errorf("-protocol 9: %v, protocol %d", err, protocol)
+	}
+	if err := applyProtocolFlag(""); err != nil || protocol != 1 {
+		t.Errorf("no -protocol: %v, protocol %d", err, protocol)
+	}
+}
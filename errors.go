@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// Codes of the query errors. They are stable, so that services wrapping the
+// tool can map them to their own statuses without matching messages.
+// The library ones are shared.
+const (
+	CodeTimeout           = idtech4.CodeTimeout
+	CodeUnreachable       = idtech4.CodeUnreachable
+	CodeResolve           = "resolve"   // The master hostname did not resolve
+	CodeBadToken          = "bad_token" // The master rejected the -master-token
+	CodeRefused           = idtech4.CodeRefused
+	CodeMalformed         = idtech4.CodeMalformed
+	CodeNeedsConfirmation = "needs_confirmation" // The run was not confirmed, see -yes
+	CodeUnknown           = "unknown"
+)
+
+// ErrorCoder - Errors carrying one of the Code* values.
+type ErrorCoder = idtech4.ErrorCoder
+
+// QueryError - Error of a master or server query.
+type QueryError struct {
+	Code       string
+	Msg        string
+	Err        error         // Underlying error, may be nil
+	RetryAfter time.Duration // How long the master asked us to wait, 0 if it didn't
+}
+
+var (
+	_ ErrorCoder = (*QueryError)(nil)
+	_ ErrorCoder = (*ConfirmError)(nil)
+	_ ErrorCoder = replayTimeout{}
+)
+
+func newQueryError(code string, msg string, err error) *QueryError {
+	return &QueryError{Code: code, Msg: msg, Err: err}
+}
+
+func (e *QueryError) Error() string {
+
+	if e.Err == nil {
+		return e.Msg
+	}
+
+	return e.Msg + ": " + e.Err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode - One of the Code* values.
+func (e *QueryError) ErrorCode() string {
+	return e.Code
+}
+
+// MarshalJSON - Written as {"code": ..., "message": ...}, values and
+// pointers alike.
+func (e QueryError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(toJSONError(&e))
+}
+
+// UnmarshalJSON - Reads back a marshalled error. The underlying error is
+// only kept as part of the message.
+func (e *QueryError) UnmarshalJSON(data []byte) error {
+
+	var je jsonError
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+
+	*e = QueryError{Code: je.Code, Msg: je.Message, RetryAfter: time.Duration(je.RetryAfter * float64(time.Second))}
+	return nil
+}
+
+type jsonError struct {
+	Code       string  `json:"code"`
+	Message    string  `json:"message"`
+	RetryAfter float64 `json:"retry_after_seconds,omitempty"`
+}
+
+// ErrorCodeOf - Code of the first ErrorCoder wrapped in err, CodeUnknown if none.
+func ErrorCodeOf(err error) string {
+
+	var coder ErrorCoder
+	if errors.As(err, &coder) {
+		return coder.ErrorCode()
+	}
+
+	return CodeUnknown
+}
+
+// toJSONError - Any error as {"code", "message"}, nil stays nil.
+func toJSONError(err error) *jsonError {
+
+	if err == nil {
+		return nil
+	}
+
+	return &jsonError{Code: ErrorCodeOf(err), Message: err.Error(), RetryAfter: RetryAfterOf(err).Seconds()}
+}
+
+// RetryAfterOf - Wait asked by the master in err, 0 if none.
+func RetryAfterOf(err error) time.Duration {
+
+	var qerr *QueryError
+	if errors.As(err, &qerr) {
+		return qerr.RetryAfter
+	}
+
+	return 0
+}
+
+// Wait hints of rate limiting masters, "wait 30" or "retry-after: 30",
+// possibly followed by a unit: "wait 2 minutes".
+var waitHintPattern = regexp.MustCompile(`(?i)\b(?:wait|retry-after)\s*:?\s*(\d+)(?:\s*([a-z]+))?`)
+
+// waitHintUnits - Units of the wait hints. A number without one, or followed
+// by another word, is in seconds.
+var waitHintUnits = map[string]time.Duration{
+	"ms": time.Millisecond, "msec": time.Millisecond, "millisecond": time.Millisecond, "milliseconds": time.Millisecond,
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+}
+
+// parseWaitHint - Wait found in a master message, capped to max.
+// Messages without a valid hint give false.
+func parseWaitHint(msg string, max time.Duration) (time.Duration, bool) {
+
+	m := waitHintPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+
+	unit, ok := waitHintUnits[strings.ToLower(m[2])]
+	if !ok {
+		unit = time.Second
+	}
+
+	wait := time.Duration(n) * unit
+	if wait/unit != time.Duration(n) || (max > 0 && wait > max) {
+		wait = max
+	}
+	if wait <= 0 {
+		return 0, false
+	}
+
+	return wait, true
+}
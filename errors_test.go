@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWaitHint(t *testing.T) {
+
+	tests := []struct {
+		msg  string
+		want time.Duration // 0 for no hint
+	}{
+		{"wait 30", 30 * time.Second},
+		{"Too many requests, please wait 30 seconds.", 30 * time.Second},
+		{"retry-after: 30", 30 * time.Second},
+		{"Retry-After:45\n", 45 * time.Second},
+		{"WAIT 5s", 5 * time.Second},
+		{"wait 2 minutes", 2 * time.Minute},
+		{"wait 2min", 2 * time.Minute},
+		{"wait 1 hour", 10 * time.Minute}, // Capped
+		{"wait 3 days", 10 * time.Minute},
+		{"wait 500ms", 500 * time.Millisecond},
+		{"wait 30 and retry", 30 * time.Second},
+		{"wait 99999999999", 0},
+		{"wait 4294967295 hours", 10 * time.Minute},
+		{"wait 0", 0},
+		{"wait", 0},
+		{"wait -5", 0},
+		{"wait a minute", 0},
+		{"retry-after: soon", 0},
+		{"awaiting 30", 0},
+		{"banned", 0},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseWaitHint(tt.msg, 10*time.Minute)
+		if ok != (tt.want > 0) || got != tt.want {
+			t.Errorf("parseWaitHint(%q) = %s, %v, want %s", tt.msg, got, ok, tt.want)
+		}
+	}
+
+	// Without a maximum
+	if got, ok := parseWaitHint("wait 2 hours", 0); !ok || got != 2*time.Hour {
+		t.Errorf("uncapped: %s, %v", got, ok)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ExecOptions - Settings of the external command hooks.
+// Commands are never run through a shell: the command line is split into
+// arguments by splitCommand and handed to the program directly, so server
+// data (hostnames...) can't be interpreted as shell syntax.
+type ExecOptions struct {
+	PerServer   string
+	StdinJSON   bool
+	Concurrency int
+	Timeout     time.Duration
+	Summary     string
+}
+
+// splitCommand - Splits a command line into arguments.
+// Single and double quotes group words, a backslash escapes the next character.
+func splitCommand(line string) ([]string, error) {
+
+	var args []string
+	var cur bytes.Buffer
+	inArg := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != '\'' && c == '\\':
+			if i+1 >= len(runes) {
+				return nil, errors.New("trailing backslash in command")
+			}
+			i++
+			cur.WriteRune(runes[i])
+			inArg = true
+		case quote != 0:
+			cur.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in command")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	return args, nil
+}
+
+// serverEnv - Environment variables describing a server.
+func serverEnv(sv idTech4_Server) []string {
+
+	env := []string{
+		"MSQ_IP=" + sv.IP.String(),
+		"MSQ_PORT=" + strconv.Itoa(int(sv.Port)),
+		"MSQ_ADDRESS=" + sv.Address(),
+	}
+
+	if sv.Reachable() {
+		env = append(env,
+			"MSQ_HOSTNAME="+sv.Info.Hostname,
+			"MSQ_MAP="+sv.Info.Map,
+			"MSQ_MOD="+sv.Info.Mod,
+			"MSQ_GAMETYPE="+sv.Info.GameType,
+			"MSQ_PLAYERS="+strconv.Itoa(sv.Info.Players),
+			"MSQ_MAXPLAYERS="+strconv.Itoa(sv.Info.MaxPlayers),
+			"MSQ_PING_MS="+strconv.FormatFloat(pingMilliseconds(sv), 'f', -1, 64),
+		)
+	}
+
+	return env
+}
+
+// runCommand - Runs a command with extra environment variables and
+// optional stdin, killing it once the timeout is reached. Its output goes
+// to stderr.
+func runCommand(args []string, env []string, stdin []byte, timeout time.Duration) error {
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	// stdout carries the results, which the hooks mustn't mix into.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	return err
+}
+
+// RunExecHooks - Runs the per-server command for every server, then the
+// summary command. Failures are returned as warnings.
+func RunExecHooks(list []idTech4_Server, opts ExecOptions) []error {
+
+	var warnings []error
+	var mu sync.Mutex
+
+	warn := func(err error) {
+		mu.Lock()
+		warnings = append(warnings, err)
+		mu.Unlock()
+	}
+
+	if opts.PerServer != "" {
+		args, err := splitCommand(opts.PerServer)
+		if err != nil {
+			return []error{fmt.Errorf("exec-per-server: %s", err)}
+		}
+
+		concurrency := opts.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		sem := make(chan struct{}, concurrency)
+
+		var wg sync.WaitGroup
+		for _, sv := range list {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(sv idTech4_Server) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				var stdin []byte
+				if opts.StdinJSON {
+					stdin, _ = json.Marshal(toJSONServer(sv))
+				}
+
+				if err := runCommand(args, serverEnv(sv), stdin, opts.Timeout); err != nil {
+					warn(fmt.Errorf("exec-per-server %s: %s", sv.Address(), err))
+				}
+			}(sv)
+		}
+		wg.Wait()
+	}
+
+	if opts.Summary != "" {
+		args, err := splitCommand(opts.Summary)
+		if err != nil {
+			return append(warnings, fmt.Errorf("exec-summary: %s", err))
+		}
+
+		servers := make([]jsonServer, 0, len(list))
+		for _, sv := range list {
+			servers = append(servers, toJSONServer(sv))
+		}
+		stdin, _ := json.Marshal(servers)
+
+		if err := runCommand(args, nil, stdin, opts.Timeout); err != nil {
+			warnings = append(warnings, fmt.Errorf("exec-summary: %s", err))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess - Not a test: the hook command run by the exec tests,
+// through the test binary. It writes its MSQ_ environment and its stdin to
+// a file of $HOOK_DIR, named after its first argument and $MSQ_PORT.
+func TestHelperProcess(t *testing.T) {
+
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		os.Exit(2)
+	}
+
+	switch args[1] {
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "fail":
+		os.Exit(3)
+	case "record":
+		var env []string
+		for _, kv := range os.Environ() {
+			if strings.HasPrefix(kv, "MSQ_") {
+				env = append(env, kv)
+			}
+		}
+		sort.Strings(env)
+		stdin, _ := io.ReadAll(os.Stdin)
+
+		name := filepath.Join(os.Getenv("HOOK_DIR"), args[2]+os.Getenv("MSQ_PORT"))
+		record, _ := json.Marshal(map[string]interface{}{"env": env, "stdin": string(stdin)})
+		if err := os.WriteFile(name, record, 0644); err != nil {
+			os.Exit(4)
+		}
+	}
+
+	os.Exit(0)
+}
+
+// helperCommand - Command line running TestHelperProcess with the given arguments.
+func helperCommand(t *testing.T, args ...string) string {
+
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+
+	line := fmt.Sprintf("%q -test.run=^TestHelperProcess$ --", os.Args[0])
+	for _, a := range args {
+		line += " " + a
+	}
+	return line
+}
+
+type hookRecord struct {
+	Env   []string `json:"env"`
+	Stdin string   `json:"stdin"`
+}
+
+func readHookRecord(t *testing.T, path string) hookRecord {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("hook not run: %v", err)
+	}
+	var rec hookRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestExecHooksEnvironment(t *testing.T) {
+
+	dir := t.TempDir()
+	t.Setenv("HOOK_DIR", dir)
+
+	list := []idTech4_Server{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 27666, Info: &ServerInfo{
+			Hostname: "Frag 'n' Beer; rm -rf /", Map: "game/mp/d3dm1", Mod: "base", GameType: "Tourney",
+			Players: 2, MaxPlayers: 8, Ping: 42300 * time.Microsecond,
+		}},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 27667},
+	}
+
+	warnings := RunExecHooks(list, ExecOptions{
+		PerServer:   helperCommand(t, "record", "server"),
+		StdinJSON:   true,
+		Concurrency: 2,
+		Timeout:     10 * time.Second,
+		Summary:     helperCommand(t, "record", "summary"),
+	})
+	if len(warnings) != 0 {
+		t.Fatalf("warnings %v", warnings)
+	}
+
+	rec := readHookRecord(t, filepath.Join(dir, "server27666"))
+	want := []string{
+		"MSQ_ADDRESS=10.0.0.1:27666",
+		"MSQ_GAMETYPE=Tourney",
+		"MSQ_HOSTNAME=Frag 'n' Beer; rm -rf /",
+		"MSQ_IP=10.0.0.1",
+		"MSQ_MAP=game/mp/d3dm1",
+		"MSQ_MAXPLAYERS=8",
+		"MSQ_MOD=base",
+		"MSQ_PING_MS=42.3",
+		"MSQ_PLAYERS=2",
+		"MSQ_PORT=27666",
+	}
+	if !reflect.DeepEqual(rec.Env, want) {
+		t.Errorf("environment\n%q\nwant\n%q", rec.Env, want)
+	}
+	var sv jsonServer
+	if err := json.Unmarshal([]byte(rec.Stdin), &sv); err != nil || sv.Port != 27666 || sv.Info == nil || sv.Info.Players != 2 {
+		t.Errorf("stdin %q, %v", rec.Stdin, err)
+	}
+
+	// A server without info only gets its address
+	rec = readHookRecord(t, filepath.Join(dir, "server27667"))
+	want = []string{"MSQ_ADDRESS=10.0.0.2:27667", "MSQ_IP=10.0.0.2", "MSQ_PORT=27667"}
+	if !reflect.DeepEqual(rec.Env, want) {
+		t.Errorf("environment without info %q, want %q", rec.Env, want)
+	}
+
+	// The summary gets every server on stdin, and no server variables
+	rec = readHookRecord(t, filepath.Join(dir, "summary"))
+	var servers []jsonServer
+	if err := json.Unmarshal([]byte(rec.Stdin), &servers); err != nil || len(servers) != 2 || len(rec.Env) != 0 {
+		t.Errorf("summary %+v, %v", rec, err)
+	}
+}
+
+func TestExecHooksTimeout(t *testing.T) {
+
+	list := []idTech4_Server{{IP: net.IPv4(10, 0, 0, 1), Port: 27666}}
+
+	start := time.Now()
+	warnings := RunExecHooks(list, ExecOptions{PerServer: helperCommand(t, "sleep"), Timeout: 200 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hook killed after %s", elapsed)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "10.0.0.1:27666: timed out after 200ms") {
+		t.Errorf("warnings %v", warnings)
+	}
+
+	warnings = RunExecHooks(list, ExecOptions{Summary: helperCommand(t, "fail"), Timeout: 10 * time.Second})
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "exec-summary: exit status 3") {
+		t.Errorf("failing summary: %v", warnings)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+
+	tests := []struct {
+		line string
+		want []string
+		err  string
+	}{
+		{`notify-send "new server" $MSQ_HOSTNAME`, []string{"notify-send", "new server", "$MSQ_HOSTNAME"}, ""},
+		{`a 'b "c"' d\ e`, []string{"a", `b "c"`, "d e"}, ""},
+		{`a '\n' "\""`, []string{"a", `\n`, `"`}, ""},
+		{`a ""`, []string{"a", ""}, ""},
+		{`a; rm -rf /`, []string{"a;", "rm", "-rf", "/"}, ""},
+		{`  `, nil, "empty command"},
+		{`a "b`, nil, "unterminated quote"},
+		{`a\`, nil, "trailing backslash"},
+	}
+
+	for _, tt := range tests {
+		got, err := splitCommand(tt.line)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("splitCommand(%q) = %q, %v, want %q", tt.line, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Games whose config directory -export writes to.
+const (
+	ExportDoom3  = "doom3"
+	ExportDhewm3 = "dhewm3"
+	ExportQuake4 = "quake4"
+)
+
+var exportEnum = Enum{Name: "-export game", Values: []string{ExportDoom3, ExportDhewm3, ExportQuake4}, Aliases: map[string]string{"q4": ExportQuake4, "d3": ExportDoom3}}
+
+// Name of the script written in the game directory, run with "exec msquery_servers".
+const exportFileName = "msquery_servers.cfg"
+
+// exportDir - Directory of the game (its base game or the mod) in the user
+// config dir of the game, where its own config files are written.
+func exportDir(game string, mod string) (string, error) {
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	gameDir := "base"
+	if game == ExportQuake4 {
+		gameDir = "q4base"
+	}
+	if mod != "" {
+		// The mod names a directory of the game, never a path out of it
+		if mod == "." || mod == ".." || strings.ContainsAny(mod, `/\:`) || filepath.IsAbs(mod) {
+			return "", fmt.Errorf("invalid -mod %q: not a directory name", mod)
+		}
+		gameDir = mod
+	}
+
+	windows := runtime.GOOS == "windows"
+	switch game {
+	case ExportDhewm3:
+		if windows {
+			return filepath.Join(home, "Documents", "My Games", "dhewm3", gameDir), nil
+		}
+		data := os.Getenv("XDG_DATA_HOME")
+		if data == "" {
+			data = filepath.Join(home, ".local", "share")
+		}
+		return filepath.Join(data, "dhewm3", gameDir), nil
+	case ExportQuake4:
+		if windows {
+			return filepath.Join(home, "Documents", "My Games", "Quake 4", gameDir), nil
+		}
+		return filepath.Join(home, ".quake4", gameDir), nil
+	}
+
+	if windows {
+		return filepath.Join(home, "Documents", "My Games", "Doom 3", gameDir), nil
+	}
+	return filepath.Join(home, ".doom3", gameDir), nil
+}
+
+// Name of the server cache written next to the script, served to the game
+// by "msquery master -cache".
+const exportCacheName = "msquery_servers.cache"
+
+// Master the script points the game at: "msquery master" with its default -listen.
+const exportMasterAddress = "127.0.0.1:27650"
+
+// exportVersions - Protocol versions a server is cached under: the ones it
+// was listed with by -protocol auto, or the protocol of the query.
+func exportVersions(sv idTech4_Server, proto Protocol) []uint32 {
+
+	var versions []uint32
+	for _, id := range sv.Protocols {
+		for _, p := range autoProtocols {
+			if p.ID == id {
+				versions = append(versions, p.Version)
+			}
+		}
+	}
+	if len(versions) == 0 {
+		versions = append(versions, proto.Version)
+	}
+
+	return versions
+}
+
+// writeServerCache - Server cache read by "msquery master -cache": one
+// "address protocol [mod]" line per server and protocol.
+func writeServerCache(w io.Writer, list []idTech4_Server, proto Protocol, mod string, now time.Time) {
+
+	fmt.Fprintf(w, "// %d servers found by msquery on %s, served by \"msquery master -cache\"\n", len(list), now.Format(time.RFC3339))
+	fmt.Fprintln(w, "// address protocol [mod]")
+
+	for _, sv := range list {
+		svMod := mod
+		if svMod == "" && sv.Reachable() {
+			svMod = sv.Info.Mod
+		}
+		for _, version := range exportVersions(sv, proto) {
+			line := fmt.Sprintf("%s %d", sv.Address(), version)
+			if svMod != "" {
+				line += " " + svMod
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// writeExportScript - Console script pointing the in-game browser at the
+// local master serving the cache, as the games keep no favorites or server
+// cache file of their own. The master is set with "set", not "seta", so that
+// the game doesn't archive it in its config: it goes back to its own masters
+// once restarted. The servers are listed as commented "connect" lines, to
+// copy to the console.
+func writeExportScript(w io.Writer, list []idTech4_Server, cachePath string, now time.Time) {
+
+	fmt.Fprintf(w, "// %d servers found by msquery on %s\n", len(list), now.Format(time.RFC3339))
+	fmt.Fprintln(w, "// \"exec msquery_servers\" in the console adds the master serving them to the")
+	fmt.Fprintln(w, "// in-game browser, once it runs:")
+	fmt.Fprintf(w, "//   msquery master -cache \"%s\"\n", cachePath)
+	fmt.Fprintf(w, "set net_master1 %q\n", exportMasterAddress)
+
+	for _, sv := range list {
+		fmt.Fprintln(w)
+		about := stripColors(sv.DisplayName())
+		if sv.Reachable() {
+			about += fmt.Sprintf(" - %s - %d/%d players - %dms", sv.Info.Map, sv.Info.Players, sv.Info.MaxPlayers, sv.Info.Ping.Milliseconds())
+		}
+		fmt.Fprintf(w, "// %s\n", about)
+		fmt.Fprintf(w, "// connect %s\n", sv.Address())
+	}
+}
+
+// ExportServers - Writes the server cache and the script in the game
+// directory, or next to path when given, and returns where they were written.
+func ExportServers(game string, mod string, proto Protocol, path string, list []idTech4_Server, now time.Time) (string, string, error) {
+
+	if path == "" {
+		dir, err := exportDir(game, mod)
+		if err != nil {
+			return "", "", err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+		path = filepath.Join(dir, exportFileName)
+	}
+	cachePath := filepath.Join(filepath.Dir(path), exportCacheName)
+	if abs, err := filepath.Abs(cachePath); err == nil {
+		cachePath = abs
+	}
+
+	var cache bytes.Buffer
+	writeServerCache(&cache, list, proto, mod, now)
+	if err := writeFileAtomic(cachePath, cache.Bytes(), 0644); err != nil {
+		return "", "", err
+	}
+
+	var script bytes.Buffer
+	writeExportScript(&script, list, cachePath, now)
+
+	return path, cachePath, writeFileAtomic(path, script.Bytes(), 0644)
+}
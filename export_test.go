@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// cachedAnswer - Servers the master lists for a getServers request.
+func cachedAnswer(t *testing.T, ms *MasterServer, version uint32, mod string, filter MasterFilter) []string {
+
+	request, _ := idtech4.BuildGetServersFilter(version, mod, filter, "")
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 50), Port: 40000}
+
+	var got []string
+	for _, datagram := range ms.Handle(from, request, time.Now().Add(24*time.Hour)) {
+		answer, err := idtech4.ParseServers(datagram, layoutDoom3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sv := range answer.Servers {
+			got = append(got, sv.String())
+		}
+	}
+	sort.Strings(got)
+
+	return got
+}
+
+func TestExportServerCache(t *testing.T) {
+
+	now := time.Date(2026, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	up := namedServer(27666, "^1Frag", 2)
+	up.Info.Mod, up.Info.Map, up.Info.MaxPlayers = "roe", "game/mp/d3dm1", 8
+	swept := idTech4_Server{IP: net.IPv4(10, 0, 0, 2), Port: 27666, Protocols: []string{"doom3", "dhewm3"}}
+	v6 := idTech4_Server{IP: net.ParseIP("2001:db8::1"), Port: 27666}
+	list := []idTech4_Server{up, swept, v6}
+
+	path := filepath.Join(t.TempDir(), "game", exportFileName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	scriptPath, cachePath, err := ExportServers(ExportDoom3, "", protocols[0], path, list, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scriptPath != path || cachePath != filepath.Join(filepath.Dir(path), exportCacheName) {
+		t.Errorf("written to %s and %s", scriptPath, cachePath)
+	}
+
+	cache, _ := os.ReadFile(cachePath)
+	wantCache := "// 3 servers found by msquery on 2026-05-06T07:08:09Z, served by \"msquery master -cache\"\n" +
+		"// address protocol [mod]\n" +
+		"10.0.0.1:27666 65577 roe\n" +
+		"10.0.0.2:27666 65577\n" +
+		"10.0.0.2:27666 65578\n" +
+		"[2001:db8::1]:27666 65577\n"
+	if string(cache) != wantCache {
+		t.Errorf("cache\n%s\nwant\n%s", cache, wantCache)
+	}
+
+	script, _ := os.ReadFile(scriptPath)
+	for _, want := range []string{
+		"set net_master1 \"127.0.0.1:27650\"\n",
+		"//   msquery master -cache \"" + cachePath + "\"\n",
+		"// Frag - game/mp/d3dm1 - 2/8 players - 0ms\n// connect 10.0.0.1:27666\n",
+		"// connect [2001:db8::1]:27666\n",
+	} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("the script lacks %q:\n%s", want, script)
+		}
+	}
+	for _, line := range strings.Split(string(script), "\n") {
+		if strings.HasPrefix(line, "connect") {
+			t.Errorf("the script joins a server: %s", line)
+		}
+	}
+
+	// The master serves the cache to the game
+	servers, err := loadServerCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := NewMasterServer(time.Minute)
+	ms.SetCache(servers)
+	ms.Expire(time.Now().Add(24 * time.Hour))
+
+	if got := cachedAnswer(t, ms, 1<<16+41, "", MasterFilter{}); strings.Join(got, " ") != "10.0.0.1:27666 10.0.0.2:27666" {
+		t.Errorf("doom3 servers %v", got)
+	}
+	if got := cachedAnswer(t, ms, 1<<16+42, "", MasterFilter{}); strings.Join(got, " ") != "10.0.0.2:27666" {
+		t.Errorf("dhewm3 servers %v", got)
+	}
+	if got := cachedAnswer(t, ms, 1<<16+41, "roe", MasterFilter{Players: idtech4.PlayersNotEmpty}); strings.Join(got, " ") != "10.0.0.1:27666" {
+		t.Errorf("roe servers %v", got)
+	}
+}
+
+func TestServerCacheReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), exportCacheName)
+	writeFile(t, path, "10.0.0.1:27666 65577\n")
+
+	ms := NewMasterServer(time.Minute)
+	cache := &serverCacheFile{path: path}
+	if err := cache.reload(ms); err != nil || ms.Count() != 1 {
+		t.Fatalf("%v, %d servers", err, ms.Count())
+	}
+
+	// Rewritten by another -export
+	writeFile(t, path, "// two now\n10.0.0.1:27666 65577\n10.0.0.3:27666 65577\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if err := cache.reload(ms); err != nil || ms.Count() != 2 {
+		t.Errorf("%v, %d servers after the change", err, ms.Count())
+	}
+
+	// A broken file keeps the servers
+	writeFile(t, path, "10.0.0.1 65577\n")
+	os.Chtimes(path, later.Add(time.Second), later.Add(time.Second))
+	if err := cache.reload(ms); err == nil || !strings.Contains(err.Error(), ":1: invalid address") || ms.Count() != 2 {
+		t.Errorf("%v, %d servers after a broken file", err, ms.Count())
+	}
+
+	for _, bad := range []string{"10.0.0.1:27666", "10.0.0.1:27666 1.x", "host:27666 65577", "10.0.0.1:0 65577", "10.0.0.1:27666 65577 roe extra"} {
+		writeFile(t, path, bad+"\n")
+		if _, err := loadServerCache(path); err == nil {
+			t.Errorf("%q loaded", bad)
+		}
+	}
+}
+
+func TestExportDirMod(t *testing.T) {
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", "")
+
+	base, err := exportDir(ExportDhewm3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := exportDir(ExportDhewm3, "d3xp")
+	if err != nil || dir != filepath.Join(filepath.Dir(base), "d3xp") {
+		t.Errorf("d3xp: %s, %v", dir, err)
+	}
+
+	for _, mod := range []string{"..", ".", "../../.ssh", "d3xp/../..", `..\..`, "/etc", "C:evil"} {
+		if dir, err := exportDir(ExportDhewm3, mod); err == nil {
+			t.Errorf("-mod %q exported to %s", mod, dir)
+		}
+	}
+}
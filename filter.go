@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"path"
+	"strings"
+	"time"
+)
+
+// ServerFilter - Client-side filters applied on the parsed server info.
+// The master doesn't know about them, so they need a getInfo query per server.
+type ServerFilter struct {
+	HideEmpty  bool
+	HideFull   bool
+	Map        string
+	MinPlayers int
+	MaxPing    time.Duration // 0 for no limit
+}
+
+// Active - Tells if any filter is set.
+func (f ServerFilter) Active() bool {
+	return f.HideEmpty || f.HideFull || f.Map != "" || f.MinPlayers > 0 || f.MaxPing > 0
+}
+
+// matchMap - Compares a map name with the si_map value,
+// which may be a full path such as game/mp/d3dm1.
+func matchMap(siMap string, name string) bool {
+
+	if strings.EqualFold(siMap, name) {
+		return true
+	}
+
+	base := path.Base(siMap)
+	base = strings.TrimSuffix(base, path.Ext(base))
+
+	return strings.EqualFold(base, name)
+}
+
+// Match - Tells if the server passes all the filters.
+// Servers without info never match an active filter.
+func (f ServerFilter) Match(sv idTech4_Server) bool {
+
+	if !f.Active() {
+		return true
+	}
+	if !sv.Reachable() {
+		return false
+	}
+
+	info := sv.Info
+	if f.HideEmpty && info.Players == 0 {
+		return false
+	}
+	if f.HideFull && info.MaxPlayers > 0 && info.Players >= info.MaxPlayers {
+		return false
+	}
+	if f.Map != "" && !matchMap(info.Map, f.Map) {
+		return false
+	}
+	if info.Players < f.MinPlayers {
+		return false
+	}
+	if f.MaxPing > 0 && info.Ping > f.MaxPing {
+		return false
+	}
+
+	return true
+}
+
+// FilterServers - Returns the servers passing the filters.
+func FilterServers(list []idTech4_Server, f ServerFilter) []idTech4_Server {
+
+	var filtered []idTech4_Server
+
+	for _, sv := range list {
+		if f.Match(sv) {
+			filtered = append(filtered, sv)
+		}
+	}
+
+	return filtered
+}
+
+// FilterFlags - Values of the filter flags. The command line and the
+// filters of the batch specs register the same flags.
+type FilterFlags struct {
+	HideEmpty  bool
+	HideFull   bool
+	Map        string
+	MinPlayers int
+	MaxPing    int // Milliseconds
+	Region     string
+	NoPassword bool
+	NotFull    bool
+	NotEmpty   bool
+	GameType   int
+}
+
+// Register - Declares the filter flags on the flag set.
+func (ff *FilterFlags) Register(fs *flag.FlagSet) {
+
+	fs.BoolVar(&ff.HideEmpty, "hide-empty", false, "Hide servers without players.")
+	fs.BoolVar(&ff.HideFull, "hide-full", false, "Hide full servers.")
+	fs.StringVar(&ff.Map, "map", "", "Only show servers running the given map.")
+	fs.IntVar(&ff.MinPlayers, "min-players", 0, "Hide servers with fewer players than this.")
+	fs.IntVar(&ff.MaxPing, "maxping", 0, "Hide servers with a ping above this, in milliseconds.")
+	fs.StringVar(&ff.Region, "region", "", "Only keep the servers in these comma-separated continents (EU, NA...) or countries (FR, US...), the first ones first. Needs -geoip.")
+	fs.BoolVar(&ff.NoPassword, "nopassword", false, "Ask the master for the servers without password only.")
+	fs.BoolVar(&ff.NotFull, "notfull", false, "Ask the master to leave out the full servers.")
+	fs.BoolVar(&ff.NotEmpty, "notempty", false, "Ask the master to leave out the empty servers.")
+	fs.IntVar(&ff.GameType, "gametype", 0, "Ask the master for one game type only, by its index in the server browser filter of the game (1 for the first one). 0 lists them all.")
+}
+
+// Filters - Checks the values and returns the client filter, the master
+// filter and the -region list.
+func (ff FilterFlags) Filters() (ServerFilter, MasterFilter, []string, error) {
+
+	if ff.MaxPing < 0 {
+		return ServerFilter{}, MasterFilter{}, nil, errors.New("invalid -maxping: must be 0 or more")
+	}
+	f := ServerFilter{
+		HideEmpty:  ff.HideEmpty,
+		HideFull:   ff.HideFull,
+		Map:        ff.Map,
+		MinPlayers: ff.MinPlayers,
+		MaxPing:    time.Duration(ff.MaxPing) * time.Millisecond,
+	}
+
+	regions, err := parseRegions(ff.Region)
+	if err != nil {
+		return f, MasterFilter{}, nil, err
+	}
+
+	mf, err := buildMasterFilter(ff.NoPassword, ff.NotFull, ff.NotEmpty, ff.GameType)
+	if err != nil {
+		return f, mf, nil, err
+	}
+
+	return f, mf, regions, nil
+}
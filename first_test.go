@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fleetConn - Game server answering getInfo after its delay, unless the
+// connection is closed first.
+type fleetConn struct {
+	fleet   *mockFleet
+	players int
+	delay   time.Duration
+
+	mu        sync.Mutex
+	challenge []byte
+	closed    chan struct{}
+	once      sync.Once
+}
+
+// mockFleet - Game servers reached through dialServer, by port.
+type mockFleet struct {
+	servers map[uint16]fleetServer
+	dialed  int32
+	closed  int32 // Closed before answering
+}
+
+type fleetServer struct {
+	delay   time.Duration
+	players int
+}
+
+func (f *mockFleet) Dial(address string) (PacketConn, error) {
+
+	_, p, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(p)
+	sv := f.servers[uint16(port)]
+	atomic.AddInt32(&f.dialed, 1)
+
+	return &fleetConn{fleet: f, players: sv.players, delay: sv.delay, closed: make(chan struct{})}, nil
+}
+
+// list - Servers of the fleet, in port order.
+func (f *mockFleet) list() []idTech4_Server {
+
+	var list []idTech4_Server
+	for port := uint16(27000); port < 27000+uint16(len(f.servers)); port++ {
+		list = append(list, idTech4_Server{IP: net.IPv4(10, 0, 0, 1), Port: port})
+	}
+	return list
+}
+
+func (c *fleetConn) Write(b []byte) (int, error) {
+
+	if bytes.HasPrefix(b, []byte("\xff\xffgetInfo\x00")) && len(b) >= 14 {
+		c.mu.Lock()
+		c.challenge = append([]byte(nil), b[10:14]...)
+		c.mu.Unlock()
+	}
+	return len(b), nil
+}
+
+func (c *fleetConn) Read(b []byte) (int, error) {
+
+	timer := time.NewTimer(c.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.closed:
+		atomic.AddInt32(&c.fleet.closed, 1)
+		return 0, net.ErrClosed
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copy(b, infoResponse(c.challenge, "fleet", c.players)), nil
+}
+
+func (c *fleetConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *fleetConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestFirstRespondersCancelPromptly(t *testing.T) {
+
+	keepGlobals(t)
+	keepSweepSettings(t)
+	timeout, retries, workers = 10*time.Second, 0, 0
+
+	// 3 fast servers, one of them empty, among 20 slow ones
+	fleet := &mockFleet{servers: make(map[uint16]fleetServer)}
+	for i := uint16(0); i < 23; i++ {
+		fleet.servers[27000+i] = fleetServer{delay: 5 * time.Second, players: 2}
+	}
+	fleet.servers[27004] = fleetServer{delay: 10 * time.Millisecond, players: 2}
+	fleet.servers[27011] = fleetServer{delay: 20 * time.Millisecond, players: 0}
+	fleet.servers[27017] = fleetServer{delay: 30 * time.Millisecond, players: 4}
+	dialServer = fleet.Dial
+
+	cancelled := stats.Counter(StatServerCancelled).Value()
+	start := time.Now()
+	first := QueryFirstResponders(context.Background(), fleet.list(), 2, ServerFilter{MinPlayers: 1})
+	elapsed := time.Since(start)
+
+	if elapsed > time.Second {
+		t.Errorf("returned after %s, the slow queries weren't cancelled", elapsed)
+	}
+	if len(first) != 2 || first[0].Port != 27004 || first[1].Port != 27017 {
+		t.Fatalf("kept %v, want 27004 then 27017", first)
+	}
+	if first[0].Info == nil || first[0].Info.Ping <= 0 {
+		t.Errorf("no info or ping: %+v", first[0].Info)
+	}
+
+	// Every other query was cancelled, and counted so
+	if n := atomic.LoadInt32(&fleet.closed); n != 20 {
+		t.Errorf("%d pending queries closed, want the 20 slow ones", n)
+	}
+	if n := stats.Counter(StatServerCancelled).Value() - cancelled; n != 20 {
+		t.Errorf("%d queries counted as cancelled, want 20", n)
+	}
+}
+
+func TestFirstRespondersStopsStarting(t *testing.T) {
+
+	keepGlobals(t)
+	keepSweepSettings(t)
+	timeout, retries, workers = 10*time.Second, 0, 2
+
+	fleet := &mockFleet{servers: make(map[uint16]fleetServer)}
+	for i := uint16(0); i < 10; i++ {
+		fleet.servers[27000+i] = fleetServer{delay: 5 * time.Second, players: 1}
+	}
+	fleet.servers[27000] = fleetServer{delay: 10 * time.Millisecond, players: 1}
+	dialServer = fleet.Dial
+
+	cancelled := stats.Counter(StatServerCancelled).Value()
+	start := time.Now()
+	first := QueryFirstResponders(context.Background(), fleet.list(), 1, ServerFilter{})
+
+	if elapsed := time.Since(start); elapsed > time.Second || len(first) != 1 {
+		t.Fatalf("%d servers after %s", len(first), elapsed)
+	}
+
+	// With 2 workers, only the second server was pending: the other 8 are
+	// never queried, yet counted as cancelled.
+	if n := atomic.LoadInt32(&fleet.dialed); n > 3 {
+		t.Errorf("%d servers queried, the pool kept starting queries", n)
+	}
+	if n := stats.Counter(StatServerCancelled).Value() - cancelled; n != 9 {
+		t.Errorf("%d queries counted as cancelled, want 9", n)
+	}
+}
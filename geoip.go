@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// GeoDB - MaxMind DB file (GeoLite2 / GeoIP2 Country or City), read in memory.
+// Only what is needed to find the country and continent of an address is
+// implemented: the search tree and the data section decoder.
+type GeoDB struct {
+	buf        []byte
+	nodeCount  uint32
+	recordSize int
+	ipVersion  int
+	treeSize   int
+	ipv4Start  uint32 // Node of ::/96, where IPv4 addresses start in an IPv6 tree
+}
+
+// Marker in front of the metadata, at the end of the file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// OpenGeoDB - Reads a MaxMind DB file.
+func OpenGeoDB(path string) (*GeoDB, error) {
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := newGeoDB(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return db, nil
+}
+
+func newGeoDB(buf []byte) (*GeoDB, error) {
+
+	start := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	start += len(mmdbMetadataMarker)
+
+	d := mmdbDecoder{buf: buf, base: start}
+	value, _, err := d.decode(start, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %s", err)
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata: not a map")
+	}
+
+	db := &GeoDB{buf: buf}
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	db.nodeCount = uint32(nodeCount)
+	db.recordSize = int(recordSize)
+	db.ipVersion = int(ipVersion)
+
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", db.ipVersion)
+	}
+	db.treeSize = int(db.nodeCount) * db.recordSize / 4
+	if db.treeSize+16 > start {
+		return nil, errors.New("search tree larger than the file")
+	}
+
+	if db.ipVersion == 6 {
+		node := uint32(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+
+	return db, nil
+}
+
+// record - Left (0) or right (1) record of a node of the search tree.
+func (db *GeoDB) record(node uint32, bit int) uint32 {
+
+	b := db.buf[int(node)*db.recordSize/4:]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	}
+
+	return binary.BigEndian.Uint32(b[bit*4:])
+}
+
+// lookup - Data of the network containing the address, nil if none.
+func (db *GeoDB) lookup(ip net.IP) (interface{}, error) {
+
+	node := uint32(0)
+	addr := ip.To4()
+	if addr != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+		if addr == nil {
+			return nil, nil
+		}
+	}
+
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := int(addr[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	offset := db.treeSize + int(node-db.nodeCount)
+	d := mmdbDecoder{buf: db.buf, base: db.treeSize + 16}
+	value, _, err := d.decode(offset, 0)
+
+	return value, err
+}
+
+// GeoLocation - Where an address is, as ISO codes.
+type GeoLocation struct {
+	Country   string // e.g. FR
+	Continent string // e.g. EU
+}
+
+// Locate - Country and continent of the address. ok is false when the
+// database doesn't know the address.
+func (db *GeoDB) Locate(ip net.IP) (loc GeoLocation, ok bool, err error) {
+
+	value, err := db.lookup(ip)
+	if err != nil || value == nil {
+		return loc, false, err
+	}
+
+	record, _ := value.(map[string]interface{})
+	loc.Country = mmdbPathString(record, "country", "iso_code")
+	if loc.Country == "" {
+		// Anonymous networks and the like only have a registered country
+		loc.Country = mmdbPathString(record, "registered_country", "iso_code")
+	}
+	loc.Continent = mmdbPathString(record, "continent", "code")
+
+	return loc, loc.Country != "" || loc.Continent != "", nil
+}
+
+// mmdbPathString - String at the path of nested maps, empty if missing.
+func mmdbPathString(m map[string]interface{}, path ...string) string {
+
+	var value interface{} = m
+	for _, key := range path {
+		sub, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = sub[key]
+	}
+
+	s, _ := value.(string)
+	return s
+}
+
+// Types of the MaxMind DB data section.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// Deepest nesting decoded, against malformed files pointing to themselves.
+const mmdbMaxDepth = 32
+
+// mmdbDecoder - Decoder of the data section. Pointers are relative to base.
+type mmdbDecoder struct {
+	buf  []byte
+	base int
+}
+
+var errMMDBTruncated = errors.New("data truncated")
+
+// take - n bytes at offset.
+func (d *mmdbDecoder) take(offset int, n int) ([]byte, error) {
+
+	if offset < 0 || n < 0 || offset+n > len(d.buf) {
+		return nil, errMMDBTruncated
+	}
+
+	return d.buf[offset : offset+n], nil
+}
+
+// decode - Value at offset, and the offset following it.
+func (d *mmdbDecoder) decode(offset int, depth int) (interface{}, int, error) {
+
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+
+	ctrl, err := d.take(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	kind := int(ctrl[0] >> 5)
+
+	if kind == mmdbPointer {
+		size := int(ctrl[0]>>3) & 3
+		b, err := d.take(offset, size+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += size + 1
+
+		vvv := int(ctrl[0] & 7)
+		var pointer int
+		switch size {
+		case 0:
+			pointer = vvv<<8 | int(b[0])
+		case 1:
+			pointer = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			pointer = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			pointer = int(binary.BigEndian.Uint32(b))
+		}
+
+		value, _, err := d.decode(d.base+pointer, depth+1)
+		return value, offset, err
+	}
+
+	if kind == mmdbExtended {
+		ext, err := d.take(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		kind = 7 + int(ext[0])
+	}
+
+	size := int(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.take(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, _ := key.(string)
+			m[k] = value
+			offset = after
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		list := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, value)
+			offset = next
+		}
+		return list, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err := d.take(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int64(int32(uint32(v))), offset, nil
+		}
+		return v, offset, nil
+	}
+
+	// Bytes and uint128 are kept raw.
+	return append([]byte(nil), b...), offset, nil
+}
+
+// Continent codes of the databases.
+var continentCodes = map[string]bool{"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true}
+
+// parseRegions - -region value: comma-separated continent or country codes.
+func parseRegions(value string) ([]string, error) {
+
+	var regions []string
+	for _, r := range strings.Split(value, ",") {
+		r = strings.ToUpper(strings.TrimSpace(r))
+		if r == "" {
+			continue
+		}
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid region %q: expected a continent (EU, NA...) or country (FR, US...) code", r)
+		}
+		regions = append(regions, r)
+	}
+
+	return regions, nil
+}
+
+// regionIndex - Position of the first region the server is in, -1 if none.
+// Continent codes (AS is Asia, not American Samoa) match the continent,
+// other codes the country.
+func regionIndex(sv idTech4_Server, regions []string) int {
+
+	for i, r := range regions {
+		if continentCodes[r] {
+			if sv.Continent == r {
+				return i
+			}
+		} else if sv.Country == r {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// LocateServers - Sets the country and continent of the servers the database knows.
+func LocateServers(list []idTech4_Server, db *GeoDB) {
+
+	for i := range list {
+		loc, ok, err := db.Locate(list[i].IP)
+		if err != nil {
+			logVerbose("geoip: %s: %s", list[i].IP, err)
+			continue
+		}
+		if ok {
+			list[i].Country = loc.Country
+			list[i].Continent = loc.Continent
+		}
+	}
+}
+
+// FilterRegions - Keeps the servers located in one of the regions, those
+// of the first region first. Servers without location are dropped.
+func FilterRegions(list []idTech4_Server, regions []string) []idTech4_Server {
+
+	if len(regions) == 0 {
+		return list
+	}
+
+	byRegion := make([][]idTech4_Server, len(regions))
+	for _, sv := range list {
+		if i := regionIndex(sv, regions); i >= 0 {
+			byRegion[i] = append(byRegion[i], sv)
+		}
+	}
+
+	var kept []idTech4_Server
+	for _, servers := range byRegion {
+		kept = append(kept, servers...)
+	}
+
+	return kept
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// byteRange - Range [Start, End) of bytes in a packet.
+type byteRange struct {
+	Start int
+	End   int
+}
+
+// maskSecret - Hides a secret in logs, keeping only its length visible.
+func maskSecret(secret string) string {
+	return fmt.Sprintf("<redacted, %d chars>", len(secret))
+}
+
+// hexDump - Hex and ASCII dump of a packet, 16 bytes per line.
+// Bytes within the secret ranges are shown as ** unless -reveal-secrets is set.
+func hexDump(data []byte, secrets []byteRange) string {
+
+	hidden := func(i int) bool {
+		if revealSecrets {
+			return false
+		}
+		for _, r := range secrets {
+			if i >= r.Start && i < r.End {
+				return true
+			}
+		}
+		return false
+	}
+
+	var b strings.Builder
+
+	for off := 0; off < len(data); off += 16 {
+		end := off + 16
+		if end > len(data) {
+			end = len(data)
+		}
+
+		fmt.Fprintf(&b, "%04x  ", off)
+		for i := off; i < off+16; i++ {
+			switch {
+			case i >= end:
+				b.WriteString("   ")
+			case hidden(i):
+				b.WriteString("** ")
+			default:
+				fmt.Fprintf(&b, "%02x ", data[i])
+			}
+			if i == off+7 {
+				b.WriteByte(' ')
+			}
+		}
+
+		b.WriteString(" |")
+		for i := off; i < end; i++ {
+			c := data[i]
+			switch {
+			case hidden(i):
+				b.WriteByte('*')
+			case c >= 0x20 && c < 0x7f:
+				b.WriteByte(c)
+			default:
+				b.WriteByte('.')
+			}
+		}
+		b.WriteString("|\n")
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// packetField - Field of a packet, for the annotated dumps.
+type packetField struct {
+	Start int
+	Name  string
+	Value string
+}
+
+// annotatePacket - Fields of an out-of-band packet, as far as they can be
+// read, and the byte ranges of its secrets.
+func annotatePacket(data []byte) ([]packetField, []byteRange) {
+
+	a := idtech4.NewAnswer(data)
+	if header, err := a.ReadShort(); err != nil || header != 0xffff {
+		return nil, nil
+	}
+	fields := []packetField{{Start: 0, Name: "header", Value: "ffff"}}
+
+	var secrets []byteRange
+	readString := func(name string, secret bool) bool {
+		start := a.Pos()
+		s, err := a.ReadString()
+		if err != nil {
+			return false
+		}
+		fields = append(fields, packetField{Start: start, Name: name, Value: strconv.Quote(s)})
+		if secret {
+			secrets = append(secrets, byteRange{start, start + len(s)})
+		}
+		return true
+	}
+	readLong := func(name string, protocol bool) bool {
+		start := a.Pos()
+		v, err := a.ReadLong()
+		if err != nil {
+			return false
+		}
+		value := fmt.Sprintf("0x%08x", v)
+		if protocol {
+			value = fmt.Sprintf("%d (%d.%d)", v, v>>16, v&0xffff)
+		}
+		fields = append(fields, packetField{Start: start, Name: name, Value: value})
+		return true
+	}
+	readByte := func(name string) bool {
+		start := a.Pos()
+		v, err := a.ReadByte()
+		if err != nil {
+			return false
+		}
+		fields = append(fields, packetField{Start: start, Name: name, Value: strconv.Itoa(int(v))})
+		return true
+	}
+
+	if !readString("command", false) {
+		return fields, nil
+	}
+	command := strings.Trim(fields[1].Value, `"`)
+
+	switch command {
+	case "getServers", idtech4.CommandGetServersExt:
+		_ = readLong("protocol", true) && readString("mod", false) &&
+			readByte("password") && readByte("players") && readByte("gametype") &&
+			a.Remaining() > 0 && readString("token", true)
+
+	case "getInfo", "getStatus":
+		readLong("challenge", false)
+
+	case "infoResponse", "statusResponse":
+		if second, ok := a.PeekLongAt(4); ok && looksLikeProtocol(second) {
+			readLong("challenge", false)
+		}
+		if first, ok := a.PeekLong(); ok && looksLikeProtocol(first) {
+			readLong("protocol", true)
+		}
+		start, pairs := a.Pos(), 0
+		for {
+			key, err := a.ReadString()
+			if err != nil {
+				break
+			}
+			if _, err := a.ReadString(); err != nil || key == "" {
+				break
+			}
+			pairs++
+		}
+		fields = append(fields, packetField{Start: start, Name: "cvars", Value: fmt.Sprintf("%d pairs", pairs)})
+		if a.Remaining() > 0 {
+			fields = append(fields, packetField{Start: a.Pos(), Name: "players", Value: fmt.Sprintf("%d bytes, then the OS mask", a.Remaining())})
+			a.Skip(a.Remaining())
+		}
+
+	case "print":
+		readString("message", false)
+	}
+
+	if a.Remaining() > 0 {
+		fields = append(fields, packetField{Start: a.Pos(), Name: "data", Value: fmt.Sprintf("%d bytes", a.Remaining())})
+	}
+
+	return fields, secrets
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// keepLogging - Restores the logging settings when the test ends.
+func keepLogging(t *testing.T) *bytes.Buffer {
+
+	savedDebug, savedReveal, savedOutput := debugLog, revealSecrets, logOutput
+	t.Cleanup(func() { debugLog, revealSecrets, logOutput = savedDebug, savedReveal, savedOutput })
+
+	var out bytes.Buffer
+	logOutput = &out
+	return &out
+}
+
+func TestAnnotateTokenRange(t *testing.T) {
+
+	request, tokenStart := idtech4.BuildGetServers(1<<16+41, "", "s3cret")
+
+	_, secrets := annotatePacket(request)
+	if len(secrets) != 1 || secrets[0] != (byteRange{tokenStart, tokenStart + len("s3cret")}) {
+		t.Fatalf("secrets %v, want the token at %d", secrets, tokenStart)
+	}
+
+	request, _ = idtech4.BuildGetServers(1<<16+41, "", "")
+	if _, secrets := annotatePacket(request); len(secrets) != 0 {
+		t.Errorf("secrets %v in a request without token", secrets)
+	}
+}
+
+func TestHexDumpRedaction(t *testing.T) {
+
+	keepLogging(t)
+
+	request, _ := idtech4.BuildGetServers(1<<16+41, "", "s3cret-token")
+	_, secrets := annotatePacket(request)
+
+	revealSecrets = false
+	dump := hexDump(request, secrets)
+	if strings.Contains(dump, "s3cret") || strings.Contains(dump, "73 33 63") {
+		t.Errorf("the token shows in the dump:\n%s", dump)
+	}
+	if n := strings.Count(dump, "** "); n != len("s3cret-token") {
+		t.Errorf("%d bytes masked, want %d:\n%s", n, len("s3cret-token"), dump)
+	}
+	if !strings.Contains(dump, "getServers") {
+		t.Errorf("the rest of the packet is masked too:\n%s", dump)
+	}
+
+	revealSecrets = true
+	if dump := hexDump(request, secrets); !strings.Contains(dump, "73 33 63") || strings.Contains(dump, "**") {
+		t.Errorf("-reveal-secrets still masks the token:\n%s", dump)
+	}
+
+	// The recorded sessions keep the layout, never the token
+	redacted := redactPacket(request)
+	if len(redacted) != len(request) || bytes.Contains(redacted, []byte("s3cret")) || !bytes.Contains(redacted, []byte("************")) {
+		t.Errorf("redacted packet %q", redacted)
+	}
+	if !bytes.Contains(request, []byte("s3cret")) {
+		t.Error("redactPacket changed the packet sent")
+	}
+}
+
+func TestLogPacketRedaction(t *testing.T) {
+
+	out := keepLogging(t)
+	debugLog, revealSecrets = true, false
+
+	request, _ := idtech4.BuildGetServers(1<<16+41, "", "s3cret-token")
+	logPacket("sent", "192.0.2.1:27650", request, nil)
+
+	if strings.Contains(out.String(), "s3cret") {
+		t.Errorf("the token shows in the debug log:\n%s", out)
+	}
+	if !strings.Contains(out.String(), maskSecret("s3cret-token")) {
+		t.Errorf("the token field is not masked:\n%s", out)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of the serve mode player history.
+const (
+	defaultHistorySize      = 1440 // A day of samples at the default refresh
+	defaultHistoryRetention = 24 * time.Hour
+)
+
+// PlayerSample - Player count of a server at a given time.
+type PlayerSample struct {
+	Time    time.Time `json:"time"`
+	Players int       `json:"players"`
+}
+
+// playerRing - Fixed size ring buffer of samples, the oldest being overwritten.
+type playerRing struct {
+	samples   []PlayerSample
+	next      int
+	full      bool
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+func newPlayerRing(size int) *playerRing {
+	return &playerRing{samples: make([]PlayerSample, size)}
+}
+
+// Add - Stores a sample, overwriting the oldest one when full.
+func (r *playerRing) Add(s PlayerSample) {
+
+	if r.firstSeen.IsZero() {
+		r.firstSeen = s.Time
+	}
+	r.samples[r.next] = s
+	r.next++
+	if r.next == len(r.samples) {
+		r.next = 0
+		r.full = true
+	}
+	r.lastSeen = s.Time
+}
+
+// Samples - Stored samples, oldest first.
+func (r *playerRing) Samples() []PlayerSample {
+
+	if !r.full {
+		return append([]PlayerSample(nil), r.samples[:r.next]...)
+	}
+
+	out := make([]PlayerSample, 0, len(r.samples))
+	out = append(out, r.samples[r.next:]...)
+	return append(out, r.samples[:r.next]...)
+}
+
+// HistoryStats - Aggregates over the stored samples of a server.
+type HistoryStats struct {
+	Samples   int       `json:"samples"`
+	Peak      int       `json:"peak"`
+	Average   float64   `json:"average"`
+	FirstSeen time.Time `json:"first_seen"` // Also on the previous address of a moved server
+}
+
+// Stats - Peak and average player count of the stored samples.
+func (r *playerRing) Stats() HistoryStats {
+
+	samples := r.Samples()
+	stats := HistoryStats{Samples: len(samples), FirstSeen: r.firstSeen}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	total := 0
+	for _, s := range samples {
+		total += s.Players
+		if s.Players > stats.Peak {
+			stats.Peak = s.Players
+		}
+	}
+	stats.Average = float64(total) / float64(len(samples))
+
+	return stats
+}
+
+// PlayerHistory - Bounded player count history of every server, keyed by IP:port.
+// Servers not seen for the retention duration lose their history. A server
+// moving to another port of its IP, as told by DiffServers, keeps it.
+type PlayerHistory struct {
+	mu            sync.Mutex
+	size          int
+	retention     time.Duration
+	minSimilarity float64 // See DiffServers
+	rings         map[string]*playerRing
+	last          []idTech4_Server // List of the previous Record
+}
+
+func NewPlayerHistory(size int, retention time.Duration, minSimilarity float64) *PlayerHistory {
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &PlayerHistory{
+		size:          size,
+		retention:     retention,
+		minSimilarity: minSimilarity,
+		rings:         make(map[string]*playerRing),
+	}
+}
+
+// Record - Carries the history of the moved servers over to their new
+// address, adds a sample for every server which answered its getInfo
+// query, then drops the servers absent for too long.
+func (h *PlayerHistory) Record(list []idTech4_Server, now time.Time) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.last != nil {
+		for _, ev := range DiffServers(h.last, list, h.minSimilarity) {
+			if ev.Type != EventMoved {
+				continue
+			}
+			ring, ok := h.rings[ev.From.Address()]
+			if _, taken := h.rings[ev.Server.Address()]; ok && !taken {
+				delete(h.rings, ev.From.Address())
+				h.rings[ev.Server.Address()] = ring
+			}
+		}
+	}
+	h.last = append([]idTech4_Server(nil), list...)
+
+	for _, sv := range list {
+		if !sv.Reachable() {
+			continue
+		}
+
+		ring, ok := h.rings[sv.Address()]
+		if !ok {
+			ring = newPlayerRing(h.size)
+			h.rings[sv.Address()] = ring
+		}
+		ring.Add(PlayerSample{Time: now, Players: sv.Info.Players})
+	}
+
+	for addr, ring := range h.rings {
+		if now.Sub(ring.lastSeen) > h.retention {
+			delete(h.rings, addr)
+		}
+	}
+}
+
+// Series - Samples of a server, oldest first. False if it has no history.
+func (h *PlayerHistory) Series(addr string) ([]PlayerSample, bool) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ring, ok := h.rings[addr]
+	if !ok {
+		return nil, false
+	}
+
+	return ring.Samples(), true
+}
+
+// Stats - Aggregates of a server. False if it has no history.
+func (h *PlayerHistory) Stats(addr string) (HistoryStats, bool) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ring, ok := h.rings[addr]
+	if !ok {
+		return HistoryStats{}, false
+	}
+
+	return ring.Stats(), true
+}
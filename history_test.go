@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlayerHistoryMove(t *testing.T) {
+
+	h := NewPlayerHistory(10, time.Hour, defaultMoveSimilarity)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	h.Record([]idTech4_Server{namedServer(27666, "^1Fast Frags", 4), namedServer(27700, "Other", 1)}, start)
+	h.Record([]idTech4_Server{namedServer(27666, "^1Fast Frags", 6), namedServer(27700, "Other", 1)}, start.Add(time.Minute))
+
+	// Restarted on another port, with a slightly different name.
+	moved := start.Add(2 * time.Minute)
+	h.Record([]idTech4_Server{namedServer(27667, "^2Fast Frags!", 2), namedServer(27701, "Something else", 0)}, moved)
+
+	stats, ok := h.Stats("10.0.0.1:27667")
+	if !ok {
+		t.Fatal("no history on the new address")
+	}
+	if stats.Samples != 3 || stats.Peak != 6 || !stats.FirstSeen.Equal(start) {
+		t.Errorf("moved server stats = %+v, want 3 samples, peak 6, first seen %s", stats, start)
+	}
+	if series, _ := h.Series("10.0.0.1:27667"); len(series) != 3 || series[2].Players != 2 {
+		t.Errorf("moved server series = %v", series)
+	}
+	if _, ok := h.Stats("10.0.0.1:27666"); ok {
+		t.Error("the old address kept its history")
+	}
+
+	// Too different a name: a new server, with a history of its own.
+	stats, ok = h.Stats("10.0.0.1:27701")
+	if !ok || stats.Samples != 1 || !stats.FirstSeen.Equal(moved) {
+		t.Errorf("new server stats = %+v, %v, want 1 sample first seen %s", stats, ok, moved)
+	}
+	if _, ok := h.Stats("10.0.0.1:27700"); !ok {
+		t.Error("the history of a vanished server is kept for the retention")
+	}
+}
+
+func TestPlayerHistoryRetention(t *testing.T) {
+
+	h := NewPlayerHistory(2, time.Hour, defaultMoveSimilarity)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		h.Record([]idTech4_Server{namedServer(27666, "A", i)}, start.Add(time.Duration(i)*time.Minute))
+	}
+	if series, _ := h.Series("10.0.0.1:27666"); len(series) != 2 || series[0].Players != 1 {
+		t.Errorf("ring of 2 holds %v, want the last 2 samples", series)
+	}
+
+	h.Record(nil, start.Add(2*time.Hour))
+	if _, ok := h.Stats("10.0.0.1:27666"); ok {
+		t.Error("history kept past the retention")
+	}
+}
+
+func TestServerHistoryEndpoint(t *testing.T) {
+
+	schedule, err := NewPollSchedule(30*time.Second, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := NewPlayerHistory(10, time.Hour, defaultMoveSimilarity)
+	st := newServeState(schedule, history, false)
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, players := range []int{2, 6, 4} {
+		history.Record([]idTech4_Server{namedServer(27666, "Frag Fest", players)}, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		st.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := get("/server/10.0.0.1/27666/history")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%d %s\n%s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"server": "10.0.0.1:27666",
+		"stats": map[string]interface{}{
+			"samples": 3.0, "peak": 6.0, "average": 4.0, "first_seen": "2026-01-01T12:00:00Z",
+		},
+		"samples": []interface{}{
+			map[string]interface{}{"time": "2026-01-01T12:00:00Z", "players": 2.0},
+			map[string]interface{}{"time": "2026-01-01T12:01:00Z", "players": 6.0},
+			map[string]interface{}{"time": "2026-01-01T12:02:00Z", "players": 4.0},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("history\n%s\nwant %v", rec.Body.String(), want)
+	}
+
+	// A trailing slash is accepted
+	if rec := get("/server/10.0.0.1/27666/history/"); rec.Code != 200 {
+		t.Errorf("trailing slash: %d", rec.Code)
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/server/10.0.0.1/27667/history", 404, "no history for 10.0.0.1:27667"},
+		{"/server/10.0.0.1/27666", 404, "404 page not found"},
+		{"/server/10.0.0.1/27666/players", 404, "404 page not found"},
+		{"/server/10.0.0.1/27666/history/more", 404, "404 page not found"},
+		{"/server/frag.example/27666/history", 400, "invalid server address"},
+		{"/server/10.0.0.1/99999/history", 400, "invalid server address"},
+	}
+	for _, tt := range tests {
+		rec := get(tt.path)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+	}
+
+	// Without a history every server is unknown
+	st = newServeState(schedule, nil, false)
+	if rec := get("/server/10.0.0.1/27666/history"); rec.Code != 404 {
+		t.Errorf("no history kept: %d", rec.Code)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// Layouts of an infoResponse packet that were seen in the wild.
+// Vanilla 1.3.1 and dhewm3 echo the challenge before the protocol,
+// some patched servers skip the challenge, and a few only send the
+// key/value block.
+const (
+	InfoVariantFull        = "full"
+	InfoVariantNoChallenge = "no-challenge"
+	InfoVariantKeyValue    = "keyvalue"
+)
+
+// Engine families guessed from an infoResponse.
+const (
+	EngineUnknown = "unknown"
+	EngineDoom3   = "doom3"
+	EngineDhewm3  = "dhewm3"
+	EnginePrey    = "prey"
+	EngineQuake4  = "quake4"
+	EngineETQW    = "etqw"
+)
+
+// MAX_ASYNC_CLIENTS, also used as the player list terminator.
+const maxAsyncClients = 32
+
+// PlayerInfo - A player of the infoResponse player list.
+type PlayerInfo struct {
+	Client int    `json:"client"` // Client number
+	Name   string `json:"name"`
+	Clan   string `json:"clan,omitempty"` // Quake 4 and ETQW
+	Ping   int    `json:"ping"`           // In milliseconds
+	Rate   uint32 `json:"rate,omitempty"` // Not sent by ETQW
+	Bot    bool   `json:"bot,omitempty"`  // ETQW only
+}
+
+// ServerInfo - What a getInfo (or getStatus) answer tells about a server.
+// In JSON, it is written as the "info" of the -output json lists, with its
+// ping; the challenge, reception time and sources are not kept.
+type ServerInfo struct {
+	Challenge  uint32
+	Protocol   uint32
+	Variant    string
+	Hostname   string
+	Map        string
+	Mod        string
+	GameType   string
+	Players    int
+	MaxPlayers int
+	OS         uint32 // Mask of osNames, written as their names
+	PlayerList []PlayerInfo
+	Ranked     bool              // ETQW only
+	TimeLeft   uint32            // ETQW only, in milliseconds
+	TV         bool              // ETQW only: the server is a TV relay
+	Rules      map[string]string // The server cvars
+	Ping       time.Duration     // Time between the getInfo request and its answer
+	Received   time.Time         // When the answer arrived
+
+	Sources  map[string]string // Answer each field was taken from, see MergeServerInfo
+	Warnings []string          // Disagreements between the answers
+}
+
+// MarshalJSON - Written as the info of the -output json lists, with the ping
+// in milliseconds.
+func (info ServerInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(toJSONInfo(&info))
+}
+
+func (info *ServerInfo) UnmarshalJSON(data []byte) error {
+
+	var ji jsonInfo
+	if err := json.Unmarshal(data, &ji); err != nil {
+		return err
+	}
+
+	*info = *ji.info()
+	return nil
+}
+
+// looksLikeProtocol - Checks if a long looks like an idTech4 protocol version (major << 16 + minor).
+func looksLikeProtocol(value uint32) bool {
+	major := value >> 16
+	minor := value & 0xffff
+	return major >= 1 && major <= 16 && minor < 1000
+}
+
+// ParseInfoResponse - Parses an infoResponse packet.
+// The leading challenge/protocol fields are only consumed when they can be
+// identified, the rest is scanned as key/value pairs followed by the player list.
+func ParseInfoResponse(data []byte, challenge uint32) (*ServerInfo, error) {
+	return parseInfoPacket(data, challenge, "infoResponse")
+}
+
+// parseInfoPacket - Parses an infoResponse, or a statusResponse which shares its layout.
+func parseInfoPacket(data []byte, challenge uint32, command string) (*ServerInfo, error) {
+
+	a := idtech4.NewAnswer(data)
+
+	_, err := a.ReadShort()
+	if err != nil {
+		return nil, newQueryError(CodeMalformed, "read Error", err)
+	}
+
+	querytxt, err := a.ReadString()
+	if err != nil {
+		return nil, newQueryError(CodeMalformed, "read Error", err)
+	}
+	if querytxt != command {
+		parseTelemetry.Record(DatagramStats{Kind: DatagramInfo, Command: querytxt, Size: len(data)})
+		return nil, newQueryError(CodeMalformed, "unknown request: "+querytxt+" != "+command, nil)
+	}
+
+	info := &ServerInfo{
+		Variant: InfoVariantKeyValue,
+		Rules:   make(map[string]string),
+	}
+
+	first, ok := a.PeekLong()
+	if ok && first == challenge && challenge != 0 {
+		info.Challenge, _ = a.ReadLong()
+		info.Variant = InfoVariantFull
+	} else if ok && !looksLikeProtocol(first) && a.Remaining() >= 8 {
+		// Unknown challenge, but the following long may still be the protocol.
+		if second, _ := a.PeekLongAt(4); looksLikeProtocol(second) {
+			info.Challenge, _ = a.ReadLong()
+			info.Variant = InfoVariantFull
+		}
+	}
+
+	if proto, ok := a.PeekLong(); ok && looksLikeProtocol(proto) {
+		info.Protocol, _ = a.ReadLong()
+		if info.Variant == InfoVariantKeyValue {
+			info.Variant = InfoVariantNoChallenge
+		}
+	}
+
+	// ETQW sends the size of the rest of the answer after the protocol.
+	if info.Protocol>>16 == etqwProtocolMajor {
+		if size, ok := a.PeekLong(); ok && int(size) <= a.Remaining() {
+			a.Skip(4)
+		}
+	}
+
+	for {
+		key, err := a.ReadString()
+		if err != nil {
+			return nil, newQueryError(CodeMalformed, "read Error", err)
+		}
+		val, err := a.ReadString()
+		if err != nil {
+			return nil, newQueryError(CodeMalformed, "read Error", err)
+		}
+		if key == "" {
+			break
+		}
+		info.Rules[key] = val
+	}
+
+	info.Hostname = info.Rules["si_name"]
+	info.Map = info.Rules["si_map"]
+	info.Mod = info.Rules["fs_game"]
+	info.GameType = info.Rules["si_gameType"]
+	info.MaxPlayers, _ = strconv.Atoi(info.Rules["si_maxPlayers"])
+
+	// Quake 4 sends the clan after each player name, ETQW has its own layout.
+	withClan := info.Protocol>>16 == 2
+	start := a.Pos()
+	if info.Protocol>>16 == etqwProtocolMajor {
+		parsePlayersETQW(info, a)
+	} else if !parsePlayers(info, a, withClan) {
+		a.Seek(start)
+		parsePlayers(info, a, !withClan)
+	}
+
+	parseTelemetry.Record(DatagramStats{Kind: DatagramInfo, Command: querytxt, Known: true, Size: len(data), Leftover: a.Remaining()})
+
+	return info, nil
+}
+
+// parsePlayers - Reads the player list and the trailing OS mask, if any.
+func parsePlayers(info *ServerInfo, a *QuakeAnswer, withClan bool) bool {
+
+	info.Players = 0
+	info.PlayerList = nil
+
+	for {
+		client, err := a.ReadByte()
+		if err != nil {
+			// Some servers don't send a player list at all.
+			return a.Remaining() == 0 && info.Players == 0
+		}
+		if client >= maxAsyncClients {
+			break
+		}
+
+		player := PlayerInfo{Client: int(client)}
+
+		ping, err := a.ReadShort()
+		if err != nil {
+			return false
+		}
+		player.Ping = int(ping)
+		if player.Rate, err = a.ReadLong(); err != nil {
+			return false
+		}
+		if player.Name, err = a.ReadString(); err != nil {
+			return false
+		}
+		if withClan {
+			if player.Clan, err = a.ReadString(); err != nil {
+				return false
+			}
+		}
+
+		info.Players++
+		info.PlayerList = append(info.PlayerList, player)
+	}
+
+	if os, err := a.ReadLong(); err == nil {
+		info.OS = os
+	}
+
+	return true
+}
+
+// Major protocol version of ETQW.
+const etqwProtocolMajor = 10
+
+// parsePlayersETQW - Reads the ETQW player list and the server state after it.
+// Players have no rate, but a clan tag and a bot flag.
+func parsePlayersETQW(info *ServerInfo, a *QuakeAnswer) bool {
+
+	info.Players = 0
+	info.PlayerList = nil
+
+	for {
+		client, err := a.ReadByte()
+		if err != nil {
+			return a.Remaining() == 0 && info.Players == 0
+		}
+		if client >= maxAsyncClients {
+			break
+		}
+
+		player := PlayerInfo{Client: int(client)}
+
+		ping, err := a.ReadShort()
+		if err != nil {
+			return false
+		}
+		player.Ping = int(ping)
+		if player.Name, err = a.ReadString(); err != nil {
+			return false
+		}
+		if _, err := a.ReadByte(); err != nil { // Clan tag position
+			return false
+		}
+		if player.Clan, err = a.ReadString(); err != nil {
+			return false
+		}
+		bot, err := a.ReadByte()
+		if err != nil {
+			return false
+		}
+		player.Bot = bot != 0
+
+		info.Players++
+		info.PlayerList = append(info.PlayerList, player)
+	}
+
+	os, err := a.ReadLong()
+	if err != nil {
+		return true
+	}
+	info.OS = os
+
+	ranked, err := a.ReadByte()
+	if err != nil {
+		return true
+	}
+	info.Ranked = ranked != 0
+	if info.TimeLeft, err = a.ReadLong(); err != nil {
+		return true
+	}
+	if _, err := a.ReadByte(); err != nil { // Game state
+		return true
+	}
+	serverType, err := a.ReadByte()
+	if err != nil {
+		return true
+	}
+	// Regular servers then send their number of interested clients,
+	// relays their connected and max clients.
+	info.TV = serverType != 0
+
+	return true
+}
+
+// OS names, by bit of the OS mask sent after the players.
+var osNames = []string{"windows", "macos", "linux"}
+
+// OSName - Operating systems of the OS mask, e.g. "linux", or "" when unknown.
+func (info *ServerInfo) OSName() string {
+
+	var names []string
+	for bit, name := range osNames {
+		if info.OS&(1<<uint(bit)) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(names, "/")
+}
+
+// parseOSName - OS mask of an OSName, unknown names being ignored.
+func parseOSName(name string) uint32 {
+
+	var mask uint32
+	for _, part := range strings.Split(name, "/") {
+		for bit, known := range osNames {
+			if part == known {
+				mask |= 1 << uint(bit)
+			}
+		}
+	}
+
+	return mask
+}
+
+// Engine - Guesses the engine family the server runs.
+func (info *ServerInfo) Engine() string {
+
+	version := strings.ToLower(info.Rules["si_version"])
+
+	switch {
+	case strings.Contains(version, "dhewm"):
+		return EngineDhewm3
+	case strings.Contains(version, "prey"):
+		return EnginePrey
+	case strings.Contains(version, "etqw") || info.Protocol>>16 == etqwProtocolMajor:
+		return EngineETQW
+	case strings.Contains(version, "quake4") || info.Protocol>>16 == 2:
+		return EngineQuake4
+	case info.Protocol == (1<<16)+42:
+		return EngineDhewm3
+	case strings.Contains(version, "doom") || info.Protocol>>16 == 1:
+		return EngineDoom3
+	}
+
+	return EngineUnknown
+}
+
+// QueryServerInfo - Sends a getInfo request to a game server and parses its answer.
+// Timeouts are retried, see -retries.
+func QueryServerInfo(ctx context.Context, sv idTech4_Server) (*ServerInfo, error) {
+
+	var info *ServerInfo
+	err := withRetries(ctx, "getInfo "+sv.Address(), func() error {
+		conn, err := openConn(ctx, sv.Address())
+		if err != nil {
+			return newQueryError(CodeUnreachable, "cannot access the server", err)
+		}
+		defer conn.Close()
+
+		info, err = QueryServerInfoConn(conn, rand.Uint32())
+		return err
+	})
+
+	return info, err
+}
+
+// QueryServerInfoConn - Sends a getInfo request on an opened connection and parses the answer.
+func QueryServerInfoConn(conn PacketConn, challenge uint32) (*ServerInfo, error) {
+
+	info, err := queryInfoConn(conn, challenge, "getInfo", "infoResponse")
+	if err == nil {
+		stats.Histogram(StatServerPing, durationBuckets).ObserveDuration(info.Ping)
+	}
+
+	return info, err
+}
+
+// queryInfoConn - Sends a getInfo or getStatus request and parses its answer.
+func queryInfoConn(conn PacketConn, challenge uint32, request string, answer string) (*ServerInfo, error) {
+
+	var pkt QuakePacket
+	pkt.PreparePacket()
+	pkt.WriteString(request)
+	pkt.WriteLong(challenge)
+
+	sent := time.Now()
+	_, err := conn.Write(pkt.ExportToBytes())
+	if err != nil {
+		return nil, newQueryError(CodeUnreachable, "write Error", err)
+	}
+
+	buffer := make([]byte, idtech4.MaxDatagram)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buffersize, err := conn.Read(buffer)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, newQueryError(CodeTimeout, "read timeout", err)
+		}
+		return nil, newQueryError(CodeUnreachable, "read Error", err)
+	}
+	received := time.Now()
+
+	info, err := parseInfoPacket(buffer[:buffersize], challenge, answer)
+	if err != nil {
+		return nil, err
+	}
+	info.Ping = received.Sub(sent)
+	if rt, ok := connRoundTrip(conn); ok {
+		info.Ping = rt
+	}
+	info.Received = received
+
+	return info, nil
+}
+
+// QueryAllServerInfo - Queries every server of the list, -workers at once.
+// Servers that don't answer are left without Info.
+func QueryAllServerInfo(ctx context.Context, list []idTech4_Server) {
+
+	forEachServer(list, ctx.Done(), func(sv *idTech4_Server) {
+		info, err := QueryServerInfo(ctx, *sv)
+		if err == nil {
+			sv.Info = info
+		}
+	})
+}
+
+// QueryFirstResponders - Queries the servers like QueryAllServerInfo, but stops
+// as soon as n of them answered and passed the filter, or ctx is done: the
+// pending queries are cancelled by closing their connection, and the
+// remaining ones not started. Returns the servers kept, in their answering order.
+func QueryFirstResponders(ctx context.Context, list []idTech4_Server, n int, f ServerFilter) []idTech4_Server {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := ctx.Done()
+	answers := make(chan idTech4_Server)
+
+	// Queries run on a copy, the list is only read.
+	queried := append([]idTech4_Server(nil), list...)
+
+	go func() {
+		started := forEachServer(queried, done, func(sv *idTech4_Server) {
+			// The connection is closed once enough servers answered.
+			conn, err := openConn(ctx, sv.Address())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			info, err := QueryServerInfoConn(conn, rand.Uint32())
+			if err != nil {
+				select {
+				case <-done:
+					stats.Counter(StatServerCancelled).Inc()
+				default:
+				}
+				return
+			}
+
+			answer := *sv
+			answer.Info = info
+			select {
+			case answers <- answer:
+			case <-done:
+				stats.Counter(StatServerCancelled).Inc()
+			}
+		})
+
+		// Never started because enough servers answered.
+		stats.Counter(StatServerCancelled).Add(int64(len(queried) - started))
+		close(answers)
+	}()
+
+	var first []idTech4_Server
+	for sv := range answers {
+		if !f.Match(sv) {
+			continue
+		}
+		first = append(first, sv)
+		if len(first) == n {
+			cancel()
+			break
+		}
+	}
+
+	// Waits for the cancelled queries, so the stats are complete.
+	for range answers {
+		stats.Counter(StatServerCancelled).Inc()
+	}
+
+	logVerbose("first responders: kept %d servers out of %d", len(first), len(list))
+
+	return first
+}
+
+// SortByPing - Sorts the list by ascending ping, unreachable servers last.
+func SortByPing(list []idTech4_Server) {
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Reachable() != b.Reachable() {
+			return a.Reachable()
+		}
+		if !a.Reachable() {
+			return false
+		}
+		return a.Info.Ping < b.Info.Ping
+	})
+}
+
+// SortByPlayers - Sorts the list by player count, the busiest servers first,
+// then the ones without Info.
+func SortByPlayers(list []idTech4_Server) {
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Reachable() != b.Reachable() {
+			return a.Reachable()
+		}
+		if !a.Reachable() {
+			return false
+		}
+		return a.Info.Players > b.Info.Players
+	})
+}
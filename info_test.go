@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// pkt - Builds a packet: strings are written with their terminating zero,
+// uint32 as little endian longs, uint16 as shorts, bytes and []byte as is.
+func pkt(parts ...interface{}) []byte {
+
+	var data []byte
+	for _, p := range parts {
+		switch v := p.(type) {
+		case string:
+			data = append(data, v...)
+			data = append(data, 0)
+		case uint32:
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], v)
+			data = append(data, b[:]...)
+		case uint16:
+			var b [2]byte
+			binary.LittleEndian.PutUint16(b[:], v)
+			data = append(data, b[:]...)
+		case byte:
+			data = append(data, v)
+		case []byte:
+			data = append(data, v...)
+		default:
+			panic("pkt: unexpected part")
+		}
+	}
+
+	return data
+}
+
+const fixtureChallenge uint32 = 0x1234abcd
+
+var infoHeader = []byte("\xff\xffinfoResponse\x00")
+
+// Fixtures of infoResponse packets from the engine families, as sent by
+// their servers.
+var infoFixtures = []struct {
+	name    string
+	data    []byte
+	variant string
+	engine  string
+	want    ServerInfo // Fields checked, besides the variant
+}{
+	{
+		name: "doom3 1.3.1",
+		data: pkt(infoHeader, fixtureChallenge, uint32(1<<16+41),
+			"si_name", "^1Frag ^7Fest", "si_map", "game/mp/d3dm1", "si_gameType", "Tourney",
+			"si_maxPlayers", "4", "si_version", "DOOM 1.3.1.1304 linux-x86 Jan 20 2005", "fs_game", "", "", "",
+			byte(0), uint16(48), uint32(25000), "marine",
+			byte(2), uint16(112), uint32(16000), "^3hunter",
+			byte(maxAsyncClients), uint32(4)),
+		variant: InfoVariantFull,
+		engine:  EngineDoom3,
+		want: ServerInfo{
+			Challenge: fixtureChallenge, Protocol: 1<<16 + 41, Hostname: "^1Frag ^7Fest", Map: "game/mp/d3dm1",
+			GameType: "Tourney", MaxPlayers: 4, Players: 2, OS: 4,
+			PlayerList: []PlayerInfo{{Client: 0, Name: "marine", Ping: 48, Rate: 25000}, {Client: 2, Name: "^3hunter", Ping: 112, Rate: 16000}},
+		},
+	},
+	{
+		name: "dhewm3",
+		data: pkt(infoHeader, fixtureChallenge, uint32(1<<16+41),
+			"si_name", "dhewm3 box", "si_map", "game/mp/d3ctf1", "si_gameType", "CTF", "si_maxPlayers", "8",
+			"si_version", "dhewm 1.5.2.1304 Linux-x86_64 Jun 18 2022", "fs_game", "", "", "",
+			byte(maxAsyncClients), uint32(4)),
+		variant: InfoVariantFull,
+		engine:  EngineDhewm3,
+		want: ServerInfo{
+			Challenge: fixtureChallenge, Protocol: 1<<16 + 41, Hostname: "dhewm3 box", Map: "game/mp/d3ctf1",
+			GameType: "CTF", MaxPlayers: 8, OS: 4,
+		},
+	},
+	{
+		name: "patched doom3 without challenge",
+		data: pkt(infoHeader, uint32(1<<16+40),
+			"si_name", "old box", "si_map", "game/mp/d3dm2", "si_maxPlayers", "6", "fs_game", "roe", "extra_key", "extra", "", "",
+			byte(1), uint16(30), uint32(9000), "solo",
+			byte(maxAsyncClients)),
+		variant: InfoVariantNoChallenge,
+		engine:  EngineDoom3,
+		want: ServerInfo{
+			Protocol: 1<<16 + 40, Hostname: "old box", Map: "game/mp/d3dm2", Mod: "roe", MaxPlayers: 6, Players: 1,
+			PlayerList: []PlayerInfo{{Client: 1, Name: "solo", Ping: 30, Rate: 9000}},
+		},
+	},
+	{
+		name: "key/value only",
+		data: pkt(infoHeader,
+			"si_name", "bare", "si_map", "game/mp/d3dm5", "si_maxPlayers", "16", "", ""),
+		variant: InfoVariantKeyValue,
+		engine:  EngineUnknown,
+		want:    ServerInfo{Hostname: "bare", Map: "game/mp/d3dm5", MaxPlayers: 16},
+	},
+	{
+		name: "prey",
+		data: pkt(infoHeader, fixtureChallenge, uint32(1<<16+41),
+			"si_name", "Prey DM", "si_map", "game/dmship", "si_maxPlayers", "8",
+			"si_version", "Prey 1.4 Linux", "", "",
+			byte(3), uint16(70), uint32(20000), "Tommy",
+			byte(maxAsyncClients), uint32(1)),
+		variant: InfoVariantFull,
+		engine:  EnginePrey,
+		want: ServerInfo{
+			Challenge: fixtureChallenge, Protocol: 1<<16 + 41, Hostname: "Prey DM", Map: "game/dmship", MaxPlayers: 8, Players: 1, OS: 1,
+			PlayerList: []PlayerInfo{{Client: 3, Name: "Tommy", Ping: 70, Rate: 20000}},
+		},
+	},
+	{
+		name: "quake4",
+		data: pkt(infoHeader, fixtureChallenge, uint32(2<<16+69),
+			"si_name", "Q4 Duel", "si_map", "mp/q4dm7", "si_gameType", "Tourney", "si_maxPlayers", "2",
+			"si_version", "Quake4 V1.4.2 linux-x86", "", "",
+			byte(0), uint16(25), uint32(25000), "Strogg", "[Q4]",
+			byte(1), uint16(40), uint32(25000), "Kane", "",
+			byte(maxAsyncClients), uint32(4)),
+		variant: InfoVariantFull,
+		engine:  EngineQuake4,
+		want: ServerInfo{
+			Challenge: fixtureChallenge, Protocol: 2<<16 + 69, Hostname: "Q4 Duel", Map: "mp/q4dm7", GameType: "Tourney",
+			MaxPlayers: 2, Players: 2, OS: 4,
+			PlayerList: []PlayerInfo{{Client: 0, Name: "Strogg", Clan: "[Q4]", Ping: 25, Rate: 25000}, {Client: 1, Name: "Kane", Ping: 40, Rate: 25000}},
+		},
+	},
+	{
+		name: "etqw",
+		data: func() []byte {
+			rest := pkt("si_name", "QW Campaign", "si_map", "maps/valley", "si_maxPlayers", "24", "", "",
+				byte(5), uint16(60), "Rifleman", byte(0), "GDF", byte(0),
+				byte(6), uint16(0), "bot01", byte(0), "", byte(1),
+				byte(maxAsyncClients), uint32(1), byte(1), uint32(900000), byte(2), byte(1))
+			return pkt(infoHeader, fixtureChallenge, uint32(10<<16+22), uint32(len(rest)), rest)
+		}(),
+		variant: InfoVariantFull,
+		engine:  EngineETQW,
+		want: ServerInfo{
+			Challenge: fixtureChallenge, Protocol: 10<<16 + 22, Hostname: "QW Campaign", Map: "maps/valley", MaxPlayers: 24,
+			Players: 2, OS: 1, Ranked: true, TimeLeft: 900000, TV: true,
+			PlayerList: []PlayerInfo{{Client: 5, Name: "Rifleman", Clan: "GDF", Ping: 60}, {Client: 6, Name: "bot01", Bot: true}},
+		},
+	},
+}
+
+func TestParseInfoResponseFixtures(t *testing.T) {
+
+	for _, f := range infoFixtures {
+		info, err := ParseInfoResponse(f.data, fixtureChallenge)
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+			continue
+		}
+
+		if info.Variant != f.variant {
+			t.Errorf("%s: variant %q, want %q", f.name, info.Variant, f.variant)
+		}
+		if engine := info.Engine(); engine != f.engine {
+			t.Errorf("%s: engine %q, want %q", f.name, engine, f.engine)
+		}
+		if info.Rules["si_name"] != f.want.Hostname {
+			t.Errorf("%s: rules %v", f.name, info.Rules)
+		}
+
+		got := *info
+		got.Variant, got.Rules = "", nil
+		if !reflect.DeepEqual(got, f.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", f.name, got, f.want)
+		}
+	}
+}
+
+func TestParseInfoResponseErrors(t *testing.T) {
+
+	full := infoFixtures[0].data
+
+	bad := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", full[:2]},
+		{"other command", pkt([]byte("\xff\xff"), "statusResponse", fixtureChallenge)},
+		{"unterminated key", full[:len(infoHeader)+8+5]},
+		{"missing value", pkt(infoHeader, fixtureChallenge, uint32(1<<16+41), "si_name")},
+	}
+
+	for _, b := range bad {
+		_, err := ParseInfoResponse(b.data, fixtureChallenge)
+		if err == nil {
+			t.Errorf("%s: parsed", b.name)
+			continue
+		}
+		if code := ErrorCodeOf(err); code != CodeMalformed {
+			t.Errorf("%s: code %q, want %q (%v)", b.name, code, CodeMalformed, err)
+		}
+	}
+
+	// The library error stays reachable through the query error.
+	if _, err := ParseInfoResponse(full[:len(infoHeader)+8+5], fixtureChallenge); !errors.Is(err, idtech4.ErrTruncatedString) {
+		t.Errorf("unterminated key: %v, want ErrTruncatedString", err)
+	}
+
+	// A truncated player list still gives the server fields.
+	info, err := ParseInfoResponse(full[:len(full)-12], fixtureChallenge)
+	if err != nil || info.Hostname != "^1Frag ^7Fest" {
+		t.Errorf("truncated player list: %v, %+v", err, info)
+	}
+}
+
+// datagramConn - Conn answering a single datagram, cut to the read buffer
+// as a UDP socket does.
+type datagramConn struct {
+	answer []byte
+}
+
+func (c *datagramConn) Write(b []byte) (int, error)       { return len(b), nil }
+func (c *datagramConn) Read(b []byte) (int, error)        { return copy(b, c.answer), nil }
+func (c *datagramConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *datagramConn) Close() error                      { return nil }
+
+func TestQueryInfoLargeAnswer(t *testing.T) {
+
+	keepGlobals(t)
+
+	// A busy server with long rules answers well past 8KB
+	parts := []interface{}{infoHeader, fixtureChallenge, uint32(1<<16 + 41), "si_name", "big"}
+	for i := 0; i < 400; i++ {
+		parts = append(parts, fmt.Sprintf("rule%03d", i), strings.Repeat("x", 40))
+	}
+	parts = append(parts, "", "")
+	for i := 0; i < 32; i++ {
+		parts = append(parts, byte(i), uint16(50), uint32(25000), strings.Repeat("n", 30))
+	}
+	parts = append(parts, byte(maxAsyncClients), uint32(4))
+	data := pkt(parts...)
+	if len(data) <= 16<<10 {
+		t.Fatalf("answer of %d bytes only", len(data))
+	}
+
+	info, err := QueryServerInfoConn(&datagramConn{answer: data}, fixtureChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Rules) != 401 || info.Players != 32 || info.OS != 4 || info.Variant != InfoVariantFull {
+		t.Errorf("%d rules, %d players, OS %d, variant %s", len(info.Rules), info.Players, info.OS, info.Variant)
+	}
+}
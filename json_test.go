@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// roundTrip - Marshals v, unmarshals it into out and marshals it again,
+// failing when the two JSON texts differ. Returns the first one.
+func roundTrip(t *testing.T, v interface{}, out interface{}) string {
+
+	t.Helper()
+
+	first, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("%T: %v", v, err)
+	}
+	if err := json.Unmarshal(first, out); err != nil {
+		t.Fatalf("%T: %v\n%s", out, err, first)
+	}
+	second, err := json.Marshal(reflect.ValueOf(out).Elem().Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != string(second) {
+		t.Errorf("%T changed:\n%s\n%s", v, first, second)
+	}
+
+	return string(first)
+}
+
+// fullInfo - Server info with every serialized field set.
+func fullInfo() *ServerInfo {
+
+	return &ServerInfo{
+		Protocol:   0x00010029,
+		Variant:    "doom3",
+		Hostname:   "^1Frag ^7Fest",
+		Map:        "game/mp/d3dm1",
+		Mod:        "base",
+		GameType:   "Tourney",
+		Players:    2,
+		MaxPlayers: 8,
+		OS:         4,
+		PlayerList: []PlayerInfo{{Client: 0, Name: "marine", Ping: 42, Rate: 25000}, {Client: 3, Name: "bot", Clan: "[B]", Bot: true}},
+		Ranked:     true,
+		TimeLeft:   600000,
+		TV:         true,
+		Rules:      map[string]string{"si_version": "DOOM 1.3.1", "si_pure": "1"},
+		Ping:       12500 * time.Microsecond,
+		Warnings:   []string{"maxPlayers: 8 (getInfo) != 10 (getStatus)"},
+	}
+}
+
+func TestServerJSONRoundTrip(t *testing.T) {
+
+	servers := []idTech4_Server{
+		{IP: net.ParseIP("10.0.0.1").To4(), Port: 27666},
+		{
+			IP: net.ParseIP("2001:db8::1"), Port: 27667, Info: fullInfo(),
+			Name: "Frag Fest", NameSource: "info", ListedBy: []string{"a:27650", "b:27650"},
+			Country: "FR", Continent: "EU", Protocols: []string{"doom3", "dhewm3"},
+		},
+	}
+
+	for _, sv := range servers {
+		var back idTech4_Server
+		text := roundTrip(t, sv, &back)
+
+		// The JSON of a server is the one of the outputs.
+		want, _ := json.Marshal(toJSONServer(sv))
+		if text != string(want) {
+			t.Errorf("server JSON differs from the output:\n%s\n%s", text, want)
+		}
+		if !back.IP.Equal(sv.IP) || !strings.Contains(text, `"ip":"`+sv.IP.String()+`"`) {
+			t.Errorf("IP %v written as %s", sv.IP, text)
+		}
+		if sv.Info != nil && (back.Info.Ping != sv.Info.Ping || back.Info.OS != sv.Info.OS) {
+			t.Errorf("ping %s, OS %d read back as %s, %d", sv.Info.Ping, sv.Info.OS, back.Info.Ping, back.Info.OS)
+		}
+	}
+
+	var sv idTech4_Server
+	if err := json.Unmarshal([]byte(`{"ip":"not an ip","port":1}`), &sv); err == nil {
+		t.Error("invalid IP accepted")
+	}
+}
+
+func TestServerInfoJSONRoundTrip(t *testing.T) {
+
+	info := fullInfo()
+	var back ServerInfo
+	text := roundTrip(t, info, &back)
+
+	for _, field := range []string{`"ping_ms":12.5`, `"os":"linux"`, `"protocol":65577`, `"warnings":[`, `"engine":"doom3"`} {
+		if !strings.Contains(text, field) {
+			t.Errorf("%s missing from %s", field, text)
+		}
+	}
+
+	want := *info
+	if !reflect.DeepEqual(back, want) {
+		t.Errorf("read back\n%+v\nwant\n%+v", back, want)
+	}
+}
+
+func TestResultTypesJSONRoundTrip(t *testing.T) {
+
+	at := time.Date(2026, 3, 4, 5, 6, 7, 8000000, time.UTC)
+	players := 3
+	sv := idTech4_Server{IP: net.ParseIP("10.0.0.1").To4(), Port: 27666, Info: fullInfo()}
+	old := sv
+	old.Port = 27667
+
+	values := []struct {
+		v   interface{}
+		out interface{}
+	}{
+		{PlayerInfo{Client: 1, Name: "a", Clan: "c", Ping: 5, Rate: 1, Bot: true}, &PlayerInfo{}},
+		{QueryMeta{Time: at, Game: "doom3", Protocol: 0x00010029, Masters: []string{"a:27650"}, LAN: true}, &QueryMeta{}},
+		{MasterResult{Master: "a:27650", Protocol: "doom3", Servers: []idTech4_Server{sv}}, &MasterResult{}},
+		{MasterResult{Master: "b:27650", Servers: []idTech4_Server{}, Err: newQueryError(CodeTimeout, "read timeout", nil)}, &MasterResult{}},
+		{HistoryStats{Samples: 3, Peak: 8, Average: 4.5, FirstSeen: at}, &HistoryStats{}},
+		{RunRecord{Time: at, Game: "doom3", Protocol: 1, Masters: []string{"a"}, Servers: []ServerRecord{{Address: "10.0.0.1:27666", Players: &players, MaxPlayers: 8}}}, &RunRecord{}},
+		{ServerTrend{Address: "10.0.0.1:27666", Name: "x", FirstSeen: at, LastSeen: at, Seen: 2, Gone: true, Peak: 4, Average: 2.5}, &ServerTrend{}},
+		{ServerEvent{Type: EventMoved, Server: sv, From: &old}, &ServerEvent{}},
+		{ServerEvent{Type: EventAdded, Server: sv}, &ServerEvent{}},
+	}
+
+	for _, v := range values {
+		roundTrip(t, v.v, v.out)
+	}
+}
+
+func TestErrorJSONRoundTrip(t *testing.T) {
+
+	errs := []*QueryError{
+		newQueryError(CodeBadToken, "master rejected the authentication token (badToken)", nil),
+		{Code: CodeRefused, Msg: "master refused the request", Err: errors.New("wait 30"), RetryAfter: 30 * time.Second},
+	}
+
+	for _, e := range errs {
+		var back QueryError
+		text := roundTrip(t, e, &back)
+		if back.ErrorCode() != e.Code || back.Error() != e.Error() || back.RetryAfter != e.RetryAfter {
+			t.Errorf("%s read back as %+v", text, back)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{newQueryError(CodeResolve, "no such host", nil), CodeResolve},
+		{&ConfirmError{Msg: "aborted"}, CodeNeedsConfirmation},
+		{replayTimeout{}, CodeTimeout},
+		{&idtech4.PrintError{Message: "go away"}, CodeRefused},
+		{&idtech4.CommandError{Command: "x", Expected: "servers"}, CodeMalformed},
+		{&idtech4.NetError{Op: "read", Err: replayTimeout{}}, CodeTimeout},
+		{&idtech4.NetError{Op: "write", Err: errors.New("connection refused")}, CodeUnreachable},
+		{errors.New("plain"), CodeUnknown},
+	}
+
+	for _, tt := range tests {
+		wrapped := fmt.Errorf("query: %w", tt.err)
+		if code := ErrorCodeOf(wrapped); code != tt.code {
+			t.Errorf("%v: code %q, want %q", tt.err, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// Game ports probed in LAN mode when no known game has one.
+const defaultLANPorts = "27666,28004"
+
+// gameLANPorts - Default -lan-ports: the game ports of the games.
+func gameLANPorts(games []Protocol) string {
+
+	var ports []string
+	seen := make(map[int]bool)
+	for _, p := range games {
+		if p.GamePort != 0 && !seen[p.GamePort] {
+			seen[p.GamePort] = true
+			ports = append(ports, strconv.Itoa(p.GamePort))
+		}
+	}
+
+	if len(ports) == 0 {
+		return defaultLANPorts
+	}
+
+	return strings.Join(ports, ",")
+}
+
+// parsePortList - Parses a list such as "27666-27670,28004".
+func parsePortList(value string) ([]int, error) {
+
+	var ports []int
+	seen := make(map[int]bool)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		first, last := entry, entry
+		if i := strings.Index(entry, "-"); i >= 0 {
+			first, last = entry[:i], entry[i+1:]
+		}
+
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 1 || from > 65535 {
+			return nil, fmt.Errorf("invalid port %q", first)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || to < from || to > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", entry)
+		}
+
+		for p := from; p <= to; p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no port given")
+	}
+
+	return ports, nil
+}
+
+// broadcastAddresses - Limited broadcast plus the directed broadcast of every IPv4 interface.
+func broadcastAddresses() []net.IP {
+
+	addrs := []net.IP{net.IPv4bcast}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range ifaddrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			if ip == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+
+			bcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				bcast[i] = ip[i] | ^ipnet.Mask[i]
+			}
+			addrs = append(addrs, bcast)
+		}
+	}
+
+	return addrs
+}
+
+// QueryLAN - Broadcasts a getInfo request on the local network and
+// collects the servers answering within the timeout, or until the context
+// is done.
+func QueryLAN(ctx context.Context, ports []int, timeout time.Duration) ([]idTech4_Server, error) {
+
+	// Go enables SO_BROADCAST on its datagram sockets, so a plain
+	// listening socket is enough to send to broadcast addresses.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the socket: %s", err)
+	}
+	defer conn.Close()
+
+	// Unblocks the read when the context is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	challenge := rand.Uint32()
+
+	var pkt QuakePacket
+	pkt.PreparePacket()
+	pkt.WriteString("getInfo")
+	pkt.WriteLong(challenge)
+	data := pkt.ExportToBytes()
+
+	sent := time.Now()
+	sentOnce := false
+	for _, bcast := range broadcastAddresses() {
+		for _, p := range ports {
+			if err := packetLimiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+			_, err := conn.WriteToUDP(data, &net.UDPAddr{IP: bcast, Port: p})
+			if err == nil {
+				sentOnce = true
+			}
+		}
+	}
+	if !sentOnce {
+		return nil, fmt.Errorf("cannot send the broadcast packets")
+	}
+
+	var list []idTech4_Server
+	seen := make(map[string]bool)
+
+	if ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	buffer := make([]byte, idtech4.MaxDatagram)
+
+	for {
+		buffersize, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("read Error: %s", err)
+		}
+
+		info, err := ParseInfoResponse(buffer[:buffersize], challenge)
+		if err != nil {
+			continue
+		}
+		info.Ping = time.Since(sent)
+
+		sv := idTech4_Server{
+			IP:   from.IP,
+			Port: uint16(from.Port),
+			Info: info,
+		}
+
+		// Every broadcast address reaches the same servers.
+		if seen[sv.Address()] {
+			continue
+		}
+		seen[sv.Address()] = true
+
+		list = append(list, sv)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return list, nil
+}
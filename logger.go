@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel - Severity of a log record.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota // Packet dumps, with -debug
+	LevelInfo                  // Progress of the queries, with -v
+	LevelWarn                  // Always shown
+)
+
+func (l LogLevel) String() string {
+
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	}
+
+	return "warn"
+}
+
+var (
+	// debugLog is set by -debug, and implies verbose.
+	debugLog bool
+
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+// logLevel - Lowest level written, from -debug and -v.
+func logLevel() LogLevel {
+
+	switch {
+	case debugLog:
+		return LevelDebug
+	case verbose:
+		return LevelInfo
+	}
+
+	return LevelWarn
+}
+
+// logEnabled - Tells if records of the level are written, to skip building costly ones.
+func logEnabled(level LogLevel) bool {
+	return level >= logLevel()
+}
+
+// logfmtValue - Value quoted when it holds spaces, quotes or '=', as in logfmt.
+func logfmtValue(v interface{}) string {
+
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\"=\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// logRecord - Writes a record in logfmt: time, level, message, then the
+// key/value pairs, e.g. host=1.2.3.4:27666. Lines of detail, such as a
+// hex dump, follow the record indented.
+func logRecord(level LogLevel, msg string, detail string, kv ...interface{}) {
+
+	if !logEnabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s level=%s msg=%s", time.Now().Format("15:04:05.000"), level, logfmtValue(msg))
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", kv[i], logfmtValue(kv[i+1]))
+	}
+	b.WriteByte('\n')
+	for _, line := range strings.Split(detail, "\n") {
+		if line != "" {
+			b.WriteString("    " + line + "\n")
+		}
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	io.WriteString(logOutput, b.String())
+}
+
+// logDebug - Debug record with key/value pairs.
+func logDebug(msg string, kv ...interface{}) {
+	logRecord(LevelDebug, msg, "", kv...)
+}
+
+// logInfo - Info record with key/value pairs.
+func logInfo(msg string, kv ...interface{}) {
+	logRecord(LevelInfo, msg, "", kv...)
+}
+
+// logVerbose - Prints a message on stderr in verbose mode.
+func logVerbose(format string, args ...interface{}) {
+	logRecord(LevelInfo, fmt.Sprintf(format, args...), "")
+}
+
+// debugConn - PacketConn logging every datagram as an annotated hex dump, with -debug.
+type debugConn struct {
+	PacketConn
+	address string
+}
+
+func (c debugConn) Unwrap() PacketConn {
+	return c.PacketConn
+}
+
+func (c debugConn) Write(b []byte) (int, error) {
+
+	n, err := c.PacketConn.Write(b)
+	logPacket("sent", c.address, b, err)
+
+	return n, err
+}
+
+func (c debugConn) Read(b []byte) (int, error) {
+
+	n, err := c.PacketConn.Read(b)
+	if err == nil {
+		logPacket("received", c.address, b[:n], nil)
+	}
+
+	return n, err
+}
+
+// logPacket - Debug record of a datagram, its fields and its hex dump.
+func logPacket(direction string, address string, data []byte, err error) {
+
+	if !logEnabled(LevelDebug) {
+		return
+	}
+
+	fields, secrets := annotatePacket(data)
+	kv := []interface{}{"host", address, "bytes", len(data)}
+	for _, f := range fields {
+		if f.Name == "command" {
+			kv = append(kv, "command", strings.Trim(f.Value, `"`))
+		}
+	}
+	if err != nil {
+		kv = append(kv, "error", err)
+	}
+
+	var detail strings.Builder
+	for _, f := range fields {
+		value := f.Value
+		for _, s := range secrets {
+			if f.Start == s.Start && !revealSecrets {
+				value = maskSecret(string(data[s.Start:s.End]))
+			}
+		}
+		fmt.Fprintf(&detail, "%04x  %-10s %s\n", f.Start, f.Name, value)
+	}
+	detail.WriteString(hexDump(data, secrets))
+
+	logRecord(LevelDebug, direction+" packet", detail.String(), kv...)
+}
@@ -1,292 +1,1111 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"idtech4query/pkg/idtech4"
 )
 
 var (
-	link     string
-	port     string
-	mod      string
-	protocol int
+	link             string
+	port             string
+	mod              string
+	protocol         int
+	protocolRaw      string
+	protocolValue    string         // -protocol as given, see applyProtocolFlag
+	protocolAuto     bool           // -protocol auto, see autoProtocols
+	ipFamily         string         // FamilyIPv4 or FamilyIPv6 with -4 or -6
+	gameProtocol     = protocols[0] // Protocol used for the queries, from -protocol and -protocol-raw
+	output           string
+	csvSeparator     string
+	decimalComma     bool
+	showPing         bool
+	filter           ServerFilter
+	lan              bool
+	lanPorts         string
+	timeout          time.Duration
+	retries          int
+	execOpts         ExecOptions
+	watch            time.Duration
+	moveSimilarity   float64
+	jitter           float64
+	startDelay       time.Duration
+	verbose          bool
+	serve            string
+	refresh          time.Duration
+	nameSources      []string
+	annotations      map[string]string
+	resolveNames     bool
+	outFile          string
+	appendOut        bool
+	exportGame       string
+	exportPath       string
+	dbPath           string
+	packetRate       float64
+	packetBurst      int
+	historySize      int
+	historyRetention time.Duration
+	confirmThreshold int
+	assumeYes        bool
+	game             string
+	overview         bool
+	sortBy           string
+	masterToken      string
+	revealSecrets    bool
+	serveUI          bool
+	maxWait          time.Duration
+	demo             bool
+	probePorts       bool
+	configPath       string
+	profile          string
+	fullStatus       bool
+	explain          bool
+	firstResponders  int
+	recordPath       string
+	replayPath       string
+	replayTiming     string
+	details          bool
+	workers          int
+	withMeta         bool
+	showPlayers      bool
+	filterFlags      FilterFlags // Resolved into filter, masterFilter and regions
+	geoIPPath        string
+	geoDB            *GeoDB
+	regions          []string
+	masterFilter     MasterFilter
 )
 
+// idTech4_Server - A server listed by a master, with what its queries found.
+// In JSON, it is written as in the -output json lists (see jsonServer).
 type idTech4_Server struct {
-	IP   net.IP
-	Port uint16
+	IP         net.IP
+	Port       uint16
+	Info       *ServerInfo // Filled by getInfo, nil if not queried or unreachable
+	Name       string      // Display name, see ResolveNames
+	NameSource string      // Where Name comes from (info, annotations, rdns)
+	ListedBy   []string    // Masters listing the server
+	Country    string      // ISO code, with -geoip
+	Continent  string      // Continent code, with -geoip
+	Protocols  []string    // Protocols listing the server, with -protocol auto
 }
 
-type QuakePacket struct {
-	buf bytes.Buffer // Buffer to send
+// MarshalJSON - Written as in the -output json lists.
+func (sv idTech4_Server) MarshalJSON() ([]byte, error) {
+	return json.Marshal(toJSONServer(sv))
 }
 
-func (pkt *QuakePacket) WriteString(cmd string) {
-	pkt.buf.Write([]byte(cmd))
-	pkt.buf.WriteByte(0)
+func (sv *idTech4_Server) UnmarshalJSON(data []byte) error {
+
+	var js jsonServer
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	if js.IP != "" && net.ParseIP(js.IP) == nil {
+		return fmt.Errorf("invalid server IP %q", js.IP)
+	}
+
+	*sv = js.server()
+	return nil
 }
 
-func (pkt *QuakePacket) WriteByte(cmd byte) {
-	pkt.buf.WriteByte(cmd)
+// Address - IP:port of the server.
+func (sv idTech4_Server) Address() string {
+	return net.JoinHostPort(sv.IP.String(), strconv.Itoa(int(sv.Port)))
 }
 
-func (pkt *QuakePacket) PreparePacket() {
-	pkt.buf.WriteByte(255)
-	pkt.buf.WriteByte(255)
+// Reachable - Tells if the server answered its getInfo query.
+func (sv idTech4_Server) Reachable() bool {
+	return sv.Info != nil
 }
 
-func (pkt *QuakePacket) WriteLong(packetsize uint32) {
+// DisplayName - Resolved name of the server, or its hostname.
+func (sv idTech4_Server) DisplayName() string {
 
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, packetsize)
+	if sv.Name != "" {
+		return sv.Name
+	}
+	if sv.Reachable() {
+		return sv.Info.Hostname
+	}
 
-	pkt.buf.Write(b)
+	return ""
 }
 
-func (pkt *QuakePacket) ExportToBytes() []byte {
+// QuakePacket and QuakeAnswer build and read the packets, see pkg/idtech4.
+type (
+	QuakePacket = idtech4.Packet
+	QuakeAnswer = idtech4.Answer
+)
 
-	return pkt.buf.Bytes()
-}
+// ErrBadToken is returned when a private master rejects the -master-token.
+var ErrBadToken = newQueryError(CodeBadToken, "master rejected the authentication token (badToken)", nil)
 
-type QuakeAnswer struct {
-	buffer    []byte
-	bufferpos int
-	bufferlen int
-}
+// Most alternate ports probed per master, so a dead master costs a few packets only.
+const maxProbedPorts = 3
 
-// ReadByte - Reads the byte.
-// Moves 1 byte in the request position.
-func (sv *QuakeAnswer) ReadByte() (byte, error) {
+// QueryMasterServer - Queries a master. With -probe-ports, a master which
+// doesn't answer on its port is tried on the known alternate ports of the game.
+func QueryMasterServer(ctx context.Context, link string, port string, req MasterRequest) ([]idTech4_Server, error) {
 
-	if sv.bufferpos+1 > sv.bufferlen {
-		errmsg := fmt.Sprintf("Buffer going too far! (pos: %d, size:%d)", sv.bufferpos+1, sv.bufferlen)
-		return 0, errors.New(errmsg)
+	list, err := queryMasterPort(ctx, link, port, req)
+	if err == nil || !probePorts {
+		return list, err
+	}
+	// A wrong port times out, or is refused when the host sends back an ICMP error
+	if ctx.Err() != nil || (!isTimeout(err) && ErrorCodeOf(err) != CodeUnreachable) {
+		return list, err
 	}
 
-	val := sv.buffer[sv.bufferpos]
-	sv.bufferpos = sv.bufferpos + 1
+	probed := 0
+	for _, alt := range req.Protocol.AltPorts {
+		if alt == port || probed == maxProbedPorts {
+			continue
+		}
+		probed++
+
+		logVerbose("%s:%s didn't answer, probing port %s", link, port, alt)
+		altList, altErr := queryMasterPort(ctx, link, alt, req)
+		if altErr == nil {
+			fmt.Fprintf(os.Stderr, "Note: master %s answered on port %s instead of %s, use -port %s to skip the probing.\n", link, alt, port, alt)
+			return altList, nil
+		}
+	}
 
-	return val, nil
+	return list, err
 }
 
-// ReadShort - Reads a short into the request list.
-// Moves 2 bytes in the request position.
-func (sv *QuakeAnswer) ReadShort() (uint16, error) {
+// queryMasterPort - Queries a master on one port, trying each of its addresses.
+func queryMasterPort(ctx context.Context, link string, port string, req MasterRequest) ([]idTech4_Server, error) {
 
-	if sv.bufferpos+2 > sv.bufferlen {
-		errmsg := fmt.Sprintf("Buffer going too far! (pos: %d, size:%d)", sv.bufferpos+2, sv.bufferlen)
-		return 0, errors.New(errmsg)
+	// Translate DNS into a readable IP
+	addrs, err := resolveMaster(ctx, link, port)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := req.Protocol
+	opts := idtech4.QueryOptions{Protocol: proto.Version, Mod: req.Mod, Layout: proto.Layout, Filter: req.Filter}
+	if masterToken != "" || proto.TokenAuth {
+		opts.Token = masterToken
 	}
 
-	test := binary.LittleEndian.Uint16(sv.buffer[sv.bufferpos:])
-	value := uint16(test)
-	sv.bufferpos = sv.bufferpos + 2
+	stats.Counter(StatMasterQueries).Inc()
+	start := time.Now()
+	defer func() {
+		stats.Histogram(StatMasterDuration, durationBuckets).ObserveDuration(time.Since(start))
+	}()
 
-	return uint16(value), nil
+	// Try the next address only when the previous one didn't answer,
+	// and all of them again on timeouts, see -retries.
+	var list []idTech4_Server
+	err = withRetries(ctx, "getServers "+net.JoinHostPort(link, port), func() error {
+		var err error
+		for _, svlink := range addrs {
+			// Masters reached over IPv6 list the IPv6 servers in the extended answer
+			opts.Master = svlink
+			opts.Extended = ipFamily == FamilyIPv6 || udpNetwork(svlink) == "udp6"
+			command := "getServers"
+			if opts.Extended {
+				command = idtech4.CommandGetServersExt
+			}
+			logInfo("sending "+command, "master", svlink)
+			list, err = queryMasterAddress(ctx, opts)
+			if err == nil || !isTimeout(err) || ctx.Err() != nil {
+				break
+			}
+		}
+		return err
+	})
+	if err != nil {
+		stats.Counter(StatMasterErrors).Inc()
+	}
+
+	return list, err
 }
 
-// Transform the byte into a long.
-func (sv *QuakeAnswer) ReadString() (string, error) {
+// buildMasterFilter - Filter fields of getServers from the flags.
+func buildMasterFilter(noPassword, notFull, notEmpty bool, gameType int) (MasterFilter, error) {
 
-	result := ""
+	var f MasterFilter
 
-	for true {
-		c, err := sv.ReadByte()
+	if gameType < 0 || gameType > 255 {
+		return f, fmt.Errorf("invalid -gametype %d: must be between 0 and 255", gameType)
+	}
+	f.GameType = byte(gameType)
 
-		if err != nil {
-			return "", err
-		}
+	if noPassword {
+		f.Password = idtech4.PasswordNone
+	}
 
-		if c <= 0 || c >= 255 {
-			break
-		}
+	switch {
+	case notFull && notEmpty:
+		f.Players = idtech4.PlayersSome
+	case notFull:
+		f.Players = idtech4.PlayersNotFull
+	case notEmpty:
+		f.Players = idtech4.PlayersNotEmpty
+	}
 
-		if c == '%' {
-			c = '.'
-		}
+	return f, nil
+}
 
-		result = result + string(c)
+// describeMasterFilter - Readable list of the master filters, empty without any.
+func describeMasterFilter(f MasterFilter) string {
+
+	var parts []string
+	if f.Password == idtech4.PasswordNone {
+		parts = append(parts, "no password")
+	}
+	switch f.Players {
+	case idtech4.PlayersSome:
+		parts = append(parts, "not empty", "not full")
+	case idtech4.PlayersNotFull:
+		parts = append(parts, "not full")
+	case idtech4.PlayersNotEmpty:
+		parts = append(parts, "not empty")
+	}
+	if f.GameType != idtech4.GameTypeAny {
+		parts = append(parts, fmt.Sprintf("game type %d", f.GameType))
 	}
 
-	return result, nil
+	return strings.Join(parts, ", ")
 }
 
-func QueryMasterServer() ([]idTech4_Server, error) {
+// applyTransportFlags - Checks -retries, -rate and -4/-6, and sets up the
+// packet limiter and the address family shared by every query.
+func applyTransportFlags(ipv4Only, ipv6Only bool) error {
 
-	// Translate DNS into a readable IP
-	daIP, err := net.LookupIP(link)
-	if err != nil {
-		fmt.Println("Unknown host")
+	if retries < 0 {
+		return errors.New("invalid -retries: must be 0 or more")
 	}
-	ip := daIP[0].String()
 
-	svlink := ip + ":" + port
+	if packetRate < 0 || packetBurst < 1 {
+		return errors.New("-rate can't be negative and -rate-burst must be at least 1")
+	}
+	packetLimiter = idtech4.NewRateLimiter(packetRate, packetBurst)
+
+	switch {
+	case ipv4Only && ipv6Only:
+		return errors.New("-4 and -6 can't be used together")
+	case ipv4Only:
+		ipFamily = FamilyIPv4
+	case ipv6Only:
+		ipFamily = FamilyIPv6
+	}
+
+	return nil
+}
 
-	var pkt QuakePacket
-	pkt.PreparePacket()
-	pkt.WriteString("getServers")
+// exitCodeOf - Exit code of a run stopped by the error.
+func exitCodeOf(err error) int {
 
-	if protocol == 0 {
-		pkt.WriteLong((1 << 16) + 41)
-	} else if protocol == 1 {
-		pkt.WriteLong(131157) // Quake 4 protocol (\x55\x00\x02\x80)
-	} else if protocol == 2 {
-		pkt.WriteLong((1 << 16) + 41 + 1)
+	if isConfirmError(err) {
+		return exitNeedsConfirmation
 	}
-	pkt.WriteString(mod)
-	pkt.WriteByte(0) // ?
-	pkt.WriteByte(0) // ?
-	pkt.WriteByte(0) // ?
+
+	return 1
+}
+
+// isTimeout - Tells if the error comes from a network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// queryMasterAddress - Sends the getServers packet to a resolved master address and parses the answer.
+func queryMasterAddress(ctx context.Context, opts idtech4.QueryOptions) ([]idTech4_Server, error) {
 
 	//Connect udp
-	conn, err := net.DialTimeout("udp", svlink, 2*time.Second)
+	conn, err := openConn(ctx, opts.Master)
 	if err != nil {
-		return nil, fmt.Errorf("cannot access the server: %s", err)
+		return nil, newQueryError(CodeUnreachable, "cannot access the server", err)
 	}
 	defer conn.Close()
 
-	// Query the server to check if we're a valid QW server
-	_, err = conn.Write(pkt.ExportToBytes())
+	return QueryMasterConn(ctx, conn, opts)
+}
+
+// QueryMasterConn - Asks a master for its servers on an opened connection,
+// with the client of pkg/idtech4, and maps its errors to query errors.
+func QueryMasterConn(ctx context.Context, conn PacketConn, opts idtech4.QueryOptions) ([]idTech4_Server, error) {
+
+	datagrams := 0
+	client := idtech4.MasterClient{
+		Timeout: timeout,
+		OnDatagram: func(data []byte, answer *idtech4.ServersAnswer, err error) {
+			datagrams++
+			recordServersDatagram(data, answer, err, opts.Layout)
+			if err != nil && datagrams > 1 {
+				logVerbose("ignoring datagram %d of the master answer: %s", datagrams, err)
+			}
+		},
+	}
+
+	servers, err := client.QueryConn(ctx, conn, opts)
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return nil, fmt.Errorf("Write Timeout: %s", err)
+		return nil, masterQueryError(err)
+	}
+	if datagrams > 1 {
+		logVerbose("master answer: %d datagrams, %d servers", datagrams, len(servers))
+	}
+
+	list := make([]idTech4_Server, 0, len(servers))
+	for _, entry := range servers {
+		list = append(list, idTech4_Server{IP: entry.IP, Port: entry.Port})
+	}
+
+	return list, nil
+}
+
+// masterQueryError - Query error of a failed master query, with its code.
+func masterQueryError(err error) error {
+
+	var netErr *idtech4.NetError
+	var printErr *idtech4.PrintError
+	var cmdErr *idtech4.CommandError
+	switch {
+	case errors.As(err, &netErr) && netErr.Op == "write":
+		if isTimeout(netErr.Err) {
+			return newQueryError(CodeTimeout, "Write Timeout", netErr.Err)
 		}
-		return nil, fmt.Errorf("write Error: %s", err)
+		return newQueryError(CodeUnreachable, "write Error", netErr.Err)
+	case errors.As(err, &netErr):
+		if isTimeout(netErr.Err) {
+			return newQueryError(CodeTimeout, "read timeout", netErr.Err)
+		}
+		return newQueryError(CodeUnreachable, "read Error", netErr.Err)
+	case errors.As(err, &printErr):
+		if strings.Contains(printErr.Message, "badToken") {
+			return ErrBadToken
+		}
+		qerr := newQueryError(CodeRefused, "master refused the request: "+printErr.Message, nil)
+		if wait, ok := parseWaitHint(printErr.Message, maxWait); ok {
+			qerr.RetryAfter = wait
+			qerr.Msg += " (asked to wait " + wait.String() + ")"
+		}
+		return qerr
+	case errors.As(err, &cmdErr):
+		return newQueryError(CodeMalformed, "Unknown request: "+cmdErr.Command+" != servers ", nil)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return newQueryError(CodeUnreachable, "read Error", err)
 	}
 
-	// Read the answer and trim it, so that empty bytes won't be displayed.
-	buffer := make([]byte, 8196)
-	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	return newQueryError(CodeMalformed, "Read Error", err)
+}
+
+// recordServersDatagram - Parse telemetry of a datagram of a master answer.
+func recordServersDatagram(data []byte, answer *idtech4.ServersAnswer, err error, layout EntryLayout) {
+
+	var cmdErr *idtech4.CommandError
+	switch {
+	case errors.As(err, &cmdErr):
+		parseTelemetry.Record(DatagramStats{Kind: DatagramServers, Command: cmdErr.Command, Size: len(data)})
+	case err == nil:
+		parseTelemetry.Record(DatagramStats{
+			Kind:       DatagramServers,
+			Command:    answer.Command,
+			Known:      true,
+			Size:       len(data),
+			Header:     answer.Header,
+			Records:    len(answer.Servers),
+			EntryBytes: entryBytes(answer, layout),
+			Trailer:    answer.Trailer,
+			Leftover:   answer.Leftover,
+		})
+	}
+}
 
-	buffersize, err := conn.Read(buffer)
+func main() {
+
+	flag.Var(&listFlag{value: &link}, "ip", "URL of a custom idTech4 masterserver, or a comma-separated list of host[:port]. Can be repeated. (default: none)")
+	flag.StringVar(&port, "port", "", "Port of the masterserver (default: 27650, 27950 for ETQW)")
+	flag.StringVar(&mod, "mod", "", "Filters the list with the mod requested.")
+	flag.Var(protocolFlag{}, "protocol", "Use the protocol for query ("+protocolHelp()+"). (default: 0)")
+	flag.StringVar(&game, "game", "", "Game to query by name, instead of -protocol, or \"all\" for an overview of every game.")
+	flag.BoolVar(&overview, "overview", false, "Print one summary row per game instead of the server list.")
+	flag.StringVar(&sortBy, "sort", "", "Column the overview is sorted by ("+strings.Join(overviewColumns, ", ")+"). The server list can be sorted by ping or players.")
+	flag.StringVar(&masterToken, "master-token", os.Getenv("MSQ_MASTER_TOKEN"), "Authentication token sent to private masters. (default: $MSQ_MASTER_TOKEN)")
+	flag.BoolVar(&revealSecrets, "reveal-secrets", false, "Show the master token in -debug packet dumps.")
+	flag.BoolVar(&debugLog, "debug", false, "Like -v, also dumping every packet sent and received as annotated hex.")
+	flag.StringVar(&protocolRaw, "protocol-raw", "", "Send this exact protocol number instead of the -protocol one, e.g. 65578 or 0x1002a.")
+	flag.StringVar(&output, "output", OutputPlain, "Output format (plain, csv, json). (default: plain)")
+	flag.BoolVar(&withMeta, "meta", false, "Add the query time, game, protocol and answering masters to the output.")
+	flag.StringVar(&csvSeparator, "csv-separator", ",", "Field separator used by the csv output. (default: ,)")
+	flag.BoolVar(&decimalComma, "decimal-comma", false, "Use a comma as decimal mark in the csv output.")
+	flag.BoolVar(&showPing, "ping", false, "Query every server to measure its ping, and sort the list by it.")
+	flag.BoolVar(&details, "details", false, "Query every server and show its name, map, mod, players and OS.")
+	flag.BoolVar(&showPlayers, "players", false, "Like -details, also listing the players of every server.")
+	flag.Float64Var(&packetRate, "rate", 0, "Most packets sent per second to the masters and servers, so that big sweeps don't trip UDP flood protections. 0 doesn't limit. (default: 0)")
+	flag.IntVar(&packetBurst, "rate-burst", 10, "Packets -rate lets go at once before spacing them out. (default: 10)")
+	flag.IntVar(&workers, "workers", defaultWorkers, "How many servers are queried at once, 0 for all of them. (default: 32)")
+	filterFlags.Register(flag.CommandLine)
+	flag.StringVar(&geoIPPath, "geoip", "", "MaxMind DB file (GeoLite2 Country or City) used to locate the servers.")
+	flag.IntVar(&firstResponders, "first-responders", 0, "Stop querying the servers once this many answered and passed the filters, and list them by ping.")
+	ipv4Only := flag.Bool("4", false, "Only use IPv4: masters are reached over IPv4 and IPv6 servers are left out.")
+	ipv6Only := flag.Bool("6", false, "Only use IPv6, asking the masters for their extended list, which has the IPv6 servers.")
+	flag.BoolVar(&lan, "lan", false, "Look for servers on the local network instead of querying a masterserver.")
+	flag.StringVar(&lanPorts, "lan-ports", defaultLANPorts, "Game ports probed in LAN mode, e.g. 27666-27670,28004. (default: the port of the selected game, or of every known game)")
+	flag.DurationVar(&timeout, "timeout", 3*time.Second, "How long to wait for answers. (default: 3s)")
+	flag.IntVar(&retries, "retries", 1, "How many times a master or server query is sent again when it times out, waiting longer before each retry. (default: 1)")
+	flag.StringVar(&execOpts.PerServer, "exec-per-server", "", "Command run for every server found, with its details in MSQ_* environment variables. It is not run through a shell.")
+	flag.BoolVar(&execOpts.StdinJSON, "exec-stdin-json", false, "Also pass the server as JSON on the standard input of -exec-per-server.")
+	flag.IntVar(&execOpts.Concurrency, "exec-concurrency", 4, "How many -exec-per-server commands may run at once. (default: 4)")
+	flag.DurationVar(&execOpts.Timeout, "exec-timeout", 10*time.Second, "Kill commands running for longer than this. (default: 10s)")
+	flag.StringVar(&execOpts.Summary, "exec-summary", "", "Command run once at the end, receiving the whole list as JSON on its standard input.")
+	flag.DurationVar(&watch, "watch", 0, "Query again at this interval and report servers appearing and disappearing, e.g. 60s. With -details, their map and player count changes too.")
+	flag.Float64Var(&moveSimilarity, "move-similarity", defaultMoveSimilarity, "Minimal hostname similarity (0-1) for a server changing port on the same IP to be reported as moved in watch mode, keeping its history in serve mode.")
+	flag.Float64Var(&jitter, "jitter", defaultJitter, "Random variation of the -watch and -refresh intervals, as a fraction of it (0 disables it). (default: 0.1)")
+	flag.DurationVar(&startDelay, "start-delay", 0, "Wait a random delay up to this long before the first -watch or -serve poll.")
+	flag.BoolVar(&verbose, "v", false, "Verbose output.")
+	flag.StringVar(&serve, "serve", "", "Serve the server list over HTTP on this address (e.g. :8080) instead of printing it.")
+	flag.DurationVar(&maxWait, "max-wait", 10*time.Minute, "Longest wait honoured when a master asks to retry later. (default: 10m)")
+	flag.StringVar(&configPath, "config", defaultConfigPath(), "Config file declaring custom games and profiles.")
+	flag.StringVar(&profile, "profile", "", "Profile of the config file to use. Flags given on the command line override its values.")
+	listGames := flag.Bool("list-games", false, "List the known games, custom ones included, and exit.")
+	flag.BoolVar(&probePorts, "probe-ports", false, "When the master doesn't answer, try the other ports masters of the game often use.")
+	flag.BoolVar(&fullStatus, "full", false, "Also send getStatus to every server and merge its answer with getInfo.")
+	flag.BoolVar(&explain, "explain", false, "Print on stderr which answer each server detail comes from.")
+	flag.BoolVar(&demo, "demo", false, "Answer every query from built-in fixtures instead of the network, for demonstrations.")
+	flag.StringVar(&recordPath, "record", "", "Record every datagram sent and received in this session file.")
+	flag.StringVar(&replayPath, "replay", "", "Answer every query from a session file written by -record instead of the network.")
+	flag.StringVar(&replayTiming, "replay-timing", ReplayCompress, "How -replay handles the recorded delays ("+replayTimingEnum.Valid()+"). (default: "+ReplayCompress+")")
+	flag.BoolVar(&serveUI, "ui", true, "Serve a web page showing the list on / in -serve mode.")
+	flag.DurationVar(&refresh, "refresh", 60*time.Second, "How often -serve queries the masters again. (default: 60s)")
+	flag.IntVar(&historySize, "history-size", defaultHistorySize, "Player count samples kept per server by -serve. (default: 1440)")
+	flag.DurationVar(&historyRetention, "history-retention", defaultHistoryRetention, "Drop the history of servers absent for this long. (default: 24h)")
+	nameSourcesFlag := flag.String("name-sources", defaultNameSources, "Where to look for server names, in order (info, annotations, rdns). (default: "+defaultNameSources+")")
+	annotationsFile := flag.String("annotations", "", "File naming servers, one \"ip:port name\" per line.")
+	flag.IntVar(&confirmThreshold, "confirm-threshold", defaultConfirmThreshold, "Ask before contacting more distinct addresses than this. (default: 1000)")
+	flag.BoolVar(&assumeYes, "yes", false, "Don't ask for confirmation before contacting many addresses.")
+	flag.StringVar(&outFile, "out", "", "Write the server list to this file instead of the standard output.")
+	flag.BoolVar(&appendOut, "append", false, "Append to the -out file, each run prefixed by its time, instead of overwriting it.")
+	flag.StringVar(&exportGame, "export", "", "Also write the servers as a cache served by \"msquery master -cache\", and a script pointing the in-game browser at it, in the config dir of this game ("+exportEnum.Valid()+").")
+	flag.StringVar(&dbPath, "db", "", "Record every run (time, masters, servers and their players) in this SQLite database, for the history command.")
+	flag.StringVar(&exportPath, "export-path", "", "Write the -export script to this file instead of the game config dir, the cache next to it.")
+	flag.Usage = func() {
+		writeUsage(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	if run, ok := subcommands[command]; ok {
+		os.Exit(run(args[1:]))
+	}
+
+	serveCommand, browseCommand := false, false
+	switch command {
+	case "batch":
+		// Flags such as -timeout, -yes or -v apply to every spec
+		positionals, _ := parseInterleaved(flag.CommandLine, args[1:])
+		if _, err := applyConfig(configPath, isFlagSet("config")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := applyTransportFlags(*ipv4Only, *ipv6Only); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if geoIPPath != "" {
+			db, err := OpenGeoDB(geoIPPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			geoDB = db
+		}
+		os.Exit(runBatchCommand(positionals))
+	case "query":
+		args = args[1:]
+	case "serve":
+		args = args[1:]
+		serveCommand = true
+	case "browse":
+		args = args[1:]
+		browseCommand = true
+	case "-h", "-help", "--help":
+	default:
+		fmt.Fprintf(os.Stderr, "Note: running without command is deprecated, use \"%s query\".\n", os.Args[0])
+	}
+
+	positionals, _ := parseInterleaved(flag.CommandLine, args)
+	if serveCommand && serve == "" {
+		serve = defaultServeAddress
+	}
+	if browseCommand {
+		// The browser shows the details and the players of every server
+		details, showPing, showPlayers = true, true, true
+	}
+
+	cfg, err := applyConfig(configPath, isFlagSet("config"))
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return nil, fmt.Errorf("read timeout: %s", err)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if profile != "" {
+		// A master given as argument replaces the one of the profile.
+		skip := make(map[string]bool)
+		if len(positionals) > 0 {
+			skip["ip"], skip["port"] = true, true
 		}
-		return nil, fmt.Errorf("read Error: %s", err)
+		if err := cfg.ApplyProfile(profile, flag.CommandLine, skip); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	if *listGames {
+		writeGames(os.Stdout)
+		return
 	}
 
-	if buffersize <= 0 {
-		return nil, fmt.Errorf("server has no data to answer with")
+	if output, err = outputEnum.Parse(output); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if game != "" {
+		if game, err = gameEnum().Parse(game); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	if sortBy != "" {
+		if sortBy, err = sortEnum.Parse(sortBy); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	if err := applyProtocolFlag(protocolValue); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
 
-	a := QuakeAnswer{
-		buffer:    buffer,
-		bufferpos: 0,
-		bufferlen: buffersize,
+	csvOpts := csvOptions{DecimalComma: decimalComma}
+	csvFlagSet, ipSet, portSet := false, false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "csv-separator", "decimal-comma":
+			csvFlagSet = true
+		case "ip":
+			ipSet = true
+		case "port":
+			portSet = true
+		case "name-sources", "annotations":
+			resolveNames = true
+		}
+	})
+
+	if filter, masterFilter, regions, err = filterFlags.Filters(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if len(regions) > 0 && geoIPPath == "" {
+		fmt.Println("-region needs a -geoip database")
+		os.Exit(2)
+	}
+	if geoIPPath != "" {
+		if geoDB, err = OpenGeoDB(geoIPPath); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
 	}
 
-	var list []idTech4_Server
+	// The players come with the details sweep.
+	if showPlayers {
+		details = true
+	}
 
-	_, err = a.ReadShort()
+	var warnings []string
+	link, port, warnings, err = applyPositionalArgs(positionals, link, port, ipSet, portSet)
 	if err != nil {
-		return nil, fmt.Errorf("Read Error: %s", err)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
 	}
 
-	querytxt, err := a.ReadString()
-	if err != nil {
-		return nil, fmt.Errorf("Read Error: %s", err)
+	if err := applyTransportFlags(*ipv4Only, *ipv6Only); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
-	if querytxt != "servers" {
-		return nil, fmt.Errorf("Unknown request: %s != servers ", querytxt)
+
+	if appendOut && outFile == "" {
+		fmt.Println("-append can only be used with -out")
+		os.Exit(2)
+	}
+
+	if exportGame != "" {
+		if exportGame, err = exportEnum.Parse(exportGame); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	} else if exportPath != "" {
+		fmt.Println("-export-path can only be used with -export")
+		os.Exit(2)
 	}
 
-	for {
+	if csvFlagSet && output != OutputCSV {
+		fmt.Println("-csv-separator and -decimal-comma can only be used with -output csv")
+		os.Exit(2)
+	}
+	sep, err := parseCSVSeparator(csvSeparator)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	csvOpts.Separator = sep
 
-		ipa, err := a.ReadByte()
+	nameSources, err = parseNameSources(*nameSourcesFlag)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *annotationsFile != "" {
+		annotations, err = LoadAnnotations(*annotationsFile)
 		if err != nil {
-			break
+			fmt.Println("Cannot read the annotations:", err)
+			os.Exit(2)
 		}
+	}
 
-		ipb, err := a.ReadByte()
-		if err != nil {
-			break
+	if demo {
+		if lan {
+			fmt.Println("-demo cannot be used with -lan")
+			os.Exit(2)
+		}
+		if err := enableDemo(); err != nil {
+			fmt.Println("Cannot load the demo fixtures:", err)
+			os.Exit(1)
 		}
+	}
 
-		ipc, err := a.ReadByte()
+	if (recordPath != "" || replayPath != "") && (lan || demo) {
+		fmt.Println("-record and -replay cannot be used with -lan or -demo")
+		os.Exit(2)
+	}
+	if recordPath != "" && replayPath != "" {
+		fmt.Println("-record and -replay cannot be used together")
+		os.Exit(2)
+	}
+	if recordPath != "" {
+		recorder, err := enableRecord(recordPath)
 		if err != nil {
-			break
+			fmt.Println("Cannot record the session:", err)
+			os.Exit(1)
 		}
+		defer recorder.Close()
+	}
+	if replayPath != "" {
+		if replayTiming, err = replayTimingEnum.Parse(replayTiming); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if err := enableReplay(replayPath, replayTiming); err != nil {
+			fmt.Println("Cannot load the session:", err)
+			os.Exit(1)
+		}
+	}
 
-		ipd, err := a.ReadByte()
+	if protocolAuto && (game != "" || protocolRaw != "" || lan) {
+		fmt.Println("-protocol auto can't be used with -game, -protocol-raw or -lan")
+		os.Exit(2)
+	}
+
+	var games []Protocol
+	if game != "" {
+		games, err = protocolsByGame(game)
 		if err != nil {
-			break
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if game == GameAll {
+			overview = true
+		} else {
+			for i := range protocols {
+				if protocols[i].ID == games[0].ID {
+					protocol = i
+				}
+			}
 		}
+	}
 
-		ipport, err := a.ReadShort()
-		if err != nil {
-			break
+	// Outside the overview, -sort orders the server list.
+	if !overview && sortBy != "" {
+		switch sortBy {
+		case "ping":
+			showPing = true
+		case "players":
+			details = true
+		default:
+			fmt.Printf("-sort %s only applies to the overview, the server list is sorted by ping or players\n", sortBy)
+			os.Exit(2)
 		}
+	}
 
-		servtoip := []byte{ipa, ipb, ipc, ipd}
+	proto, err := protocolByIndex(protocol)
+	prot := proto.Name
+	if err != nil {
+		prot = "Unknown choice, reverting to Doom3 / Prey."
+		protocol = 0
+		proto = protocols[0]
+	}
 
-		tempentry := idTech4_Server{
-			IP:   net.IP(servtoip),
-			Port: ipport,
+	if protocolRaw != "" {
+		version, err := parseRawProtocol(protocolRaw)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
 		}
+		proto.Version = version
+		prot = proto.Name + " (raw protocol)"
+	}
+	if protocolAuto {
+		proto.ID = ProtocolAuto
+		proto.Name = "Auto"
+		prot = "Auto (" + describeProtocols(autoProtocols, false) + ")"
+	}
+	gameProtocol = proto
+	if mod == "" {
+		mod = proto.DefaultMod
+	}
 
-		list = append(list, tempentry)
+	if link == "" {
+		link = proto.Master
+	}
+	if port == "" {
+		port = proto.MasterPort
+	}
+	if lan && !isFlagSet("lan-ports") {
+		lanGames := protocols
+		if (game != "" && game != GameAll) || isFlagSet("protocol") {
+			lanGames = []Protocol{proto}
+		}
+		lanPorts = gameLANPorts(lanGames)
 	}
 
-	return list, nil
-}
+	// The overview sweeps the games of -game all, or the one selected.
+	mastersGiven := ipSet || len(positionals) > 0
+	if overview && games == nil {
+		games = []Protocol{proto}
+		if protocolAuto {
+			// The protocols of the sweep, all sent to the same master
+			games = nil
+			for _, p := range autoProtocols {
+				p.Master, p.MasterPort = link, port
+				games = append(games, p)
+			}
+		}
+	}
 
-func main() {
+	// Keep stdout clean for machine-readable outputs.
+	banner := os.Stdout
+	if output != OutputPlain {
+		banner = os.Stderr
+	}
 
-	flag.StringVar(&link, "ip", "", "URL of a custom idTech4 masterserver (default: none)")
-	flag.StringVar(&port, "port", "27650", "Port of the masterserver (default: 27650)")
-	flag.StringVar(&mod, "mod", "", "Filters the list with the mod requested.")
-	flag.IntVar(&protocol, "protocol", 0, "Use the protocol for query (0: for Doom 3 & Prey, 1: Quake4, 2: DHEWM3). (default: 0)")
-	flag.Parse()
-
-	prot := ""
-	if protocol == 0 {
-		prot = "Doom 3 / Prey"
-	} else if protocol == 1 {
-		prot = "Quake 4"
-	} else if protocol == 2 {
-		prot = "DHEWM3"
+	fmt.Fprintln(banner, "==========================")
+	fmt.Fprintln(banner, "iDTech4 MasterServer Query Tool")
+	fmt.Fprintln(banner, "Written by Ch0wW - https://ch0ww.fr")
+	fmt.Fprintln(banner, "")
+	fmt.Fprintln(banner, "Settings:")
+	if demo {
+		fmt.Fprintln(banner, "-", demoWatermark)
+	}
+	if lan {
+		fmt.Fprintln(banner, "- LAN ports:", lanPorts)
+	} else if overview {
+		// Each game is queried on its own master, unless one is given
+		if mastersGiven {
+			fmt.Fprintln(banner, "- MasterServer Address:", link)
+			fmt.Fprintln(banner, "- Port:", port)
+		}
+		fmt.Fprintln(banner, "- Protocols:", describeProtocols(games, !mastersGiven))
+		if masterToken != "" {
+			fmt.Fprintln(banner, "- Master token:", maskSecret(masterToken))
+		}
+		if filters := describeMasterFilter(masterFilter); filters != "" {
+			fmt.Fprintln(banner, "- Master filters:", filters)
+		}
 	} else {
-		prot = "Unknown choice, reverting to Doom3 / Prey."
-		protocol = 0
+		fmt.Fprintln(banner, "- MasterServer Address:", link)
+		fmt.Fprintln(banner, "- Port:", port)
+		fmt.Fprintln(banner, "- Protocol:", prot)
+		if !protocolAuto {
+			fmt.Fprintf(banner, "- Protocol number: %d (%d.%d)\n", proto.Version, proto.Version>>16, proto.Version&0xffff)
+		}
+		if masterToken != "" {
+			fmt.Fprintln(banner, "- Master token:", maskSecret(masterToken))
+		}
+		if filters := describeMasterFilter(masterFilter); filters != "" {
+			fmt.Fprintln(banner, "- Master filters:", filters)
+		}
 	}
+	fmt.Fprintln(banner, "==========================")
+
+	// Interrupting cancels the scan in progress: the one-shot modes still
+	// print what they got, a second interruption stops the tool.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if overview {
+		var masters []string
+		if mastersGiven {
+			masters, err = splitMasterList(link, port)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+		}
 
-	if link == "" {
-		if protocol == 0 || protocol == 2 {
-			link = "idnet.ua-corp.com"
-		} else if protocol == 1 {
-			link = "q4master.idsoftware.com"
+		rows, err := BuildOverview(ctx, games, masters)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitCodeOf(err))
+		}
+		if err := SortOverview(rows, sortBy); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
 		}
+		if err := writeOverview(os.Stdout, rows, output == OutputJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if demo {
+			fmt.Fprintln(banner, demoWatermark)
+		}
+		return
 	}
 
-	fmt.Println("==========================")
-	fmt.Println("iDTech4 MasterServer Query Tool")
-	fmt.Println("Written by Ch0wW - https://ch0ww.fr")
-	fmt.Println("")
-	fmt.Println("Settings:")
-	fmt.Println("- MasterServer Address:", link)
-	fmt.Println("- Port:", port)
-	fmt.Println("- Protocol:", prot)
-	fmt.Println("==========================")
+	var masters []string
+	var ports []int
 
-	list, err := QueryMasterServer()
+	if lan {
+		ports, err = parsePortList(lanPorts)
+	} else {
+		masters, err = splitMasterList(link, port)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	// A run killed while writing may have left the files it appends to damaged.
+	if watch > 0 || serve != "" || dbPath != "" {
+		recoverFiles()
+	}
 
+	if watch > 0 || serve != "" || browseCommand {
+		dumpStatsOnSignal(ctx)
+
+		poll := func() ([]idTech4_Server, []MasterResult, error) {
+			started := time.Now()
+			list, results, err := collectServers(ctx, masters, ports)
+			for _, res := range results {
+				if res.Err != nil && err == nil {
+					fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", res.Label(), res.Err)
+				}
+			}
+			if err == nil {
+				recordRun(started, list, results)
+			}
+			return list, results, err
+		}
+		collect := func() ([]idTech4_Server, error) {
+			list, _, err := poll()
+			return list, err
+		}
+
+		if browseCommand {
+			if err := RunBrowse(ctx, collect); err != nil {
+				fmt.Println(err)
+				os.Exit(exitCodeOf(err))
+			}
+			return
+		}
+
+		interval := watch
+		if serve != "" {
+			interval = refresh
+		}
+		schedule, err := NewPollSchedule(interval, jitter, startDelay, time.Now().UnixNano())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+
+		if serve != "" {
+			fmt.Fprintln(banner, "Serving the server list on", serve)
+			history := NewPlayerHistory(historySize, historyRetention, moveSimilarity)
+			if err := RunServe(ctx, serve, schedule, history, serveUI, collect); err != nil {
+				fmt.Println(err)
+				os.Exit(exitCodeOf(err))
+			}
+			return
+		}
+
+		if err := RunWatch(ctx, schedule, poll, os.Stdout, output == OutputJSON, moveSimilarity); err != nil {
+			fmt.Println(err)
+			os.Exit(exitCodeOf(err))
+		}
+		return
+	}
+
+	started := time.Now()
+	list, results, err := collectServers(ctx, masters, ports)
 	if err != nil {
 		fmt.Println(err)
+		if isConfirmError(err) {
+			os.Exit(exitNeedsConfirmation)
+		}
 		return
 	}
+	recordRun(started, list, results)
+
+	var meta *QueryMeta
+	if withMeta {
+		meta = newQueryMeta(started, gameProtocol, results, lan)
+	}
+
+	total := 0
+	var counts []string
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", res.Label(), res.Err)
+			continue
+		}
+		total += len(res.Servers)
+		counts = append(counts, fmt.Sprintf("%s: %d", res.Label(), len(res.Servers)))
+	}
+
+	if outFile != "" {
+		if err := writeOutputFile(outFile, appendOut, list, output, meta, csvOpts, time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot write the output file:", err)
+			os.Exit(3)
+		}
+	} else if err := writeOutput(os.Stdout, list, meta, csvOpts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if exportGame != "" {
+		path, cachePath, err := ExportServers(exportGame, mod, gameProtocol, exportPath, list, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot export the servers:", err)
+			os.Exit(3)
+		}
+		fmt.Fprintf(banner, "Exported %d servers to %s, run \"msquery master -cache %s\" and \"exec msquery_servers\" in game\n", len(list), path, cachePath)
+	}
+
+	if explain {
+		writeExplain(os.Stderr, list)
+	}
+
+	if demo {
+		fmt.Fprintln(banner, demoWatermark)
+	}
 
-	for a := range list {
+	if protocolAuto {
+		fmt.Fprintf(banner, "Merged %d servers from %d protocols (%s), %d unique.\n", total, len(autoProtocols), strings.Join(counts, ", "), len(list))
+	} else if len(masters) > 1 {
+		fmt.Fprintf(banner, "Merged %d servers from %d masters (%s), %d unique.\n", total, len(masters), strings.Join(counts, ", "), len(list))
+	}
 
-		sv := list[a]
-		fmt.Printf("%s:%d\n", sv.IP, sv.Port)
+	for _, warning := range RunExecHooks(list, execOpts) {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
 	}
 
-	fmt.Println("There are", len(list), "servers found.")
+}
+
+// collectServers - Gets the server list from the masters (or the LAN),
+// then queries the servers when needed and applies the filters.
+func collectServers(ctx context.Context, masters []string, ports []int) ([]idTech4_Server, []MasterResult, error) {
+
+	var list []idTech4_Server
+	var results []MasterResult
+	var err error
+
+	if lan {
+		if err := requireConfirmation(planLAN(ports)); err != nil {
+			return nil, nil, err
+		}
+		list, err = QueryLAN(ctx, ports, timeout)
+	} else {
+		req := MasterRequest{Protocol: gameProtocol, Mod: mod, Filter: masterFilter}
+		if protocolAuto {
+			list, results, err = QueryMasterSweep(ctx, masters, autoProtocols, req)
+		} else {
+			list, results, err = QueryMasterServers(ctx, masters, req)
+		}
+	}
+	if err != nil {
+		return nil, results, err
+	}
+
+	// Located from the master list alone, so that the servers out of the
+	// -region aren't queried at all.
+	if geoDB != nil {
+		LocateServers(list, geoDB)
+		list = FilterRegions(list, regions)
+	}
+	list = FilterFamily(list, ipFamily)
+
+	// The serve mode sweeps the servers details to keep their history.
+	sweep := (showPing || details || filter.Active() || fullStatus || serve != "" || firstResponders > 0) && !lan
+	if sweep {
+		if err := requireConfirmation(planDetailSweep(list, fullStatus)); err != nil {
+			return nil, results, err
+		}
+	}
+	if sweep && firstResponders > 0 {
+		list = QueryFirstResponders(ctx, list, firstResponders, filter)
+	} else if sweep {
+		QueryAllServerInfo(ctx, list)
+	}
+	if fullStatus {
+		QueryAllServerStatus(ctx, list)
+	}
+	list = FilterServers(list, filter)
+	if showPing || firstResponders > 0 {
+		SortByPing(list)
+	}
+	if firstResponders > 0 && len(list) > firstResponders {
+		list = list[:firstResponders]
+	}
+	if sortBy == "players" && !overview {
+		SortByPlayers(list)
+	}
+	if resolveNames || showPing || details || filter.Active() || fullStatus || firstResponders > 0 || lan {
+		ResolveNames(ctx, list, nameSources, annotations)
+	}
+	parseTelemetry.WarnDrift()
+
+	reachable := 0
+	for _, sv := range list {
+		if sv.Reachable() {
+			reachable++
+		}
+	}
+	stats.Gauge(StatServersKnown).Set(int64(len(list)))
+	stats.Gauge(StatServersReachable).Set(int64(reachable))
 
+	return list, results, nil
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// serversPacket - servers answer listing 10.0.0.1 on the given ports.
+func serversPacket(ports ...uint16) []byte {
+
+	data := []byte("\xff\xffservers\x00")
+	for _, p := range ports {
+		data = append(data, 10, 0, 0, 1, byte(p), byte(p>>8))
+	}
+	return data
+}
+
+func TestQueryMasterConn(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		responses [][]byte
+		ports     []uint16 // Expected servers
+		code      string   // Expected error code, "" for none
+	}{
+		{
+			name:      "single datagram",
+			responses: [][]byte{serversPacket(27666, 27667)},
+			ports:     []uint16{27666, 27667},
+		},
+		{
+			name:      "split over several datagrams",
+			responses: [][]byte{serversPacket(27666, 27667), serversPacket(27667, 27668), serversPacket(27669)},
+			ports:     []uint16{27666, 27667, 27668, 27669},
+		},
+		{
+			name:      "end of list marker",
+			responses: [][]byte{append(serversPacket(27666), "EOT\x00\x00\x00"...), serversPacket(27700)},
+			ports:     []uint16{27666},
+		},
+		{
+			name:      "empty list",
+			responses: [][]byte{serversPacket()},
+			ports:     []uint16{},
+		},
+		{
+			name:      "wrong header",
+			responses: [][]byte{[]byte("\xff\xffinfoResponse\x00\x01\x02\x03\x04")},
+			code:      CodeMalformed,
+		},
+		{
+			name:      "truncated command",
+			responses: [][]byte{[]byte("\xff\xffserv")},
+			code:      CodeMalformed,
+		},
+		{
+			name:      "truncated entry",
+			responses: [][]byte{append(serversPacket(27666), 10, 0, 0)},
+			ports:     []uint16{27666},
+		},
+		{
+			name:      "empty datagram",
+			responses: [][]byte{{}},
+			code:      CodeMalformed,
+		},
+		{
+			name:      "bad token",
+			responses: [][]byte{[]byte("\xff\xffprint\x00badToken\x00")},
+			code:      CodeBadToken,
+		},
+		{
+			name:      "asked to wait",
+			responses: [][]byte{[]byte("\xff\xffprint\x00please wait 10 seconds\x00")},
+			code:      CodeRefused,
+		},
+		{
+			name: "no answer",
+			code: CodeTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewReplayConn(tt.responses...)
+			opts := idtech4.QueryOptions{Protocol: 65577, Mod: "", Layout: layoutDoom3, Token: "secret"}
+
+			list, err := QueryMasterConn(context.Background(), conn, opts)
+
+			if tt.code != "" {
+				if code := ErrorCodeOf(err); code != tt.code {
+					t.Fatalf("error %v has code %q, want %q", err, code, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != len(tt.ports) {
+				t.Fatalf("got %d servers, want %d", len(list), len(tt.ports))
+			}
+			for i, p := range tt.ports {
+				if list[i].Port != p || list[i].IP.String() != "10.0.0.1" {
+					t.Errorf("server %d = %s, want 10.0.0.1:%d", i, list[i].Address(), p)
+				}
+			}
+
+			request, _ := idtech4.BuildGetServersFilter(65577, "", MasterFilter{}, "secret")
+			if len(conn.Written) != 1 || string(conn.Written[0]) != string(request) {
+				t.Errorf("sent %q, want %q", conn.Written, request)
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MasterRequest - What is asked to the masters.
+type MasterRequest struct {
+	Protocol Protocol
+	Mod      string       // Only list the servers running this mod
+	Filter   MasterFilter // Filtering done by the master itself
+}
+
+// MasterResult - Outcome of the query of a single master server.
+type MasterResult struct {
+	Master   string           `json:"master"`
+	Protocol string           `json:"protocol,omitempty"` // ID of the protocol asked, with -protocol auto
+	Servers  []idTech4_Server `json:"servers"`
+	Err      error            `json:"-"`
+}
+
+// Label - The master, and the protocol asked in a sweep, for the messages.
+func (res MasterResult) Label() string {
+
+	if res.Protocol == "" {
+		return res.Master
+	}
+
+	return res.Master + " (" + res.Protocol + ")"
+}
+
+// MarshalJSON - The error is written as {"code", "message"}.
+func (res MasterResult) MarshalJSON() ([]byte, error) {
+
+	type plain MasterResult
+	return json.Marshal(struct {
+		plain
+		Error *jsonError `json:"error,omitempty"`
+	}{plain(res), toJSONError(res.Err)})
+}
+
+// UnmarshalJSON - The error is read back as a *QueryError.
+func (res *MasterResult) UnmarshalJSON(data []byte) error {
+
+	type plain MasterResult
+	var v struct {
+		plain
+		Error *QueryError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*res = MasterResult(v.plain)
+	if v.Error != nil {
+		res.Err = v.Error
+	}
+	return nil
+}
+
+// splitHostMaybePort - Splits host[:port], IPv4/IPv6 literals and [IPv6]:port.
+// The port is empty when the address has none.
+func splitHostMaybePort(entry string) (string, string, error) {
+
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return "", "", errors.New("empty address")
+	}
+
+	host, p := entry, ""
+
+	if ip := net.ParseIP(entry); ip != nil {
+		// Bare IPv6 literal, its colons are not a port separator.
+		host = entry
+	} else if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		host = entry[1 : len(entry)-1]
+	} else if strings.Contains(entry, ":") {
+		var err error
+		host, p, err = net.SplitHostPort(entry)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid address %q: %s", entry, err)
+		}
+	}
+
+	if host == "" {
+		return "", "", fmt.Errorf("invalid address %q: missing host", entry)
+	}
+
+	return host, p, nil
+}
+
+// validPort - Checks a port given as a string.
+func validPort(p string) error {
+	if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", p)
+	}
+	return nil
+}
+
+// parseMasterAddress - Splits a master address into host and port.
+// A port embedded in the address overrides defaultPort.
+func parseMasterAddress(entry string, defaultPort string) (string, string, error) {
+
+	host, p, err := splitHostMaybePort(entry)
+	if err != nil {
+		return "", "", fmt.Errorf("master: %s", err)
+	}
+	if p == "" {
+		p = defaultPort
+	}
+	if err := validPort(p); err != nil {
+		return "", "", fmt.Errorf("master: %s", err)
+	}
+
+	return host, p, nil
+}
+
+// splitMasterList - Splits the -ip value into host:port pairs.
+// Entries without a port use defaultPort.
+func splitMasterList(value string, defaultPort string) ([]string, error) {
+
+	var masters []string
+
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		host, p, err := parseMasterAddress(entry, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+
+		masters = append(masters, net.JoinHostPort(host, p))
+	}
+
+	return masters, nil
+}
+
+// Address families selected with -4 and -6.
+const (
+	FamilyAny  = ""
+	FamilyIPv4 = "4"
+	FamilyIPv6 = "6"
+)
+
+// familyOf - FamilyIPv4 or FamilyIPv6.
+func familyOf(ip net.IP) string {
+
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+
+	return FamilyIPv6
+}
+
+// FilterFamily - Keeps the servers of the -4 or -6 address family.
+func FilterFamily(list []idTech4_Server, family string) []idTech4_Server {
+
+	if family == FamilyAny {
+		return list
+	}
+
+	kept := list[:0]
+	for _, sv := range list {
+		if familyOf(sv.IP) == family {
+			kept = append(kept, sv)
+		}
+	}
+
+	return kept
+}
+
+// resolveMaster - Builds the addresses to dial for a master, in the order they should be tried.
+// Literal IPs are used as is. Hostnames are resolved with IPv4 addresses first,
+// since most masters only speak IPv4, then the IPv6 ones. -4 and -6 keep
+// the addresses of their family only. The lookup is bounded by -timeout.
+func resolveMaster(ctx context.Context, host string, port string) ([]string, error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ipFamily != FamilyAny && familyOf(ip) != ipFamily {
+			return nil, newQueryError(CodeResolve, fmt.Sprintf("%s is not an IPv%s address", host, ipFamily), nil)
+		}
+		return []string{net.JoinHostPort(ip.String(), port)}, nil
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var ips []net.IP
+	var err error
+	if dnsCache != nil {
+		ips, err = dnsCache.LookupIP(ctx, host)
+	} else {
+		ips, err = lookupIP(ctx, host)
+	}
+	if err != nil {
+		return nil, newQueryError(CodeResolve, "unknown host "+host, err)
+	}
+	if ipFamily != FamilyAny {
+		var kept []net.IP
+		for _, ip := range ips {
+			if familyOf(ip) == ipFamily {
+				kept = append(kept, ip)
+			}
+		}
+		if len(kept) == 0 {
+			return nil, newQueryError(CodeResolve, fmt.Sprintf("%s has no IPv%s address", host, ipFamily), nil)
+		}
+		ips = kept
+	}
+
+	return orderMasterIPs(ips, port), nil
+}
+
+// orderMasterIPs - Puts IPv4 addresses before IPv6 ones, keeping the resolver order otherwise.
+func orderMasterIPs(ips []net.IP, port string) []string {
+
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(ip.String(), port))
+		} else {
+			v6 = append(v6, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	return append(v4, v6...)
+}
+
+// QueryMasterServers - Queries all the masters at once and merges their lists.
+// Duplicate servers (same IP:port) are only kept once, with every master
+// listing them in ListedBy. An error is only returned when no master answered.
+func QueryMasterServers(ctx context.Context, masters []string, req MasterRequest) ([]idTech4_Server, []MasterResult, error) {
+
+	if len(masters) == 0 {
+		return nil, nil, errors.New("no master server given")
+	}
+
+	results := make([]MasterResult, len(masters))
+
+	var wg sync.WaitGroup
+	for i, master := range masters {
+		wg.Add(1)
+		go func(i int, master string) {
+			defer wg.Done()
+
+			host, p, _ := net.SplitHostPort(master)
+			list, err := QueryMasterServer(ctx, host, p, req)
+			results[i] = MasterResult{Master: master, Servers: list, Err: err}
+		}(i, master)
+	}
+	wg.Wait()
+
+	var list []idTech4_Server
+	var errs []string
+	seen := make(map[string]int) // Index in list
+	code := ""
+	var wait time.Duration
+
+	for _, res := range results {
+		if res.Err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", res.Master, res.Err))
+			if c := ErrorCodeOf(res.Err); code == "" || code == c {
+				code = c
+			} else {
+				code = CodeUnknown
+			}
+			if w := RetryAfterOf(res.Err); w > wait {
+				wait = w
+			}
+			continue
+		}
+
+		for _, sv := range res.Servers {
+			if i, ok := seen[sv.Address()]; ok {
+				list[i].ListedBy = append(list[i].ListedBy, res.Master)
+				continue
+			}
+			seen[sv.Address()] = len(list)
+			sv.ListedBy = []string{res.Master}
+			list = append(list, sv)
+		}
+	}
+
+	if len(errs) == len(results) {
+		// Keep the code shared by every failure, and the longest wait asked
+		return nil, results, &QueryError{Code: code, Msg: strings.Join(errs, "; "), RetryAfter: wait}
+	}
+
+	return list, results, nil
+}
+
+// QueryMasterSweep - Asks the masters for the servers of each protocol in
+// turn and merges the lists. Every server is tagged with the protocols it
+// was listed under. An error is only returned when no protocol got an answer.
+func QueryMasterSweep(ctx context.Context, masters []string, protos []Protocol, req MasterRequest) ([]idTech4_Server, []MasterResult, error) {
+
+	var list []idTech4_Server
+	var results []MasterResult
+	var lastErr error
+	answered := false
+	seen := make(map[string]int) // Index in list
+
+	for _, proto := range protos {
+		if ctx.Err() != nil {
+			break
+		}
+		req.Protocol = proto
+		servers, protoResults, err := QueryMasterServers(ctx, masters, req)
+		for i := range protoResults {
+			protoResults[i].Protocol = proto.ID
+		}
+		results = append(results, protoResults...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answered = true
+		logInfo("protocol swept", "protocol", proto.ID, "servers", len(servers))
+
+		for _, sv := range servers {
+			i, ok := seen[sv.Address()]
+			if !ok {
+				seen[sv.Address()] = len(list)
+				sv.Protocols = []string{proto.ID}
+				list = append(list, sv)
+				continue
+			}
+			list[i].Protocols = append(list[i].Protocols, proto.ID)
+			for _, master := range sv.ListedBy {
+				if !containsString(list[i].ListedBy, master) {
+					list[i].ListedBy = append(list[i].ListedBy, master)
+				}
+			}
+		}
+	}
+
+	if !answered {
+		return nil, results, lastErr
+	}
+
+	return list, results, nil
+}
+
+// containsString - Tells if the list holds the string.
+func containsString(list []string, s string) bool {
+
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DNSCache - Remembers the resolved masters, for runs querying the same masters many times.
+// Concurrent lookups of a host wait for the first one.
+type DNSCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+// dnsEntry - Lookup of a host, done once resolved is closed.
+type dnsEntry struct {
+	resolved chan struct{}
+	ips      []net.IP
+	err      error
+}
+
+// lookupIP resolves the master hostnames, it can be swapped like dialServer.
+var lookupIP = resolverLookupIP
+
+// resolverLookupIP - IP addresses of a host, from the default resolver.
+func resolverLookupIP(ctx context.Context, host string) ([]net.IP, error) {
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// dnsCache is used by resolveMaster when set.
+var dnsCache *DNSCache
+
+func NewDNSCache() *DNSCache {
+	return &DNSCache{entries: make(map[string]*dnsEntry)}
+}
+
+// LookupIP - lookupIP, answering from the cache when possible.
+// Failures are not cached.
+func (c *DNSCache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok {
+		c.mu.Unlock()
+		select {
+		case <-e.resolved:
+			return e.ips, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	e = &dnsEntry{resolved: make(chan struct{})}
+	c.entries[host] = e
+	c.mu.Unlock()
+
+	e.ips, e.err = lookupIP(ctx, host)
+	if e.err != nil {
+		c.mu.Lock()
+		delete(c.entries, host)
+		c.mu.Unlock()
+	}
+	close(e.resolved)
+
+	return e.ips, e.err
+}
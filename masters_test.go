@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLookup - Swaps lookupIP for a table of hosts, counting the lookups.
+func fakeLookup(t *testing.T, hosts map[string][]string) *int32 {
+
+	savedLookup, savedCache, savedFamily := lookupIP, dnsCache, ipFamily
+	t.Cleanup(func() { lookupIP, dnsCache, ipFamily = savedLookup, savedCache, savedFamily })
+
+	var calls int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&calls, 1)
+		addrs, ok := hosts[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		var ips []net.IP
+		for _, a := range addrs {
+			ips = append(ips, net.ParseIP(a))
+		}
+		return ips, nil
+	}
+	dnsCache = nil
+
+	return &calls
+}
+
+func TestOrderMasterIPs(t *testing.T) {
+
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("::ffff:192.0.2.2"), // IPv4-mapped, still IPv4
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.3").To4(),
+	}
+
+	got := orderMasterIPs(ips, "27650")
+	want := []string{"192.0.2.1:27650", "192.0.2.2:27650", "192.0.2.3:27650", "[2001:db8::1]:27650", "[2001:db8::2]:27650"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	if got := orderMasterIPs(nil, "27650"); len(got) != 0 {
+		t.Errorf("no IP gave %v", got)
+	}
+}
+
+func TestResolveMaster(t *testing.T) {
+
+	fakeLookup(t, map[string][]string{
+		"dual.example":   {"2001:db8::1", "192.0.2.1"},
+		"v4only.example": {"192.0.2.9"},
+		"v6only.example": {"2001:db8::9"},
+	})
+
+	tests := []struct {
+		host   string
+		family string
+		want   []string
+		err    bool
+	}{
+		{"dual.example", FamilyAny, []string{"192.0.2.1:27650", "[2001:db8::1]:27650"}, false},
+		{"dual.example", FamilyIPv4, []string{"192.0.2.1:27650"}, false},
+		{"dual.example", FamilyIPv6, []string{"[2001:db8::1]:27650"}, false},
+		{"v4only.example", FamilyIPv6, nil, true},
+		{"v6only.example", FamilyIPv4, nil, true},
+		{"missing.example", FamilyAny, nil, true},
+		{"192.0.2.5", FamilyAny, []string{"192.0.2.5:27650"}, false},
+		{"192.0.2.5", FamilyIPv6, nil, true},
+		{"2001:db8::5", FamilyAny, []string{"[2001:db8::5]:27650"}, false},
+		{"2001:db8::5", FamilyIPv4, nil, true},
+	}
+
+	for _, tt := range tests {
+		ipFamily = tt.family
+		got, err := resolveMaster(context.Background(), tt.host, "27650")
+		if tt.err {
+			if err == nil || ErrorCodeOf(err) != CodeResolve {
+				t.Errorf("%s (%q): %v, %v, want a resolve error", tt.host, tt.family, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s (%q): %v, %v, want %v", tt.host, tt.family, got, err, tt.want)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+
+	calls := fakeLookup(t, map[string][]string{"master.example": {"192.0.2.1"}})
+
+	// A slow lookup shared by concurrent resolutions.
+	release := make(chan struct{})
+	fast := lookupIP
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		<-release
+		return fast(ctx, host)
+	}
+	dnsCache = NewDNSCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := resolveMaster(context.Background(), "master.example", "27650"); err != nil || len(got) != 1 {
+				t.Errorf("%v, %v", got, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("%d lookups for concurrent resolutions, want 1", n)
+	}
+
+	// Failures are looked up again.
+	for i := 0; i < 2; i++ {
+		_, err := resolveMaster(context.Background(), "missing.example", "27650")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) {
+			t.Errorf("%v, want the resolver error", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Errorf("%d lookups, want a new one for each failure", n)
+	}
+}
+
+func TestResolveMasterContext(t *testing.T) {
+
+	fakeLookup(t, nil)
+	savedTimeout := timeout
+	t.Cleanup(func() { timeout = savedTimeout })
+
+	// A resolver answering only when its context is done
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host}
+	}
+
+	timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := resolveMaster(context.Background(), "slow.example", "27650"); err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("-timeout not applied to the lookup: %v after %s", err, time.Since(start))
+	}
+
+	timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := resolveMaster(ctx, "slow.example", "27650"); err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("cancellation not applied to the lookup: %v after %s", err, time.Since(start))
+	}
+
+	// Waiting for the lookup of another resolution stops with the context too
+	dnsCache = NewDNSCache()
+	first, cancelFirst := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		resolveMaster(first, "slow.example", "27650")
+		close(done)
+	}()
+	defer func() {
+		cancelFirst()
+		<-done
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := dnsCache.LookupIP(ctx, "slow.example"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting for a pending lookup: %v", err)
+	}
+}
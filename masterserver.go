@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// How long a server stays listed after its last heartbeat.
+// The games send one every few minutes.
+const defaultMasterTTL = 6 * time.Minute
+
+// How long a heartbeat waits for the infoResponse of the server.
+const heartbeatChallengeTTL = 10 * time.Second
+
+// Most heartbeats waiting for their infoResponse, so a flood of fake
+// heartbeats can't grow the master without bound.
+const maxPendingHeartbeats = 4096
+
+// Largest payload of a servers answer datagram, EOT included: with the IP
+// and UDP headers, it stays under the 1500 bytes of the usual MTU. The
+// servers per datagram depend on the size of the entries of the layout.
+const masterDatagramPayload = 1400
+
+// End-of-list marker closing the last datagram of a servers answer.
+const masterEOT = "EOT"
+
+// How often "msquery master" checks whether the -cache file changed.
+const cacheReloadInterval = 5 * time.Second
+
+// registeredServer - Game server listed by the emulated master.
+type registeredServer struct {
+	IP         net.IP
+	Port       uint16
+	Protocol   uint32
+	Mod        string
+	Players    int
+	MaxPlayers int
+	Password   bool
+	LastSeen   time.Time
+	Cached     bool // From the -cache file: never expires, players unknown
+}
+
+// pendingHeartbeat - getInfo sent to a server after its heartbeat.
+type pendingHeartbeat struct {
+	challenge uint32
+	sent      time.Time
+}
+
+// MasterServer - Emulated idTech4 master. A heartbeat makes it send getInfo
+// to the server, whose answer registers it for TTL; getServers lists the
+// registered servers of the requested protocol and mod.
+type MasterServer struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	servers map[string]*registeredServer // By ip:port
+	pending map[string]pendingHeartbeat  // By ip:port
+	cached  []*registeredServer          // Of the -cache file
+}
+
+// NewMasterServer - Emulated master without any server.
+func NewMasterServer(ttl time.Duration) *MasterServer {
+	return &MasterServer{
+		TTL:     ttl,
+		servers: make(map[string]*registeredServer),
+		pending: make(map[string]pendingHeartbeat),
+	}
+}
+
+// Handle - Processes a datagram received from addr and returns the
+// datagrams to send back to it.
+func (ms *MasterServer) Handle(from *net.UDPAddr, data []byte, now time.Time) [][]byte {
+
+	a := idtech4.NewAnswer(data)
+	if header, err := a.ReadShort(); err != nil || header != 0xffff {
+		return nil
+	}
+	command, err := a.ReadString()
+	if err != nil {
+		return nil
+	}
+
+	switch command {
+	case "heartbeat":
+		return ms.heartbeat(from, now)
+	case "infoResponse":
+		ms.register(from, data, now)
+	case "getServers":
+		return ms.getServers(from, a, now, false)
+	case idtech4.CommandGetServersExt:
+		return ms.getServers(from, a, now, true)
+	default:
+		logVerbose("%s: ignoring %q", from, command)
+	}
+
+	return nil
+}
+
+// heartbeat - Asks the server for its info, to check it is a game server
+// answering on that address.
+func (ms *MasterServer) heartbeat(from *net.UDPAddr, now time.Time) [][]byte {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	addr := from.String()
+	if _, ok := ms.pending[addr]; !ok && len(ms.pending) >= maxPendingHeartbeats {
+		logVerbose("%s: heartbeat dropped, too many pending", addr)
+		return nil
+	}
+
+	challenge := rand.Uint32()
+	ms.pending[addr] = pendingHeartbeat{challenge: challenge, sent: now}
+	logVerbose("%s: heartbeat", addr)
+
+	var pkt QuakePacket
+	pkt.PreparePacket()
+	pkt.WriteString("getInfo")
+	pkt.WriteLong(challenge)
+
+	return [][]byte{pkt.ExportToBytes()}
+}
+
+// register - Lists the server answering the getInfo of its heartbeat.
+func (ms *MasterServer) register(from *net.UDPAddr, data []byte, now time.Time) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	addr := from.String()
+	hb, ok := ms.pending[addr]
+	if !ok {
+		return
+	}
+
+	info, err := ParseInfoResponse(data, hb.challenge)
+	if err != nil || info.Challenge != hb.challenge {
+		logVerbose("%s: infoResponse rejected", addr)
+		return
+	}
+	delete(ms.pending, addr)
+
+	ip := from.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if info.Protocol == 0 {
+		logVerbose("%s: not listed, servers sending their protocol only", addr)
+		return
+	}
+
+	sv, known := ms.servers[addr]
+	if !known {
+		sv = &registeredServer{IP: ip, Port: uint16(from.Port)}
+		ms.servers[addr] = sv
+		logVerbose("%s: listed, protocol %d.%d", addr, info.Protocol>>16, info.Protocol&0xffff)
+	}
+	sv.Protocol = info.Protocol
+	sv.Mod = info.Mod
+	sv.Players = info.Players
+	sv.MaxPlayers = info.MaxPlayers
+	sv.Password = info.Rules["si_usePass"] == "1"
+	sv.LastSeen = now
+}
+
+// matches - Tells if the server is listed for a getServers request.
+// The game type filter is an index in the list of the client, which the
+// master can't map to a game type, so it is ignored. So are the password
+// and players filters for the cached servers, which the master never heard from.
+func (sv *registeredServer) matches(version uint32, mod string, filter MasterFilter) bool {
+
+	if sv.Protocol != version {
+		return false
+	}
+	if mod != "" && !strings.EqualFold(sv.Mod, mod) {
+		return false
+	}
+	if sv.Cached {
+		return true
+	}
+
+	switch filter.Password {
+	case idtech4.PasswordNone:
+		if sv.Password {
+			return false
+		}
+	case idtech4.PasswordOnly:
+		if !sv.Password {
+			return false
+		}
+	}
+
+	empty := sv.Players == 0
+	full := sv.MaxPlayers > 0 && sv.Players >= sv.MaxPlayers
+	switch filter.Players {
+	case idtech4.PlayersNotEmpty:
+		return !empty
+	case idtech4.PlayersNotFull:
+		return !full
+	case idtech4.PlayersSome:
+		return !empty && !full
+	}
+
+	return true
+}
+
+// getServers - servers answer to a client, split in several datagrams
+// when the list is long. The extended answer, to getServersExt, lists the
+// IPv6 servers too; the plain one only has room for IPv4 addresses.
+func (ms *MasterServer) getServers(from *net.UDPAddr, a *QuakeAnswer, now time.Time, extended bool) [][]byte {
+
+	version, err := a.ReadLong()
+	if err != nil {
+		return nil
+	}
+	mod, _ := a.ReadString()
+
+	// Older clients may stop before the filter bytes.
+	var filter MasterFilter
+	filter.Password, _ = a.ReadByte()
+	filter.Players, _ = a.ReadByte()
+	filter.GameType, _ = a.ReadByte()
+
+	layout := layoutDoom3
+	if version>>16 == etqwProtocolMajor {
+		layout = layoutETQW
+	}
+
+	ms.mu.Lock()
+	var entries [][]byte
+	listed := make(map[string]bool)
+	for addr, sv := range ms.servers {
+		if now.Sub(sv.LastSeen) > ms.TTL || !sv.matches(version, mod, filter) {
+			continue
+		}
+		listed[addr] = true
+		if extended {
+			entries = append(entries, encodeExtServerEntry(sv.IP, sv.Port, layout))
+		} else if sv.IP.To4() != nil {
+			entries = append(entries, encodeServerEntry(sv.IP, sv.Port, layout))
+		}
+	}
+	// A cached server sending heartbeats is listed once
+	for _, sv := range ms.cached {
+		addr := net.JoinHostPort(sv.IP.String(), strconv.Itoa(int(sv.Port)))
+		if listed[addr] || !sv.matches(version, mod, filter) {
+			continue
+		}
+		listed[addr] = true
+		if extended {
+			entries = append(entries, encodeExtServerEntry(sv.IP, sv.Port, layout))
+		} else if sv.IP.To4() != nil {
+			entries = append(entries, encodeServerEntry(sv.IP, sv.Port, layout))
+		}
+	}
+	ms.mu.Unlock()
+
+	command, answer := "getServers", "servers"
+	if extended {
+		command, answer = idtech4.CommandGetServersExt, idtech4.CommandServersExt
+	}
+	logVerbose("%s: %s %d.%d %q, %d servers", from, command, version>>16, version&0xffff, mod, len(entries))
+
+	var header QuakePacket
+	header.PreparePacket()
+	header.WriteString(answer)
+	room := masterDatagramPayload - len(header.ExportToBytes()) - len(masterEOT)
+
+	var datagrams [][]byte
+	for start := 0; ; {
+		end, size := start, 0
+		for end < len(entries) && size+len(entries[end]) <= room {
+			size += len(entries[end])
+			end++
+		}
+
+		var pkt QuakePacket
+		pkt.PreparePacket()
+		pkt.WriteString(answer)
+		for _, entry := range entries[start:end] {
+			pkt.WriteBytes(entry)
+		}
+		last := end == len(entries)
+		if last {
+			pkt.WriteBytes([]byte(masterEOT))
+		}
+		datagrams = append(datagrams, pkt.ExportToBytes())
+		if last {
+			break
+		}
+		start = end
+	}
+
+	return datagrams
+}
+
+// encodeServerEntry - Entry of a servers answer, in the layout of the game.
+func encodeServerEntry(ip net.IP, port uint16, layout EntryLayout) []byte {
+
+	entry := make([]byte, layout.Size())
+	copy(entry, ip.To4())
+	if layout.PortBigEndian {
+		binary.BigEndian.PutUint16(entry[4:], port)
+	} else {
+		binary.LittleEndian.PutUint16(entry[4:], port)
+	}
+
+	return entry
+}
+
+// encodeExtServerEntry - Entry of a serversExt answer: the family marker,
+// then the address and the port as in the layout of the game.
+func encodeExtServerEntry(ip net.IP, port uint16, layout EntryLayout) []byte {
+
+	marker, addr := idtech4.ExtMarkerIPv4, ip.To4()
+	if addr == nil {
+		marker, addr = idtech4.ExtMarkerIPv6, ip.To16()
+	}
+
+	entry := make([]byte, 1+len(addr)+2+layout.FlagBytes)
+	entry[0] = marker
+	copy(entry[1:], addr)
+	if layout.PortBigEndian {
+		binary.BigEndian.PutUint16(entry[1+len(addr):], port)
+	} else {
+		binary.LittleEndian.PutUint16(entry[1+len(addr):], port)
+	}
+
+	return entry
+}
+
+// Expire - Forgets the servers without heartbeat for TTL, and the
+// heartbeats whose server never answered.
+func (ms *MasterServer) Expire(now time.Time) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for addr, sv := range ms.servers {
+		if now.Sub(sv.LastSeen) > ms.TTL {
+			delete(ms.servers, addr)
+			logVerbose("%s: expired", addr)
+		}
+	}
+	for addr, hb := range ms.pending {
+		if now.Sub(hb.sent) > heartbeatChallengeTTL {
+			delete(ms.pending, addr)
+		}
+	}
+}
+
+// Count - Number of listed servers, the cached ones included.
+func (ms *MasterServer) Count() int {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return len(ms.servers) + len(ms.cached)
+}
+
+// SetCache - Replaces the cached servers, listed besides the ones sending heartbeats.
+func (ms *MasterServer) SetCache(servers []*registeredServer) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.cached = servers
+}
+
+// loadServerCache - Reads the server cache written by -export: one
+// "address protocol [mod]" line per server and protocol, // comments.
+func loadServerCache(path string) ([]*registeredServer, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []*registeredServer
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"address protocol [mod]\"", path, i+1)
+		}
+		host, p, err := net.SplitHostPort(fields[0])
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || validPort(p) != nil {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", path, i+1, fields[0])
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port, _ := strconv.Atoi(p)
+		version, err := parseRawProtocol(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+
+		sv := &registeredServer{IP: ip, Port: uint16(port), Protocol: version, Cached: true}
+		if len(fields) == 3 {
+			sv.Mod = fields[2]
+		}
+		servers = append(servers, sv)
+	}
+
+	return servers, nil
+}
+
+// serverCacheFile - -cache file, loaded again when it changes.
+type serverCacheFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// reload - Loads the file into the master when it changed since the last
+// load. A file being rewritten, or broken, keeps the previous servers.
+func (c *serverCacheFile) reload(ms *MasterServer) error {
+
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(c.modTime) && fi.Size() == c.size {
+		return nil
+	}
+
+	servers, err := loadServerCache(c.path)
+	if err != nil {
+		return err
+	}
+	c.modTime, c.size = fi.ModTime(), fi.Size()
+	ms.SetCache(servers)
+	logVerbose("%s: %d cached servers loaded", c.path, len(servers))
+
+	return nil
+}
+
+// runMasterCommand - "master" subcommand: runs an emulated master until interrupted.
+func runMasterCommand(args []string) int {
+
+	fs := flag.NewFlagSet("master", flag.ExitOnError)
+	listen := fs.String("listen", ":27650", "UDP address to listen on.")
+	ttl := fs.Duration("ttl", defaultMasterTTL, "How long a server stays listed after its last heartbeat.")
+	cachePath := fs.String("cache", "", "Also list the servers of this cache, written by -export, without expiry. It is loaded again when it changes.")
+	fs.BoolVar(&verbose, "v", false, "Log every packet.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s master [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if rest, _ := parseInterleaved(fs, args); len(rest) > 0 {
+		fs.Usage()
+		return 2
+	}
+	if *ttl <= 0 {
+		fmt.Fprintln(os.Stderr, "-ttl must be positive")
+		return 2
+	}
+
+	var cache *serverCacheFile
+	ms := NewMasterServer(*ttl)
+	if *cachePath != "" {
+		cache = &serverCacheFile{path: *cachePath}
+		if err := cache.reload(ms); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if cache != nil {
+		go func() {
+			ticker := time.NewTicker(cacheReloadInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := cache.reload(ms); err != nil {
+					logVerbose("%s, keeping the cached servers", err)
+				}
+			}
+		}()
+	}
+
+	fmt.Fprintln(os.Stderr, "Master listening on", conn.LocalAddr())
+
+	buffer := make([]byte, idtech4.MaxDatagram)
+	lastExpire := time.Now()
+	for {
+		n, from, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Fprintf(os.Stderr, "Master stopped, %d servers listed\n", ms.Count())
+				return 0
+			}
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		now := time.Now()
+		if now.Sub(lastExpire) > time.Second {
+			ms.Expire(now)
+			lastExpire = now
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		for _, reply := range ms.Handle(udpAddr, buffer[:n], now) {
+			if _, err := conn.WriteTo(reply, from); err != nil {
+				logVerbose("%s: %s", from, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+func TestMasterServersDatagrams(t *testing.T) {
+
+	const doom3, etqw = 1<<16 + 41, etqwProtocolMajor<<16 + 10
+
+	tests := []struct {
+		name      string
+		version   uint32
+		layout    EntryLayout
+		extended  bool
+		servers   int
+		datagrams int
+	}{
+		{"empty", doom3, layoutDoom3, false, 0, 1},
+		{"one datagram", doom3, layoutDoom3, false, 10, 1},
+		{"doom3", doom3, layoutDoom3, false, 600, 3},
+		{"etqw", etqw, layoutETQW, false, 600, 4},
+		{"ext", doom3, layoutDoom3, true, 600, 6},
+	}
+
+	for _, tt := range tests {
+		var cached []*registeredServer
+		for i := 0; i < tt.servers; i++ {
+			ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+			if tt.extended && i%2 == 1 {
+				ip = net.ParseIP("2001:db8::1")
+				ip[14], ip[15] = byte(i>>8), byte(i)
+			}
+			cached = append(cached, &registeredServer{IP: ip, Port: 27666, Protocol: tt.version, Cached: true})
+		}
+		ms := NewMasterServer(time.Minute)
+		ms.SetCache(cached)
+
+		request, _ := idtech4.BuildGetServersFilter(tt.version, "", MasterFilter{}, "")
+		if tt.extended {
+			request, _ = idtech4.BuildGetServersExt(tt.version, "", MasterFilter{}, "")
+		}
+		datagrams := ms.Handle(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 50), Port: 40000}, request, time.Now())
+		if len(datagrams) != tt.datagrams {
+			t.Errorf("%s: %d datagrams, want %d", tt.name, len(datagrams), tt.datagrams)
+		}
+
+		listed := make(map[string]bool)
+		for i, datagram := range datagrams {
+			if len(datagram) > masterDatagramPayload {
+				t.Errorf("%s: datagram %d of %d bytes", tt.name, i, len(datagram))
+			}
+			answer, err := idtech4.ParseServers(datagram, tt.layout)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			// Only the last datagram ends the list
+			if last := i == len(datagrams)-1; answer.Last != last || last && answer.Trailer != len(masterEOT) {
+				t.Errorf("%s: datagram %d ends the list: %v, trailer %d", tt.name, i, answer.Last, answer.Trailer)
+			}
+			if !recordsConsistent(DatagramStats{Size: len(datagram), Header: answer.Header, EntryBytes: entryBytes(answer, tt.layout), Trailer: answer.Trailer}) {
+				t.Errorf("%s: datagram %d isn't made of whole entries", tt.name, i)
+			}
+			for _, sv := range answer.Servers {
+				listed[sv.String()] = true
+			}
+		}
+		if len(listed) != tt.servers {
+			t.Errorf("%s: %d servers listed, want %d", tt.name, len(listed), tt.servers)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of a server seen from a vantage point.
+const (
+	ReachOK     = "ok"     // Answered getInfo
+	ReachDown   = "down"   // Listed, but didn't answer getInfo
+	ReachListed = "listed" // Listed, the vantage point didn't query the details
+	ReachAbsent = "-"      // Not in the list of the vantage point
+)
+
+// VantageResult - Server list uploaded by one vantage point.
+type VantageResult struct {
+	Vantage string
+	Servers []jsonServer
+}
+
+// parseResultFile - Reads a -output json result: an array of servers, or the
+// NDJSON records of -append, in which case the last record is used.
+func parseResultFile(data []byte) ([]jsonServer, error) {
+
+	var servers []jsonServer
+	if err := json.Unmarshal(data, &servers); err == nil {
+		return servers, nil
+	}
+
+	// Written with -meta
+	var result jsonResult
+	if err := json.Unmarshal(data, &result); err == nil && result.Servers != nil {
+		return result.Servers, nil
+	}
+
+	var last *struct {
+		Servers []jsonServer `json:"servers"`
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record struct {
+			Servers []jsonServer `json:"servers"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, errors.New("not a json result: expected a server array or NDJSON records")
+		}
+		last = &record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, errors.New("empty result")
+	}
+
+	return last.Servers, nil
+}
+
+// MatrixRow - Reachability of a server from every vantage point.
+type MatrixRow struct {
+	Server  string            `json:"server"`
+	Name    string            `json:"name,omitempty"`
+	States  map[string]string `json:"states"` // By vantage point
+	Partial bool              `json:"partial"`
+}
+
+// MatrixReport - Reachability of every server from every vantage point.
+type MatrixReport struct {
+	Vantages []string    `json:"vantages"`
+	Rows     []MatrixRow `json:"rows"`
+	Partial  int         `json:"partial"` // Servers only reachable from some vantage points
+}
+
+// BuildMatrix - Merges the results of the vantage points.
+// A server is partial when it answered getInfo from some vantage points but
+// was down or missing from others. Vantage points which didn't query the
+// details can't tell, so they are left out of that decision.
+func BuildMatrix(results []VantageResult) MatrixReport {
+
+	var report MatrixReport
+	rows := make(map[string]*MatrixRow)
+
+	for _, res := range results {
+		report.Vantages = append(report.Vantages, res.Vantage)
+
+		detailed := false
+		for _, sv := range res.Servers {
+			if sv.Info != nil {
+				detailed = true
+				break
+			}
+		}
+
+		for _, sv := range res.Servers {
+			addr := jsonServerAddress(sv)
+			row, ok := rows[addr]
+			if !ok {
+				row = &MatrixRow{Server: addr, States: make(map[string]string)}
+				rows[addr] = row
+			}
+
+			switch {
+			case sv.Info != nil:
+				row.States[res.Vantage] = ReachOK
+				if row.Name == "" {
+					row.Name = stripColors(sv.Info.Hostname)
+				}
+			case detailed:
+				row.States[res.Vantage] = ReachDown
+			default:
+				row.States[res.Vantage] = ReachListed
+			}
+		}
+	}
+
+	for _, row := range rows {
+		ok, failed := 0, 0
+		for _, res := range results {
+			state, seen := row.States[res.Vantage]
+			if !seen {
+				state = ReachAbsent
+				row.States[res.Vantage] = state
+			}
+			switch state {
+			case ReachOK:
+				ok++
+			case ReachDown, ReachAbsent:
+				failed++
+			}
+		}
+		row.Partial = ok > 0 && failed > 0
+		if row.Partial {
+			report.Partial++
+		}
+		report.Rows = append(report.Rows, *row)
+	}
+
+	sort.Slice(report.Rows, func(i, j int) bool {
+		a, b := report.Rows[i], report.Rows[j]
+		if a.Partial != b.Partial {
+			return a.Partial
+		}
+		return a.Server < b.Server
+	})
+
+	return report
+}
+
+func jsonServerAddress(sv jsonServer) string {
+	return sv.IP + ":" + strconv.Itoa(int(sv.Port))
+}
+
+// writeMatrix - Writes the report as a table, or as JSON.
+func writeMatrix(w io.Writer, report MatrixReport, jsonOut bool) error {
+
+	if jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	header := append([]string{"SERVER", "NAME"}, report.Vantages...)
+	header = append(header, "FLAG")
+
+	var table [][]string
+	for _, row := range report.Rows {
+		line := []string{row.Server, row.Name}
+		for _, v := range report.Vantages {
+			line = append(line, row.States[v])
+		}
+		flagText := ""
+		if row.Partial {
+			flagText = "PARTIAL"
+		}
+		table = append(table, append(line, flagText))
+	}
+
+	if err := writeTable(w, header, table); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d servers, %d only reachable from some vantage points.\n", len(report.Rows), report.Partial)
+	return err
+}
+
+// Valid vantage point names, also used as file names in the drop directory.
+var vantageNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// LoadTrustedKeys - Reads "vantage base64-ed25519-public-key" lines.
+func LoadTrustedKeys(path string) (map[string]ed25519.PublicKey, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]ed25519.PublicKey)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"vantage public-key\"", path, i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid ed25519 public key", path, i+1)
+		}
+		keys[fields[0]] = ed25519.PublicKey(key)
+	}
+
+	return keys, nil
+}
+
+// verifyResult - Checks the base64 ed25519 signature of a result against
+// the key of its vantage point. Without trusted keys nothing can be verified,
+// and every result is refused.
+func verifyResult(keys map[string]ed25519.PublicKey, vantage string, data []byte, signature string) error {
+
+	if keys == nil {
+		return errors.New("no trusted keys, unsigned results are refused")
+	}
+	if strings.TrimSpace(signature) == "" {
+		return fmt.Errorf("result of vantage point %q isn't signed", vantage)
+	}
+
+	key, ok := keys[vantage]
+	if !ok {
+		return fmt.Errorf("no trusted key for vantage point %q", vantage)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("invalid signature for vantage point %q", vantage)
+	}
+
+	return nil
+}
+
+// loadVantageFile - Result file of a vantage point, named after the file.
+// Its signature is read from the file with a .sig suffix.
+func loadVantageFile(path string, keys map[string]ed25519.PublicKey) (VantageResult, error) {
+
+	vantage := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return VantageResult{}, err
+	}
+
+	if keys != nil {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return VantageResult{}, fmt.Errorf("%s: missing signature: %s", path, err)
+		}
+		if err := verifyResult(keys, vantage, data, string(sig)); err != nil {
+			return VantageResult{}, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	servers, err := parseResultFile(data)
+	if err != nil {
+		return VantageResult{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return VantageResult{Vantage: vantage, Servers: servers}, nil
+}
+
+// loadVantages - Results of the given files, and of the .json files of the given directories.
+func loadVantages(paths []string, keys map[string]ed25519.PublicKey) ([]VantageResult, error) {
+
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+
+	var results []VantageResult
+	seen := make(map[string]bool)
+	for _, f := range files {
+		res, err := loadVantageFile(f, keys)
+		if err != nil {
+			return nil, err
+		}
+		if seen[res.Vantage] {
+			return nil, fmt.Errorf("%s: vantage point %q given twice", f, res.Vantage)
+		}
+		seen[res.Vantage] = true
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// GenerateVantageKey - Writes a new ed25519 private key to path, readable by
+// its owner only, and returns the base64 public key for the -keys file.
+func GenerateVantageKey(path string) (string, error) {
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv)); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// LoadSigningKey - Reads a private key written by GenerateVantageKey.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s: invalid ed25519 private key", path)
+	}
+
+	return ed25519.PrivateKey(key), nil
+}
+
+// signResultFile - Writes the base64 signature of a result next to it, in
+// the .sig file the coordinator and loadVantageFile read.
+func signResultFile(key ed25519.PrivateKey, path string) error {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return writeFileAtomic(path+".sig", []byte(sig+"\n"), 0644)
+}
+
+// matrixCoordinator - HTTP endpoint receiving the results into the drop directory.
+type matrixCoordinator struct {
+	dir  string
+	keys map[string]ed25519.PublicKey
+}
+
+// Largest result accepted by the coordinator.
+const maxUploadSize = 32 << 20
+
+func (mc *matrixCoordinator) Handler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload/", mc.handleUpload)
+	mux.HandleFunc("/matrix", mc.handleMatrix)
+
+	return mux
+}
+
+// handleUpload - PUT or POST /upload/{vantage}, with the result as body and
+// its signature in the X-Signature header.
+func (mc *matrixCoordinator) handleUpload(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vantage := strings.TrimPrefix(r.URL.Path, "/upload/")
+	if !vantageNamePattern.MatchString(vantage) {
+		http.Error(w, "invalid vantage point name", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxUploadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxUploadSize {
+		http.Error(w, "result too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	signature := r.Header.Get("X-Signature")
+	if err := verifyResult(mc.keys, vantage, data, signature); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := parseResultFile(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(mc.dir, vantage+".json")
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeFileAtomic(path+".sig", []byte(signature), 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logVerbose("matrix: received %d bytes from %s", len(data), vantage)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMatrix - GET /matrix, the report of the drop directory.
+func (mc *matrixCoordinator) handleMatrix(w http.ResponseWriter, r *http.Request) {
+
+	results, err := loadVantages([]string{mc.dir}, mc.keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeMatrix(w, BuildMatrix(results), true)
+}
+
+// runMatrixCommand - "matrix [flags] <file|dir>...": prints the reachability
+// matrix of result files, or runs the coordinator receiving them.
+func runMatrixCommand(args []string) int {
+
+	fs := flag.NewFlagSet("matrix", flag.ExitOnError)
+	listen := fs.String("listen", "", "Receive the results over HTTP on this address, into -drop.")
+	drop := fs.String("drop", "", "Directory the received results are stored in.")
+	keysFile := fs.String("keys", "", "File of \"vantage ed25519-public-key\" lines; results must then be signed.")
+	jsonOut := fs.Bool("json", false, "Write the report as JSON.")
+	genKey := fs.String("genkey", "", "Write a new private key to this file, print its public key for -keys, and exit.")
+	signKey := fs.String("sign", "", "Sign the given result files with this private key, into <file>.sig, and exit.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s matrix [flags] <result.json|dir>...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s matrix -genkey paris.key\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s matrix -sign paris.key paris.json\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	paths, _ := parseInterleaved(fs, args)
+
+	if *genKey != "" {
+		pub, err := GenerateVantageKey(*genKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		vantage := strings.TrimSuffix(filepath.Base(*genKey), filepath.Ext(*genKey))
+		fmt.Println(vantage, pub)
+		return 0
+	}
+
+	if *signKey != "" {
+		if len(paths) == 0 {
+			fs.Usage()
+			return 2
+		}
+		key, err := LoadSigningKey(*signKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		for _, p := range paths {
+			if err := signResultFile(key, p); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	var keys map[string]ed25519.PublicKey
+	if *keysFile != "" {
+		var err error
+		if keys, err = LoadTrustedKeys(*keysFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	if *listen != "" {
+		if *drop == "" {
+			fmt.Fprintln(os.Stderr, "-listen needs a -drop directory")
+			return 2
+		}
+		if keys == nil {
+			fmt.Fprintln(os.Stderr, "-listen needs the -keys of the vantage points, only signed results are accepted")
+			return 2
+		}
+		if err := os.MkdirAll(*drop, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		mc := &matrixCoordinator{dir: *drop, keys: keys}
+		srv := &http.Server{Addr: *listen, Handler: mc.Handler(), ReadTimeout: time.Minute}
+		fmt.Fprintln(os.Stderr, "Receiving results on", *listen)
+		if err := srv.ListenAndServe(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if *drop != "" {
+		paths = append(paths, *drop)
+	}
+	if len(paths) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	results, err := loadVantages(paths, keys)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := writeMatrix(os.Stdout, BuildMatrix(results), *jsonOut); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// vantageList - Servers 10.0.0.1:port, answering when up is set.
+func vantageList(servers map[uint16]bool) []idTech4_Server {
+
+	var list []idTech4_Server
+	for port, up := range servers {
+		sv := namedServer(port, "^2server "+string(rune('A'+port-27660)), 1)
+		if !up {
+			sv.Info = nil
+		}
+		list = append(list, sv)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+
+	return list
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeVantageFiles - The results of three vantage points, each written
+// in one of the json outputs: a server array, -meta, and -append records.
+func writeVantageFiles(t *testing.T, dir string) {
+
+	now := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	meta := newQueryMeta(now, protocols[0], nil, false)
+
+	// A 27660, B 27661, C 27662, D 27663
+	var paris bytes.Buffer
+	if err := writeJSON(&paris, vantageList(map[uint16]bool{27660: true, 27661: true, 27662: false}), nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "paris.json"), paris.String())
+
+	var tokyo bytes.Buffer
+	if err := writeJSON(&tokyo, vantageList(map[uint16]bool{27660: true, 27662: true}), meta); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "tokyo.json"), tokyo.String())
+
+	// Only the last record counts
+	nyc := filepath.Join(dir, "nyc.json")
+	for _, list := range [][]idTech4_Server{
+		vantageList(map[uint16]bool{27660: false}),
+		vantageList(map[uint16]bool{27660: true, 27661: false, 27663: true}),
+	} {
+		if err := writeOutputFile(nyc, true, list, OutputJSON, meta, csvOptions{}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMatrixMerge(t *testing.T) {
+
+	dir := t.TempDir()
+	writeVantageFiles(t, dir)
+
+	results, err := loadVantages([]string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := BuildMatrix(results)
+
+	if want := []string{"nyc", "paris", "tokyo"}; !reflect.DeepEqual(report.Vantages, want) {
+		t.Errorf("vantages %v, want %v", report.Vantages, want)
+	}
+
+	want := []MatrixRow{
+		{Server: "10.0.0.1:27661", Name: "server B", States: map[string]string{"nyc": ReachDown, "paris": ReachOK, "tokyo": ReachAbsent}, Partial: true},
+		{Server: "10.0.0.1:27662", Name: "server C", States: map[string]string{"nyc": ReachAbsent, "paris": ReachDown, "tokyo": ReachOK}, Partial: true},
+		{Server: "10.0.0.1:27663", Name: "server D", States: map[string]string{"nyc": ReachOK, "paris": ReachAbsent, "tokyo": ReachAbsent}, Partial: true},
+		{Server: "10.0.0.1:27660", Name: "server A", States: map[string]string{"nyc": ReachOK, "paris": ReachOK, "tokyo": ReachOK}},
+	}
+	if !reflect.DeepEqual(report.Rows, want) {
+		t.Errorf("rows\n got %+v\nwant %+v", report.Rows, want)
+	}
+	if report.Partial != 3 {
+		t.Errorf("%d partial servers, want 3", report.Partial)
+	}
+
+	var out bytes.Buffer
+	if err := writeMatrix(&out, report, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), "PARTIAL"); n != 3 {
+		t.Errorf("%d rows flagged, want 3:\n%s", n, out.String())
+	}
+	if !strings.HasSuffix(out.String(), "4 servers, 3 only reachable from some vantage points.\n") {
+		t.Errorf("summary:\n%s", out.String())
+	}
+}
+
+func TestMatrixListedOnly(t *testing.T) {
+
+	// A vantage point which didn't query the details can't tell a server is
+	// down, it doesn't make it partial.
+	listed := vantageList(map[uint16]bool{27660: false})
+	report := BuildMatrix([]VantageResult{
+		{Vantage: "a", Servers: []jsonServer{toJSONServer(vantageList(map[uint16]bool{27660: true})[0])}},
+		{Vantage: "b", Servers: []jsonServer{toJSONServer(listed[0])}},
+	})
+
+	if len(report.Rows) != 1 || report.Rows[0].States["b"] != ReachListed || report.Rows[0].Partial {
+		t.Errorf("%+v", report.Rows)
+	}
+}
+
+func TestMatrixSignedResults(t *testing.T) {
+
+	dir := t.TempDir()
+	writeVantageFiles(t, dir)
+
+	keys := make(map[string]ed25519.PublicKey)
+	var lines []string
+	for _, vantage := range []string{"nyc", "paris", "tokyo"} {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[vantage] = pub
+		lines = append(lines, vantage+" "+base64.StdEncoding.EncodeToString(pub))
+
+		path := filepath.Join(dir, vantage+".json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, path+".sig", base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+	}
+
+	keysPath := filepath.Join(t.TempDir(), "keys")
+	writeFile(t, keysPath, "# vantage points\n"+strings.Join(lines, "\n")+"\n")
+	loaded, err := LoadTrustedKeys(keysPath)
+	if err != nil || !reflect.DeepEqual(loaded, keys) {
+		t.Fatalf("%v, %v", loaded, err)
+	}
+
+	if results, err := loadVantages([]string{dir}, keys); err != nil || len(results) != 3 {
+		t.Fatalf("%d results, %v", len(results), err)
+	}
+
+	// A result changed after its signature is refused
+	tokyo := filepath.Join(dir, "tokyo.json")
+	data, _ := os.ReadFile(tokyo)
+	writeFile(t, tokyo, strings.Replace(string(data), "27662", "27669", 1))
+	if _, err := loadVantages([]string{dir}, keys); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("%v, want an invalid signature", err)
+	}
+}
+
+func TestMatrixUpload(t *testing.T) {
+
+	src, drop := t.TempDir(), t.TempDir()
+	writeVantageFiles(t, src)
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	mc := &matrixCoordinator{dir: drop, keys: map[string]ed25519.PublicKey{"paris": pub}}
+
+	data, _ := os.ReadFile(filepath.Join(src, "paris.json"))
+	upload := func(vantage string, body []byte, sig []byte) int {
+		req := httptest.NewRequest("PUT", "/upload/"+vantage, bytes.NewReader(body))
+		req.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(sig))
+		rec := httptest.NewRecorder()
+		mc.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := upload("paris", data, ed25519.Sign(priv, data)); code != 204 {
+		t.Errorf("signed upload: %d", code)
+	}
+	if code := upload("paris", data, ed25519.Sign(priv, []byte("other"))); code != 403 {
+		t.Errorf("bad signature: %d, want 403", code)
+	}
+	if code := upload("tokyo", data, ed25519.Sign(priv, data)); code != 403 {
+		t.Errorf("unknown vantage point: %d, want 403", code)
+	}
+	if code := upload("bad!name", data, nil); code != 400 {
+		t.Errorf("invalid name: %d, want 400", code)
+	}
+	if code := upload("paris", data, nil); code != 403 {
+		t.Errorf("unsigned upload: %d, want 403", code)
+	}
+	if sig, err := os.ReadFile(filepath.Join(drop, "paris.json.sig")); err != nil || len(sig) == 0 {
+		t.Errorf("signature of the upload: %q, %v", sig, err)
+	}
+
+	// Without keys nothing is accepted
+	open := &matrixCoordinator{dir: t.TempDir()}
+	req := httptest.NewRequest("PUT", "/upload/paris", bytes.NewReader(data))
+	req.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+	rec := httptest.NewRecorder()
+	open.Handler().ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("upload without keys: %d, want 403", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mc.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/matrix", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"paris"`) || strings.Contains(rec.Body.String(), `"tokyo"`) {
+		t.Errorf("GET /matrix: %d\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMatrixSigningKeys(t *testing.T) {
+
+	dir := t.TempDir()
+	writeVantageFiles(t, dir)
+
+	keyPath := filepath.Join(t.TempDir(), "paris.key")
+	pub, err := GenerateVantageKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", fi.Mode(), err)
+	}
+	if _, err := GenerateVantageKey(keyPath); err == nil {
+		t.Error("an existing key was overwritten")
+	}
+
+	key, err := LoadSigningKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := filepath.Join(dir, "paris.json")
+	if err := signResultFile(key, result); err != nil {
+		t.Fatal(err)
+	}
+
+	keysPath := filepath.Join(t.TempDir(), "keys")
+	writeFile(t, keysPath, "paris "+pub+"\n")
+	keys, err := LoadTrustedKeys(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadVantageFile(result, keys); err != nil {
+		t.Errorf("signed result refused: %v", err)
+	}
+
+	writeFile(t, keyPath, "not a key\n")
+	if _, err := LoadSigningKey(keyPath); err == nil {
+		t.Error("invalid private key accepted")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of the metric names exported on /metrics.
+const metricsPrefix = "msquery_"
+
+// metricLabelEscaper - Escapes a label value of the text exposition format.
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatMetricValue - Number as written in the text exposition format.
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys - Keys of a map, sorted, so that the output is stable.
+func sortedKeys(m map[string]int64) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// writeLabeledGauge - Gauge with one sample per value of the label.
+func writeLabeledGauge(w io.Writer, name string, help string, label string, values map[string]int64) {
+
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(w, "# TYPE %s%s gauge\n", metricsPrefix, name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s{%s=\"%s\"} %d\n", metricsPrefix, name, label, metricLabelEscaper.Replace(k), values[k])
+	}
+}
+
+// writeMetrics - Writes the statistics of the snapshot, and gauges about
+// the server list, in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, snap StatsSnapshot, list []idTech4_Server, refreshed time.Time) error {
+
+	bw := bufio.NewWriter(w)
+
+	for _, name := range sortedKeys(snap.Counters) {
+		fmt.Fprintf(bw, "# TYPE %s%s counter\n", metricsPrefix, name)
+		fmt.Fprintf(bw, "%s%s %d\n", metricsPrefix, name, snap.Counters[name])
+	}
+	for _, name := range sortedKeys(snap.Gauges) {
+		fmt.Fprintf(bw, "# TYPE %s%s gauge\n", metricsPrefix, name)
+		fmt.Fprintf(bw, "%s%s %d\n", metricsPrefix, name, snap.Gauges[name])
+	}
+
+	var histograms []string
+	for name := range snap.Histograms {
+		histograms = append(histograms, name)
+	}
+	sort.Strings(histograms)
+	for _, name := range histograms {
+		h := snap.Histograms[name]
+		fmt.Fprintf(bw, "# TYPE %s%s histogram\n", metricsPrefix, name)
+
+		// Buckets are cumulative in the exposition format.
+		var cumulative uint64
+		for i, bound := range h.Bounds {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(bw, "%s%s_bucket{le=\"%s\"} %d\n", metricsPrefix, name, formatMetricValue(bound), cumulative)
+		}
+		fmt.Fprintf(bw, "%s%s_bucket{le=\"+Inf\"} %d\n", metricsPrefix, name, h.Count)
+		fmt.Fprintf(bw, "%s%s_sum %s\n", metricsPrefix, name, formatMetricValue(h.Sum))
+		fmt.Fprintf(bw, "%s%s_count %d\n", metricsPrefix, name, h.Count)
+	}
+
+	// Gauges of the last server list
+	perMaster := make(map[string]int64)
+	perMod := make(map[string]int64)
+	playersPerMod := make(map[string]int64)
+	var players int64
+	for _, sv := range list {
+		for _, master := range sv.ListedBy {
+			perMaster[master]++
+		}
+		if sv.Reachable() {
+			perMod[sv.Info.Mod]++
+			playersPerMod[sv.Info.Mod] += int64(sv.Info.Players)
+			players += int64(sv.Info.Players)
+		}
+	}
+
+	writeLabeledGauge(bw, "master_servers", "Servers listed by each master.", "master", perMaster)
+	writeLabeledGauge(bw, "mod_servers", "Reachable servers running each mod, base game being \"\".", "mod", perMod)
+	writeLabeledGauge(bw, "mod_players", "Players on the servers of each mod.", "mod", playersPerMod)
+
+	fmt.Fprintf(bw, "# HELP %splayers Players on the reachable servers.\n", metricsPrefix)
+	fmt.Fprintf(bw, "# TYPE %splayers gauge\n", metricsPrefix)
+	fmt.Fprintf(bw, "%splayers %d\n", metricsPrefix, players)
+
+	if !refreshed.IsZero() {
+		fmt.Fprintf(bw, "# HELP %slast_refresh_timestamp_seconds Time of the last successful refresh.\n", metricsPrefix)
+		fmt.Fprintf(bw, "# TYPE %slast_refresh_timestamp_seconds gauge\n", metricsPrefix)
+		fmt.Fprintf(bw, "%slast_refresh_timestamp_seconds %d\n", metricsPrefix, refreshed.Unix())
+	}
+
+	return bw.Flush()
+}
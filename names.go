@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where the display name of a server can come from, see -name-sources.
+const (
+	NameSourceInfo        = "info"
+	NameSourceAnnotations = "annotations"
+	NameSourceRDNS        = "rdns"
+)
+
+// Default order of the display name sources.
+const defaultNameSources = "info,annotations,rdns"
+
+// parseNameSources - Parses the -name-sources list.
+func parseNameSources(value string) ([]string, error) {
+	return nameSourceEnum.ParseList(value)
+}
+
+// LoadAnnotations - Reads an annotations file, one "ip:port name" per line.
+// Empty lines and lines starting with # are ignored.
+func LoadAnnotations(path string) (map[string]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	annotations := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// The address ends at the first space or tab
+		i := strings.IndexAny(text, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"ip:port name\"", path, line)
+		}
+		fields := []string{text[:i], text[i+1:]}
+
+		host, p, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP %q", path, line, host)
+		}
+
+		annotations[net.JoinHostPort(ip.String(), p)] = strings.TrimSpace(fields[1])
+	}
+
+	return annotations, scanner.Err()
+}
+
+// lookupAddr does the reverse lookups, it can be swapped like lookupIP.
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// reverseLookup - First PTR name of the IP, without the trailing dot.
+func reverseLookup(ctx context.Context, ip net.IP, timeout time.Duration) string {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	names, err := lookupAddr(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// ResolveNames - Sets the display name of every server from the first source
+// of the list giving one, and records which source it was. Servers not
+// reached yet when the context is done keep no name.
+func ResolveNames(ctx context.Context, list []idTech4_Server, sources []string, annotations map[string]string) {
+
+	forEachServer(list, ctx.Done(), func(sv *idTech4_Server) {
+		sv.Name, sv.NameSource = "", ""
+
+		for _, src := range sources {
+			name := ""
+			switch src {
+			case NameSourceInfo:
+				if sv.Reachable() {
+					name = sv.Info.Hostname
+				}
+			case NameSourceAnnotations:
+				name = annotations[sv.Address()]
+			case NameSourceRDNS:
+				name = reverseLookup(ctx, sv.IP, timeout)
+			}
+
+			if name != "" {
+				sv.Name, sv.NameSource = name, src
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeReverse - Swaps lookupAddr for a table of PTR names by IP.
+func fakeReverse(t *testing.T, names map[string]string) {
+
+	saved := lookupAddr
+	t.Cleanup(func() { lookupAddr = saved })
+
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		if name, ok := names[addr]; ok {
+			return []string{name}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+}
+
+func TestResolveNamesFallback(t *testing.T) {
+
+	fakeReverse(t, map[string]string{"10.0.0.1": "frag.example.org.", "10.0.0.2": "box.example.net.", "10.0.0.3": "ptr.example.com."})
+	annotations := map[string]string{"10.0.0.1:27666": "Annotated 1", "10.0.0.2:27666": "Annotated 2"}
+
+	info := &ServerInfo{Hostname: "^1Frag ^7Fest"}
+	emptyInfo := &ServerInfo{}
+
+	tests := []struct {
+		name    string
+		sv      idTech4_Server
+		sources []string
+		want    string
+		source  string
+	}{
+		{"info name", idTech4_Server{IP: net.IPv4(10, 0, 0, 1), Port: 27666, Info: info}, nil, "^1Frag ^7Fest", NameSourceInfo},
+		{"empty info name", idTech4_Server{IP: net.IPv4(10, 0, 0, 2), Port: 27666, Info: emptyInfo}, nil, "Annotated 2", NameSourceAnnotations},
+		{"unreachable, annotated", idTech4_Server{IP: net.IPv4(10, 0, 0, 1), Port: 27666}, nil, "Annotated 1", NameSourceAnnotations},
+		{"reverse DNS", idTech4_Server{IP: net.IPv4(10, 0, 0, 3), Port: 27666}, nil, "ptr.example.com", NameSourceRDNS},
+		{"nothing", idTech4_Server{IP: net.IPv4(10, 0, 0, 4), Port: 27666}, nil, "", ""},
+		{"annotations first", idTech4_Server{IP: net.IPv4(10, 0, 0, 1), Port: 27666, Info: info},
+			[]string{NameSourceAnnotations, NameSourceInfo}, "Annotated 1", NameSourceAnnotations},
+		{"reverse DNS only", idTech4_Server{IP: net.IPv4(10, 0, 0, 1), Port: 27666, Info: info},
+			[]string{NameSourceRDNS}, "frag.example.org", NameSourceRDNS},
+		{"source left out", idTech4_Server{IP: net.IPv4(10, 0, 0, 3), Port: 27666},
+			[]string{NameSourceInfo, NameSourceAnnotations}, "", ""},
+	}
+
+	defaults, err := parseNameSources(defaultNameSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		sources := tt.sources
+		if sources == nil {
+			sources = defaults
+		}
+
+		// A name from an earlier resolution is replaced
+		sv := tt.sv
+		sv.Name, sv.NameSource = "stale", NameSourceInfo
+		list := []idTech4_Server{sv}
+
+		ResolveNames(context.Background(), list, sources, annotations)
+		if list[0].Name != tt.want || list[0].NameSource != tt.source {
+			t.Errorf("%s: name %q from %q, want %q from %q", tt.name, list[0].Name, list[0].NameSource, tt.want, tt.source)
+		}
+	}
+}
+
+func TestReverseLookupTimeout(t *testing.T) {
+
+	saved := lookupAddr
+	t.Cleanup(func() { lookupAddr = saved })
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	if name := reverseLookup(context.Background(), net.IPv4(10, 0, 0, 1), 20*time.Millisecond); name != "" || time.Since(start) > 2*time.Second {
+		t.Errorf("%q after %s", name, time.Since(start))
+	}
+}
+
+func TestLoadAnnotations(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "names.txt")
+	writeFile(t, path, "# LAN\n10.0.0.1:27666 LAN party\n\n[::1]:27667\tIPv6 box\n")
+
+	annotations, err := LoadAnnotations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 2 || annotations["10.0.0.1:27666"] != "LAN party" || annotations["[::1]:27667"] != "IPv6 box" {
+		t.Errorf("%q", annotations)
+	}
+
+	writeFile(t, path, "10.0.0.1:27666 ok\nnot-an-ip:1 bad\n")
+	if _, err := LoadAnnotations(path); err == nil || err.Error() != path+`:2: invalid IP "not-an-ip"` {
+		t.Errorf("invalid IP: %v", err)
+	}
+	if _, err := LoadAnnotations(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestResolveNamesCancelled(t *testing.T) {
+
+	list := []idTech4_Server{
+		{IP: net.IPv4(127, 0, 0, 1), Port: 27666},
+		{IP: net.IPv4(127, 0, 0, 1), Port: 27667},
+	}
+	annotations := map[string]string{"127.0.0.1:27666": "LAN party", "127.0.0.1:27667": "Backup"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ResolveNames(ctx, list, []string{NameSourceAnnotations}, annotations)
+	for _, sv := range list {
+		if sv.Name != "" {
+			t.Errorf("%s named %q after the context was done", sv.Address(), sv.Name)
+		}
+	}
+
+	ResolveNames(context.Background(), list, []string{NameSourceAnnotations}, annotations)
+	if list[0].Name != "LAN party" || list[0].NameSource != NameSourceAnnotations {
+		t.Errorf("name = %q from %q, want \"LAN party\" from annotations", list[0].Name, list[0].NameSource)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output modes accepted by -output.
+const (
+	OutputPlain = "plain"
+	OutputCSV   = "csv"
+	OutputJSON  = "json"
+)
+
+// jsonServer - JSON representation of a server: the only one, used by the
+// outputs and by the MarshalJSON of idTech4_Server.
+type jsonServer struct {
+	IP         string        `json:"ip"`
+	Port       uint16        `json:"port"`
+	Name       string        `json:"name,omitempty"`
+	NameSource string        `json:"name_source,omitempty"`
+	ListedBy   []string      `json:"listed_by,omitempty"`
+	Country    string        `json:"country,omitempty"`
+	Continent  string        `json:"continent,omitempty"`
+	Protocols  []string      `json:"protocols,omitempty"`
+	PingMs     float64       `json:"ping_ms,omitempty"`
+	Info       *jsonInfo     `json:"info,omitempty"`
+	History    *HistoryStats `json:"history,omitempty"` // Serve mode only
+}
+
+// jsonInfo - JSON representation of a ServerInfo. The ping is only written
+// here when the info is marshalled on its own, servers have it at their level.
+type jsonInfo struct {
+	Hostname   string            `json:"hostname"`
+	Map        string            `json:"map"`
+	Mod        string            `json:"mod"`
+	GameType   string            `json:"gametype"`
+	Players    int               `json:"players"`
+	MaxPlayers int               `json:"max_players"`
+	PlayerList []PlayerInfo      `json:"player_list,omitempty"`
+	Protocol   uint32            `json:"protocol,omitempty"`
+	OS         string            `json:"os,omitempty"`
+	Ranked     bool              `json:"ranked,omitempty"`       // ETQW only
+	TimeLeft   uint32            `json:"time_left_ms,omitempty"` // ETQW only
+	TV         bool              `json:"tv,omitempty"`           // ETQW only
+	Engine     string            `json:"engine"`                 // Derived, ignored when read
+	Variant    string            `json:"variant"`
+	Rules      map[string]string `json:"rules,omitempty"`
+	PingMs     float64           `json:"ping_ms,omitempty"`
+	Warnings   []string          `json:"warnings,omitempty"`
+}
+
+// toJSONServer - Converts a server into its JSON representation.
+func toJSONServer(sv idTech4_Server) jsonServer {
+
+	js := jsonServer{
+		IP:         sv.IP.String(),
+		Port:       sv.Port,
+		Name:       sv.Name,
+		NameSource: sv.NameSource,
+		ListedBy:   sv.ListedBy,
+		Country:    sv.Country,
+		Continent:  sv.Continent,
+		Protocols:  sv.Protocols,
+	}
+
+	if sv.Reachable() {
+		js.PingMs = pingMilliseconds(sv)
+		js.Info = toJSONInfo(sv.Info)
+		js.Info.PingMs = 0
+	}
+
+	return js
+}
+
+// server - Server of a JSON representation, the reverse of toJSONServer.
+func (js jsonServer) server() idTech4_Server {
+
+	sv := idTech4_Server{
+		IP:         net.ParseIP(js.IP),
+		Port:       js.Port,
+		Name:       js.Name,
+		NameSource: js.NameSource,
+		ListedBy:   js.ListedBy,
+		Country:    js.Country,
+		Continent:  js.Continent,
+		Protocols:  js.Protocols,
+	}
+
+	if js.Info != nil {
+		sv.Info = js.Info.info()
+		sv.Info.Ping = time.Duration(js.PingMs * float64(time.Millisecond))
+	}
+
+	return sv
+}
+
+// toJSONInfo - Converts a server info into its JSON representation.
+func toJSONInfo(info *ServerInfo) *jsonInfo {
+
+	return &jsonInfo{
+		Hostname:   info.Hostname,
+		Map:        info.Map,
+		Mod:        info.Mod,
+		GameType:   info.GameType,
+		Players:    info.Players,
+		MaxPlayers: info.MaxPlayers,
+		PlayerList: info.PlayerList,
+		Protocol:   info.Protocol,
+		OS:         info.OSName(),
+		Ranked:     info.Ranked,
+		TimeLeft:   info.TimeLeft,
+		TV:         info.TV,
+		Engine:     info.Engine(),
+		Variant:    info.Variant,
+		Rules:      info.Rules,
+		PingMs:     durationMilliseconds(info.Ping),
+		Warnings:   info.Warnings,
+	}
+}
+
+// info - Server info of a JSON representation, the reverse of toJSONInfo.
+func (ji *jsonInfo) info() *ServerInfo {
+
+	return &ServerInfo{
+		Protocol:   ji.Protocol,
+		Variant:    ji.Variant,
+		Hostname:   ji.Hostname,
+		Map:        ji.Map,
+		Mod:        ji.Mod,
+		GameType:   ji.GameType,
+		Players:    ji.Players,
+		MaxPlayers: ji.MaxPlayers,
+		OS:         parseOSName(ji.OS),
+		PlayerList: ji.PlayerList,
+		Ranked:     ji.Ranked,
+		TimeLeft:   ji.TimeLeft,
+		TV:         ji.TV,
+		Rules:      ji.Rules,
+		Ping:       time.Duration(ji.PingMs * float64(time.Millisecond)),
+		Warnings:   ji.Warnings,
+	}
+}
+
+// QueryMeta - Context of a query, added to the outputs by -meta.
+type QueryMeta struct {
+	Time     time.Time `json:"time"`
+	Game     string    `json:"game"`
+	Protocol uint32    `json:"protocol"`
+	Masters  []string  `json:"masters,omitempty"` // Masters that answered
+	LAN      bool      `json:"lan,omitempty"`
+}
+
+// newQueryMeta - Metadata of a query started at the given time.
+func newQueryMeta(start time.Time, proto Protocol, results []MasterResult, lan bool) *QueryMeta {
+
+	meta := &QueryMeta{Time: start.UTC().Truncate(time.Millisecond), Game: proto.ID, Protocol: proto.Version, LAN: lan}
+	for _, res := range results {
+		if res.Err == nil && !containsString(meta.Masters, res.Master) {
+			meta.Masters = append(meta.Masters, res.Master)
+		}
+	}
+
+	return meta
+}
+
+// source - Where the servers come from, for the plain and csv outputs.
+func (meta *QueryMeta) source() string {
+
+	if meta.LAN {
+		return "lan"
+	}
+
+	return strings.Join(meta.Masters, " ")
+}
+
+type csvOptions struct {
+	Separator    rune
+	DecimalComma bool
+}
+
+// parseCSVSeparator - Validates the -csv-separator value.
+func parseCSVSeparator(value string) (rune, error) {
+
+	r := []rune(value)
+	if len(r) != 1 {
+		return 0, fmt.Errorf("csv separator must be a single character, got %q", value)
+	}
+	if r[0] == '"' || r[0] == '\r' || r[0] == '\n' || r[0] == '.' {
+		return 0, fmt.Errorf("invalid csv separator %q", value)
+	}
+
+	return r[0], nil
+}
+
+// formatCSVValue - Turns a value into its CSV representation.
+// Floats use a comma as decimal mark when requested.
+func formatCSVValue(value interface{}, opts csvOptions) string {
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case uint16:
+		return strconv.Itoa(int(v))
+	case float64:
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if opts.DecimalComma {
+			s = strings.Replace(s, ".", ",", 1)
+		}
+		return s
+	}
+
+	return fmt.Sprint(value)
+}
+
+// pingMilliseconds - Ping of a server in milliseconds, rounded to 0.1ms.
+func pingMilliseconds(sv idTech4_Server) float64 {
+	return math.Round(float64(sv.Info.Ping.Microseconds())/100) / 10
+}
+
+// writeCSV - Writes the server list as CSV.
+// encoding/csv takes care of quoting fields containing the separator.
+func writeCSV(w io.Writer, list []idTech4_Server, showPing bool, details bool, meta *QueryMeta, opts csvOptions) error {
+
+	cw := csv.NewWriter(w)
+	if opts.Separator != 0 {
+		cw.Comma = opts.Separator
+	}
+
+	header := []string{"ip", "port"}
+	if showPing {
+		header = append(header, "ping_ms")
+	}
+	if details {
+		header = append(header, "name", "map", "mod", "players", "max_players", "os", "listed_by")
+	}
+	if protocolAuto {
+		header = append(header, "protocols")
+	}
+	if meta != nil {
+		header = append(header, "queried_at", "game", "protocol", "masters")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, sv := range list {
+		values := []interface{}{sv.IP.String(), sv.Port}
+		if showPing {
+			if sv.Reachable() {
+				values = append(values, pingMilliseconds(sv))
+			} else {
+				values = append(values, "")
+			}
+		}
+		if details {
+			if sv.Reachable() {
+				values = append(values, stripColors(sv.DisplayName()), sv.Info.Map, sv.Info.Mod, sv.Info.Players, sv.Info.MaxPlayers, sv.Info.OSName())
+			} else {
+				values = append(values, stripColors(sv.DisplayName()), "", "", "", "", "")
+			}
+			values = append(values, strings.Join(sv.ListedBy, " "))
+		}
+		if protocolAuto {
+			values = append(values, strings.Join(sv.Protocols, " "))
+		}
+		if meta != nil {
+			values = append(values, meta.Time.Format(time.RFC3339), meta.Game, strconv.FormatUint(uint64(meta.Protocol), 10), meta.source())
+		}
+
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = formatCSVValue(v, opts)
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON - Writes the server list as a JSON array, or as an object with
+// the query metadata and the servers when meta is given.
+func writeJSON(w io.Writer, list []idTech4_Server, meta *QueryMeta) error {
+
+	servers := make([]jsonServer, 0, len(list))
+	for _, sv := range list {
+		servers = append(servers, toJSONServer(sv))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if meta != nil {
+		return enc.Encode(jsonResult{Query: meta, Servers: servers})
+	}
+	return enc.Encode(servers)
+}
+
+// jsonResult - JSON output with its metadata.
+type jsonResult struct {
+	Query   *QueryMeta   `json:"query"`
+	Servers []jsonServer `json:"servers"`
+}
+
+// writeOutput - Writes the server list in the -output format.
+func writeOutput(w io.Writer, list []idTech4_Server, meta *QueryMeta, csvOpts csvOptions) error {
+	return writeOutputFormat(w, list, output, showPing, details, meta, csvOpts)
+}
+
+// writeOutputFormat - Writes the server list in the given format.
+// JSON always has the details of the servers that answered.
+// The query metadata is written when meta is given.
+func writeOutputFormat(w io.Writer, list []idTech4_Server, format string, withPing bool, withDetails bool, meta *QueryMeta, csvOpts csvOptions) error {
+
+	switch format {
+	case OutputJSON:
+		return writeJSON(w, list, meta)
+	case OutputCSV:
+		return writeCSV(w, list, withPing, withDetails, meta, csvOpts)
+	}
+
+	if meta != nil {
+		fmt.Fprintf(w, "# %s %s protocol %d from %s\n", meta.Time.Format(time.RFC3339), meta.Game, meta.Protocol, meta.source())
+	}
+
+	if withDetails {
+		return writeDetails(w, list, withPing)
+	}
+
+	writePlain(w, list, withPing)
+	return nil
+}
+
+// writeOutputFile - Writes the server list to a file, replacing it or appending to it.
+// Appended runs are prefixed by a "# time" line, or written as one JSON
+// record per line in json mode so the file stays valid NDJSON. A partial
+// record left by an interrupted run is removed before appending.
+func writeOutputFile(path string, appendMode bool, list []idTech4_Server, format string, meta *QueryMeta, csvOpts csvOptions, now time.Time) error {
+
+	var buf bytes.Buffer
+
+	if appendMode && format == OutputJSON {
+		servers := make([]jsonServer, 0, len(list))
+		for _, sv := range list {
+			servers = append(servers, toJSONServer(sv))
+		}
+		record := struct {
+			Time    time.Time    `json:"time"`
+			Query   *QueryMeta   `json:"query,omitempty"`
+			Servers []jsonServer `json:"servers"`
+		}{now, meta, servers}
+
+		if err := json.NewEncoder(&buf).Encode(record); err != nil {
+			return err
+		}
+	} else {
+		if appendMode && meta == nil {
+			fmt.Fprintf(&buf, "# %s\n", now.Format(time.RFC3339))
+		}
+		if err := writeOutputFormat(&buf, list, format, showPing, details, meta, csvOpts); err != nil {
+			return err
+		}
+	}
+
+	if !appendMode {
+		return writeFileAtomic(path, buf.Bytes(), 0644)
+	}
+
+	if format == OutputJSON {
+		action, err := recoverNDJSON(path)
+		if err != nil {
+			return err
+		}
+		if action != "" {
+			fmt.Fprintf(os.Stderr, "Recovered %s: %s\n", path, action)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writePlain - Writes the server list as plain text, one server per line.
+func writePlain(w io.Writer, list []idTech4_Server, showPing bool) {
+
+	for a := range list {
+
+		sv := list[a]
+		tag := ""
+		if protocolAuto {
+			tag = "  [" + strings.Join(sv.Protocols, ",") + "]"
+		}
+		if !showPing {
+			fmt.Fprintf(w, "%s%s\n", sv.Address(), tag)
+		} else if sv.Reachable() {
+			fmt.Fprintf(w, "%s  %dms%s\n", sv.Address(), sv.Info.Ping.Milliseconds(), tag)
+		} else {
+			fmt.Fprintf(w, "%s  unreachable%s\n", sv.Address(), tag)
+		}
+	}
+
+	fmt.Fprintln(w, "There are", len(list), "servers found.")
+}
+
+// writeDetails - Plain output with a row of details per server,
+// followed by its players with -players.
+func writeDetails(w io.Writer, list []idTech4_Server, showPing bool) error {
+
+	header := []string{"ADDRESS"}
+	if geoDB != nil {
+		header = append(header, "COUNTRY")
+	}
+	if showPing {
+		header = append(header, "PING")
+	}
+	if protocolAuto {
+		header = append(header, "PROTOCOLS")
+	}
+	header = append(header, "PLAYERS", "MAP", "MOD", "OS", "NAME")
+
+	var rows [][]string
+	for _, sv := range list {
+		row := []string{sv.Address()}
+		if geoDB != nil {
+			row = append(row, sv.Country)
+		}
+		if !sv.Reachable() {
+			if showPing {
+				row = append(row, "-")
+			}
+			if protocolAuto {
+				row = append(row, strings.Join(sv.Protocols, ","))
+			}
+			rows = append(rows, append(row, "unreachable", "", "", "", stripColors(sv.DisplayName())))
+			continue
+		}
+
+		if showPing {
+			row = append(row, fmt.Sprintf("%dms", sv.Info.Ping.Milliseconds()))
+		}
+		if protocolAuto {
+			row = append(row, strings.Join(sv.Protocols, ","))
+		}
+		players := fmt.Sprintf("%d/%d", sv.Info.Players, sv.Info.MaxPlayers)
+		rows = append(rows, append(row, players, sv.Info.Map, sv.Info.Mod, sv.Info.OSName(), stripColors(sv.DisplayName())))
+
+		// One row per player, under the server name
+		if showPlayers {
+			for _, p := range sv.Info.PlayerList {
+				playerRow := make([]string, len(header))
+				playerRow[len(header)-1] = fmt.Sprintf("- %s  %dms", stripColors(p.Name), p.Ping)
+				rows = append(rows, playerRow)
+			}
+		}
+	}
+
+	if err := writeTable(w, header, rows); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintln(w, "There are", len(list), "servers found.")
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of the tests.")
+
+// golden - Compares got with the file in testdata, rewritten with -update.
+func golden(t *testing.T, name string, got []byte) {
+
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+// csvServers - Servers exercising the quoting of the csv output: names with
+// separators, quotes and colors, a silent server and an IPv6 one.
+func csvServers() []idTech4_Server {
+
+	info := func(name string, ping time.Duration, players int) *ServerInfo {
+		return &ServerInfo{Hostname: name, Map: "game/mp/d3dm1", Mod: "base", Players: players, MaxPlayers: 8, OS: 4, Ping: ping}
+	}
+
+	return []idTech4_Server{
+		{IP: net.ParseIP("10.0.0.1").To4(), Port: 27666, Info: info("^1Frag, Beer; and\tTabs", 12500*time.Microsecond, 3), ListedBy: []string{"a:27650", "b:27650"}},
+		{IP: net.ParseIP("10.0.0.2").To4(), Port: 27667, Info: info(`The "Quoted" One`, 80*time.Millisecond, 0), ListedBy: []string{"a:27650"}},
+		{IP: net.ParseIP("10.0.0.3").To4(), Port: 27666, ListedBy: []string{"b:27650"}},
+		{IP: net.ParseIP("2001:db8::7"), Port: 27666, Info: info("v6 only", 1050*time.Microsecond, 8)},
+	}
+}
+
+func TestWriteCSVGolden(t *testing.T) {
+
+	meta := &QueryMeta{Time: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC), Game: "doom3", Protocol: 1<<16 + 41, Masters: []string{"a:27650", "b:27650"}}
+
+	tests := []struct {
+		file      string
+		ping      bool
+		details   bool
+		meta      *QueryMeta
+		separator rune
+		comma     bool
+	}{
+		{"plain.csv", false, false, nil, 0, false},
+		{"details.csv", true, true, meta, 0, false},
+		{"decimal_comma.csv", true, true, nil, 0, true},
+		{"semicolon_decimal_comma.csv", true, true, nil, ';', true},
+		{"tab.csv", true, true, meta, '\t', false},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeCSV(&buf, csvServers(), tt.ping, tt.details, tt.meta, csvOptions{Separator: tt.separator, DecimalComma: tt.comma}); err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		golden(t, filepath.Join("csv", tt.file), buf.Bytes())
+
+		// Read back, every row has the columns of the header.
+		r := csv.NewReader(bytes.NewReader(buf.Bytes()))
+		if tt.separator != 0 {
+			r.Comma = tt.separator
+		}
+		rows, err := r.ReadAll()
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if len(rows) != 5 {
+			t.Errorf("%s: %d rows, want 5", tt.file, len(rows))
+		}
+		if tt.details && (rows[1][3] != "Frag, Beer; and\tTabs" || rows[2][3] != `The "Quoted" One`) {
+			t.Errorf("%s: names read back as %q and %q", tt.file, rows[1][3], rows[2][3])
+		}
+		if tt.ping && tt.comma && rows[1][2] != "12,5" {
+			t.Errorf("%s: ping read back as %q", tt.file, rows[1][2])
+		}
+	}
+}
+
+func TestParseCSVSeparator(t *testing.T) {
+
+	for _, ok := range []string{",", ";", "\t", "|", "§"} {
+		if _, err := parseCSVSeparator(ok); err != nil {
+			t.Errorf("%q: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", ";;", `"`, "\n", "\r", "."} {
+		if _, err := parseCSVSeparator(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
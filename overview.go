@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// OverviewRow - Summary of the query of one game.
+type OverviewRow struct {
+	Game      string        `json:"game"`
+	Master    string        `json:"master"`
+	Servers   int           `json:"servers"`
+	Players   int           `json:"players"`
+	BestPing  time.Duration `json:"-"`
+	QueryTime time.Duration `json:"-"`
+	Errors    int           `json:"errors"`
+}
+
+// MarshalJSON - Durations are written in milliseconds.
+func (row OverviewRow) MarshalJSON() ([]byte, error) {
+
+	type plain OverviewRow
+	return json.Marshal(struct {
+		plain
+		BestPingMs  float64 `json:"best_ping_ms"`
+		QueryTimeMs float64 `json:"query_time_ms"`
+	}{plain(row), durationMilliseconds(row.BestPing), durationMilliseconds(row.QueryTime)})
+}
+
+// durationMilliseconds - Duration in milliseconds, rounded to 0.1ms.
+func durationMilliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()/100) / 10
+}
+
+// Columns -sort accepts for the overview.
+var overviewColumns = []string{"game", "master", "servers", "players", "ping", "time", "errors"}
+
+// humanDuration - Short duration for tables: 34ms, 1.2s, 2m5s.
+func humanDuration(d time.Duration) string {
+
+	switch {
+	case d <= 0:
+		return "-"
+	case d < time.Second:
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	case d < time.Minute:
+		return strconv.FormatFloat(d.Seconds(), 'f', 1, 64) + "s"
+	}
+
+	return d.Round(time.Second).String()
+}
+
+// writeTable - Writes rows under a header, with aligned columns.
+func writeTable(w io.Writer, header []string, rows [][]string) error {
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// BuildOverview - Queries every game and summarizes it in a row.
+// Games use their default master unless masters is given. Only a refused
+// sweep is returned as an error, failing masters are counted in the rows.
+func BuildOverview(ctx context.Context, games []Protocol, masters []string) ([]OverviewRow, error) {
+
+	var rows []OverviewRow
+
+	for _, game := range games {
+		gameMasters := masters
+		if len(gameMasters) == 0 {
+			gameMasters = []string{net.JoinHostPort(game.Master, game.MasterPort)}
+		}
+
+		row := OverviewRow{Game: game.ID, Master: strings.Join(gameMasters, ",")}
+		start := time.Now()
+
+		list, results, err := QueryMasterServers(ctx, gameMasters, MasterRequest{Protocol: game, Mod: mod, Filter: masterFilter})
+		for _, res := range results {
+			if res.Err != nil {
+				row.Errors++
+			}
+		}
+		if err == nil {
+			if err := requireConfirmation(planDetailSweep(list, false)); err != nil {
+				return rows, err
+			}
+			QueryAllServerInfo(ctx, list)
+
+			row.Servers = len(list)
+			for _, sv := range list {
+				if !sv.Reachable() {
+					continue
+				}
+				row.Players += sv.Info.Players
+				if row.BestPing == 0 || sv.Info.Ping < row.BestPing {
+					row.BestPing = sv.Info.Ping
+				}
+			}
+		}
+
+		row.QueryTime = time.Since(start)
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// SortOverview - Sorts the rows by a column: names ascending, numbers descending
+// except ping and time which are ascending.
+func SortOverview(rows []OverviewRow, column string) error {
+
+	var less func(a, b OverviewRow) bool
+
+	if column != "" {
+		var err error
+		if column, err = sortEnum.Parse(column); err != nil {
+			return err
+		}
+	}
+
+	switch column {
+	case "", "game":
+		less = func(a, b OverviewRow) bool { return a.Game < b.Game }
+	case "master":
+		less = func(a, b OverviewRow) bool { return a.Master < b.Master }
+	case "servers":
+		less = func(a, b OverviewRow) bool { return a.Servers > b.Servers }
+	case "players":
+		less = func(a, b OverviewRow) bool { return a.Players > b.Players }
+	case "ping":
+		// Games without any answering server last.
+		less = func(a, b OverviewRow) bool {
+			if (a.BestPing == 0) != (b.BestPing == 0) {
+				return b.BestPing == 0
+			}
+			return a.BestPing < b.BestPing
+		}
+	case "time":
+		less = func(a, b OverviewRow) bool { return a.QueryTime < b.QueryTime }
+	case "errors":
+		less = func(a, b OverviewRow) bool { return a.Errors > b.Errors }
+	default:
+		return fmt.Errorf("cannot sort the overview by %q (valid: %s)", column, strings.Join(overviewColumns, ", "))
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	return nil
+}
+
+// writeOverview - Writes the overview as a table, or as {"overview": [...]} in json.
+func writeOverview(w io.Writer, rows []OverviewRow, jsonOut bool) error {
+
+	if jsonOut {
+		if rows == nil {
+			rows = []OverviewRow{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Overview []OverviewRow `json:"overview"`
+		}{rows})
+	}
+
+	var table [][]string
+	for _, row := range rows {
+		table = append(table, []string{
+			row.Game,
+			row.Master,
+			strconv.Itoa(row.Servers),
+			strconv.Itoa(row.Players),
+			humanDuration(row.BestPing),
+			humanDuration(row.QueryTime),
+			strconv.Itoa(row.Errors),
+		})
+	}
+
+	return writeTable(w, []string{"GAME", "MASTER", "SERVERS", "PLAYERS", "BEST PING", "QUERY TIME", "ERRORS"}, table)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// demoOverview - Overview of every game of the demo network, with the
+// durations replaced by fixed ones so that the outputs can be compared.
+func demoOverview(t *testing.T) []OverviewRow {
+
+	keepGlobals(t)
+	noNetwork(t)
+	if err := enableDemo(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := BuildOverview(context.Background(), protocols, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range rows {
+		if rows[i].BestPing <= 0 {
+			t.Errorf("%s: no ping measured", rows[i].Game)
+		}
+		rows[i].BestPing = time.Duration(20+7*i) * time.Millisecond
+		rows[i].QueryTime = time.Duration(i+1) * 450 * time.Millisecond
+	}
+
+	// A game whose master didn't answer, after a long query
+	rows = append(rows, OverviewRow{Game: "broken", Master: "192.0.2.1:27650", Errors: 1, QueryTime: 125 * time.Second})
+
+	return rows
+}
+
+func TestOverviewGolden(t *testing.T) {
+
+	rows := demoOverview(t)
+
+	tests := []struct {
+		file    string
+		sort    string
+		jsonOut bool
+	}{
+		{"overview.golden", "", false},
+		{"overview_players.golden", "players", false},
+		{"overview_ping.golden", "ping", false},
+		{"overview.json.golden", "servers", true},
+	}
+
+	for _, tt := range tests {
+		sorted := append([]OverviewRow(nil), rows...)
+		if err := SortOverview(sorted, tt.sort); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := writeOverview(&buf, sorted, tt.jsonOut); err != nil {
+			t.Fatal(err)
+		}
+		golden(t, tt.file, buf.Bytes())
+	}
+}
+
+func TestOverviewEmpty(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := writeOverview(&buf, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "{\n  \"overview\": []\n}\n" {
+		t.Errorf("%q", buf.String())
+	}
+
+	if err := SortOverview(nil, "hostname"); err == nil {
+		t.Error("sorted by an unknown column")
+	}
+}
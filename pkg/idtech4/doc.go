@@ -0,0 +1,10 @@
+// Package idtech4 speaks the master server protocol of the idTech4 games
+// (Doom 3, Prey, Quake 4, ETQW): building the out-of-band packets, reading
+// the answers, and listing the servers of a master.
+//
+//	servers, err := idtech4.QueryMasterServer(ctx, idtech4.QueryOptions{
+//		Master:   "idnet.ua-corp.com:27650",
+//		Protocol: 65577, // Doom 3 1.41
+//		Layout:   idtech4.LayoutDoom3,
+//	})
+package idtech4
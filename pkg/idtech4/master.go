@@ -0,0 +1,513 @@
+package idtech4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// EntryLayout - How a master encodes each server of its getServers answer.
+// Every entry starts with the 4 bytes of the IPv4 address.
+type EntryLayout struct {
+	PortBigEndian bool // Port in network order instead of little endian
+	FlagBytes     int  // Extra per-server bytes following the port
+}
+
+// Size - Size of an entry in bytes.
+func (l EntryLayout) Size() int {
+	return 4 + 2 + l.FlagBytes
+}
+
+var (
+	// LayoutDoom3 - Doom 3, Prey, Quake 4 and dhewm3: IP then little endian port.
+	LayoutDoom3 = EntryLayout{}
+
+	// LayoutETQW - ETQW: IP, port in network order, then a flag byte per server.
+	LayoutETQW = EntryLayout{PortBigEndian: true, FlagBytes: 1}
+)
+
+// Server - A server listed by a master.
+type Server struct {
+	IP   net.IP
+	Port uint16
+}
+
+// String - ip:port of the server.
+func (sv Server) String() string {
+	return net.JoinHostPort(sv.IP.String(), strconv.Itoa(int(sv.Port)))
+}
+
+// Commands of the extended exchange, whose entries carry IPv4 or IPv6
+// addresses. Each entry starts with a family marker, followed by the
+// address (4 or 16 bytes), then the port and flag bytes of the layout.
+// Masters only send it when asked with getServersExt.
+const (
+	CommandGetServersExt = "getServersExt"
+	CommandServersExt    = "serversExt"
+
+	ExtMarkerIPv4 byte = '\\'
+	ExtMarkerIPv6 byte = '/'
+)
+
+// ServersAnswer - A parsed "servers" or "serversExt" answer.
+type ServersAnswer struct {
+	Servers  []Server
+	Command  string
+	Header   int  // Bytes before the entries
+	Leftover int  // Bytes left after the last whole entry
+	Trailer  int  // Bytes of the EOT marker and its padding
+	Last     bool // The datagram ends with an EOT marker: no more will follow
+}
+
+// End-of-list marker some masters put after the last entry.
+var eotMarker = []byte("EOT")
+
+// isEOT - Tells if the rest of a datagram is the end-of-list marker,
+// possibly padded with zeros.
+func isEOT(rest []byte) bool {
+	return bytes.HasPrefix(rest, eotMarker) && len(bytes.Trim(rest[len(eotMarker):], "\x00")) == 0
+}
+
+// Codes of the errors, returned by their ErrorCode method. They are stable,
+// so that services can map them to their own statuses without matching
+// messages.
+const (
+	CodeTimeout     = "timeout"     // No answer in time
+	CodeUnreachable = "unreachable" // The address could not be dialed or refused the packet
+	CodeRefused     = "refused"     // The master answered with a print message
+	CodeMalformed   = "malformed"   // The answer could not be parsed
+)
+
+// ErrorCoder - Errors carrying one of the Code* values.
+type ErrorCoder interface {
+	error
+	ErrorCode() string
+}
+
+var (
+	_ ErrorCoder = (*PrintError)(nil)
+	_ ErrorCoder = (*CommandError)(nil)
+	_ ErrorCoder = (*NetError)(nil)
+)
+
+// PrintError - The master answered with a print message instead of servers,
+// e.g. to refuse the request.
+type PrintError struct {
+	Message string
+}
+
+func (e *PrintError) Error() string {
+	return "master refused the request: " + e.Message
+}
+
+// ErrorCode - CodeRefused.
+func (e *PrintError) ErrorCode() string {
+	return CodeRefused
+}
+
+// CommandError - The answer has an unexpected command word.
+type CommandError struct {
+	Command  string
+	Expected string
+}
+
+func (e *CommandError) Error() string {
+	return "unknown request: " + e.Command + " != " + e.Expected
+}
+
+// ErrorCode - CodeMalformed.
+func (e *CommandError) ErrorCode() string {
+	return CodeMalformed
+}
+
+// Values of the filter fields of getServers, as set by the server browser
+// of the game. Zero means no filtering.
+const (
+	PasswordAny  byte = 0
+	PasswordNone byte = 1 // Only servers without password
+	PasswordOnly byte = 2 // Only servers with a password
+
+	PlayersAny      byte = 0
+	PlayersNotEmpty byte = 1
+	PlayersNotFull  byte = 2
+	PlayersSome     byte = 3 // Neither empty nor full
+
+	GameTypeAny byte = 0 // Game types are indexes in the filter list of the game, from 1
+)
+
+// Filter - The filter fields of getServers, applied by the master.
+type Filter struct {
+	Password byte
+	Players  byte
+	GameType byte
+}
+
+// BuildGetServers - Builds the getServers request for the protocol version and mod.
+// Private masters expect their token as a string after the three filter
+// bytes; tokenStart is its offset in the request, -1 without token.
+func BuildGetServers(version uint32, mod string, token string) (request []byte, tokenStart int) {
+	return BuildGetServersFilter(version, mod, Filter{}, token)
+}
+
+// BuildGetServersFilter - Like BuildGetServers, asking the master to filter the servers.
+func BuildGetServersFilter(version uint32, mod string, filter Filter, token string) (request []byte, tokenStart int) {
+
+	return buildGetServers("getServers", version, mod, filter, token)
+}
+
+// BuildGetServersExt - Like BuildGetServersFilter, asking for the extended
+// answer, which lists the IPv6 servers too.
+func BuildGetServersExt(version uint32, mod string, filter Filter, token string) (request []byte, tokenStart int) {
+	return buildGetServers(CommandGetServersExt, version, mod, filter, token)
+}
+
+func buildGetServers(command string, version uint32, mod string, filter Filter, token string) (request []byte, tokenStart int) {
+
+	var pkt Packet
+	pkt.PreparePacket()
+	pkt.WriteString(command)
+
+	pkt.WriteLong(version)
+	pkt.WriteString(mod)
+	pkt.WriteByte(filter.Password)
+	pkt.WriteByte(filter.Players)
+	pkt.WriteByte(filter.GameType)
+
+	tokenStart = -1
+	if token != "" {
+		tokenStart = pkt.Len()
+		pkt.WriteString(token)
+	}
+
+	return pkt.ExportToBytes(), tokenStart
+}
+
+// ParseServers - Parses the answer of a master to getServers.
+// The layout tells how the master encodes each server. A print answer is
+// returned as a *PrintError, any other command as a *CommandError.
+func ParseServers(data []byte, layout EntryLayout) (*ServersAnswer, error) {
+
+	if len(data) == 0 {
+		return nil, errors.New("server has no data to answer with")
+	}
+
+	a := NewAnswer(data)
+
+	if _, err := a.ReadShort(); err != nil {
+		return nil, err
+	}
+
+	command, err := a.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	answer := &ServersAnswer{Command: command, Header: a.Pos()}
+
+	if command == "print" {
+		msg, _ := a.ReadString()
+		return answer, &PrintError{Message: msg}
+	}
+	if command == CommandServersExt {
+		return answer, parseExtEntries(a, data, layout, answer)
+	}
+	if command != "servers" {
+		return answer, &CommandError{Command: command, Expected: "servers"}
+	}
+
+	for a.Remaining() >= layout.Size() {
+		if isEOT(data[a.Pos():]) {
+			break
+		}
+
+		ip := make(net.IP, 4)
+		for i := range ip {
+			ip[i], _ = a.ReadByte()
+		}
+
+		var port uint16
+		if layout.PortBigEndian {
+			port, _ = a.ReadShortBigEndian()
+		} else {
+			port, _ = a.ReadShort()
+		}
+		a.Skip(layout.FlagBytes)
+
+		answer.Servers = append(answer.Servers, Server{IP: ip, Port: port})
+	}
+	if isEOT(data[a.Pos():]) {
+		answer.Last = true
+		answer.Trailer = a.Remaining()
+	} else {
+		answer.Leftover = a.Remaining()
+	}
+
+	return answer, nil
+}
+
+// parseExtEntries - Entries of a serversExt answer. An unknown family
+// marker ends the list, the rest being counted as leftover.
+func parseExtEntries(a *Answer, data []byte, layout EntryLayout, answer *ServersAnswer) error {
+
+	for a.Remaining() > 0 && !isEOT(data[a.Pos():]) {
+		marker, _ := a.PeekByte()
+
+		size := 0
+		switch marker {
+		case ExtMarkerIPv4:
+			size = 4
+		case ExtMarkerIPv6:
+			size = 16
+		}
+		if size == 0 || a.Remaining() < 1+size+2+layout.FlagBytes {
+			break
+		}
+		a.Skip(1)
+
+		ip := make(net.IP, size)
+		for i := range ip {
+			ip[i], _ = a.ReadByte()
+		}
+
+		var port uint16
+		if layout.PortBigEndian {
+			port, _ = a.ReadShortBigEndian()
+		} else {
+			port, _ = a.ReadShort()
+		}
+		a.Skip(layout.FlagBytes)
+
+		answer.Servers = append(answer.Servers, Server{IP: ip, Port: port})
+	}
+	if isEOT(data[a.Pos():]) {
+		answer.Last = true
+		answer.Trailer = a.Remaining()
+	} else {
+		answer.Leftover = a.Remaining()
+	}
+
+	return nil
+}
+
+// MaxDatagram - Largest UDP payload.
+const MaxDatagram = 65507
+
+// PacketGap - How long QueryMasterServer waits for the next datagram of a
+// list split over several ones.
+const PacketGap = 500 * time.Millisecond
+
+// QueryOptions - What to ask a master.
+type QueryOptions struct {
+	Master   string // host:port
+	Protocol uint32 // Protocol long of the game
+	Mod      string
+	Token    string // Only for private masters
+	Layout   EntryLayout
+	Filter   Filter
+	Extended bool // Send getServersExt, for masters listing IPv6 servers
+}
+
+// Conn - Connection to a master. net.Conn satisfies it; tests and
+// replays can fake it.
+type Conn interface {
+	Write(b []byte) (int, error)
+	Read(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// NetError - Error of the connection while sending the request (Op "write")
+// or waiting for the answer (Op "read").
+type NetError struct {
+	Op  string
+	Err error
+}
+
+func (e *NetError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *NetError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode - CodeTimeout when no answer came in time, CodeUnreachable
+// otherwise.
+func (e *NetError) ErrorCode() string {
+
+	var nerr net.Error
+	if errors.As(e.Err, &nerr) && nerr.Timeout() {
+		return CodeTimeout
+	}
+
+	return CodeUnreachable
+}
+
+// MasterClient - Queries idTech4 masters over UDP.
+type MasterClient struct {
+	Timeout time.Duration // Wait for the answer, 3s when zero, or the context deadline then
+	Dialer  net.Dialer
+	Limiter *RateLimiter // Paces the requests, may be shared between clients
+
+	// Dial opens the connections instead of Dialer when set.
+	Dial func(ctx context.Context, address string) (Conn, error)
+
+	// OnDatagram is called for every datagram of the answer with what
+	// ParseServers made of it, for logs and statistics.
+	OnDatagram func(data []byte, answer *ServersAnswer, err error)
+}
+
+// QueryMasterServer - Asks a master for its servers, with a default client.
+func QueryMasterServer(ctx context.Context, opts QueryOptions) ([]Server, error) {
+
+	var c MasterClient
+	return c.QueryMasterServer(ctx, opts)
+}
+
+// QueryMasterServer - Asks a master for its servers. The query stops when the
+// context is done.
+func (c *MasterClient) QueryMasterServer(ctx context.Context, opts QueryOptions) ([]Server, error) {
+
+	var conn Conn
+	var err error
+	if c.Dial != nil {
+		conn, err = c.Dial(ctx, opts.Master)
+	} else {
+		conn, err = c.Dialer.DialContext(ctx, "udp", opts.Master)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	servers, err := c.QueryConn(ctx, conn, opts)
+	var netErr *NetError
+	if err != nil && !errors.As(err, &netErr) && ctx.Err() == nil {
+		err = fmt.Errorf("%s: %w", opts.Master, err)
+	}
+
+	return servers, err
+}
+
+// timeout - Wait for the first datagram of the answer.
+func (c *MasterClient) timeout(ctx context.Context) time.Time {
+
+	deadline, ok := ctx.Deadline()
+	if ok && c.Timeout <= 0 {
+		return deadline
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	if d := time.Now().Add(timeout); !ok || d.Before(deadline) {
+		deadline = d
+	}
+
+	return deadline
+}
+
+// packetGap - Wait for the next datagram of a list split over several ones.
+func (c *MasterClient) packetGap(ctx context.Context) time.Time {
+
+	gap := PacketGap
+	if c.Timeout > 0 && c.Timeout < gap {
+		gap = c.Timeout
+	}
+
+	next := time.Now().Add(gap)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(next) {
+		next = deadline
+	}
+
+	return next
+}
+
+// QueryConn - Sends the request of opts on an opened connection and reads the
+// answer, until the master marks the end of the list or goes quiet for
+// PacketGap. opts.Master is not used. The connection is left open.
+func (c *MasterClient) QueryConn(ctx context.Context, conn Conn, opts QueryOptions) ([]Server, error) {
+
+	// Unblocks the read when the context is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	build := BuildGetServersFilter
+	if opts.Extended {
+		build = BuildGetServersExt
+	}
+	request, _ := build(opts.Protocol, opts.Mod, opts.Filter, opts.Token)
+	if err := c.Limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &NetError{Op: "write", Err: err}
+	}
+
+	buffer := make([]byte, MaxDatagram)
+	conn.SetReadDeadline(c.timeout(ctx))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &NetError{Op: "read", Err: err}
+	}
+
+	answer, err := ParseServers(buffer[:n], opts.Layout)
+	if c.OnDatagram != nil {
+		c.OnDatagram(buffer[:n], answer, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	servers := answer.Servers
+
+	// Long lists are split over several datagrams.
+	seen := make(map[string]bool)
+	for _, sv := range servers {
+		seen[sv.String()] = true
+	}
+	for last := answer.Last; !last && ctx.Err() == nil; {
+		conn.SetReadDeadline(c.packetGap(ctx))
+
+		n, err := conn.Read(buffer)
+		if err != nil {
+			break
+		}
+		more, err := ParseServers(buffer[:n], opts.Layout)
+		if c.OnDatagram != nil {
+			c.OnDatagram(buffer[:n], more, err)
+		}
+		if err != nil {
+			continue
+		}
+		for _, sv := range more.Servers {
+			if !seen[sv.String()] {
+				seen[sv.String()] = true
+				servers = append(servers, sv)
+			}
+		}
+		last = more.Last
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return servers, nil
+}
@@ -0,0 +1,187 @@
+package idtech4
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConn - Conn answering with the given datagrams, then timing out.
+type fakeConn struct {
+	answers [][]byte
+	written [][]byte
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	if len(c.answers) == 0 {
+		return 0, timeoutError{}
+	}
+	n := copy(b, c.answers[0])
+	c.answers = c.answers[1:]
+	return n, nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *fakeConn) Close() error                      { return nil }
+
+func serversDatagram(ports ...uint16) []byte {
+	data := []byte("\xff\xffservers\x00")
+	for _, p := range ports {
+		data = append(data, 10, 0, 0, 1, byte(p), byte(p>>8))
+	}
+	return data
+}
+
+func TestQueryConn(t *testing.T) {
+
+	conn := &fakeConn{answers: [][]byte{serversDatagram(1, 2), []byte("\xff\xffjunk\x00"), serversDatagram(2, 3)}}
+	var seen int
+	c := MasterClient{Timeout: time.Second, OnDatagram: func(data []byte, answer *ServersAnswer, err error) { seen++ }}
+
+	servers, err := c.QueryConn(context.Background(), conn, QueryOptions{Protocol: 65577, Layout: LayoutDoom3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 || servers[2].Port != 3 {
+		t.Errorf("servers = %v, want ports 1, 2, 3", servers)
+	}
+	if seen != 3 {
+		t.Errorf("OnDatagram called %d times, want 3", seen)
+	}
+	want, _ := BuildGetServersFilter(65577, "", Filter{}, "")
+	if len(conn.written) != 1 || string(conn.written[0]) != string(want) {
+		t.Errorf("request = %q, want %q", conn.written, want)
+	}
+}
+
+func TestQueryConnErrors(t *testing.T) {
+
+	c := MasterClient{Timeout: time.Second}
+
+	_, err := c.QueryConn(context.Background(), &fakeConn{}, QueryOptions{Layout: LayoutDoom3})
+	var netErr *NetError
+	var ne net.Error
+	if !errors.As(err, &netErr) || netErr.Op != "read" || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("no answer: got %v, want a read timeout", err)
+	}
+
+	conn := &fakeConn{answers: [][]byte{[]byte("\xff\xffprint\x00badToken\x00")}}
+	_, err = c.QueryConn(context.Background(), conn, QueryOptions{Layout: LayoutDoom3})
+	var printErr *PrintError
+	if !errors.As(err, &printErr) {
+		t.Errorf("print answer: got %v, want a *PrintError", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.QueryConn(ctx, &fakeConn{answers: [][]byte{serversDatagram(1)}}, QueryOptions{Layout: LayoutDoom3})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: got %v, want context.Canceled", err)
+	}
+}
+
+func TestBuildGetServersLayout(t *testing.T) {
+
+	filter := Filter{Password: 1, Players: 2, GameType: 3}
+	header := "\xff\xffgetServers\x00\x29\x00\x01\x00roe\x00\x01\x02\x03"
+
+	request, tokenStart := BuildGetServersFilter(1<<16+41, "roe", filter, "s3cret")
+	if want := header + "s3cret\x00"; string(request) != want {
+		t.Errorf("request %q, want %q", request, want)
+	}
+	if tokenStart != len(header) || string(request[tokenStart:len(request)-1]) != "s3cret" {
+		t.Errorf("token at %d in %q", tokenStart, request)
+	}
+
+	// Without token the request stops after the filter bytes
+	request, tokenStart = BuildGetServersFilter(1<<16+41, "roe", filter, "")
+	if string(request) != header || tokenStart != -1 {
+		t.Errorf("request %q, token at %d", request, tokenStart)
+	}
+
+	// The extended command keeps the same layout
+	request, tokenStart = BuildGetServersExt(1<<16+41, "", Filter{}, "tok")
+	want := "\xff\xff" + CommandGetServersExt + "\x00\x29\x00\x01\x00\x00\x00\x00\x00tok\x00"
+	if string(request) != want || tokenStart != len(want)-4 {
+		t.Errorf("request %q, token at %d, want %q", request, tokenStart, want)
+	}
+}
+
+// readHexFixture - Bytes of a testdata file written as hex, with # comments.
+func readHexFixture(t *testing.T, name string) []byte {
+
+	text, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var digits strings.Builder
+	for _, line := range strings.Split(string(text), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return data
+}
+
+func TestParseServersETQW(t *testing.T) {
+
+	data := readHexFixture(t, "etqw_servers.hex")
+
+	answer, err := ParseServers(data, LayoutETQW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"192.0.2.1:27733", "192.0.2.1:27734", "203.0.113.7:27733", "198.51.100.20:27935"}
+	var got []string
+	for _, sv := range answer.Servers {
+		got = append(got, sv.String())
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("servers %v, want %v", got, want)
+	}
+	if !answer.Last || answer.Leftover != 0 || answer.Trailer != 3 || answer.Header != len("\xff\xffservers\x00") {
+		t.Errorf("answer %+v", answer)
+	}
+
+	// Read with the Doom 3 layout, the ports are swapped and the flag bytes
+	// taken for addresses
+	answer, err = ParseServers(data, LayoutDoom3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Servers) == 4 && answer.Servers[0].Port == 27733 {
+		t.Errorf("the ETQW answer reads the same in the Doom 3 layout: %v", answer.Servers)
+	}
+
+	// Through a client, as a single datagram ended by EOT
+	c := MasterClient{Timeout: time.Second}
+	servers, err := c.QueryConn(context.Background(), &fakeConn{answers: [][]byte{data}}, QueryOptions{Protocol: 10<<16 + 22, Layout: LayoutETQW})
+	if err != nil || len(servers) != 4 || servers[3].Port != 27935 {
+		t.Errorf("QueryConn: %v, %v", servers, err)
+	}
+}
@@ -0,0 +1,222 @@
+package idtech4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTruncatedString is returned when the answer ends in the middle of a string.
+var ErrTruncatedString = errors.New("string truncated by the end of the packet")
+
+// Packet - Out-of-band packet being built, starting with the 0xFFFF header.
+type Packet struct {
+	buf bytes.Buffer // Buffer to send
+}
+
+// PreparePacket - Writes the out-of-band header.
+func (pkt *Packet) PreparePacket() {
+	pkt.buf.WriteByte(255)
+	pkt.buf.WriteByte(255)
+}
+
+// WriteString - Writes a string and its terminator.
+func (pkt *Packet) WriteString(cmd string) {
+	pkt.buf.Write([]byte(cmd))
+	pkt.buf.WriteByte(0)
+}
+
+// WriteByte - Writes a byte.
+func (pkt *Packet) WriteByte(cmd byte) error {
+	return pkt.buf.WriteByte(cmd)
+}
+
+// WriteBytes - Writes raw bytes.
+func (pkt *Packet) WriteBytes(b []byte) {
+	pkt.buf.Write(b)
+}
+
+// WriteShort - Writes a little endian short.
+func (pkt *Packet) WriteShort(value uint16) {
+
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, value)
+
+	pkt.buf.Write(b)
+}
+
+// WriteLong - Writes a little endian long.
+func (pkt *Packet) WriteLong(value uint32) {
+
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, value)
+
+	pkt.buf.Write(b)
+}
+
+// Len - Number of bytes written so far.
+func (pkt *Packet) Len() int {
+	return pkt.buf.Len()
+}
+
+// ExportToBytes - The packet to send.
+func (pkt *Packet) ExportToBytes() []byte {
+	return pkt.buf.Bytes()
+}
+
+// Answer - Reader over a received packet.
+type Answer struct {
+	buffer    []byte
+	bufferpos int
+	bufferlen int
+}
+
+// NewAnswer - Reader over the packet, starting at its first byte.
+func NewAnswer(data []byte) *Answer {
+	return &Answer{buffer: data, bufferlen: len(data)}
+}
+
+// overflow - Error for a read of n bytes going past the end.
+func (a *Answer) overflow(n int) error {
+	return fmt.Errorf("Buffer going too far! (pos: %d, size:%d)", a.bufferpos+n, a.bufferlen)
+}
+
+// ReadByte - Reads the byte.
+// Moves 1 byte in the request position.
+func (a *Answer) ReadByte() (byte, error) {
+
+	if a.bufferpos+1 > a.bufferlen {
+		return 0, a.overflow(1)
+	}
+
+	val := a.buffer[a.bufferpos]
+	a.bufferpos++
+
+	return val, nil
+}
+
+// ReadShort - Reads a little endian short.
+// Moves 2 bytes in the request position.
+func (a *Answer) ReadShort() (uint16, error) {
+
+	if a.bufferpos+2 > a.bufferlen {
+		return 0, a.overflow(2)
+	}
+
+	value := binary.LittleEndian.Uint16(a.buffer[a.bufferpos:])
+	a.bufferpos += 2
+
+	return value, nil
+}
+
+// ReadShortBigEndian - Reads a short in network order.
+// Moves 2 bytes in the request position.
+func (a *Answer) ReadShortBigEndian() (uint16, error) {
+
+	if a.bufferpos+2 > a.bufferlen {
+		return 0, a.overflow(2)
+	}
+
+	value := binary.BigEndian.Uint16(a.buffer[a.bufferpos:])
+	a.bufferpos += 2
+
+	return value, nil
+}
+
+// ReadLong - Reads a little endian long.
+// Moves 4 bytes in the request position.
+func (a *Answer) ReadLong() (uint32, error) {
+
+	if a.bufferpos+4 > a.bufferlen {
+		return 0, a.overflow(4)
+	}
+
+	value := binary.LittleEndian.Uint32(a.buffer[a.bufferpos:])
+	a.bufferpos += 4
+
+	return value, nil
+}
+
+// PeekLong - Reads a long without moving the request position.
+func (a *Answer) PeekLong() (uint32, bool) {
+	return a.PeekLongAt(0)
+}
+
+// PeekLongAt - Reads the long offset bytes ahead without moving the request position.
+func (a *Answer) PeekLongAt(offset int) (uint32, bool) {
+
+	if offset < 0 || a.bufferpos+offset+4 > a.bufferlen {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint32(a.buffer[a.bufferpos+offset:]), true
+}
+
+// PeekByte - Reads a byte without moving the request position.
+func (a *Answer) PeekByte() (byte, bool) {
+
+	if a.bufferpos >= a.bufferlen {
+		return 0, false
+	}
+
+	return a.buffer[a.bufferpos], true
+}
+
+// ReadString - Reads a string up to its terminator.
+// A string cut off by the end of the buffer is reported with ErrTruncatedString.
+func (a *Answer) ReadString() (string, error) {
+
+	// Bytes are taken as Latin-1, and stored as UTF-8.
+	var result strings.Builder
+
+	for {
+		if a.bufferpos >= a.bufferlen {
+			return "", fmt.Errorf("%w (pos: %d, size:%d)", ErrTruncatedString, a.bufferpos, a.bufferlen)
+		}
+
+		c, err := a.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if c <= 0 || c >= 255 {
+			break
+		}
+
+		if c == '%' {
+			c = '.'
+		}
+
+		result.WriteRune(rune(c))
+	}
+
+	return result.String(), nil
+}
+
+// Skip - Moves n bytes forward.
+func (a *Answer) Skip(n int) error {
+
+	if a.bufferpos+n > a.bufferlen {
+		return a.overflow(n)
+	}
+	a.bufferpos += n
+
+	return nil
+}
+
+// Pos - Current request position, for Seek.
+func (a *Answer) Pos() int {
+	return a.bufferpos
+}
+
+// Seek - Moves back to a position returned by Pos.
+func (a *Answer) Seek(pos int) {
+	a.bufferpos = pos
+}
+
+// Remaining - Number of unread bytes left in the answer.
+func (a *Answer) Remaining() int {
+	return a.bufferlen - a.bufferpos
+}
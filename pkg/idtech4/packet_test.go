@@ -0,0 +1,105 @@
+package idtech4
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadStringTruncated(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data []byte
+		skip int
+	}{
+		{"empty packet", nil, 0},
+		{"no terminator", []byte("si_name"), 0},
+		{"after a whole string", []byte("key\x00val"), 4},
+		{"at the end", []byte("key\x00"), 4},
+	}
+
+	for _, tt := range tests {
+		a := NewAnswer(tt.data)
+		a.Skip(tt.skip)
+
+		s, err := a.ReadString()
+		if !errors.Is(err, ErrTruncatedString) {
+			t.Errorf("%s: got %q, %v, want ErrTruncatedString", tt.name, s, err)
+		}
+		if s != "" {
+			t.Errorf("%s: partial string %q returned", tt.name, s)
+		}
+		if a.Remaining() != 0 {
+			t.Errorf("%s: %d bytes left", tt.name, a.Remaining())
+		}
+	}
+}
+
+func TestReadString(t *testing.T) {
+
+	a := NewAnswer([]byte("si_name\x00Fr\xe9d 100%\x00\x00end\xff"))
+
+	want := []string{"si_name", "Fréd 100.", "", "end"}
+	for _, w := range want {
+		s, err := a.ReadString()
+		if err != nil || s != w {
+			t.Errorf("got %q, %v, want %q", s, err, w)
+		}
+	}
+
+	if _, err := a.ReadString(); !errors.Is(err, ErrTruncatedString) {
+		t.Errorf("read past the end: %v", err)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+
+	var pkt Packet
+	pkt.PreparePacket()
+	pkt.WriteString("getInfo")
+	pkt.WriteLong(0xdeadbeef)
+	pkt.WriteShort(27666)
+	pkt.WriteByte(7)
+	pkt.WriteBytes([]byte{0x6c, 0x12})
+
+	if pkt.Len() != 2+8+4+2+1+2 {
+		t.Fatalf("packet of %d bytes", pkt.Len())
+	}
+
+	a := NewAnswer(pkt.ExportToBytes())
+	if v, err := a.ReadShort(); err != nil || v != 0xffff {
+		t.Errorf("header %x, %v", v, err)
+	}
+	if s, err := a.ReadString(); err != nil || s != "getInfo" {
+		t.Errorf("command %q, %v", s, err)
+	}
+	if v, ok := a.PeekLong(); !ok || v != 0xdeadbeef {
+		t.Errorf("peeked %x", v)
+	}
+	if v, err := a.ReadLong(); err != nil || v != 0xdeadbeef {
+		t.Errorf("long %x, %v", v, err)
+	}
+	if v, err := a.ReadShort(); err != nil || v != 27666 {
+		t.Errorf("short %d, %v", v, err)
+	}
+	if v, err := a.ReadByte(); err != nil || v != 7 {
+		t.Errorf("byte %d, %v", v, err)
+	}
+	if v, err := a.ReadShortBigEndian(); err != nil || v != 0x6c12 {
+		t.Errorf("big endian short %x, %v", v, err)
+	}
+
+	// Past the end, every read fails without moving.
+	if _, err := a.ReadByte(); err == nil {
+		t.Error("byte read past the end")
+	}
+	if _, err := a.ReadLong(); err == nil {
+		t.Error("long read past the end")
+	}
+	if _, ok := a.PeekLong(); ok {
+		t.Error("long peeked past the end")
+	}
+	if err := a.Skip(1); err == nil || a.Remaining() != 0 {
+		t.Errorf("skipped past the end: %v, %d left", err, a.Remaining())
+	}
+}
@@ -0,0 +1,63 @@
+package idtech4
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter - Spaces out the packets sent, so that sweeping hundreds of
+// servers doesn't look like a UDP flood to ISPs and firewalls. Up to burst
+// packets go at once, then one every 1/rate second. A nil limiter lets
+// every packet through.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    time.Duration // Advance allowed on the schedule, burst-1 intervals
+	next     time.Time     // When the schedule is fully caught up
+}
+
+// NewRateLimiter - Limiter of rate packets per second, nil when rate isn't positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	interval := time.Duration(float64(time.Second) / rate)
+	return &RateLimiter{interval: interval, burst: time.Duration(burst-1) * interval}
+}
+
+// Wait - Blocks until a packet may be sent, or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+
+	if l == nil {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next.Add(-l.burst)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := at.Sub(now)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
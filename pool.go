@@ -0,0 +1,75 @@
+package main
+
+import "sync"
+
+// Default of -workers.
+const defaultWorkers = 32
+
+var (
+	poolMu   sync.Mutex
+	pool     chan struct{} // Slots of the -workers queries running
+	poolSize int
+)
+
+// workerPool - Slots shared by every forEachServer call, so that the sweeps
+// running at once, such as the specs of a batch, don't go past -workers
+// queries together. nil when -workers is 0.
+func workerPool() chan struct{} {
+
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	if workers <= 0 {
+		return nil
+	}
+	if pool == nil || poolSize != workers {
+		pool, poolSize = make(chan struct{}, workers), workers
+	}
+
+	return pool
+}
+
+// forEachServer - Calls fn for every server of the list, with at most
+// -workers calls running at once in the whole process, or one per server
+// when it is 0. Starts no new call once stop is closed; stop may be nil.
+// Returns how many calls were started, once they are all done.
+func forEachServer(list []idTech4_Server, stop <-chan struct{}, fn func(sv *idTech4_Server)) int {
+
+	sem := workerPool()
+	if sem == nil {
+		sem = make(chan struct{}, len(list))
+	}
+
+	var wg sync.WaitGroup
+	started := 0
+
+loop:
+	for i := range list {
+		select {
+		case sem <- struct{}{}:
+		case <-stop:
+			break loop
+		}
+
+		// Both cases may be ready: stop wins.
+		select {
+		case <-stop:
+			<-sem
+			break loop
+		default:
+		}
+
+		started++
+		wg.Add(1)
+		go func(sv *idTech4_Server) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fn(sv)
+		}(&list[i])
+	}
+
+	wg.Wait()
+
+	return started
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockMaster - Master on a localhost port, answering getServers with the
+// answer, or never when it is nil. It counts the requests received and
+// keeps the last one.
+type mockMaster struct {
+	conn     net.PacketConn
+	requests int32
+
+	mu   sync.Mutex
+	last []byte
+}
+
+func newMockMaster(t *testing.T, answer []byte) *mockMaster {
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockMaster{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !bytes.HasPrefix(buf[:n], []byte("\xff\xffgetServers\x00")) {
+				continue
+			}
+			atomic.AddInt32(&m.requests, 1)
+			m.mu.Lock()
+			m.last = append([]byte(nil), buf[:n]...)
+			m.mu.Unlock()
+			if answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *mockMaster) Port() string {
+	return strconv.Itoa(m.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func (m *mockMaster) Requests() int {
+	return int(atomic.LoadInt32(&m.requests))
+}
+
+func (m *mockMaster) LastRequest() []byte {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.last
+}
+
+// keepProbeSettings - Real UDP queries with a short timeout and no retry.
+func keepProbeSettings(t *testing.T) {
+
+	keepGlobals(t)
+	keepSweepSettings(t)
+	saved := probePorts
+	t.Cleanup(func() { probePorts = saved })
+
+	dialServer = dialUDP
+	timeout, retries = 200*time.Millisecond, 0
+}
+
+// probeRequest - Request of the game with the ports of the masters as alternate ports.
+func probeRequest(masters ...*mockMaster) MasterRequest {
+
+	proto := protocols[0]
+	proto.AltPorts = nil
+	for _, m := range masters {
+		proto.AltPorts = append(proto.AltPorts, m.Port())
+	}
+
+	return MasterRequest{Protocol: proto}
+}
+
+func TestProbePorts(t *testing.T) {
+
+	keepProbeSettings(t)
+
+	primary := newMockMaster(t, nil)
+	silent := newMockMaster(t, nil)
+	good := newMockMaster(t, serversPacket(27666, 27667))
+	after := newMockMaster(t, serversPacket(27668))
+	req := probeRequest(primary, silent, good, after)
+
+	// Off by default: the timeout is returned as is
+	probePorts = false
+	if _, err := QueryMasterServer(context.Background(), "127.0.0.1", primary.Port(), req); ErrorCodeOf(err) != CodeTimeout {
+		t.Errorf("without -probe-ports: %v, want a timeout", err)
+	}
+	if silent.Requests()+good.Requests() != 0 {
+		t.Error("the alternate ports are probed without -probe-ports")
+	}
+
+	// The primary port, listed among the alternate ones, isn't tried twice,
+	// and the probing stops at the first port answering
+	probePorts = true
+	list, err := QueryMasterServer(context.Background(), "127.0.0.1", primary.Port(), req)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("%v, %d servers, want the 2 of the answering port", err, len(list))
+	}
+	if primary.Requests() != 2 || silent.Requests() != 1 || good.Requests() != 1 || after.Requests() != 0 {
+		t.Errorf("requests: primary %d, silent %d, good %d, after %d", primary.Requests(), silent.Requests(), good.Requests(), after.Requests())
+	}
+
+	// A master answering on its port isn't probed
+	if list, err := QueryMasterServer(context.Background(), "127.0.0.1", good.Port(), req); err != nil || len(list) != 2 {
+		t.Errorf("answering master: %v, %d servers", err, len(list))
+	}
+	if after.Requests() != 0 {
+		t.Error("a master answering on its port is probed")
+	}
+}
+
+func TestProbePortsBudget(t *testing.T) {
+
+	keepProbeSettings(t)
+	probePorts = true
+
+	primary := newMockMaster(t, nil)
+	var silent []*mockMaster
+	for i := 0; i < maxProbedPorts; i++ {
+		silent = append(silent, newMockMaster(t, nil))
+	}
+	good := newMockMaster(t, serversPacket(27666))
+	req := probeRequest(append(silent, good)...)
+
+	_, err := QueryMasterServer(context.Background(), "127.0.0.1", primary.Port(), req)
+	if ErrorCodeOf(err) != CodeTimeout {
+		t.Errorf("%v, want the timeout of the primary port", err)
+	}
+	for i, m := range silent {
+		if m.Requests() != 1 {
+			t.Errorf("alternate port %d got %d requests, want 1", i, m.Requests())
+		}
+	}
+	if good.Requests() != 0 {
+		t.Errorf("%d ports probed, want at most %d", maxProbedPorts+1, maxProbedPorts)
+	}
+}
+
+func TestProbePortsOtherErrors(t *testing.T) {
+
+	keepProbeSettings(t)
+	probePorts = true
+
+	refusing := newMockMaster(t, []byte("\xff\xffprint\x00badToken\x00"))
+	good := newMockMaster(t, serversPacket(27666))
+
+	_, err := QueryMasterServer(context.Background(), "127.0.0.1", refusing.Port(), probeRequest(good))
+	if ErrorCodeOf(err) != CodeBadToken {
+		t.Errorf("%v, want the badToken error", err)
+	}
+	if good.Requests() != 0 {
+		t.Error("a master answering with an error is probed")
+	}
+}
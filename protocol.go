@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// EntryLayout - How a master encodes each server of its getServers answer.
+type EntryLayout = idtech4.EntryLayout
+
+// MasterFilter - Filter fields of the getServers request, applied by the master.
+type MasterFilter = idtech4.Filter
+
+var (
+	layoutDoom3 = idtech4.LayoutDoom3
+	layoutETQW  = idtech4.LayoutETQW
+)
+
+// Protocol - A game speaking to idTech4 masters.
+type Protocol struct {
+	ID         string // Short name used by -game
+	Name       string
+	Version    uint32 // Protocol long sent in getServers
+	Master     string // Default master host
+	MasterPort string // Default master port
+	Layout     EntryLayout
+	TokenAuth  bool     // Master needs -master-token
+	AltPorts   []string // Other ports community masters are known to use, see -probe-ports
+	GamePort   int      // Default port of the game servers, 0 if unknown
+	DefaultMod string   // -mod used when none is given
+}
+
+// Ports community masters of the idTech4 games often listen on.
+var (
+	altPortsIdTech4 = []string{"27650", "27950", "28000"}
+	altPortsETQW    = []string{"27950", "27650", "28000"}
+)
+
+// Protocols selectable with -protocol, by index.
+var protocols = []Protocol{
+	{ID: "doom3", Name: "Doom 3 / Prey", Version: (1 << 16) + 41, Master: "idnet.ua-corp.com", MasterPort: "27650", Layout: layoutDoom3, AltPorts: altPortsIdTech4, GamePort: 27666},
+	{ID: "quake4", Name: "Quake 4", Version: 131157, Master: "q4master.idsoftware.com", MasterPort: "27650", Layout: layoutDoom3, AltPorts: altPortsIdTech4, GamePort: 28004}, // \x55\x00\x02\x00
+	{ID: "dhewm3", Name: "DHEWM3", Version: (1 << 16) + 41 + 1, Master: "idnet.ua-corp.com", MasterPort: "27650", Layout: layoutDoom3, AltPorts: altPortsIdTech4, GamePort: 27666},
+	{ID: "etqw", Name: "Enemy Territory: Quake Wars", Version: (10 << 16) + 22, Master: "etqwmaster.idsoftware.com", MasterPort: "27950", Layout: layoutETQW, AltPorts: altPortsETQW, GamePort: 27733},
+}
+
+// ProtocolAuto - -protocol value sweeping every protocol of autoProtocols.
+const ProtocolAuto = "auto"
+
+// Protocols sent to the same master by -protocol auto: those of the games
+// listed by the Doom 3 masters, older Doom 3 releases included.
+var autoProtocols = []Protocol{
+	protocols[0],
+	{ID: "doom3-1.3.0", Name: "Doom 3 1.3.0", Version: (1 << 16) + 40, Layout: layoutDoom3},
+	protocols[1],
+	protocols[2],
+}
+
+// protocolFlag - -protocol value, kept as given: it is parsed by
+// applyProtocolFlag once the custom games of the config are known.
+type protocolFlag struct{}
+
+func (protocolFlag) String() string {
+	return protocolValue
+}
+
+func (protocolFlag) Set(value string) error {
+	protocolValue = value
+	return nil
+}
+
+// protocolEnum - Values of -protocol: an index of protocols or "auto".
+// The game IDs and their aliases stand for their index.
+func protocolEnum() Enum {
+
+	e := Enum{Name: "protocol", Aliases: make(map[string]string)}
+	for i, p := range protocols {
+		index := strconv.Itoa(i)
+		e.Values = append(e.Values, index)
+		e.Aliases[strings.ToLower(p.ID)] = index
+	}
+	e.Values = append(e.Values, ProtocolAuto)
+
+	for alias, id := range gameAliases {
+		if index, ok := e.Aliases[id]; ok {
+			e.Aliases[alias] = index
+		}
+	}
+
+	return e
+}
+
+// applyProtocolFlag - Sets protocol and protocolAuto from the -protocol value.
+func applyProtocolFlag(value string) error {
+
+	if value == "" {
+		return nil
+	}
+
+	v, err := protocolEnum().Parse(value)
+	if err != nil {
+		return err
+	}
+	if v == ProtocolAuto {
+		protocolAuto = true
+		return nil
+	}
+	protocolAuto = false
+	protocol, err = strconv.Atoi(v)
+
+	return err
+}
+
+// protocolByIndex - Protocol selected with -protocol.
+func protocolByIndex(index int) (Protocol, error) {
+
+	if index < 0 || index >= len(protocols) {
+		return Protocol{}, fmt.Errorf("unknown protocol %d", index)
+	}
+
+	return protocols[index], nil
+}
+
+// GameAll - -game value selecting every known game.
+const GameAll = "all"
+
+// protocolsByGame - Protocols selected with -game, a game ID or "all".
+func protocolsByGame(game string) ([]Protocol, error) {
+
+	id, err := gameEnum().Parse(game)
+	if err != nil {
+		return nil, err
+	}
+	if id == GameAll {
+		return append([]Protocol(nil), protocols...), nil
+	}
+
+	for _, p := range protocols {
+		if strings.EqualFold(p.ID, id) {
+			return []Protocol{p}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown game %q", game)
+}
+
+// protocolHelp - Description of the protocols for the -protocol flag.
+func protocolHelp() string {
+
+	help := ""
+	for i, p := range protocols {
+		if i > 0 {
+			help += ", "
+		}
+		help += fmt.Sprintf("%d: %s", i, p.Name)
+	}
+	help += ", " + ProtocolAuto + ": every Doom 3 engine protocol at once"
+
+	return help
+}
+
+// describeProtocols - Protocols of a sweep for the banner, e.g.
+// "Quake 4 2.85 (q4master.idsoftware.com:27650)", with their master or not.
+func describeProtocols(list []Protocol, withMaster bool) string {
+
+	var names []string
+	for _, p := range list {
+		name := fmt.Sprintf("%s %d.%d", p.Name, p.Version>>16, p.Version&0xffff)
+		if withMaster {
+			name += " (" + net.JoinHostPort(p.Master, p.MasterPort) + ")"
+		}
+		names = append(names, name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// writeGames - Lists the known games, custom ones included.
+func writeGames(w io.Writer) error {
+
+	var rows [][]string
+	for i, p := range protocols {
+		layout := "doom3"
+		if p.Layout == layoutETQW {
+			layout = "etqw"
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(i),
+			p.ID,
+			p.Name,
+			fmt.Sprintf("%d (%d.%d)", p.Version, p.Version>>16, p.Version&0xffff),
+			net.JoinHostPort(p.Master, p.MasterPort),
+			layout,
+		})
+	}
+
+	return writeTable(w, []string{"#", "GAME", "NAME", "PROTOCOL", "MASTER", "LAYOUT"}, rows)
+}
+
+// parseRawProtocol - Parses the -protocol-raw value, in decimal or 0x hexadecimal.
+func parseRawProtocol(value string) (uint32, error) {
+
+	version, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid raw protocol %q: must be a number between 0 and %d", value, uint32(1<<32-1))
+	}
+
+	return uint32(version), nil
+}
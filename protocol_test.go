@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestDescribeProtocols(t *testing.T) {
+
+	if got, want := describeProtocols(autoProtocols, false), "Doom 3 / Prey 1.41, Doom 3 1.3.0 1.40, Quake 4 2.85, DHEWM3 1.42"; got != want {
+		t.Errorf("auto sweep %q, want %q", got, want)
+	}
+
+	got := describeProtocols(protocols[:2], true)
+	if want := "Doom 3 / Prey 1.41 (idnet.ua-corp.com:27650), Quake 4 2.85 (q4master.idsoftware.com:27650)"; got != want {
+		t.Errorf("games %q, want %q", got, want)
+	}
+}
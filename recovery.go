@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Size of the blocks read when looking for the last complete NDJSON record.
+const recoveryBlockSize = 64 * 1024
+
+// recoverNDJSON - Truncates the partial record an interrupted append may have
+// left at the end of an NDJSON file. Every record ends with a newline, so
+// anything after the last one is incomplete, unless it is valid JSON: then
+// only the newline is missing, and it is added.
+// Returns what was done, empty when the file was fine or doesn't exist.
+func recoverNDJSON(path string) (string, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return "", nil
+	}
+
+	// Look backwards for the last newline.
+	end := size
+	keep := int64(0)
+	buf := make([]byte, recoveryBlockSize)
+	for end > 0 {
+		start := end - recoveryBlockSize
+		if start < 0 {
+			start = 0
+		}
+		block := buf[:end-start]
+		if _, err := f.ReadAt(block, start); err != nil && err != io.EOF {
+			return "", err
+		}
+
+		if i := bytes.LastIndexByte(block, '\n'); i >= 0 {
+			keep = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	if keep == size {
+		return "", nil
+	}
+
+	// A last record written whole but for its newline is kept.
+	tail := make([]byte, size-keep)
+	if _, err := f.ReadAt(tail, keep); err != nil && err != io.EOF {
+		return "", err
+	}
+	if json.Valid(tail) {
+		if _, err := f.WriteAt([]byte{'\n'}, size); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("added the newline missing after the last record (%d bytes)", size-keep), nil
+	}
+
+	if err := f.Truncate(keep); err != nil {
+		return "", err
+	}
+
+	if keep == 0 {
+		return fmt.Sprintf("no complete record, truncated the %d bytes of the file", size), nil
+	}
+	return fmt.Sprintf("truncated a partial last record of %d bytes (file now %d bytes)", size-keep, keep), nil
+}
+
+// recoverSQLite - Runs SQLite's integrity check on the -db database. A
+// damaged one is moved to <path>.corrupt and rebuilt from the runs still
+// readable in it.
+// Returns what was done, empty when the database was fine or doesn't exist.
+func recoverSQLite(path string) (string, error) {
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil
+	}
+
+	db, err := openSQLite(path)
+	if err != nil {
+		return "", err
+	}
+
+	problem := ""
+	err = db.Query("PRAGMA integrity_check", func(row sqliteRow) error {
+		if problem == "" && row.Text(0) != "ok" {
+			problem = row.Text(0)
+		}
+		return nil
+	})
+	if err != nil {
+		problem = err.Error()
+	}
+	db.Close()
+
+	if problem == "" {
+		return "", nil
+	}
+
+	corrupt := path + ".corrupt"
+	if err := os.Rename(path, corrupt); err != nil {
+		return "", err
+	}
+	// The journal goes with its database, to be rolled back when read.
+	os.Rename(path+"-journal", corrupt+"-journal")
+
+	runs, lost := salvageRuns(corrupt)
+
+	store, err := OpenRunStore(path)
+	if err != nil {
+		return "", err
+	}
+	for _, run := range runs {
+		if err := store.Append(run); err != nil {
+			store.Close()
+			return "", err
+		}
+	}
+	if err := store.Close(); err != nil {
+		return "", err
+	}
+
+	action := fmt.Sprintf("integrity check failed (%s), moved to %s, rebuilt from the %d runs still readable", problem, corrupt, len(runs))
+	if lost != "" {
+		action += ", the others are lost: " + lost
+	}
+	return action, nil
+}
+
+// salvageRuns - Runs that can still be read from a damaged database, with
+// all their servers. Reading stops at the first damaged page of the runs,
+// and a run whose servers can't be read is dropped. Also returns why runs
+// were lost, empty when none was.
+func salvageRuns(path string) ([]RunRecord, string) {
+
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err.Error()
+	}
+	defer db.Close()
+
+	var runs []RunRecord
+	var ids []int64
+	lost := ""
+	err = db.Query(`SELECT id, time, game, protocol, masters, lan FROM runs ORDER BY id`, func(row sqliteRow) error {
+		ids = append(ids, row.Int(0))
+		runs = append(runs, RunRecord{
+			Time:     time.UnixMilli(row.Int(1)),
+			Game:     row.Text(2),
+			Protocol: uint32(row.Int(3)),
+			Masters:  strings.Fields(row.Text(4)),
+			LAN:      row.Int(5) != 0,
+			Servers:  []ServerRecord{},
+		})
+		return nil
+	})
+	if err != nil {
+		lost = err.Error()
+	}
+
+	kept := runs[:0]
+	for i, run := range runs {
+		err := db.Query(`SELECT address, name, map, players, max_players FROM servers WHERE run_id = ? ORDER BY rowid`, func(row sqliteRow) error {
+			rec := ServerRecord{Address: row.Text(0), Name: row.Text(1), Map: row.Text(2), MaxPlayers: int(row.Int(4))}
+			if !row.Null(3) {
+				players := int(row.Int(3))
+				rec.Players = &players
+			}
+			run.Servers = append(run.Servers, rec)
+			return nil
+		}, ids[i])
+		if err != nil {
+			lost = err.Error()
+			continue
+		}
+		kept = append(kept, run)
+	}
+
+	return kept, lost
+}
+
+// recoverFiles - Repairs what a killed run may have left in the -db database
+// and the -append JSON output, logging every action. Run at startup.
+func recoverFiles() {
+
+	check := func(path string, fn func(string) (string, error)) {
+		action, err := fn(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot check %s: %s\n", path, err)
+		} else if action != "" {
+			fmt.Fprintf(os.Stderr, "Recovered %s: %s\n", path, action)
+		}
+	}
+
+	if dbPath != "" {
+		check(dbPath, recoverSQLite)
+	}
+	if outFile != "" && appendOut && output == OutputJSON {
+		check(outFile, recoverNDJSON)
+	}
+}
+
+// writeFileAtomic - Writes the file through a temporary file renamed over it,
+// so readers and interrupted runs never see it half written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendedRuns - NDJSON file of three runs appended by the -out writer.
+func appendedRuns(t *testing.T) (string, []byte) {
+
+	path := filepath.Join(t.TempDir(), "servers.ndjson")
+	for i := 0; i < 3; i++ {
+		list := []idTech4_Server{namedServer(uint16(27666+i), "server", i)}
+		if err := writeOutputFile(path, true, list, OutputJSON, nil, csvOptions{}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, data
+}
+
+// ndjsonRecords - Number of records of the file, failing on any invalid one.
+func ndjsonRecords(t *testing.T, path string) int {
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if !json.Valid(scanner.Bytes()) {
+			t.Errorf("invalid record %q", scanner.Text())
+		}
+		n++
+	}
+
+	return n
+}
+
+func TestRecoverNDJSON(t *testing.T) {
+
+	path, data := appendedRuns(t)
+	last := strings.LastIndexByte(string(data[:len(data)-1]), '\n') + 1
+
+	tests := []struct {
+		name    string
+		content []byte
+		records int
+		action  string
+	}{
+		{"intact", data, 3, ""},
+		{"partial last record", data[:last+20], 2, "truncated a partial last record of 20 bytes"},
+		{"missing newline", data[:len(data)-1], 3, "added the newline"},
+		{"partial only record", data[:20], 0, "no complete record, truncated the 20 bytes"},
+		{"empty", nil, 0, ""},
+	}
+
+	for _, tt := range tests {
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		action, err := recoverNDJSON(path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.action == "" && action != "" || !strings.Contains(action, tt.action) {
+			t.Errorf("%s: action %q, want %q", tt.name, action, tt.action)
+		}
+		if n := ndjsonRecords(t, path); n != tt.records {
+			t.Errorf("%s: %d records left, want %d", tt.name, n, tt.records)
+		}
+
+		// Appending after the recovery gives valid records.
+		writeOutputFile(path, true, nil, OutputJSON, nil, csvOptions{}, time.Now())
+		if n := ndjsonRecords(t, path); n != tt.records+1 {
+			t.Errorf("%s: %d records after an append, want %d", tt.name, n, tt.records+1)
+		}
+	}
+
+	if action, err := recoverNDJSON(filepath.Join(t.TempDir(), "missing")); action != "" || err != nil {
+		t.Errorf("missing file: %q, %v", action, err)
+	}
+}
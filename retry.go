@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Wait before the first retry, doubled after every failed attempt up to retryMaxDelay.
+const (
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 4 * time.Second
+)
+
+// retryDelay - Wait before the retry following the attempt (counted from 0).
+func retryDelay(attempt int) time.Duration {
+
+	delay := retryBaseDelay
+	for i := 0; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	return delay
+}
+
+// withRetries - Runs the query again, up to -retries times, while it times
+// out or the master asks to wait. A lost datagram is worth another try after
+// a backoff, a master asking to wait another one once the wait is over; a
+// refusal or a malformed answer is not. Failed attempts are only reported in
+// verbose mode.
+func withRetries(ctx context.Context, what string, query func() error) error {
+
+	for attempt := 0; ; attempt++ {
+		err := query()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || attempt >= retries {
+			return err
+		}
+
+		var delay time.Duration
+		switch {
+		case RetryAfterOf(err) > 0:
+			delay = RetryAfterOf(err)
+		case ErrorCodeOf(err) == CodeTimeout:
+			delay = retryDelay(attempt)
+		default:
+			return err
+		}
+
+		logVerbose("%s: attempt %d/%d failed: %v, retrying in %s", what, attempt+1, retries+1, err, delay)
+		stats.Counter(StatQueryRetries).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetries(t *testing.T) {
+
+	keepSweepSettings(t)
+	retries = 1
+
+	refusal := func(wait time.Duration) error {
+		qerr := newQueryError(CodeRefused, "master refused the request: wait", nil)
+		qerr.RetryAfter = wait
+		return qerr
+	}
+
+	tests := []struct {
+		name     string
+		errs     []error // Returned by the attempts, then nil
+		attempts int
+		minWait  time.Duration
+		code     string
+	}{
+		{"answered", nil, 1, 0, ""},
+		{"timeout then answer", []error{newQueryError(CodeTimeout, "read timeout", nil)}, 2, retryBaseDelay, ""},
+		{"wait hint then answer", []error{refusal(300 * time.Millisecond)}, 2, 300 * time.Millisecond, ""},
+		{"refused", []error{refusal(0)}, 1, 0, CodeRefused},
+		{"malformed", []error{newQueryError(CodeMalformed, "Unknown request", nil)}, 1, 0, CodeMalformed},
+		{"retries exhausted", []error{refusal(10 * time.Millisecond), refusal(10 * time.Millisecond)}, 2, 0, CodeRefused},
+	}
+
+	for _, tt := range tests {
+		attempts := 0
+		start := time.Now()
+		err := withRetries(context.Background(), tt.name, func() error {
+			attempts++
+			if attempts <= len(tt.errs) {
+				return tt.errs[attempts-1]
+			}
+			return nil
+		})
+
+		if attempts != tt.attempts || (err == nil) != (tt.code == "") || (err != nil && ErrorCodeOf(err) != tt.code) {
+			t.Errorf("%s: %d attempts, %v", tt.name, attempts, err)
+		}
+		if elapsed := time.Since(start); elapsed < tt.minWait {
+			t.Errorf("%s: retried after %s, want %s", tt.name, elapsed, tt.minWait)
+		}
+	}
+}
+
+func TestWithRetriesCancelledWait(t *testing.T) {
+
+	keepSweepSettings(t)
+	retries = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := withRetries(ctx, "getServers", func() error {
+		qerr := newQueryError(CodeRefused, "master refused the request: wait 10 minutes", nil)
+		qerr.RetryAfter = 10 * time.Minute
+		return qerr
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Errorf("%v after %s, want the context to end the wait", err, time.Since(start))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default number of distinct addresses a run may contact without confirmation.
+const defaultConfirmThreshold = 1000
+
+// Exit code of the runs aborted because they needed a confirmation.
+const exitNeedsConfirmation = 4
+
+// QueryPlan - Estimate of the traffic a query step will send.
+type QueryPlan struct {
+	Step     string
+	Targets  int // Distinct addresses contacted
+	Packets  int
+	Bytes    int           // UDP payload bytes
+	Duration time.Duration // Worst case, when no target answers
+}
+
+func (p QueryPlan) String() string {
+	return fmt.Sprintf("%s: %d targets, %d packets, %d bytes, up to %s", p.Step, p.Targets, p.Packets, p.Bytes, p.Duration.Round(time.Second))
+}
+
+// requestSize - Payload size of a getInfo or getStatus request.
+func requestSize(command string) int {
+
+	var pkt QuakePacket
+	pkt.PreparePacket()
+	pkt.WriteString(command)
+	pkt.WriteLong(0)
+
+	return len(pkt.ExportToBytes())
+}
+
+// pacedDuration - How long the -rate limiter takes to let the packets go.
+func pacedDuration(packets int) time.Duration {
+
+	if packetRate <= 0 || packets <= packetBurst {
+		return 0
+	}
+
+	return time.Duration(float64(packets-packetBurst) / packetRate * float64(time.Second))
+}
+
+// planDetailSweep - Plan of the getInfo queries sent to every server of the
+// list, followed by getStatus ones with withStatus (-full).
+// At worst no server answers: each query is then sent -retries+1 times,
+// each one taking a timeout and the waits between them, -workers at a time,
+// and the packets can't go faster than -rate.
+func planDetailSweep(list []idTech4_Server, withStatus bool) QueryPlan {
+
+	commands := []string{"getInfo"}
+	if withStatus {
+		commands = append(commands, "getStatus")
+	}
+
+	n := len(list)
+	attempts := retries + 1
+	plan := QueryPlan{
+		Step:    "server details",
+		Targets: n,
+		Packets: n * attempts * len(commands),
+	}
+	for _, command := range commands {
+		plan.Bytes += n * attempts * requestSize(command)
+	}
+	if n == 0 {
+		return plan
+	}
+
+	perServer := time.Duration(attempts) * timeout
+	for i := 0; i < retries; i++ {
+		perServer += retryDelay(i)
+	}
+	waves := 1
+	if workers > 0 {
+		waves = (n + workers - 1) / workers
+	}
+
+	// The getStatus queries start once every getInfo is over
+	plan.Duration = time.Duration(len(commands)*waves) * perServer
+	if paced := pacedDuration(plan.Packets) + time.Duration(len(commands))*timeout; paced > plan.Duration {
+		plan.Duration = paced
+	}
+
+	return plan
+}
+
+// planLAN - Plan of the LAN discovery broadcasts, sent at once then
+// answered within a timeout.
+func planLAN(ports []int) QueryPlan {
+
+	targets := len(broadcastAddresses()) * len(ports)
+
+	return QueryPlan{
+		Step:     "LAN discovery",
+		Targets:  targets,
+		Packets:  targets,
+		Bytes:    targets * requestSize("getInfo"),
+		Duration: pacedDuration(targets) + timeout,
+	}
+}
+
+// ConfirmError - A plan was refused, or needed a confirmation that can't be
+// asked. The run stops with exitNeedsConfirmation.
+type ConfirmError struct {
+	Msg string
+}
+
+func (e *ConfirmError) Error() string {
+	return e.Msg
+}
+
+// ErrorCode - CodeNeedsConfirmation.
+func (e *ConfirmError) ErrorCode() string {
+	return CodeNeedsConfirmation
+}
+
+// isConfirmError - Tells if the error comes from a refused plan.
+func isConfirmError(err error) bool {
+	var confirmErr *ConfirmError
+	return errors.As(err, &confirmErr)
+}
+
+var (
+	confirmMu sync.Mutex
+	confirmed bool // Set once the user agreed, so watch and serve only ask once
+)
+
+// confirmPlan - Asks before running a plan contacting more than threshold addresses.
+// Without -yes, the question is asked on a terminal; non-interactive runs are refused.
+func confirmPlan(plan QueryPlan, threshold int, yes bool, in io.Reader, interactive bool, out io.Writer) error {
+
+	if plan.Targets <= threshold || yes {
+		return nil
+	}
+
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	if confirmed {
+		return nil
+	}
+
+	fmt.Fprintf(out, "This run will contact more than %d addresses you may not control.\n", threshold)
+	fmt.Fprintln(out, "-", plan)
+
+	if !interactive {
+		return &ConfirmError{Msg: fmt.Sprintf("refusing to contact %d addresses without confirmation, pass -yes to proceed", plan.Targets)}
+	}
+
+	fmt.Fprint(out, "Continue? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return &ConfirmError{Msg: "aborted"}
+	}
+
+	confirmed = true
+	return nil
+}
+
+// requireConfirmation - confirmPlan on the standard streams. The caller
+// stops with the *ConfirmError it returns when refused.
+func requireConfirmation(plan QueryPlan) error {
+	return confirmPlan(plan, confirmThreshold, assumeYes, os.Stdin, isTerminal(os.Stdin), os.Stderr)
+}
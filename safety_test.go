@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepSweepSettings - Restores the settings planDetailSweep reads.
+func keepSweepSettings(t *testing.T) {
+
+	savedTimeout, savedRetries, savedWorkers := timeout, retries, workers
+	savedRate, savedBurst := packetRate, packetBurst
+	t.Cleanup(func() {
+		timeout, retries, workers = savedTimeout, savedRetries, savedWorkers
+		packetRate, packetBurst = savedRate, savedBurst
+	})
+}
+
+func TestPlanDetailSweep(t *testing.T) {
+
+	keepSweepSettings(t)
+
+	tests := []struct {
+		name       string
+		servers    int
+		workers    int
+		retries    int
+		rate       float64
+		withStatus bool
+		want       time.Duration
+		packets    int
+		bytes      int
+	}{
+		{"empty", 0, 32, 1, 0, false, 0, 0, 0},
+		{"one wave", 10, 32, 0, 0, false, 3 * time.Second, 10, 140},
+		{"waves", 2400, 32, 1, 0, false, 75 * (6*time.Second + 250*time.Millisecond), 4800, 67200},
+		{"retries back off", 1, 1, 3, 0, false, 4*3*time.Second + (250+500+1000)*time.Millisecond, 4, 56},
+		{"all at once", 5000, 0, 0, 0, false, 3 * time.Second, 5000, 70000},
+		{"rate bound", 1000, 0, 0, 10, false, 99*time.Second + 3*time.Second, 1000, 14000},
+		{"workers bound despite rate", 100, 1, 0, 1000, false, 100 * 3 * time.Second, 100, 1400},
+		{"getStatus", 10, 32, 1, 0, true, 2 * (6*time.Second + 250*time.Millisecond), 40, 10 * 2 * (14 + 16)},
+		{"getStatus rate bound", 1000, 0, 0, 10, true, 199*time.Second + 2*3*time.Second, 2000, 30000},
+	}
+
+	for _, tt := range tests {
+		timeout, workers, retries = 3*time.Second, tt.workers, tt.retries
+		packetRate, packetBurst = tt.rate, 10
+
+		plan := planDetailSweep(make([]idTech4_Server, tt.servers), tt.withStatus)
+		if plan.Duration != tt.want {
+			t.Errorf("%s: duration %s, want %s", tt.name, plan.Duration, tt.want)
+		}
+		if plan.Targets != tt.servers || plan.Packets != tt.packets || plan.Bytes != tt.bytes {
+			t.Errorf("%s: plan %+v, want %d packets, %d bytes", tt.name, plan, tt.packets, tt.bytes)
+		}
+	}
+}
+
+func TestConfirmPlan(t *testing.T) {
+
+	saved := confirmed
+	t.Cleanup(func() { confirmed = saved })
+
+	plan := QueryPlan{Step: "server details", Targets: 1001}
+
+	tests := []struct {
+		name        string
+		plan        QueryPlan
+		yes         bool
+		interactive bool
+		answer      string
+		refused     bool
+	}{
+		{"under the threshold", QueryPlan{Targets: 1000}, false, false, "", false},
+		{"-yes", plan, true, false, "", false},
+		{"no terminal", plan, false, false, "y\n", true},
+		{"answered no", plan, false, true, "n\n", true},
+		{"no answer", plan, false, true, "", true},
+		{"answered yes", plan, false, true, "YES\n", false},
+	}
+
+	for _, tt := range tests {
+		confirmed = false
+		var out bytes.Buffer
+		err := confirmPlan(tt.plan, 1000, tt.yes, strings.NewReader(tt.answer), tt.interactive, &out)
+
+		if tt.refused != (err != nil) {
+			t.Errorf("%s: err = %v, want refused %v", tt.name, err, tt.refused)
+		}
+		if err != nil && !isConfirmError(err) {
+			t.Errorf("%s: %v is not a *ConfirmError", tt.name, err)
+		}
+		if tt.refused && !strings.Contains(out.String(), "1001 targets") {
+			t.Errorf("%s: the plan isn't shown:\n%s", tt.name, out.String())
+		}
+	}
+
+	// Asked once: later sweeps of a watch go on.
+	if err := confirmPlan(plan, 1000, false, strings.NewReader(""), false, &bytes.Buffer{}); err != nil {
+		t.Errorf("asked again after a yes: %v", err)
+	}
+}
+
+func TestWatchStopsOnRefusedSweep(t *testing.T) {
+
+	schedule, err := NewPollSchedule(time.Millisecond, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	refused := &ConfirmError{Msg: "aborted"}
+	collect := func() ([]idTech4_Server, []MasterResult, error) {
+		calls++
+		if calls == 2 {
+			return nil, nil, refused
+		}
+		return nil, nil, nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- RunWatch(contextWithTimeout(t, 5*time.Second), schedule, collect, &bytes.Buffer{}, false, defaultMoveSimilarity)
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, refused) || exitCodeOf(err) != exitNeedsConfirmation {
+			t.Errorf("RunWatch = %v, want the confirmation error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunWatch kept running after the refused sweep")
+	}
+	if calls != 2 {
+		t.Errorf("collect called %d times, want 2", calls)
+	}
+}
+
+// contextWithTimeout - Context cancelled at the end of the test, or after d.
+func contextWithTimeout(t *testing.T, d time.Duration) context.Context {
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
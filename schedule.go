@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Default jitter applied to the polling interval, as a fraction of it.
+const defaultJitter = 0.1
+
+// PollSchedule - Computes the delay before each poll of the watch mode.
+// Randomizing the delays keeps many instances from hitting the public
+// masters at the same time.
+type PollSchedule struct {
+	Interval   time.Duration
+	Jitter     float64       // Fraction of the interval, 0 disables it
+	StartDelay time.Duration // Maximum random delay before the first poll
+	rng        *rand.Rand
+}
+
+// NewPollSchedule - Creates a schedule, seeding its random source with seed.
+func NewPollSchedule(interval time.Duration, jitter float64, startDelay time.Duration, seed int64) (*PollSchedule, error) {
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %s", interval)
+	}
+	if jitter < 0 || jitter >= 1 {
+		return nil, fmt.Errorf("jitter must be between 0 and 1 (excluded), got %g", jitter)
+	}
+	if startDelay < 0 {
+		return nil, fmt.Errorf("invalid start delay %s", startDelay)
+	}
+
+	return &PollSchedule{
+		Interval:   interval,
+		Jitter:     jitter,
+		StartDelay: startDelay,
+		rng:        rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+// Start - Delay before the first poll, between 0 and StartDelay.
+func (s *PollSchedule) Start() time.Duration {
+
+	if s.StartDelay <= 0 {
+		return 0
+	}
+
+	return time.Duration(s.rng.Int63n(int64(s.StartDelay)))
+}
+
+// Next - Delay before the next poll, Interval ± Jitter * Interval.
+func (s *PollSchedule) Next() time.Duration {
+
+	if s.Jitter == 0 {
+		return s.Interval
+	}
+
+	offset := (s.rng.Float64()*2 - 1) * s.Jitter * float64(s.Interval)
+
+	return s.Interval + time.Duration(offset)
+}
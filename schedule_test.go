@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewPollScheduleChecks(t *testing.T) {
+
+	bad := []struct {
+		interval   time.Duration
+		jitter     float64
+		startDelay time.Duration
+	}{
+		{0, 0.1, 0},
+		{time.Minute, -0.1, 0},
+		{time.Minute, 1, 0},
+		{time.Minute, 0.1, -time.Second},
+	}
+
+	for _, b := range bad {
+		if _, err := NewPollSchedule(b.interval, b.jitter, b.startDelay, 1); err == nil {
+			t.Errorf("NewPollSchedule(%s, %g, %s) accepted", b.interval, b.jitter, b.startDelay)
+		}
+	}
+}
+
+func TestPollScheduleJitterBounds(t *testing.T) {
+
+	const samples = 10000
+	interval := time.Minute
+
+	s, err := NewPollSchedule(interval, 0.1, 0, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low, high := 54*time.Second, 66*time.Second
+	var sum, min, max time.Duration = 0, high, low
+	for i := 0; i < samples; i++ {
+		d := s.Next()
+		if d < low || d > high {
+			t.Fatalf("delay %s out of [%s, %s]", d, low, high)
+		}
+		sum += d
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+
+	// Uniform over ±6s: the mean stays near the interval, and both ends
+	// of the range are reached.
+	mean := sum / samples
+	if math.Abs(float64(mean-interval)) > float64(200*time.Millisecond) {
+		t.Errorf("mean delay %s, want about %s", mean, interval)
+	}
+	if min > 55*time.Second || max < 65*time.Second {
+		t.Errorf("delays only spread over [%s, %s]", min, max)
+	}
+}
+
+func TestPollScheduleSeeded(t *testing.T) {
+
+	a, _ := NewPollSchedule(time.Minute, 0.1, 30*time.Second, 7)
+	b, _ := NewPollSchedule(time.Minute, 0.1, 30*time.Second, 7)
+	c, _ := NewPollSchedule(time.Minute, 0.1, 30*time.Second, 8)
+
+	if a.Start() != b.Start() {
+		t.Error("same seed, other start delays")
+	}
+	same := true
+	for i := 0; i < 10; i++ {
+		na, nb, nc := a.Next(), b.Next(), c.Next()
+		if na != nb {
+			t.Fatalf("same seed, delay %d differs: %s and %s", i, na, nb)
+		}
+		same = same && na == nc
+	}
+	if same {
+		t.Error("another seed gave the same delays")
+	}
+}
+
+func TestPollScheduleStartAndNoJitter(t *testing.T) {
+
+	s, _ := NewPollSchedule(time.Minute, 0, 10*time.Second, 3)
+	for i := 0; i < 1000; i++ {
+		if d := s.Start(); d < 0 || d >= 10*time.Second {
+			t.Fatalf("start delay %s out of [0, 10s)", d)
+		}
+		if d := s.Next(); d != time.Minute {
+			t.Fatalf("delay %s without jitter", d)
+		}
+	}
+
+	s, _ = NewPollSchedule(time.Minute, 0, 0, 3)
+	if d := s.Start(); d != 0 {
+		t.Errorf("start delay %s without -start-delay", d)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServeState - Last server list fetched by the refresher, shared with the HTTP handlers.
+type ServeState struct {
+	history   *PlayerHistory
+	mu        sync.RWMutex
+	servers   []idTech4_Server
+	refreshed time.Time // Time of the last successful refresh
+	lastErr   error     // Error of the last refresh, nil if it worked
+
+	ui           bool          // Serve the web page on /
+	refreshEvery time.Duration // Refresh interval, for the web page
+
+	schedule *PollSchedule
+	nextPoll time.Time // When the refresher polls next, zero while polling
+}
+
+// Refresh - Runs the query and stores its result.
+// A failed query keeps the previous list, which is then served stale.
+func (st *ServeState) Refresh(collect func() ([]idTech4_Server, error)) {
+
+	list, err := collect()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.lastErr = err
+	if err == nil {
+		st.servers = list
+		st.refreshed = time.Now()
+		if st.history != nil {
+			st.history.Record(list, st.refreshed)
+		}
+	}
+}
+
+// Snapshot - Current list, time of its refresh and last refresh error.
+func (st *ServeState) Snapshot() ([]idTech4_Server, time.Time, error) {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.servers, st.refreshed, st.lastErr
+}
+
+// SetNextPoll - Records when the refresher polls next.
+func (st *ServeState) SetNextPoll(t time.Time) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.nextPoll = t
+}
+
+// newServeState - State of the serve mode, before its first refresh.
+// Without ui (-ui=false), / is not served.
+func newServeState(schedule *PollSchedule, history *PlayerHistory, ui bool) *ServeState {
+	return &ServeState{history: history, ui: ui, refreshEvery: schedule.Interval, schedule: schedule}
+}
+
+// Handler - HTTP routes of the serve mode.
+func (st *ServeState) Handler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/servers", st.handleServers)
+	mux.HandleFunc("/servers/", st.handleServer)
+	mux.HandleFunc("/healthz", st.handleHealth)
+	mux.HandleFunc("/server/", st.handleServerHistory)
+	mux.HandleFunc("/debug/stats", handleStats)
+	mux.HandleFunc("/debug/state", st.handleState)
+	mux.HandleFunc("/metrics", st.handleMetrics)
+	if st.ui {
+		mux.HandleFunc("/", st.handleUI)
+	}
+
+	return mux
+}
+
+func (st *ServeState) handleServers(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, refreshed, err := st.Snapshot()
+	if refreshed.IsZero() {
+		msg := "no server list yet"
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Refreshed", refreshed.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(refreshed).Seconds())))
+
+	servers := make([]jsonServer, 0, len(list))
+	for _, sv := range list {
+		servers = append(servers, st.toJSON(sv))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(servers)
+}
+
+// toJSON - JSON representation of a server, with its history if kept.
+func (st *ServeState) toJSON(sv idTech4_Server) jsonServer {
+
+	js := toJSONServer(sv)
+	if st.history != nil {
+		if stats, ok := st.history.Stats(sv.Address()); ok {
+			js.History = &stats
+		}
+	}
+
+	return js
+}
+
+// handleServer - GET /servers/{ip}:{port}
+func (st *ServeState) handleServer(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(r.URL.Path, "/servers/"))
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil || validPort(port) != nil {
+		http.Error(w, "invalid server address, expected /servers/{ip}:{port}", http.StatusBadRequest)
+		return
+	}
+	address := net.JoinHostPort(ip.String(), port)
+
+	list, refreshed, err := st.Snapshot()
+	if refreshed.IsZero() {
+		msg := "no server list yet"
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, sv := range list {
+		if sv.Address() != address {
+			continue
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Last-Refreshed", refreshed.UTC().Format(http.TimeFormat))
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(refreshed).Seconds())))
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(st.toJSON(sv))
+		return
+	}
+
+	http.Error(w, "server not in the list", http.StatusNotFound)
+}
+
+// handleServerHistory - GET /server/{ip}/{port}/history
+func (st *ServeState) handleServerHistory(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/server/"), "/"), "/")
+	if len(parts) != 3 || parts[2] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ip := net.ParseIP(parts[0])
+	if ip == nil || validPort(parts[1]) != nil {
+		http.Error(w, "invalid server address", http.StatusBadRequest)
+		return
+	}
+	addr := net.JoinHostPort(ip.String(), parts[1])
+
+	var series []PlayerSample
+	ok := false
+	if st.history != nil {
+		series, ok = st.history.Series(addr)
+	}
+	if !ok {
+		http.Error(w, "no history for "+addr, http.StatusNotFound)
+		return
+	}
+	stats, _ := st.history.Stats(addr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Server  string         `json:"server"`
+		Stats   HistoryStats   `json:"stats"`
+		Samples []PlayerSample `json:"samples"`
+	}{addr, stats, series})
+}
+
+// handleStats - GET /debug/stats, a snapshot of the statistics registry.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	writeStats(w, stats.Snapshot())
+}
+
+// handleState - GET /debug/state, the refresher state and its schedule.
+func (st *ServeState) handleState(w http.ResponseWriter, r *http.Request) {
+
+	st.mu.RLock()
+	state := struct {
+		Servers    int        `json:"servers"`
+		Refreshed  *time.Time `json:"refreshed,omitempty"`
+		LastError  string     `json:"last_error,omitempty"`
+		NextPoll   *time.Time `json:"next_poll,omitempty"`
+		NextPollIn float64    `json:"next_poll_in_seconds,omitempty"`
+		Interval   string     `json:"interval,omitempty"`
+		Jitter     float64    `json:"jitter"`
+		StartDelay string     `json:"start_delay,omitempty"`
+	}{Servers: len(st.servers)}
+
+	if !st.refreshed.IsZero() {
+		refreshed := st.refreshed
+		state.Refreshed = &refreshed
+	}
+	if st.lastErr != nil {
+		state.LastError = st.lastErr.Error()
+	}
+	if !st.nextPoll.IsZero() {
+		next := st.nextPoll
+		state.NextPoll = &next
+		state.NextPollIn = time.Until(next).Seconds()
+	}
+	if st.schedule != nil {
+		state.Interval = st.schedule.Interval.String()
+		state.Jitter = st.schedule.Jitter
+		state.StartDelay = st.schedule.StartDelay.String()
+	}
+	st.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(state)
+}
+
+// handleMetrics - Statistics and server list gauges for Prometheus.
+func (st *ServeState) handleMetrics(w http.ResponseWriter, r *http.Request) {
+
+	list, refreshed, _ := st.Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, stats.Snapshot(), list, refreshed)
+}
+
+func (st *ServeState) handleHealth(w http.ResponseWriter, r *http.Request) {
+
+	list, refreshed, err := st.Snapshot()
+
+	health := struct {
+		Status        string         `json:"status"`
+		Servers       int            `json:"servers"`
+		LastRefreshed *time.Time     `json:"last_refreshed,omitempty"`
+		AgeSeconds    float64        `json:"age_seconds,omitempty"`
+		LastError     string         `json:"last_error,omitempty"`
+		Protocol      ProtocolHealth `json:"protocol_health"`
+	}{
+		Status:   "ok",
+		Servers:  len(list),
+		Protocol: parseTelemetry.Health(),
+	}
+
+	if !refreshed.IsZero() {
+		health.LastRefreshed = &refreshed
+		health.AgeSeconds = time.Since(refreshed).Seconds()
+	}
+	if err != nil {
+		health.Status = "stale"
+		health.LastError = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
+
+// RunServe - Serves the server list over HTTP, refreshing it in the background
+// following the schedule, until the context is cancelled. With ui, a web
+// page showing the list is served on /.
+// Only the refresher goroutine ever queries the masters, the handlers read
+// the last snapshot.
+func RunServe(ctx context.Context, addr string, schedule *PollSchedule, history *PlayerHistory, ui bool, collect func() ([]idTech4_Server, error)) error {
+
+	st := newServeState(schedule, history, ui)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: st.Handler(),
+	}
+
+	errc := make(chan error, 2)
+
+	go func() {
+		delay := schedule.Start()
+		if delay > 0 {
+			logVerbose("first refresh in %s, at %s", delay.Round(time.Millisecond), time.Now().Add(delay).Format("15:04:05"))
+		}
+		st.SetNextPoll(time.Now().Add(delay))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		for {
+			st.SetNextPoll(time.Time{})
+			st.Refresh(collect)
+			if _, _, err := st.Snapshot(); isConfirmError(err) {
+				errc <- err
+				return
+			} else if err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: refresh failed, serving the previous list:", err)
+			}
+
+			delay = schedule.Next()
+			if _, _, err := st.Snapshot(); RetryAfterOf(err) > 0 {
+				delay = RetryAfterOf(err)
+			}
+			next := time.Now().Add(delay)
+			st.SetNextPoll(next)
+			logVerbose("next refresh in %s, at %s", delay.Round(time.Millisecond), next.Format("15:04:05"))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	var stopErr error
+	select {
+	case stopErr = <-errc:
+		if !isConfirmError(stopErr) {
+			return stopErr
+		}
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	return stopErr
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugState(t *testing.T) {
+
+	schedule, _ := NewPollSchedule(time.Minute, 0.1, 5*time.Second, 1)
+	st := &ServeState{schedule: schedule}
+
+	st.Refresh(func() ([]idTech4_Server, error) {
+		return []idTech4_Server{namedServer(27666, "a", 1), namedServer(27667, "b", 2)}, nil
+	})
+	st.Refresh(func() ([]idTech4_Server, error) {
+		return nil, errors.New("read timeout")
+	})
+	next := time.Now().Add(42 * time.Second)
+	st.SetNextPoll(next)
+
+	rec := httptest.NewRecorder()
+	st.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/state", nil))
+
+	var state struct {
+		Servers    int        `json:"servers"`
+		Refreshed  *time.Time `json:"refreshed"`
+		LastError  string     `json:"last_error"`
+		NextPoll   *time.Time `json:"next_poll"`
+		NextPollIn float64    `json:"next_poll_in_seconds"`
+		Interval   string     `json:"interval"`
+		Jitter     float64    `json:"jitter"`
+		StartDelay string     `json:"start_delay"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+
+	if state.Servers != 2 || state.Refreshed == nil || state.LastError != "read timeout" {
+		t.Errorf("refresh state %+v", state)
+	}
+	if state.NextPoll == nil || !state.NextPoll.Equal(next) || state.NextPollIn < 40 || state.NextPollIn > 42 {
+		t.Errorf("next poll %v in %gs, want %v", state.NextPoll, state.NextPollIn, next)
+	}
+	if state.Interval != "1m0s" || state.Jitter != 0.1 || state.StartDelay != "5s" {
+		t.Errorf("schedule %s ±%g, start %s", state.Interval, state.Jitter, state.StartDelay)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of the session events.
+const (
+	EventHeader   = "header"
+	EventLookup   = "lookup"
+	EventDial     = "dial"
+	EventSent     = "sent"
+	EventReceived = "received"
+	EventTimeout  = "timeout"
+)
+
+// Version of the session files written by -record.
+const sessionVersion = 1
+
+// SessionEvent - One line of a session file: a DNS lookup, a connection,
+// or a datagram sent or received on it.
+type SessionEvent struct {
+	Kind    string   `json:"kind"`
+	At      int64    `json:"at_us"` // Microseconds since the start of the session
+	Conn    int      `json:"conn,omitempty"`
+	Address string   `json:"address,omitempty"` // Dialed host:port, or looked up host
+	IPs     []string `json:"ips,omitempty"`
+	Data    []byte   `json:"data,omitempty"`
+
+	// Header only
+	Version int      `json:"version,omitempty"`
+	Started string   `json:"started,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// roundTripper - Connections knowing the round trip of the last answer read,
+// so replayed pings are the recorded ones.
+type roundTripper interface {
+	RoundTrip() (time.Duration, bool)
+}
+
+// wrappedConn - Connections adding a behaviour to another one, such as
+// ctxConn, countingConn and debugConn.
+type wrappedConn interface {
+	Unwrap() PacketConn
+}
+
+// connRoundTrip - Round trip of the last answer, when the connection, or one
+// it wraps, knows it.
+func connRoundTrip(conn PacketConn) (time.Duration, bool) {
+
+	for {
+		if rt, ok := conn.(roundTripper); ok {
+			return rt.RoundTrip()
+		}
+		w, ok := conn.(wrappedConn)
+		if !ok {
+			return 0, false
+		}
+		conn = w.Unwrap()
+	}
+}
+
+// SessionRecorder - Writes every lookup and datagram of the run to a session
+// file, one JSON event per line, as they happen: a run killed halfway still
+// leaves a usable session.
+type SessionRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	start   time.Time
+	lastID  int
+	dial    DialFunc
+	lookup  func(ctx context.Context, host string) ([]net.IP, error)
+	lastErr error
+}
+
+// NewSessionRecorder - Creates the session file and writes its header.
+func NewSessionRecorder(path string, args []string) (*SessionRecorder, error) {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SessionRecorder{f: f, enc: json.NewEncoder(f), start: time.Now(), dial: dialServer, lookup: lookupIP}
+	r.event(SessionEvent{Kind: EventHeader, Version: sessionVersion, Started: r.start.UTC().Format(time.RFC3339), Args: redactArgs(args)})
+
+	return r, nil
+}
+
+// Flags whose value is left out of the recorded command line.
+var secretFlags = []string{"master-token"}
+
+// redactArgs - Command line with the values of the secret flags masked,
+// so that a session can be shared.
+func redactArgs(args []string) []string {
+
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+
+	for i := 0; i < len(redacted); i++ {
+		name := strings.TrimLeft(redacted[i], "-")
+		if name == redacted[i] {
+			continue
+		}
+		for _, secret := range secretFlags {
+			switch {
+			case strings.HasPrefix(name, secret+"="):
+				redacted[i] = redacted[i][:len(redacted[i])-len(name)] + secret + "=" + maskSecret(name[len(secret)+1:])
+			case name == secret && i+1 < len(redacted):
+				i++
+				redacted[i] = maskSecret(redacted[i])
+			}
+		}
+	}
+
+	return redacted
+}
+
+// redactPacket - Copy of a datagram with its secrets, such as the token of
+// a getServers request, overwritten with '*'. Offsets and length are kept.
+func redactPacket(data []byte) []byte {
+
+	_, secrets := annotatePacket(data)
+	if len(secrets) == 0 {
+		return data
+	}
+
+	redacted := append([]byte(nil), data...)
+	for _, s := range secrets {
+		for i := s.Start; i < s.End; i++ {
+			redacted[i] = '*'
+		}
+	}
+
+	return redacted
+}
+
+// since - Offset of a time in the session.
+func (r *SessionRecorder) since(t time.Time) int64 {
+	return t.Sub(r.start).Microseconds()
+}
+
+func (r *SessionRecorder) event(e SessionEvent) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(e); err != nil && r.lastErr == nil {
+		r.lastErr = err
+	}
+}
+
+// Close - Closes the session file. Returns the first write error.
+func (r *SessionRecorder) Close() error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.f.Close(); err != nil && r.lastErr == nil {
+		r.lastErr = err
+	}
+
+	return r.lastErr
+}
+
+// LookupIP - lookupIP, recording the answer.
+func (r *SessionRecorder) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	e := SessionEvent{Kind: EventLookup, At: r.since(time.Now()), Address: host}
+	for _, ip := range ips {
+		e.IPs = append(e.IPs, ip.String())
+	}
+	r.event(e)
+
+	return ips, nil
+}
+
+// Dial - dialServer, recording the traffic of the connection.
+func (r *SessionRecorder) Dial(address string) (PacketConn, error) {
+
+	conn, err := r.dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.lastID++
+	id := r.lastID
+	r.mu.Unlock()
+
+	r.event(SessionEvent{Kind: EventDial, At: r.since(time.Now()), Conn: id, Address: address})
+
+	return &recordingConn{PacketConn: conn, recorder: r, id: id}, nil
+}
+
+// recordingConn - Connection of a recorded session.
+type recordingConn struct {
+	PacketConn
+	recorder *SessionRecorder
+	id       int
+
+	mu        sync.Mutex
+	sent      time.Time
+	roundTrip time.Duration
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+
+	now := time.Now()
+	n, err := c.PacketConn.Write(b)
+	if err == nil {
+		c.mu.Lock()
+		c.sent = now
+		c.mu.Unlock()
+		c.recorder.event(SessionEvent{Kind: EventSent, At: c.recorder.since(now), Conn: c.id, Data: redactPacket(b[:n])})
+	}
+
+	return n, err
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+
+	n, err := c.PacketConn.Read(b)
+	now := time.Now()
+
+	switch {
+	case err == nil:
+		// Rounded as in the session file, so that a replay shows the same pings
+		c.mu.Lock()
+		c.roundTrip = time.Duration(c.recorder.since(now)-c.recorder.since(c.sent)) * time.Microsecond
+		c.mu.Unlock()
+		c.recorder.event(SessionEvent{Kind: EventReceived, At: c.recorder.since(now), Conn: c.id, Data: b[:n]})
+	case isTimeout(err):
+		c.recorder.event(SessionEvent{Kind: EventTimeout, At: c.recorder.since(now), Conn: c.id})
+	}
+
+	return n, err
+}
+
+// RoundTrip - Time between the last request and the last answer, as recorded.
+func (c *recordingConn) RoundTrip() (time.Duration, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.roundTrip, true
+}
+
+// recordedConn - Events of one connection of a session.
+type recordedConn struct {
+	address string
+	events  []SessionEvent // sent, received and timeout events, in order
+	used    bool
+}
+
+// firstSent - First datagram sent on the connection.
+func (rc *recordedConn) firstSent() []byte {
+
+	for _, e := range rc.events {
+		if e.Kind == EventSent {
+			return e.Data
+		}
+	}
+
+	return nil
+}
+
+// SessionReplay - Network answering from a recorded session.
+// Connections are matched on their address and first request, so the
+// concurrent queries may run in any order.
+type SessionReplay struct {
+	Honor bool // Wait for the recorded delays instead of answering at once
+
+	mu      sync.Mutex
+	lookups map[string][]net.IP
+	conns   []*recordedConn
+}
+
+// LoadSession - Reads a session file written by -record.
+func LoadSession(path string) (*SessionReplay, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SessionReplay{lookups: make(map[string][]net.IP)}
+	byID := make(map[int]*recordedConn)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for line := 1; dec.More(); line++ {
+		var e SessionEvent
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("%s: event %d: %s", path, line, err)
+		}
+
+		switch e.Kind {
+		case EventHeader:
+			if e.Version != sessionVersion {
+				return nil, fmt.Errorf("%s: unsupported session version %d", path, e.Version)
+			}
+		case EventLookup:
+			// The last answer wins when a host was looked up again.
+			var ips []net.IP
+			for _, addr := range e.IPs {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					return nil, fmt.Errorf("%s: event %d: invalid IP %q", path, line, addr)
+				}
+				ips = append(ips, ip)
+			}
+			s.lookups[e.Address] = ips
+		case EventDial:
+			rc := &recordedConn{address: e.Address}
+			byID[e.Conn] = rc
+			s.conns = append(s.conns, rc)
+		case EventSent, EventReceived, EventTimeout:
+			rc, ok := byID[e.Conn]
+			if !ok {
+				return nil, fmt.Errorf("%s: event %d: unknown connection %d", path, line, e.Conn)
+			}
+			rc.events = append(rc.events, e)
+		default:
+			return nil, fmt.Errorf("%s: event %d: unknown kind %q", path, line, e.Kind)
+		}
+	}
+
+	return s, nil
+}
+
+// LookupIP - Recorded answer of a lookup.
+func (s *SessionReplay) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips, ok := s.lookups[host]
+	if !ok {
+		return nil, fmt.Errorf("lookup %s: not in the recorded session", host)
+	}
+
+	return ips, nil
+}
+
+// Dial - Connection replaying a recorded one, picked on the first write.
+func (s *SessionReplay) Dial(address string) (PacketConn, error) {
+	return &replayedConn{session: s, address: address}, nil
+}
+
+// claim - First unused recorded connection to the address starting with the
+// same request, ignoring the challenge.
+func (s *SessionReplay) claim(address string, request []byte) *recordedConn {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rc := range s.conns {
+		if !rc.used && rc.address == address && sameCommand(rc.firstSent(), request) {
+			rc.used = true
+			return rc
+		}
+	}
+
+	return nil
+}
+
+// sameCommand - Tells if two requests start with the same command word.
+func sameCommand(a []byte, b []byte) bool {
+
+	if len(a) < 2 || len(b) < 2 {
+		return bytes.Equal(a, b)
+	}
+
+	end := func(p []byte) []byte {
+		if i := bytes.IndexByte(p[2:], 0); i >= 0 {
+			return p[:2+i]
+		}
+		return p
+	}
+
+	return bytes.Equal(end(a), end(b))
+}
+
+// replayedConn - Connection answering with the datagrams of a recorded one.
+type replayedConn struct {
+	session *SessionReplay
+	address string
+
+	mu        sync.Mutex
+	recorded  *recordedConn
+	next      int    // Next event of the recorded connection
+	sentAt    int64  // Offset of the last request
+	challenge []byte // Challenge bytes to patch: recorded, then written
+	written   []byte
+	roundTrip time.Duration
+	closed    bool
+}
+
+func (c *replayedConn) Write(b []byte) (int, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	if c.recorded == nil {
+		c.recorded = c.session.claim(c.address, b)
+		if c.recorded == nil {
+			return 0, fmt.Errorf("no recorded connection to %s sending this request", c.address)
+		}
+	}
+
+	// Skip to the matching request
+	for c.next < len(c.recorded.events) {
+		e := c.recorded.events[c.next]
+		c.next++
+		if e.Kind == EventSent {
+			c.sentAt = e.At
+			c.challenge, c.written = challengeBytes(e.Data, b)
+			break
+		}
+	}
+
+	return len(b), nil
+}
+
+// challengeBytes - The 4 bytes following the command word of the recorded
+// and written requests, when they differ: queries pick random challenges,
+// which the answers echo.
+func challengeBytes(recorded []byte, written []byte) ([]byte, []byte) {
+
+	if len(recorded) < 2 {
+		return nil, nil
+	}
+	i := bytes.IndexByte(recorded[2:], 0)
+	if i < 0 {
+		return nil, nil
+	}
+	start := 2 + i + 1
+	if len(recorded) < start+4 || len(written) < start+4 {
+		return nil, nil
+	}
+
+	r, w := recorded[start:start+4], written[start:start+4]
+	if bytes.Equal(r, w) {
+		return nil, nil
+	}
+
+	return r, w
+}
+
+func (c *replayedConn) Read(b []byte) (int, error) {
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if c.recorded == nil || c.next >= len(c.recorded.events) || c.recorded.events[c.next].Kind == EventSent {
+		c.mu.Unlock()
+		return 0, replayTimeout{}
+	}
+
+	e := c.recorded.events[c.next]
+	c.next++
+	delay := time.Duration(e.At-c.sentAt) * time.Microsecond
+	data := e.Data
+	if c.challenge != nil {
+		data = bytes.Replace(data, c.challenge, c.written, 1)
+	}
+	if e.Kind == EventReceived {
+		c.roundTrip = delay
+	}
+	honor := c.session.Honor
+	c.mu.Unlock()
+
+	if honor && delay > 0 {
+		time.Sleep(delay)
+	}
+	if e.Kind == EventTimeout {
+		return 0, replayTimeout{}
+	}
+
+	return copy(b, data), nil
+}
+
+// RoundTrip - Recorded time between the last request and its answer.
+func (c *replayedConn) RoundTrip() (time.Duration, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.roundTrip, true
+}
+
+func (c *replayedConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *replayedConn) Close() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+
+	return nil
+}
+
+// Timings of a replayed session.
+const (
+	ReplayCompress = "compress"
+	ReplayHonor    = "honor"
+)
+
+var replayTimingEnum = Enum{Name: "replay timing", Values: []string{ReplayCompress, ReplayHonor}}
+
+// enableRecord - Records the traffic of the run in the file.
+func enableRecord(path string) (*SessionRecorder, error) {
+
+	r, err := NewSessionRecorder(path, os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	dialServer = r.Dial
+	lookupIP = r.LookupIP
+	// Reverse lookups are not recorded
+	withoutRDNS()
+
+	return r, nil
+}
+
+// enableReplay - Answers every query from a recorded session.
+func enableReplay(path string, timing string) error {
+
+	s, err := LoadSession(path)
+	if err != nil {
+		return err
+	}
+	s.Honor = timing == ReplayHonor
+
+	dialServer = s.Dial
+	lookupIP = s.LookupIP
+	withoutRDNS()
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timedConn - ReplayConn knowing its round trip, as replayedConn does.
+type timedConn struct {
+	*ReplayConn
+	rtt time.Duration
+}
+
+func (c timedConn) RoundTrip() (time.Duration, bool) {
+	return c.rtt, true
+}
+
+func TestConnRoundTripUnwraps(t *testing.T) {
+
+	inner := timedConn{NewReplayConn(), 42 * time.Millisecond}
+
+	conns := map[string]PacketConn{
+		"bare":     inner,
+		"counting": countingConn{inner},
+		"debug":    debugConn{PacketConn: inner, address: "127.0.0.1:27666"},
+		"ctx":      newCtxConn(context.Background(), inner),
+		"openConn": newCtxConn(context.Background(), countingConn{debugConn{PacketConn: inner}}),
+	}
+	for name, conn := range conns {
+		if rt, ok := connRoundTrip(conn); !ok || rt != inner.rtt {
+			t.Errorf("%s: connRoundTrip = %s, %v, want %s, true", name, rt, ok, inner.rtt)
+		}
+	}
+
+	if _, ok := connRoundTrip(countingConn{NewReplayConn()}); ok {
+		t.Error("connRoundTrip found a round trip on a connection without one")
+	}
+}
+
+// fakeServer - Connection to a fake master listing two servers, or to one
+// of these servers answering getInfo.
+type fakeServer struct {
+	address string
+	answers [][]byte
+}
+
+func infoResponse(challenge []byte, name string, players int) []byte {
+
+	data := append([]byte("\xff\xffinfoResponse\x00"), challenge...)
+	data = append(data, 0x29, 0x00, 0x01, 0x00) // Protocol 1.41
+	for _, kv := range [][2]string{{"si_name", name}, {"si_map", "game/mp/d3dm1"}, {"si_maxPlayers", "8"}, {"si_gameType", "DM"}} {
+		data = append(data, kv[0]+"\x00"+kv[1]+"\x00"...)
+	}
+	data = append(data, 0, 0)
+	for i := 0; i < players; i++ {
+		data = append(data, byte(i), 50, 0, 0xa8, 0x61, 0, 0)
+		data = append(data, fmt.Sprintf("player%d\x00", i)...)
+	}
+	data = append(data, 32, 1, 0, 0, 0)
+
+	return data
+}
+
+func (c *fakeServer) Write(b []byte) (int, error) {
+
+	switch {
+	case bytes.HasPrefix(b, []byte("\xff\xffgetServers\x00")):
+		c.answers = append(c.answers, []byte("\xff\xffservers\x00\x7f\x00\x00\x01\x12\x6c\x7f\x00\x00\x01\x13\x6c"))
+	case bytes.HasPrefix(b, []byte("\xff\xffgetInfo\x00")) && len(b) >= 14:
+		players := 1
+		if strings.HasSuffix(c.address, ":27667") {
+			players = 3
+		}
+		c.answers = append(c.answers, infoResponse(b[10:14], "^1Fake "+c.address, players))
+	}
+
+	return len(b), nil
+}
+
+func (c *fakeServer) Read(b []byte) (int, error) {
+
+	if len(c.answers) == 0 {
+		return 0, replayTimeout{}
+	}
+	time.Sleep(2 * time.Millisecond) // Some ping to record
+	n := copy(b, c.answers[0])
+	c.answers = c.answers[1:]
+
+	return n, nil
+}
+
+func (c *fakeServer) SetReadDeadline(t time.Time) error { return nil }
+func (c *fakeServer) Close() error                      { return nil }
+
+func dialFake(address string) (PacketConn, error) {
+	return &fakeServer{address: address}, nil
+}
+
+// keepGlobals - Restores the settings changed by a test when it ends.
+func keepGlobals(t *testing.T) {
+
+	savedDial, savedLookup := dialServer, lookupIP
+	savedToken, savedPing, savedTimeout := masterToken, showPing, timeout
+	savedProtocol, savedThreshold := gameProtocol, confirmThreshold
+	t.Cleanup(func() {
+		dialServer, lookupIP = savedDial, savedLookup
+		masterToken, showPing, timeout = savedToken, savedPing, savedTimeout
+		gameProtocol, confirmThreshold = savedProtocol, savedThreshold
+	})
+
+	gameProtocol = protocols[0]
+	confirmThreshold = defaultConfirmThreshold
+	timeout = time.Second
+}
+
+// sessionRun - JSON output of a query of the fake master.
+func sessionRun(t *testing.T) []byte {
+
+	list, results, err := collectServers(context.Background(), []string{"127.0.0.1:27650"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := newQueryMeta(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), gameProtocol, results, false)
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, list, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestSessionRecordReplay(t *testing.T) {
+
+	keepGlobals(t)
+	path := filepath.Join(t.TempDir(), "run.session")
+	masterToken, showPing = "hunter2", true
+
+	dialServer = dialFake
+	r, err := NewSessionRecorder(path, []string{"-ip", "127.0.0.1", "-master-token", "hunter2", "--master-token=hunter2", "-ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialServer, lookupIP = r.Dial, r.LookupIP
+	recorded := sessionRun(t)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is nowhere in the file, neither in the arguments nor,
+	// base64 encoded, in the getServers datagram.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var e SessionEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(e.Data, []byte("hunter2")) || strings.Contains(strings.Join(e.Args, " "), "hunter2") {
+			t.Errorf("the token is recorded in the %s event", e.Kind)
+		}
+		if e.Kind == EventSent && bytes.HasPrefix(e.Data, []byte("\xff\xffgetServers\x00")) && !bytes.HasSuffix(e.Data, []byte("*******\x00")) {
+			t.Errorf("getServers recorded as %q, want the token overwritten", e.Data)
+		}
+	}
+
+	s, err := LoadSession(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialServer, lookupIP = s.Dial, s.LookupIP
+	replayed := sessionRun(t)
+
+	if !bytes.Equal(recorded, replayed) {
+		t.Errorf("replayed output differs from the recorded one:\n%s\nreplayed:\n%s", recorded, replayed)
+	}
+	if !bytes.Contains(recorded, []byte(`"ping_ms"`)) || !bytes.Contains(recorded, []byte("player2")) {
+		t.Errorf("output misses the pings or the players:\n%s", recorded)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+
+	args := []string{"-master-token", "abc", "-v", "--master-token=secret", "-ip", "master-token"}
+	got := strings.Join(redactArgs(args), " ")
+	want := "-master-token <redacted, 3 chars> -v --master-token=<redacted, 6 chars> -ip master-token"
+	if got != want {
+		t.Errorf("redactArgs = %q, want %q", got, want)
+	}
+	if args[1] != "abc" {
+		t.Error("redactArgs changed its argument")
+	}
+}
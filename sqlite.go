@@ -0,0 +1,246 @@
+//go:build sqlite && cgo
+// +build sqlite,cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -lsqlite3
+#include <sqlite3.h>
+#include <stdlib.h>
+
+// SQLITE_TRANSIENT casts -1 to a function pointer, which cgo can't express.
+static int bind_text(sqlite3_stmt *stmt, int i, const char *s, int n) {
+	return sqlite3_bind_text(stmt, i, s, n, SQLITE_TRANSIENT);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// sqliteDB - Connection to a SQLite database, through the system libsqlite3.
+// Only what the -db store needs is bound: statements with ? parameters,
+// integer, text and NULL columns.
+type sqliteDB struct {
+	db *C.sqlite3
+}
+
+// sqliteStmt - Prepared statement, to run several times.
+type sqliteStmt struct {
+	db   *sqliteDB
+	stmt *C.sqlite3_stmt
+}
+
+// sqliteRow - Current row of a query, only valid in the Query callback.
+type sqliteRow struct {
+	stmt *C.sqlite3_stmt
+}
+
+// openSQLite - Opens the database file, created if needed. Writers wait up
+// to 5 seconds for each other instead of failing with "database is locked".
+func openSQLite(path string) (*sqliteDB, error) {
+
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	var db *C.sqlite3
+	rc := C.sqlite3_open_v2(cpath, &db, C.SQLITE_OPEN_READWRITE|C.SQLITE_OPEN_CREATE|C.SQLITE_OPEN_FULLMUTEX, nil)
+	if rc != C.SQLITE_OK {
+		err := (&sqliteDB{db: db}).error()
+		C.sqlite3_close(db)
+		return nil, err
+	}
+	C.sqlite3_busy_timeout(db, 5000)
+
+	return &sqliteDB{db: db}, nil
+}
+
+// error - Error of the last failed call on the connection.
+func (db *sqliteDB) error() error {
+	return errors.New("sqlite: " + C.GoString(C.sqlite3_errmsg(db.db)))
+}
+
+// Close - Closes the connection, once every statement is closed.
+func (db *sqliteDB) Close() error {
+
+	if rc := C.sqlite3_close(db.db); rc != C.SQLITE_OK {
+		return db.error()
+	}
+
+	return nil
+}
+
+// ExecScript - Runs SQL statements without parameters, separated by ';'.
+func (db *sqliteDB) ExecScript(sql string) error {
+
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+
+	if rc := C.sqlite3_exec(db.db, csql, nil, nil, nil); rc != C.SQLITE_OK {
+		return db.error()
+	}
+
+	return nil
+}
+
+// Exec - Runs a single statement with its parameters.
+func (db *sqliteDB) Exec(sql string, args ...interface{}) error {
+
+	stmt, err := db.Prepare(sql)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.Exec(args...)
+}
+
+// LastInsertID - Row ID of the last row inserted.
+func (db *sqliteDB) LastInsertID() int64 {
+	return int64(C.sqlite3_last_insert_rowid(db.db))
+}
+
+// Prepare - Compiles a single statement.
+func (db *sqliteDB) Prepare(sql string) (*sqliteStmt, error) {
+
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+
+	var stmt *C.sqlite3_stmt
+	if rc := C.sqlite3_prepare_v2(db.db, csql, -1, &stmt, nil); rc != C.SQLITE_OK {
+		return nil, db.error()
+	}
+
+	return &sqliteStmt{db: db, stmt: stmt}, nil
+}
+
+// Close - Frees the statement.
+func (st *sqliteStmt) Close() error {
+	C.sqlite3_finalize(st.stmt)
+	return nil
+}
+
+// bind - Resets the statement and binds its parameters: nil, integers,
+// booleans, strings, or *int for a nullable integer.
+func (st *sqliteStmt) bind(args []interface{}) error {
+
+	C.sqlite3_reset(st.stmt)
+	C.sqlite3_clear_bindings(st.stmt)
+
+	for i, arg := range args {
+		n := C.int(i + 1)
+
+		var rc C.int
+		switch v := arg.(type) {
+		case nil:
+			rc = C.sqlite3_bind_null(st.stmt, n)
+		case int:
+			rc = C.sqlite3_bind_int64(st.stmt, n, C.sqlite3_int64(v))
+		case int64:
+			rc = C.sqlite3_bind_int64(st.stmt, n, C.sqlite3_int64(v))
+		case uint32:
+			rc = C.sqlite3_bind_int64(st.stmt, n, C.sqlite3_int64(v))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			rc = C.sqlite3_bind_int64(st.stmt, n, C.sqlite3_int64(b))
+		case *int:
+			if v == nil {
+				rc = C.sqlite3_bind_null(st.stmt, n)
+			} else {
+				rc = C.sqlite3_bind_int64(st.stmt, n, C.sqlite3_int64(*v))
+			}
+		case string:
+			cs := C.CString(v)
+			rc = C.bind_text(st.stmt, n, cs, C.int(len(v)))
+			C.free(unsafe.Pointer(cs))
+		default:
+			return fmt.Errorf("sqlite: cannot bind a %T", arg)
+		}
+
+		if rc != C.SQLITE_OK {
+			return st.db.error()
+		}
+	}
+
+	return nil
+}
+
+// Exec - Runs the statement with the parameters, ignoring its rows.
+func (st *sqliteStmt) Exec(args ...interface{}) error {
+
+	if err := st.bind(args); err != nil {
+		return err
+	}
+
+	for {
+		switch C.sqlite3_step(st.stmt) {
+		case C.SQLITE_ROW:
+		case C.SQLITE_DONE:
+			return nil
+		default:
+			return st.db.error()
+		}
+	}
+}
+
+// Query - Runs the statement with the parameters, calling fn for every row.
+// An error from fn stops the query and is returned.
+func (st *sqliteStmt) Query(fn func(row sqliteRow) error, args ...interface{}) error {
+
+	if err := st.bind(args); err != nil {
+		return err
+	}
+
+	for {
+		switch C.sqlite3_step(st.stmt) {
+		case C.SQLITE_ROW:
+			if err := fn(sqliteRow{stmt: st.stmt}); err != nil {
+				C.sqlite3_reset(st.stmt)
+				return err
+			}
+		case C.SQLITE_DONE:
+			return nil
+		default:
+			return st.db.error()
+		}
+	}
+}
+
+// Query - Runs a single statement, calling fn for every row.
+func (db *sqliteDB) Query(sql string, fn func(row sqliteRow) error, args ...interface{}) error {
+
+	stmt, err := db.Prepare(sql)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.Query(fn, args...)
+}
+
+// Null - Tells if the column i (from 0) is NULL.
+func (r sqliteRow) Null(i int) bool {
+	return C.sqlite3_column_type(r.stmt, C.int(i)) == C.SQLITE_NULL
+}
+
+// Int - Integer value of the column i, 0 for NULL.
+func (r sqliteRow) Int(i int) int64 {
+	return int64(C.sqlite3_column_int64(r.stmt, C.int(i)))
+}
+
+// Text - Text value of the column i, empty for NULL.
+func (r sqliteRow) Text(i int) string {
+
+	p := C.sqlite3_column_text(r.stmt, C.int(i))
+	if p == nil {
+		return ""
+	}
+
+	return C.GoStringN((*C.char)(unsafe.Pointer(p)), C.sqlite3_column_bytes(r.stmt, C.int(i)))
+}
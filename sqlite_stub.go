@@ -0,0 +1,37 @@
+//go:build !sqlite || !cgo
+// +build !sqlite !cgo
+
+package main
+
+import "errors"
+
+// errNoSQLite - The SQLite store is only bound with the sqlite build tag.
+var errNoSQLite = errors.New("-db needs SQLite: build msquery with cgo and -tags sqlite")
+
+// sqliteDB - Built without SQLite, every call fails.
+type sqliteDB struct{}
+
+type sqliteStmt struct{}
+
+type sqliteRow struct{}
+
+func openSQLite(path string) (*sqliteDB, error) {
+	return nil, errNoSQLite
+}
+
+func (db *sqliteDB) Close() error                               { return errNoSQLite }
+func (db *sqliteDB) ExecScript(sql string) error                { return errNoSQLite }
+func (db *sqliteDB) Exec(sql string, args ...interface{}) error { return errNoSQLite }
+func (db *sqliteDB) LastInsertID() int64                        { return 0 }
+func (db *sqliteDB) Prepare(sql string) (*sqliteStmt, error)    { return nil, errNoSQLite }
+func (st *sqliteStmt) Close() error                             { return errNoSQLite }
+func (st *sqliteStmt) Exec(args ...interface{}) error           { return errNoSQLite }
+func (st *sqliteStmt) Query(fn func(row sqliteRow) error, args ...interface{}) error {
+	return errNoSQLite
+}
+func (db *sqliteDB) Query(sql string, fn func(row sqliteRow) error, args ...interface{}) error {
+	return errNoSQLite
+}
+func (r sqliteRow) Null(i int) bool   { return true }
+func (r sqliteRow) Int(i int) int64   { return 0 }
+func (r sqliteRow) Text(i int) string { return "" }
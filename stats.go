@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the statistics. Metrics are derived from them, so they must not change.
+const (
+	StatPacketsSent      = "udp_packets_sent_total"
+	StatBytesSent        = "udp_bytes_sent_total"
+	StatPacketsReceived  = "udp_packets_received_total"
+	StatBytesReceived    = "udp_bytes_received_total"
+	StatDialErrors       = "udp_dial_errors_total"
+	StatReadTimeouts     = "udp_read_timeouts_total"
+	StatDatagramsParsed  = "parse_datagrams_total"
+	StatUnknownCommands  = "parse_unknown_commands_total"
+	StatLeftoverPackets  = "parse_leftover_datagrams_total"
+	StatMasterQueries    = "master_queries_total"
+	StatMasterErrors     = "master_query_errors_total"
+	StatMasterDuration   = "master_query_duration_seconds"
+	StatServerPing       = "server_ping_seconds"
+	StatServerCancelled  = "server_queries_cancelled_total"
+	StatQueryRetries     = "query_retries_total"
+	StatServersKnown     = "servers_known"
+	StatServersReachable = "servers_reachable"
+)
+
+// Bucket upper bounds, in seconds, of the duration histograms.
+var durationBuckets = []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counter - Value only going up.
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// Gauge - Value going up and down.
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// Histogram - Distribution of observed values in fixed buckets.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // Upper bounds, ascending; the last bucket is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+
+	return &Histogram{bounds: b, counts: make([]uint64, len(b)+1)}
+}
+
+// Observe - Adds a value to its bucket.
+func (h *Histogram) Observe(v float64) {
+
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// ObserveDuration - Adds a duration, in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// HistogramSnapshot - Copy of a histogram. Counts are per bucket, not cumulative.
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"` // One more than Bounds, the last one being +Inf
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+func (h *Histogram) snapshot() HistogramSnapshot {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return HistogramSnapshot{
+		Bounds: append([]float64(nil), h.bounds...),
+		Counts: append([]uint64(nil), h.counts...),
+		Sum:    h.sum,
+		Count:  h.count,
+	}
+}
+
+// StatsSnapshot - Copy of every statistic of a registry, for rendering.
+type StatsSnapshot struct {
+	Time       time.Time                    `json:"time"`
+	Counters   map[string]int64             `json:"counters"`
+	Gauges     map[string]int64             `json:"gauges"`
+	Histograms map[string]HistogramSnapshot `json:"histograms"`
+}
+
+// StatsRegistry - Named statistics, safe for concurrent use.
+// They are created on first use and live as long as the registry.
+type StatsRegistry struct {
+	mu         sync.RWMutex
+	counters   map[string]*Counter
+	gauges     map[string]*Gauge
+	histograms map[string]*Histogram
+}
+
+func NewStatsRegistry() *StatsRegistry {
+	return &StatsRegistry{
+		counters:   make(map[string]*Counter),
+		gauges:     make(map[string]*Gauge),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// stats is the registry of the process.
+var stats = NewStatsRegistry()
+
+// Counter - Counter of that name, created if needed.
+func (r *StatsRegistry) Counter(name string) *Counter {
+
+	r.mu.RLock()
+	c, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok = r.counters[name]; !ok {
+		c = &Counter{}
+		r.counters[name] = c
+	}
+	return c
+}
+
+// Gauge - Gauge of that name, created if needed.
+func (r *StatsRegistry) Gauge(name string) *Gauge {
+
+	r.mu.RLock()
+	g, ok := r.gauges[name]
+	r.mu.RUnlock()
+	if ok {
+		return g
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if g, ok = r.gauges[name]; !ok {
+		g = &Gauge{}
+		r.gauges[name] = g
+	}
+	return g
+}
+
+// Histogram - Histogram of that name, created with the bounds if needed.
+// The bounds of an existing histogram are kept.
+func (r *StatsRegistry) Histogram(name string, bounds []float64) *Histogram {
+
+	r.mu.RLock()
+	h, ok := r.histograms[name]
+	r.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h, ok = r.histograms[name]; !ok {
+		h = newHistogram(bounds)
+		r.histograms[name] = h
+	}
+	return h
+}
+
+// Snapshot - Copy of every statistic. No statistic can be created while
+// it is taken, and each histogram is copied under its lock.
+func (r *StatsRegistry) Snapshot() StatsSnapshot {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snap := StatsSnapshot{
+		Time:       time.Now(),
+		Counters:   make(map[string]int64, len(r.counters)),
+		Gauges:     make(map[string]int64, len(r.gauges)),
+		Histograms: make(map[string]HistogramSnapshot, len(r.histograms)),
+	}
+	for name, c := range r.counters {
+		snap.Counters[name] = c.Value()
+	}
+	for name, g := range r.gauges {
+		snap.Gauges[name] = g.Value()
+	}
+	for name, h := range r.histograms {
+		snap.Histograms[name] = h.snapshot()
+	}
+
+	return snap
+}
+
+// writeStats - Writes a snapshot as indented JSON.
+func writeStats(w io.Writer, snap StatsSnapshot) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// countingConn - PacketConn feeding the transport statistics.
+type countingConn struct {
+	PacketConn
+}
+
+func (c countingConn) Unwrap() PacketConn {
+	return c.PacketConn
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+
+	n, err := c.PacketConn.Write(b)
+	if err == nil {
+		stats.Counter(StatPacketsSent).Inc()
+		stats.Counter(StatBytesSent).Add(int64(n))
+	}
+	return n, err
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+
+	n, err := c.PacketConn.Read(b)
+	if err == nil {
+		stats.Counter(StatPacketsReceived).Inc()
+		stats.Counter(StatBytesReceived).Add(int64(n))
+	} else if isTimeout(err) {
+		stats.Counter(StatReadTimeouts).Inc()
+	}
+	return n, err
+}
+
+// openConn - dialServer, with the connection counted in the statistics and
+// bound to the context, see ctxConn.
+func openConn(ctx context.Context, address string) (PacketConn, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialServer(address)
+	if err != nil {
+		stats.Counter(StatDialErrors).Inc()
+		return nil, err
+	}
+
+	if logEnabled(LevelDebug) {
+		conn = debugConn{PacketConn: conn, address: address}
+	}
+
+	return newCtxConn(ctx, countingConn{conn}), nil
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "context"
+
+// dumpStatsOnSignal - There is no SIGUSR1 on Windows, use /debug/stats of -serve.
+func dumpStatsOnSignal(ctx context.Context) {}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpStatsOnSignal - Writes the statistics on stderr on every SIGUSR1,
+// until the context is cancelled.
+func dumpStatsOnSignal(ctx context.Context) {
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sig:
+				writeStats(os.Stderr, stats.Snapshot())
+			}
+		}
+	}()
+}
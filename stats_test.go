@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestStatsRegistryConcurrent - Hammers a registry from many goroutines
+// while taking snapshots. Meant to run with go test -race.
+func TestStatsRegistryConcurrent(t *testing.T) {
+
+	const (
+		writers = 16
+		rounds  = 2000
+	)
+
+	r := NewStatsRegistry()
+	stop := make(chan struct{})
+
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			last := int64(0)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				snap := r.Snapshot()
+				v := snap.Counters["shared"]
+				if v < last {
+					t.Errorf("counter went down: %d after %d", v, last)
+					return
+				}
+				last = v
+				for name, h := range snap.Histograms {
+					total := uint64(0)
+					for _, c := range h.Counts {
+						total += c
+					}
+					if total != h.Count {
+						t.Errorf("histogram %s: buckets hold %d values, count is %d", name, total, h.Count)
+						return
+					}
+				}
+				writeStats(&bytes.Buffer{}, snap)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				r.Counter("shared").Inc()
+				r.Counter(fmt.Sprintf("writer_%d", w)).Add(2)
+				r.Gauge("inflight").Add(1)
+				r.Histogram("latency", durationBuckets).Observe(float64(i%100) / 10)
+				r.Gauge("inflight").Add(-1)
+				// Statistics created while snapshots are taken
+				if i%500 == 0 {
+					r.Counter(fmt.Sprintf("created_%d_%d", w, i)).Inc()
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	snap := r.Snapshot()
+	if v := snap.Counters["shared"]; v != writers*rounds {
+		t.Errorf("shared counter %d, want %d", v, writers*rounds)
+	}
+	for w := 0; w < writers; w++ {
+		if v := snap.Counters[fmt.Sprintf("writer_%d", w)]; v != 2*rounds {
+			t.Errorf("writer %d counter %d, want %d", w, v, 2*rounds)
+		}
+	}
+	if v := snap.Gauges["inflight"]; v != 0 {
+		t.Errorf("inflight gauge %d, want 0", v)
+	}
+	if h := snap.Histograms["latency"]; h.Count != writers*rounds {
+		t.Errorf("histogram count %d, want %d", h.Count, writers*rounds)
+	}
+	if len(snap.Counters) != 1+writers+writers*rounds/500 {
+		t.Errorf("%d counters", len(snap.Counters))
+	}
+}
+
+func TestStatsSnapshotIsACopy(t *testing.T) {
+
+	r := NewStatsRegistry()
+	r.Counter(StatPacketsSent).Add(3)
+	h := r.Histogram(StatServerPing, []float64{0.1, 0.01})
+	h.Observe(0.05)
+	h.Observe(1)
+
+	snap := r.Snapshot()
+	r.Counter(StatPacketsSent).Inc()
+	h.Observe(0.001)
+
+	if snap.Counters[StatPacketsSent] != 3 {
+		t.Errorf("snapshot counter changed to %d", snap.Counters[StatPacketsSent])
+	}
+	hs := snap.Histograms[StatServerPing]
+	if fmt.Sprint(hs.Bounds) != "[0.01 0.1]" || fmt.Sprint(hs.Counts) != "[0 1 1]" || hs.Count != 2 {
+		t.Errorf("histogram snapshot %+v", hs)
+	}
+
+	var back StatsSnapshot
+	var buf bytes.Buffer
+	writeStats(&buf, snap)
+	if err := json.Unmarshal(buf.Bytes(), &back); err != nil || back.Counters[StatPacketsSent] != 3 {
+		t.Errorf("written stats: %v\n%s", err, buf.String())
+	}
+}
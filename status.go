@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Answers a merged field can come from.
+const (
+	SourceInfo   = "info"
+	SourceStatus = "status"
+)
+
+// Player count difference between getInfo and getStatus reported as a warning.
+// Smaller ones are just players joining or leaving between the two packets.
+const maxPlayersDisagreement = 2
+
+// QueryServerStatus - Sends a getStatus request to a game server and parses its answer.
+// Timeouts are retried, see -retries.
+func QueryServerStatus(ctx context.Context, sv idTech4_Server) (*ServerInfo, error) {
+
+	var status *ServerInfo
+	err := withRetries(ctx, "getStatus "+sv.Address(), func() error {
+		conn, err := openConn(ctx, sv.Address())
+		if err != nil {
+			return newQueryError(CodeUnreachable, "cannot access the server", err)
+		}
+		defer conn.Close()
+
+		status, err = queryInfoConn(conn, rand.Uint32(), "getStatus", "statusResponse")
+		return err
+	})
+
+	return status, err
+}
+
+// MergeServerInfo - Combines the getInfo and getStatus answers of a server.
+// Structural fields (hostname, map, mod, game type) prefer the status, the
+// player counts come from the answer received last, and the cvars only come
+// from the status. The source of every field is kept in Sources.
+// Either answer may be nil.
+func MergeServerInfo(info *ServerInfo, status *ServerInfo) *ServerInfo {
+
+	if info == nil || status == nil {
+		only := info
+		if only == nil {
+			only = status
+		}
+		if only == nil {
+			return nil
+		}
+		merged := *only
+		return &merged
+	}
+
+	merged := *info
+	merged.Sources = make(map[string]string)
+	merged.Warnings = append([]string(nil), info.Warnings...)
+
+	structural := []struct {
+		field       string
+		dst         *string
+		infoValue   string
+		statusValue string
+	}{
+		{"hostname", &merged.Hostname, info.Hostname, status.Hostname},
+		{"map", &merged.Map, info.Map, status.Map},
+		{"mod", &merged.Mod, info.Mod, status.Mod},
+		{"gametype", &merged.GameType, info.GameType, status.GameType},
+	}
+	for _, f := range structural {
+		if f.statusValue != "" {
+			*f.dst = f.statusValue
+			merged.Sources[f.field] = SourceStatus
+		} else {
+			*f.dst = f.infoValue
+			merged.Sources[f.field] = SourceInfo
+		}
+	}
+
+	live, liveSource := info, SourceInfo
+	if status.Received.After(info.Received) {
+		live, liveSource = status, SourceStatus
+	}
+	merged.Players = live.Players
+	merged.PlayerList = live.PlayerList
+	merged.MaxPlayers = live.MaxPlayers
+	merged.TimeLeft = live.TimeLeft
+	merged.Sources["players"] = liveSource
+	merged.Sources["player_list"] = liveSource
+	merged.Sources["max_players"] = liveSource
+
+	merged.Rules = status.Rules
+	merged.Sources["rules"] = SourceStatus
+
+	// The ping of the getInfo answer is the one measured for every server
+	merged.Sources["ping"] = SourceInfo
+
+	if d := info.Players - status.Players; d > maxPlayersDisagreement || d < -maxPlayersDisagreement {
+		merged.Warnings = append(merged.Warnings, fmt.Sprintf("getInfo reports %d players, getStatus %d", info.Players, status.Players))
+	}
+	if info.Map != "" && status.Map != "" && info.Map != status.Map {
+		merged.Warnings = append(merged.Warnings, fmt.Sprintf("getInfo reports map %q, getStatus %q", info.Map, status.Map))
+	}
+
+	return &merged
+}
+
+// QueryAllServerStatus - Queries the status of every server which answered
+// getInfo, -workers at once, and merges it into its details.
+// Servers not answering getStatus keep their getInfo details.
+func QueryAllServerStatus(ctx context.Context, list []idTech4_Server) {
+
+	forEachServer(list, ctx.Done(), func(sv *idTech4_Server) {
+		if !sv.Reachable() {
+			return
+		}
+
+		status, err := QueryServerStatus(ctx, *sv)
+		if err != nil {
+			logVerbose("%s: no getStatus answer: %s", sv.Address(), err)
+			return
+		}
+		sv.Info = MergeServerInfo(sv.Info, status)
+	})
+}
+
+// writeExplain - Writes where each detail of the servers comes from, and
+// their merge warnings.
+func writeExplain(w io.Writer, list []idTech4_Server) {
+
+	for _, sv := range list {
+		if !sv.Reachable() {
+			fmt.Fprintf(w, "%s: no details\n", sv.Address())
+			continue
+		}
+		if len(sv.Info.Sources) == 0 {
+			fmt.Fprintf(w, "%s: every field from %s\n", sv.Address(), SourceInfo)
+			continue
+		}
+
+		var fields []string
+		for field, src := range sv.Info.Sources {
+			fields = append(fields, field+"="+src)
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(w, "%s: %s\n", sv.Address(), strings.Join(fields, " "))
+
+		for _, warning := range sv.Info.Warnings {
+			fmt.Fprintf(w, "%s: warning: %s\n", sv.Address(), warning)
+		}
+	}
+}
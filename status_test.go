@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeServerInfoSingleAnswer(t *testing.T) {
+
+	at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	info := &ServerInfo{Hostname: "Frag Fest", Map: "game/mp/d3dm1", Players: 3, Ping: 40 * time.Millisecond, Received: at}
+	status := &ServerInfo{Hostname: "Frag Fest", Map: "game/mp/d3dm1", Players: 3, Rules: map[string]string{"si_pure": "1"}, Received: at}
+
+	if merged := MergeServerInfo(nil, nil); merged != nil {
+		t.Errorf("no answer: %+v", merged)
+	}
+
+	// A single answer is copied as is, without sources
+	for name, only := range map[string]*ServerInfo{"info only": info, "status only": status} {
+		var merged *ServerInfo
+		if only == info {
+			merged = MergeServerInfo(info, nil)
+		} else {
+			merged = MergeServerInfo(nil, status)
+		}
+		if merged == only || !reflect.DeepEqual(merged, only) {
+			t.Errorf("%s: %+v, want a copy of %+v", name, merged, only)
+		}
+		if merged.Sources != nil || merged.Warnings != nil {
+			t.Errorf("%s: sources %v, warnings %v", name, merged.Sources, merged.Warnings)
+		}
+	}
+}
+
+func TestMergeServerInfo(t *testing.T) {
+
+	at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	info := &ServerInfo{
+		Hostname: "Frag Fest", Map: "game/mp/d3dm1", Mod: "base", GameType: "DM",
+		Players: 2, MaxPlayers: 8, PlayerList: []PlayerInfo{{Name: "a"}, {Name: "b"}},
+		Ping: 40 * time.Millisecond, Received: at, Warnings: []string{"from the parser"},
+	}
+	status := &ServerInfo{
+		Hostname: "^1Frag ^7Fest", Map: "game/mp/d3dm2", GameType: "Tourney",
+		Players: 6, MaxPlayers: 16, PlayerList: []PlayerInfo{{Name: "c"}},
+		Rules: map[string]string{"si_pure": "1"}, Received: at.Add(50 * time.Millisecond),
+	}
+
+	merged := MergeServerInfo(info, status)
+
+	// Structural fields from the status, unless it has none
+	if merged.Hostname != "^1Frag ^7Fest" || merged.Map != "game/mp/d3dm2" || merged.GameType != "Tourney" || merged.Mod != "base" {
+		t.Errorf("structural fields %+v", merged)
+	}
+	// Player counts from the last answer, the status here
+	if merged.Players != 6 || merged.MaxPlayers != 16 || len(merged.PlayerList) != 1 {
+		t.Errorf("players %d/%d %v", merged.Players, merged.MaxPlayers, merged.PlayerList)
+	}
+	if merged.Ping != 40*time.Millisecond || merged.Rules["si_pure"] != "1" {
+		t.Errorf("ping %s, rules %v", merged.Ping, merged.Rules)
+	}
+
+	wantSources := map[string]string{
+		"hostname": SourceStatus, "map": SourceStatus, "mod": SourceInfo, "gametype": SourceStatus,
+		"players": SourceStatus, "player_list": SourceStatus, "max_players": SourceStatus,
+		"rules": SourceStatus, "ping": SourceInfo,
+	}
+	if !reflect.DeepEqual(merged.Sources, wantSources) {
+		t.Errorf("sources %v, want %v", merged.Sources, wantSources)
+	}
+
+	wantWarnings := []string{
+		"from the parser",
+		"getInfo reports 2 players, getStatus 6",
+		`getInfo reports map "game/mp/d3dm1", getStatus "game/mp/d3dm2"`,
+	}
+	if !reflect.DeepEqual(merged.Warnings, wantWarnings) {
+		t.Errorf("warnings %q, want %q", merged.Warnings, wantWarnings)
+	}
+	if len(info.Warnings) != 1 {
+		t.Errorf("the info warnings were changed: %q", info.Warnings)
+	}
+
+	// The info answered last: its player counts win
+	status.Received = at.Add(-time.Second)
+	merged = MergeServerInfo(info, status)
+	if merged.Players != 2 || merged.MaxPlayers != 8 || merged.Sources["players"] != SourceInfo {
+		t.Errorf("info answered last: %d/%d from %s", merged.Players, merged.MaxPlayers, merged.Sources["players"])
+	}
+
+	// Small differences are players joining or leaving, not a disagreement
+	status.Players, status.Map = 4, ""
+	merged = MergeServerInfo(info, status)
+	if len(merged.Warnings) != 1 || merged.Map != "game/mp/d3dm1" || merged.Sources["map"] != SourceInfo {
+		t.Errorf("agreeing answers: map %q from %s, warnings %q", merged.Map, merged.Sources["map"], merged.Warnings)
+	}
+}
+
+func TestWriteExplain(t *testing.T) {
+
+	at := time.Now()
+	merged := MergeServerInfo(&ServerInfo{Map: "a", Players: 1, Received: at}, &ServerInfo{Map: "b", Players: 1, Received: at})
+	list := []idTech4_Server{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 27666, Info: merged},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 27666, Info: &ServerInfo{}},
+		{IP: net.IPv4(10, 0, 0, 3), Port: 27666},
+	}
+
+	var buf bytes.Buffer
+	writeExplain(&buf, list)
+
+	want := []string{
+		"10.0.0.1:27666: gametype=info hostname=info map=status max_players=info mod=info ping=info player_list=info players=info rules=status",
+		`10.0.0.1:27666: warning: getInfo reports map "a", getStatus "b"`,
+		"10.0.0.2:27666: every field from info",
+		"10.0.0.3:27666: no details",
+	}
+	if got := strings.Split(strings.TrimSpace(buf.String()), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("explain\n%s\nwant\n%s", buf.String(), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// Kinds of the parsed datagrams.
+const (
+	DatagramServers = "servers"
+	DatagramInfo    = "infoResponse"
+)
+
+// DatagramStats - What the parser saw in one datagram.
+type DatagramStats struct {
+	Kind       string // DatagramServers or DatagramInfo
+	Command    string // Command word of the datagram
+	Known      bool   // False when the command word was not expected
+	Size       int    // Payload size
+	Header     int    // Bytes before the records
+	Records    int    // Server entries, only for DatagramServers
+	EntryBytes int    // Bytes of these entries
+	Trailer    int    // Bytes of the end-of-list marker
+	Leftover   int    // Unread bytes once parsing stopped
+}
+
+// Healthy ratios of drifted datagrams, above which a warning is printed.
+// Ratios are only judged after minHealthDatagrams datagrams.
+const (
+	maxLeftoverRatio     = 0.1
+	maxInconsistentRatio = 0.1
+	minHealthDatagrams   = 10
+)
+
+// ProtocolHealth - Aggregates of the parse telemetry.
+type ProtocolHealth struct {
+	Datagrams       int            `json:"datagrams"`
+	WithLeftover    int            `json:"with_leftover"`
+	Inconsistent    int            `json:"inconsistent"` // Servers datagrams not made of whole records
+	Leftover        map[string]int `json:"leftover_bytes"`
+	UnknownCommands map[string]int `json:"unknown_commands,omitempty"`
+	Warnings        []string       `json:"warnings,omitempty"`
+}
+
+// leftoverBucket - Bucket of the leftover bytes distribution.
+func leftoverBucket(n int) string {
+
+	switch {
+	case n <= 0:
+		return "0"
+	case n < 4:
+		return "1-3"
+	case n < 16:
+		return "4-15"
+	}
+
+	return "16+"
+}
+
+// recordsConsistent - Tells if a servers datagram is exactly its header
+// followed by whole records, and its end-of-list marker if any.
+func recordsConsistent(d DatagramStats) bool {
+
+	if d.Kind != DatagramServers {
+		return true
+	}
+
+	return d.Size-d.Header-d.Trailer == d.EntryBytes
+}
+
+// entryBytes - Size of the entries of a servers answer in the layout. The
+// entries of serversExt also have a family marker, and IPv6 addresses.
+func entryBytes(answer *idtech4.ServersAnswer, layout EntryLayout) int {
+
+	if answer.Command != idtech4.CommandServersExt {
+		return len(answer.Servers) * layout.Size()
+	}
+
+	n := 0
+	for _, sv := range answer.Servers {
+		n += 1 + len(sv.IP) + 2 + layout.FlagBytes
+	}
+	return n
+}
+
+// healthWarnings - Heuristics telling the format of the answers drifted.
+func healthWarnings(h ProtocolHealth) []string {
+
+	var warnings []string
+
+	var unknown []string
+	for cmd := range h.UnknownCommands {
+		unknown = append(unknown, fmt.Sprintf("%q", cmd))
+	}
+	sort.Strings(unknown)
+	for _, cmd := range unknown {
+		warnings = append(warnings, "unknown command word "+cmd+" in answers")
+	}
+
+	if h.Datagrams < minHealthDatagrams {
+		return warnings
+	}
+
+	if ratio := float64(h.WithLeftover) / float64(h.Datagrams); ratio > maxLeftoverRatio {
+		warnings = append(warnings, fmt.Sprintf("%.0f%% of the answers have unparsed trailing bytes", ratio*100))
+	}
+	if ratio := float64(h.Inconsistent) / float64(h.Datagrams); ratio > maxInconsistentRatio {
+		warnings = append(warnings, fmt.Sprintf("%.0f%% of the master answers are not made of whole server entries", ratio*100))
+	}
+
+	return warnings
+}
+
+// ParseTelemetry - Counters fed by the parsers, to notice protocol changes.
+type ParseTelemetry struct {
+	mu     sync.Mutex
+	health ProtocolHealth
+	warned map[string]bool // Warnings already printed
+}
+
+func NewParseTelemetry() *ParseTelemetry {
+	return &ParseTelemetry{
+		health: ProtocolHealth{Leftover: make(map[string]int), UnknownCommands: make(map[string]int)},
+		warned: make(map[string]bool),
+	}
+}
+
+// parseTelemetry collects the stats of every parsed datagram.
+var parseTelemetry = NewParseTelemetry()
+
+// Record - Adds a parsed datagram.
+func (t *ParseTelemetry) Record(d DatagramStats) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := &t.health
+	h.Datagrams++
+	stats.Counter(StatDatagramsParsed).Inc()
+	if !d.Known {
+		h.UnknownCommands[d.Command]++
+		stats.Counter(StatUnknownCommands).Inc()
+		return
+	}
+
+	h.Leftover[leftoverBucket(d.Leftover)]++
+	if d.Leftover > 0 {
+		h.WithLeftover++
+		stats.Counter(StatLeftoverPackets).Inc()
+	}
+	if !recordsConsistent(d) {
+		h.Inconsistent++
+	}
+}
+
+// Health - Copy of the aggregates, with their warnings.
+func (t *ParseTelemetry) Health() ProtocolHealth {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := t.health
+	h.Leftover = make(map[string]int, len(t.health.Leftover))
+	for k, v := range t.health.Leftover {
+		h.Leftover[k] = v
+	}
+	h.UnknownCommands = make(map[string]int, len(t.health.UnknownCommands))
+	for k, v := range t.health.UnknownCommands {
+		h.UnknownCommands[k] = v
+	}
+	h.Warnings = healthWarnings(h)
+
+	return h
+}
+
+// WarnDrift - Prints the health warnings not printed yet on stderr.
+func (t *ParseTelemetry) WarnDrift() {
+
+	for _, warning := range t.Health().Warnings {
+		t.mu.Lock()
+		seen := t.warned[warning]
+		t.warned[warning] = true
+		t.mu.Unlock()
+
+		if !seen {
+			fmt.Fprintln(os.Stderr, "Warning: protocol drift:", warning)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// keepTelemetry - Gives the test its own parse telemetry.
+func keepTelemetry(t *testing.T) {
+
+	saved := parseTelemetry
+	parseTelemetry = NewParseTelemetry()
+	t.Cleanup(func() { parseTelemetry = saved })
+}
+
+var (
+	serversHeader = []byte("\xff\xffservers\x00")
+	extHeader     = []byte("\xff\xffserversExt\x00")
+	entryIPv4     = []byte{10, 0, 0, 1}
+	entryIPv6     = []byte(net.ParseIP("2001:db8::1"))
+)
+
+// telemetryFixtures - Master answers as sent by healthy masters, and by
+// masters whose format drifted from the one the parser expects.
+var telemetryFixtures = []struct {
+	name    string
+	data    []byte
+	layout  EntryLayout
+	drifted bool
+}{
+	{"servers", pkt(serversHeader, entryIPv4, uint16(27666), entryIPv4, uint16(27667)), layoutDoom3, false},
+	{"servers EOT", pkt(serversHeader, entryIPv4, uint16(27666), []byte("EOT")), layoutDoom3, false},
+	{"servers EOT padded", pkt(serversHeader, entryIPv4, uint16(27666), []byte("EOT\x00\x00\x00")), layoutDoom3, false},
+	{"empty EOT", pkt(serversHeader, []byte("EOT")), layoutDoom3, false},
+	{"etqw EOT", pkt(serversHeader, entryIPv4, []byte{0x6d, 0x1e}, byte(1), entryIPv4, []byte{0x6d, 0x1f}, byte(0), []byte("EOT")), layoutETQW, false},
+	{"ext IPv4", pkt(extHeader, idtech4.ExtMarkerIPv4, entryIPv4, uint16(27666)), layoutDoom3, false},
+	{"ext IPv6 EOT", pkt(extHeader, idtech4.ExtMarkerIPv6, entryIPv6, uint16(27666), []byte("EOT")), layoutDoom3, false},
+	{"ext mixed EOT", pkt(extHeader, idtech4.ExtMarkerIPv6, entryIPv6, uint16(27666), idtech4.ExtMarkerIPv4, entryIPv4, uint16(27667), idtech4.ExtMarkerIPv6, entryIPv6, uint16(27668), []byte("EOT")), layoutDoom3, false},
+	{"etqw ext", pkt(extHeader, idtech4.ExtMarkerIPv6, entryIPv6, []byte{0x6d, 0x1e}, byte(1), []byte("EOT")), layoutETQW, false},
+
+	// A flag byte added to every entry
+	{"servers with flags", pkt(serversHeader, entryIPv4, uint16(27666), byte(1), entryIPv4, uint16(27667), byte(1)), layoutDoom3, true},
+	// The last entry cut
+	{"servers cut", pkt(serversHeader, entryIPv4, uint16(27666), []byte{10, 0, 0}), layoutDoom3, true},
+	// Another end marker
+	{"servers END", pkt(serversHeader, entryIPv4, uint16(27666), []byte("END")), layoutDoom3, true},
+	// An address family the parser doesn't know
+	{"ext unknown family", pkt(extHeader, idtech4.ExtMarkerIPv4, entryIPv4, uint16(27666), byte('#'), []byte{1, 2, 3, 4, 5, 6, 7, 8}, uint16(27667)), layoutDoom3, true},
+	// IPv6 entries with flag bytes, parsed with the Doom 3 layout
+	{"ext with flags", pkt(extHeader, idtech4.ExtMarkerIPv6, entryIPv6, uint16(27666), byte(1), idtech4.ExtMarkerIPv6, entryIPv6, uint16(27667), byte(1)), layoutDoom3, true},
+}
+
+func TestRecordsConsistent(t *testing.T) {
+
+	for _, f := range telemetryFixtures {
+		keepTelemetry(t)
+
+		answer, err := idtech4.ParseServers(f.data, f.layout)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		recordServersDatagram(f.data, answer, err, f.layout)
+
+		h := parseTelemetry.Health()
+		if drifted := h.Inconsistent > 0 || h.WithLeftover > 0; drifted != f.drifted {
+			t.Errorf("%s: drifted %v, want %v (%d servers, health %+v)", f.name, drifted, f.drifted, len(answer.Servers), h)
+		}
+	}
+}
+
+func TestDriftWarnings(t *testing.T) {
+
+	record := func(drifted bool) []string {
+		keepTelemetry(t)
+		for i := 0; i < minHealthDatagrams; i++ {
+			for _, f := range telemetryFixtures {
+				if f.drifted != drifted {
+					continue
+				}
+				answer, err := idtech4.ParseServers(f.data, f.layout)
+				recordServersDatagram(f.data, answer, err, f.layout)
+			}
+		}
+		return parseTelemetry.Health().Warnings
+	}
+
+	if warnings := record(false); len(warnings) != 0 {
+		t.Errorf("healthy masters: %q", warnings)
+	}
+
+	warnings := strings.Join(record(true), "\n")
+	if !strings.Contains(warnings, "unparsed trailing bytes") || !strings.Contains(warnings, "not made of whole server entries") {
+		t.Errorf("drifted masters: %q", warnings)
+	}
+
+	// An unknown command word is reported at once
+	keepTelemetry(t)
+	data := pkt([]byte("\xff\xffserversV2\x00"), entryIPv4, uint16(27666))
+	answer, err := idtech4.ParseServers(data, layoutDoom3)
+	recordServersDatagram(data, answer, err, layoutDoom3)
+	if warnings := parseTelemetry.Health().Warnings; len(warnings) != 1 || !strings.Contains(warnings[0], `"serversV2"`) {
+		t.Errorf("unknown command: %q", warnings)
+	}
+}
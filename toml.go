@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML - Reads the subset of TOML used by the batch files into the
+// tree encoding/json would decode: tables are maps, arrays slices.
+// Supported: comments, bare, quoted and dotted keys, basic and literal
+// strings, integers, floats, booleans, single-line arrays, inline tables,
+// [table] and [[array of tables]] headers. Multi-line strings and dates
+// are not.
+func parseTOML(data string) (map[string]interface{}, error) {
+
+	root := make(map[string]interface{})
+	current := root
+
+	for n, line := range strings.Split(data, "\n") {
+		p := &tomlParser{s: strings.TrimSuffix(line, "\r"), line: n + 1}
+		p.skipSpace()
+		if p.done() {
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(p.rest(), "[["):
+			p.pos += 2
+			current, err = p.header(root, "]]", true)
+		case p.peek() == '[':
+			p.pos++
+			current, err = p.header(root, "]", false)
+		default:
+			err = p.keyValue(current)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if !p.done() {
+			return nil, p.errorf("unexpected %q", p.rest())
+		}
+	}
+
+	return root, nil
+}
+
+// tomlParser - Reads one line of a TOML file.
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) rest() string {
+	return p.s[p.pos:]
+}
+
+// done - Tells if only a comment, or nothing, is left on the line.
+func (p *tomlParser) done() bool {
+	return p.pos >= len(p.s) || p.s[p.pos] == '#'
+}
+
+func (p *tomlParser) peek() byte {
+
+	if p.pos >= len(p.s) {
+		return 0
+	}
+
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// expect - Skips the spaces and the given byte.
+func (p *tomlParser) expect(c byte) error {
+
+	p.skipSpace()
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+
+	return nil
+}
+
+// header - Table selected by a [a.b] or [[a.b]] header line.
+func (p *tomlParser) header(root map[string]interface{}, end string, array bool) (map[string]interface{}, error) {
+
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !strings.HasPrefix(p.rest(), end) {
+		return nil, p.errorf("expected %q", end)
+	}
+	p.pos += len(end)
+
+	parent, err := p.table(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+
+	if array {
+		list, ok := parent[last].([]interface{})
+		if _, exists := parent[last]; exists && !ok {
+			return nil, p.errorf("%q is not an array of tables", last)
+		}
+		t := make(map[string]interface{})
+		parent[last] = append(list, t)
+		return t, nil
+	}
+
+	return p.table(parent, []string{last})
+}
+
+// table - Table at the path of keys, created when missing. A key naming an
+// array of tables leads to its last table.
+func (p *tomlParser) table(t map[string]interface{}, keys []string) (map[string]interface{}, error) {
+
+	for _, key := range keys {
+		switch v := t[key].(type) {
+		case nil:
+			sub := make(map[string]interface{})
+			t[key] = sub
+			t = sub
+		case map[string]interface{}:
+			t = v
+		case []interface{}:
+			if len(v) == 0 {
+				return nil, p.errorf("%q is not a table", key)
+			}
+			last, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, p.errorf("%q is not a table", key)
+			}
+			t = last
+		default:
+			return nil, p.errorf("%q is not a table", key)
+		}
+	}
+
+	return t, nil
+}
+
+// keyValue - Sets the value of a key = value line in the table.
+func (p *tomlParser) keyValue(t map[string]interface{}) error {
+
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if err := p.expect('='); err != nil {
+		return err
+	}
+	p.skipSpace()
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	parent, err := p.table(t, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := parent[last]; exists {
+		return p.errorf("duplicate key %q", last)
+	}
+	parent[last] = value
+
+	return nil
+}
+
+// keys - Parts of a bare, quoted or dotted key.
+func (p *tomlParser) keys() ([]string, error) {
+
+	var keys []string
+	for {
+		p.skipSpace()
+
+		var key string
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			var err error
+			if key, err = p.str(); err != nil {
+				return nil, err
+			}
+		default:
+			start := p.pos
+			for p.pos < len(p.s) && isBareKeyChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, p.errorf("expected a key")
+			}
+			key = p.s[start:p.pos]
+		}
+		keys = append(keys, key)
+
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// value - String, number, boolean, array or inline table.
+func (p *tomlParser) value() (interface{}, error) {
+
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.str()
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(" \t,]}#", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	word := p.s[start:p.pos]
+
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "":
+		return nil, p.errorf("expected a value")
+	}
+
+	clean := strings.ReplaceAll(word, "_", "")
+	if i, err := strconv.ParseInt(clean, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil {
+		return f, nil
+	}
+
+	return nil, p.errorf("invalid value %q (strings need quotes)", word)
+}
+
+// str - Basic "string" with escapes, or 'literal' string.
+func (p *tomlParser) str() (string, error) {
+
+	quote := p.s[p.pos]
+	p.pos++
+
+	if quote == '\'' {
+		end := strings.IndexByte(p.rest(), '\'')
+		if end < 0 {
+			return "", p.errorf("unterminated string")
+		}
+		s := p.s[p.pos : p.pos+end]
+		p.pos += end + 1
+		return s, nil
+	}
+
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.pos >= len(p.s) {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'u', 'U':
+				size := 4
+				if e == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.s) {
+					return "", p.errorf("invalid escape \\%c", e)
+				}
+				r, err := strconv.ParseUint(p.s[p.pos:p.pos+size], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid escape \\%c%s", e, p.s[p.pos:p.pos+size])
+				}
+				b.WriteRune(rune(r))
+				p.pos += size
+			default:
+				return "", p.errorf("invalid escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
+
+// array - [a, b, ...] on a single line.
+func (p *tomlParser) array() ([]interface{}, error) {
+
+	p.pos++
+	list := []interface{}{}
+	for {
+		p.skipSpace()
+		if p.peek() == ']' {
+			p.pos++
+			return list, nil
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// inlineTable - {key = value, ...}.
+func (p *tomlParser) inlineTable() (map[string]interface{}, error) {
+
+	p.pos++
+	t := make(map[string]interface{})
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		return t, nil
+	}
+
+	for {
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return t, nil
+		default:
+			return nil, p.errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+
+	input := `# Batch of two specs
+title = "nightly" # trailing comment
+
+[[specs]]
+name = "q4"
+"quoted key" = 'C:\path'
+filters = { hide-empty = true, min_players = 2, maxping = 1_500 }
+ports = [27666, 27667]
+
+[specs.output]
+path = "q4.csv"
+
+[[specs]]
+name = "d3\t\u00e9"
+rate.limit = 2.5
+`
+	tree, err := parseTOML(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := json.Marshal(tree)
+	want := `{"specs":[{"filters":{"hide-empty":true,"maxping":1500,"min_players":2},"name":"q4","output":{"path":"q4.csv"},"ports":[27666,27667],"quoted key":"C:\\path"},{"name":"d3\té","rate":{"limit":2.5}}],"title":"nightly"}`
+	if string(got) != want {
+		t.Errorf("parseTOML =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"name = q4", `line 1: invalid value "q4" (strings need quotes)`},
+		{"a = 1\na = 2", `line 2: duplicate key "a"`},
+		{"name = \"open", "line 1: unterminated string"},
+		{"[specs\nname = 1", `line 1: expected "]"`},
+		{"a = 1\n[[a]]", `line 2: "a" is not an array of tables`},
+		{"a = [1 2]", "line 1: expected ',' or ']' in array"},
+		{"a = 1 b = 2", `line 1: unexpected "b = 2"`},
+		{"= 1", "line 1: expected a key"},
+		{`a = "\q"`, `line 1: invalid escape \q`},
+	}
+
+	for _, tt := range tests {
+		_, err := parseTOML(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseTOML(%q) = %v, want %q", tt.input, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"idtech4query/pkg/idtech4"
+)
+
+// PacketConn - What the queries need from a UDP connection.
+// net.Conn satisfies it, ReplayConn fakes it.
+type PacketConn = idtech4.Conn
+
+// DialFunc - Opens a connection to a host:port address.
+type DialFunc func(address string) (PacketConn, error)
+
+// dialServer is used by every query to reach masters and game servers.
+// It can be swapped to run the queries without a network.
+var dialServer DialFunc = dialUDP
+
+// dialNet opens the UDP sockets of dialUDP; tests swap it to make sure
+// no socket is opened.
+var dialNet = net.DialTimeout
+
+// dialUDP - Connects an UDP socket to the address.
+func dialUDP(address string) (PacketConn, error) {
+	return dialNet(udpNetwork(address), address, 2*time.Second)
+}
+
+// udpNetwork - "udp4" or "udp6" for an ip:port address, following -4 and
+// -6 for a hostname.
+func udpNetwork(address string) string {
+
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return "udp" + familyOf(ip)
+		}
+	}
+
+	return "udp" + ipFamily
+}
+
+// packetLimiter paces the packets sent to masters and servers, see -rate.
+var packetLimiter *idtech4.RateLimiter
+
+// ctxConn - Connection bound to a context: writes wait for the -rate
+// limiter, and the connection is closed once the context is done, which
+// unblocks a pending read.
+type ctxConn struct {
+	PacketConn
+	ctx    context.Context
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCtxConn(ctx context.Context, conn PacketConn) *ctxConn {
+
+	c := &ctxConn{PacketConn: conn, ctx: ctx, closed: make(chan struct{})}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-c.closed:
+			}
+		}()
+	}
+
+	return c
+}
+
+func (c *ctxConn) Unwrap() PacketConn {
+	return c.PacketConn
+}
+
+func (c *ctxConn) Write(b []byte) (int, error) {
+
+	if err := packetLimiter.Wait(c.ctx); err != nil {
+		return 0, err
+	}
+
+	return c.PacketConn.Write(b)
+}
+
+func (c *ctxConn) Read(b []byte) (int, error) {
+
+	n, err := c.PacketConn.Read(b)
+	if err != nil && c.ctx.Err() != nil {
+		return n, c.ctx.Err()
+	}
+
+	return n, err
+}
+
+func (c *ctxConn) Close() error {
+
+	c.once.Do(func() { close(c.closed) })
+	return c.PacketConn.Close()
+}
+
+// replayTimeout - Error returned by ReplayConn when it has nothing left to answer.
+type replayTimeout struct{}
+
+func (replayTimeout) Error() string     { return "i/o timeout (no more recorded answers)" }
+func (replayTimeout) Timeout() bool     { return true }
+func (replayTimeout) Temporary() bool   { return true }
+func (replayTimeout) ErrorCode() string { return CodeTimeout }
+
+var _ net.Error = replayTimeout{}
+
+// ReplayConn - In-process fake connection replaying recorded answers.
+// Every Read returns the next answer, then a timeout once they're all used.
+// What was written is kept in Written.
+type ReplayConn struct {
+	mu        sync.Mutex
+	Responses [][]byte
+	Written   [][]byte
+	closed    bool
+}
+
+// NewReplayConn - Fake connection answering with the given packets, in order.
+func NewReplayConn(responses ...[]byte) *ReplayConn {
+	return &ReplayConn{Responses: responses}
+}
+
+func (c *ReplayConn) Write(b []byte) (int, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.Written = append(c.Written, append([]byte(nil), b...))
+
+	return len(b), nil
+}
+
+func (c *ReplayConn) Read(b []byte) (int, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(c.Responses) == 0 {
+		return 0, replayTimeout{}
+	}
+
+	n := copy(b, c.Responses[0])
+	c.Responses = c.Responses[1:]
+
+	return n, nil
+}
+
+func (c *ReplayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *ReplayConn) Close() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("connection already closed")
+	}
+	c.closed = true
+
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal - Tells if the file is an interactive terminal.
+// Character devices are the best guess without terminal ioctls.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// makeRaw - Raw mode needs the terminal ioctls, only used on Linux, macOS
+// and the BSDs.
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("the terminal browser is only supported on Linux, macOS and the BSDs")
+}
+
+// terminalSize - Columns and rows of the terminal, 80x24 without terminal ioctls.
+func terminalSize(f *os.File) (int, int) {
+	return 80, 24
+}
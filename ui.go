@@ -0,0 +1,86 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+var uiTemplate = template.Must(template.ParseFS(uiFiles, "ui/index.html"))
+
+// uiRow - Server as shown by the web page.
+type uiRow struct {
+	Address  string
+	Name     string
+	Map      string
+	GameType string
+	Players  string
+	Ping     string
+}
+
+// uiPage - Data of the web page. The table is rendered server side, so
+// the page also works without JavaScript; the script then keeps it fresh.
+type uiPage struct {
+	Servers        int
+	Players        int
+	Refreshed      time.Time
+	LastError      string
+	RefreshSeconds int
+	Rows           []uiRow
+}
+
+// buildUIPage - Page data of a snapshot.
+func buildUIPage(list []idTech4_Server, refreshed time.Time, lastErr error, every time.Duration) uiPage {
+
+	page := uiPage{
+		Servers:        len(list),
+		Refreshed:      refreshed,
+		RefreshSeconds: int(every.Seconds()),
+	}
+	if page.RefreshSeconds < 1 {
+		page.RefreshSeconds = 1
+	}
+	if lastErr != nil {
+		page.LastError = lastErr.Error()
+	}
+
+	for _, sv := range list {
+		row := uiRow{Address: sv.Address(), Name: stripColors(sv.Name)}
+		if sv.Reachable() {
+			if row.Name == "" {
+				row.Name = stripColors(sv.Info.Hostname)
+			}
+			row.Map = sv.Info.Map
+			row.GameType = sv.Info.GameType
+			row.Players = strconv.Itoa(sv.Info.Players) + "/" + strconv.Itoa(sv.Info.MaxPlayers)
+			row.Ping = strconv.FormatInt(sv.Info.Ping.Milliseconds(), 10) + "ms"
+			page.Players += sv.Info.Players
+		}
+		page.Rows = append(page.Rows, row)
+	}
+
+	return page
+}
+
+// handleUI - GET /, the server table as a web page.
+func (st *ServeState) handleUI(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, refreshed, err := st.Snapshot()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	uiTemplate.Execute(w, buildUIPage(list, refreshed, err, st.refreshEvery))
+}
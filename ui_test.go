@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uiState - Serve state refreshed with a reachable and an unreachable server.
+func uiState(t *testing.T, ui bool) *ServeState {
+
+	schedule, err := NewPollSchedule(30*time.Second, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := newServeState(schedule, nil, ui)
+
+	up := namedServer(27666, "^1Frag <b>Fest</b>", 3)
+	up.Info.Map, up.Info.GameType, up.Info.MaxPlayers = "game/mp/d3dm1", "Tourney", 8
+	up.Info.Ping = 42 * time.Millisecond
+	down := idTech4_Server{IP: up.IP, Port: 27667}
+	st.Refresh(func() ([]idTech4_Server, error) {
+		return []idTech4_Server{up, down}, nil
+	})
+
+	return st
+}
+
+func TestUIPage(t *testing.T) {
+
+	st := uiState(t, true)
+
+	rec := httptest.NewRecorder()
+	st.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	page := rec.Body.String()
+
+	// The table is rendered without JavaScript, names escaped and uncolored
+	for _, want := range []string{
+		`<b id="servers">2</b>`,
+		`<b id="players">3</b>`,
+		"<td>10.0.0.1:27666</td>",
+		"<td>Frag &lt;b&gt;Fest&lt;/b&gt;</td>",
+		"<td>game/mp/d3dm1</td>",
+		"<td>Tourney</td>",
+		`<td class="num">3/8</td>`,
+		`<td class="num">42ms</td>`,
+		"<td>10.0.0.1:27667</td>",
+		`<meta http-equiv="refresh" content="30">`,
+		"setInterval(load,  30  * 1000)",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the page lacks %s", want)
+		}
+	}
+	if strings.Contains(page, "^1") || strings.Contains(page, "<b>Fest") {
+		t.Error("the name is shown raw")
+	}
+
+	for _, path := range []string{"/index.html", "/favicon.ico"} {
+		rec := httptest.NewRecorder()
+		st.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != 404 {
+			t.Errorf("GET %s: %d, want 404", path, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	st.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != 405 {
+		t.Errorf("POST /: %d, want 405", rec.Code)
+	}
+}
+
+func TestUIDisabled(t *testing.T) {
+
+	st := uiState(t, false)
+
+	rec := httptest.NewRecorder()
+	st.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 404 || strings.Contains(rec.Body.String(), "<table>") {
+		t.Errorf("GET / with -ui=false: %d\n%s", rec.Code, rec.Body.String())
+	}
+
+	// The API stays
+	rec = httptest.NewRecorder()
+	st.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/servers", nil))
+	if rec.Code != 200 {
+		t.Errorf("GET /servers with -ui=false: %d", rec.Code)
+	}
+}
+
+func TestUIEmbeddedAssets(t *testing.T) {
+
+	data, err := uiFiles.ReadFile("ui/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+
+	// Self-contained: nothing loaded from elsewhere
+	for _, external := range []string{"src=", "href=", "@import", "http://", "https://", "//cdn"} {
+		if strings.Contains(page, external) {
+			t.Errorf("the page loads %s", external)
+		}
+	}
+
+	// The script reads the fields of the /servers answer by name
+	rec := httptest.NewRecorder()
+	uiState(t, true).Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/servers", nil))
+	var list []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 2 {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	info, _ := list[0]["info"].(map[string]interface{})
+	for _, key := range []string{"ip", "port", "ping_ms"} {
+		if _, ok := list[0][key]; !ok || !strings.Contains(page, "sv."+key) {
+			t.Errorf("the script reads sv.%s, the server has %v", key, list[0])
+		}
+	}
+	for _, key := range []string{"hostname", "map", "gametype", "players", "max_players"} {
+		if _, ok := info[key]; !ok || !strings.Contains(page, "info."+key) {
+			t.Errorf("the script reads info.%s, the info has %v", key, info)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchIteration - One iteration of the watch mode, as written in JSON.
+type watchIteration struct {
+	Time   time.Time     `json:"time"`
+	Total  int           `json:"total"`
+	Events []ServerEvent `json:"events"`
+	Error  string        `json:"error,omitempty"`
+
+	Baseline bool     `json:"baseline,omitempty"`  // First list, no events
+	Kept     []string `json:"kept_from,omitempty"` // Failed masters whose previous servers are kept
+
+	RetryAfter float64 `json:"retry_after_seconds,omitempty"` // Wait asked by the masters
+}
+
+// RunWatch - Runs collect at every interval of the schedule and reports the
+// differences with the previous list, until the context is cancelled.
+// The first list is the baseline: only its total is reported.
+// A failed iteration is reported and skipped, keeping the known servers,
+// so a timeout doesn't look like every server vanished and came back. In
+// the same way, when some masters fail while others answer, the servers
+// the failed ones listed before are kept.
+// A sweep refused at the confirmation stops the watch with its error.
+func RunWatch(ctx context.Context, schedule *PollSchedule, collect func() ([]idTech4_Server, []MasterResult, error), w io.Writer, jsonOut bool, minSimilarity float64) error {
+
+	var known []idTech4_Server
+	baseline := true
+	enc := json.NewEncoder(w)
+
+	if delay := schedule.Start(); delay > 0 {
+		logVerbose("first poll in %s, at %s", delay.Round(time.Millisecond), time.Now().Add(delay).Format("15:04:05"))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+
+	for {
+		now := time.Now()
+		list, results, err := collect()
+		if isConfirmError(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		wait := RetryAfterOf(err)
+
+		if err != nil {
+			if jsonOut {
+				enc.Encode(watchIteration{Time: now, Total: len(known), Events: []ServerEvent{}, Error: err.Error(), RetryAfter: wait.Seconds()})
+			} else {
+				fmt.Fprintf(os.Stderr, "[%s] query failed, keeping the previous list: %s\n", now.Format("2006-01-02 15:04:05"), err)
+			}
+		} else {
+			list, kept := keepFailedMasters(known, list, results)
+			var events []ServerEvent
+			if !baseline {
+				events = DiffServers(known, list, minSimilarity)
+			}
+			known = list
+
+			if jsonOut {
+				if events == nil {
+					events = []ServerEvent{}
+				}
+				enc.Encode(watchIteration{Time: now, Total: len(known), Events: events, Baseline: baseline, Kept: kept})
+			} else {
+				stamp := now.Format("2006-01-02 15:04:05")
+				for _, ev := range events {
+					fmt.Fprintf(w, "[%s] %s\n", stamp, ev)
+				}
+				if len(kept) > 0 {
+					fmt.Fprintf(os.Stderr, "[%s] keeping the previous servers of %s\n", stamp, strings.Join(kept, ", "))
+				}
+				fmt.Fprintf(w, "[%s] %d servers\n", stamp, len(known))
+			}
+			baseline = false
+		}
+
+		delay := schedule.Next()
+		if wait > 0 {
+			// The master knows better than our interval when it can be asked again
+			delay = wait
+		}
+		logVerbose("next poll in %s, at %s", delay.Round(time.Millisecond), time.Now().Add(delay).Format("15:04:05"))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// keepFailedMasters - Adds to the list the known servers missing from it
+// which were listed by a master that failed this time, so they aren't
+// reported gone. Returns the list and the failed masters.
+func keepFailedMasters(known []idTech4_Server, list []idTech4_Server, results []MasterResult) ([]idTech4_Server, []string) {
+
+	var failed []string
+	for _, res := range results {
+		if res.Err != nil && !containsString(failed, res.Master) {
+			failed = append(failed, res.Master)
+		}
+	}
+	if len(failed) == 0 {
+		return list, nil
+	}
+
+	listed := make(map[string]bool, len(list))
+	for _, sv := range list {
+		listed[sv.Address()] = true
+	}
+
+	for _, sv := range known {
+		if listed[sv.Address()] {
+			continue
+		}
+		for _, master := range sv.ListedBy {
+			if containsString(failed, master) {
+				list = append(list, sv)
+				break
+			}
+		}
+	}
+
+	return list, failed
+}
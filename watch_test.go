@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listedServer - Server listed by the given masters.
+func listedServer(port uint16, masters ...string) idTech4_Server {
+
+	// Names with nothing in common, so that no change is taken for a move
+	sv := namedServer(port, strings.Repeat(string(rune('a'+port%26)), 8), 1)
+	sv.ListedBy = masters
+	return sv
+}
+
+// runWatchPolls - Runs RunWatch over the given polls, then stops it.
+func runWatchPolls(t *testing.T, jsonOut bool, polls ...func() ([]idTech4_Server, []MasterResult, error)) string {
+
+	schedule, err := NewPollSchedule(time.Millisecond, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	collect := func() ([]idTech4_Server, []MasterResult, error) {
+		if calls == len(polls) {
+			cancel()
+			return nil, nil, context.Canceled
+		}
+		calls++
+		return polls[calls-1]()
+	}
+
+	var out bytes.Buffer
+	if err := RunWatch(ctx, schedule, collect, &out, jsonOut, defaultMoveSimilarity); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+func TestWatchBaseline(t *testing.T) {
+
+	first := func() ([]idTech4_Server, []MasterResult, error) {
+		return []idTech4_Server{listedServer(27666, "a"), listedServer(27667, "a")}, nil, nil
+	}
+	second := func() ([]idTech4_Server, []MasterResult, error) {
+		return []idTech4_Server{listedServer(27666, "a"), listedServer(27668, "a")}, nil, nil
+	}
+
+	out := runWatchPolls(t, false, first, second)
+	if strings.Count(out, "(new)") != 1 || !strings.Contains(out, "+ 10.0.0.1:27668 (new)") || !strings.Contains(out, "- 10.0.0.1:27667 (gone)") {
+		t.Errorf("unexpected events:\n%s", out)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); !strings.HasSuffix(lines[0], "] 2 servers") {
+		t.Errorf("the baseline prints more than its total:\n%s", out)
+	}
+}
+
+func TestWatchKeepsFailedMasters(t *testing.T) {
+
+	failed := errors.New("read timeout")
+	polls := []func() ([]idTech4_Server, []MasterResult, error){
+		func() ([]idTech4_Server, []MasterResult, error) {
+			return []idTech4_Server{listedServer(27666, "a"), listedServer(27667, "b"), listedServer(27668, "a", "b")}, nil, nil
+		},
+		// b times out: its servers stay, the one a dropped goes
+		func() ([]idTech4_Server, []MasterResult, error) {
+			return []idTech4_Server{listedServer(27668, "a")}, []MasterResult{{Master: "a"}, {Master: "b", Err: failed}}, nil
+		},
+		// b is back without 27667
+		func() ([]idTech4_Server, []MasterResult, error) {
+			return []idTech4_Server{listedServer(27668, "a", "b")}, []MasterResult{{Master: "a"}, {Master: "b"}}, nil
+		},
+	}
+
+	type event struct {
+		Type   string `json:"type"`
+		Server struct {
+			Port int `json:"port"`
+		} `json:"server"`
+	}
+	type iteration struct {
+		Total    int      `json:"total"`
+		Baseline bool     `json:"baseline"`
+		Kept     []string `json:"kept_from"`
+		Events   []event  `json:"events"`
+	}
+
+	var iterations []iteration
+	dec := json.NewDecoder(strings.NewReader(runWatchPolls(t, true, polls...)))
+	for dec.More() {
+		var it iteration
+		if err := dec.Decode(&it); err != nil {
+			t.Fatal(err)
+		}
+		iterations = append(iterations, it)
+	}
+	if len(iterations) != 3 {
+		t.Fatalf("%d iterations, want 3", len(iterations))
+	}
+	if !iterations[0].Baseline || len(iterations[0].Events) != 0 || iterations[0].Total != 3 {
+		t.Errorf("baseline %+v", iterations[0])
+	}
+
+	second := iterations[1]
+	if second.Baseline || second.Total != 2 || len(second.Kept) != 1 || second.Kept[0] != "b" {
+		t.Errorf("second poll %+v", second)
+	}
+	if len(second.Events) != 1 || second.Events[0].Type != EventRemoved || second.Events[0].Server.Port != 27666 {
+		t.Errorf("second poll events %+v, want 27666 gone only", second.Events)
+	}
+
+	third := iterations[2]
+	if third.Total != 1 || len(third.Events) != 1 || third.Events[0].Type != EventRemoved || third.Events[0].Server.Port != 27667 {
+		t.Errorf("third poll %+v, want 27667 gone", third)
+	}
+}
+
+func TestWatchSkipsFailedPolls(t *testing.T) {
+
+	polls := []func() ([]idTech4_Server, []MasterResult, error){
+		func() ([]idTech4_Server, []MasterResult, error) {
+			return []idTech4_Server{listedServer(27666, "a")}, nil, nil
+		},
+		func() ([]idTech4_Server, []MasterResult, error) {
+			return nil, nil, errors.New("no master answered")
+		},
+		func() ([]idTech4_Server, []MasterResult, error) {
+			return []idTech4_Server{listedServer(27666, "a")}, nil, nil
+		},
+	}
+
+	out := runWatchPolls(t, false, polls...)
+	if strings.Contains(out, "(gone)") || strings.Contains(out, "(new)") {
+		t.Errorf("a failed poll shows up as churn:\n%s", out)
+	}
+}